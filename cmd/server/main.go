@@ -21,11 +21,19 @@ import (
 	"github.com/ottavia-music/ottavia/internal/artwork"
 	"github.com/ottavia-music/ottavia/internal/audioscan"
 	"github.com/ottavia-music/ottavia/internal/config"
+	"github.com/ottavia-music/ottavia/internal/converter"
 	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/duplicates"
+	"github.com/ottavia-music/ottavia/internal/events"
+	"github.com/ottavia-music/ottavia/internal/fingerprint"
+	"github.com/ottavia-music/ottavia/internal/gc"
 	"github.com/ottavia-music/ottavia/internal/handlers"
+	"github.com/ottavia-music/ottavia/internal/iobudget"
 	"github.com/ottavia-music/ottavia/internal/jobs"
 	"github.com/ottavia-music/ottavia/internal/metadata"
+	"github.com/ottavia-music/ottavia/internal/metadata/lookup"
 	"github.com/ottavia-music/ottavia/internal/models"
+	"github.com/ottavia-music/ottavia/internal/replaygain"
 	"github.com/ottavia-music/ottavia/internal/scanner"
 	"github.com/ottavia-music/ottavia/web/templates/pages"
 )
@@ -74,14 +82,17 @@ func main() {
 	}
 
 	// Ensure directories exist
-	for _, dir := range []string{cfg.Storage.ArtifactsPath, cfg.Storage.TempPath} {
+	for _, dir := range []string{cfg.Storage.ArtifactsPath, cfg.Storage.TempPath, cfg.Storage.LogsPath} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			log.Fatal().Err(err).Str("dir", dir).Msg("Failed to create directory")
 		}
 	}
 
+	// Initialize the event bus for live job, log, scan and conversion updates
+	bus := events.NewBus(events.DefaultHistorySize)
+
 	// Initialize services
-	scannerSvc := scanner.New(db, cfg.Scanner.WorkerCount, cfg.Scanner.BatchSize)
+	scannerSvc := scanner.New(db, bus, cfg.Scanner.WorkerCount, cfg.Scanner.BatchSize)
 	analyzerSvc := analyzer.New(db, cfg.FFmpeg.FFprobePath, cfg.FFmpeg.FFmpegPath, cfg.Storage.ArtifactsPath)
 	metadataWriter := metadata.New(db, cfg.FFmpeg.FFmpegPath)
 	artworkManager := artwork.New(db, cfg.FFmpeg.FFmpegPath, cfg.Storage.ArtifactsPath)
@@ -92,22 +103,69 @@ func main() {
 		FFmpegPath:     cfg.FFmpeg.FFmpegPath,
 		FFprobePath:    cfg.FFmpeg.FFprobePath,
 		ArtifactsPath:  cfg.Storage.ArtifactsPath,
+		VerifyRips:     cfg.AudioScan.VerifyRips,
 	}
 	audioScanner := audioscan.NewScanner(db, audioScanConfig)
 
-	// Initialize handlers
-	h := handlers.New(db, scannerSvc, analyzerSvc, metadataWriter, artworkManager)
+	// Initialize conversion executor (verifies outputs with the analyzer and audio scanner)
+	conversionSvc := converter.New(db, bus, analyzerSvc, audioScanner, cfg.FFmpeg.FFmpegPath, cfg.Storage.LogsPath)
 
-	// Initialize audio scan API handler for dynamic series endpoints
-	audioScanAPI := audioscan.NewAPIHandler(audioScanner)
+	// Initialize duplicate detection (full-file and decoded PCM hashes)
+	duplicateDetector := duplicates.New(db, cfg.FFmpeg.FFmpegPath)
+
+	// Initialize acoustic fingerprint matching (index is built on first use)
+	fingerprintMatcher := fingerprint.NewMatcher(db)
+
+	// Initialize release lookup (MusicBrainz-compatible endpoint, applied via the metadata writer)
+	lookupInterval, err := time.ParseDuration(cfg.Lookup.MinInterval)
+	if err != nil {
+		log.Warn().Err(err).Str("min_interval", cfg.Lookup.MinInterval).Msg("Invalid lookup interval, using 1s")
+		lookupInterval = time.Second
+	}
+	lookupSvc := lookup.New(db, metadataWriter, lookup.NewMusicBrainz(cfg.Lookup.MusicBrainzURL, cfg.Lookup.UserAgent, lookupInterval))
+
+	// Initialize ReplayGain computation (EBU R128 measurement, written via the metadata writer)
+	referenceLUFS := cfg.ReplayGain.ReferenceLUFS
+	if referenceLUFS == 0 {
+		referenceLUFS = replaygain.DefaultReference
+	}
+	replayGainSvc := replaygain.New(db, metadataWriter, cfg.FFmpeg.FFmpegPath, referenceLUFS)
+
+	// Set up the persistent job logger and its retention
+	jobLogger := jobs.NewLogger(db, bus, jobs.LogRetention{
+		MaxAge:  time.Duration(cfg.JobLogs.MaxAgeDays) * 24 * time.Hour,
+		MaxJobs: cfg.JobLogs.MaxJobs,
+	})
+	jobs.SetGlobalLogger(jobLogger)
+	jobLogger.Start(context.Background())
+	defer jobLogger.Stop()
 
-	// Set up job logger for handlers
-	handlers.SetJobLogger(jobs.GetGlobalLogger())
+	// Limit how fast jobs read from the library, shared by every worker
+	iobudget.SetGlobal(iobudget.New(int64(cfg.Jobs.ReadMBPerSec * 1e6)))
 
-	// Start job workers
-	worker := jobs.NewWorker(db, analyzerSvc, audioScanner, cfg.Scanner.WorkerCount)
+	// Garbage collection of long-deleted files and orphaned artifacts, run as a job
+	gcInterval, err := time.ParseDuration(cfg.GC.Interval)
+	if err != nil {
+		log.Warn().Err(err).Str("interval", cfg.GC.Interval).Msg("Invalid GC interval, using 24h")
+		gcInterval = 24 * time.Hour
+	}
+	collector := gc.New(db, cfg.Storage.ArtifactsPath, time.Duration(cfg.GC.GraceDays)*24*time.Hour, gcInterval)
+
+	// Start job workers, shared between job types by their caps and weights
+	worker := jobs.NewWorker(db, bus, analyzerSvc, audioScanner, conversionSvc, duplicateDetector, replayGainSvc, collector, cfg.Scanner.WorkerCount, jobs.TypeLimits{
+		Concurrency: cfg.Jobs.Concurrency,
+		Weights:     cfg.Jobs.Weights,
+	})
 	worker.Start(context.Background())
 	defer worker.Stop()
+	collector.Start(context.Background())
+	defer collector.Stop()
+
+	// Initialize handlers
+	h := handlers.New(db, scannerSvc, analyzerSvc, metadataWriter, artworkManager, conversionSvc, worker, fingerprintMatcher, lookupSvc, collector, bus)
+
+	// Initialize audio scan API handler for dynamic series endpoints
+	audioScanAPI := audioscan.NewAPIHandler(audioScanner)
 
 	// Start scheduler for periodic scans
 	scheduler := jobs.NewScheduler(db, func(ctx context.Context, libraryID string) {
@@ -125,6 +183,23 @@ func main() {
 	scheduler.Start(context.Background())
 	defer scheduler.Stop()
 
+	// Watch library folders to scan changes between interval scans
+	if cfg.Scanner.Watch {
+		debounce, err := time.ParseDuration(cfg.Scanner.WatchDebounce)
+		if err != nil {
+			log.Warn().Err(err).Str("watch_debounce", cfg.Scanner.WatchDebounce).Msg("Invalid watch debounce, using 10s")
+			debounce = 10 * time.Second
+		}
+		maxDelay, err := time.ParseDuration(cfg.Scanner.WatchMaxDelay)
+		if err != nil {
+			log.Warn().Err(err).Str("watch_max_delay", cfg.Scanner.WatchMaxDelay).Msg("Invalid watch max delay, using 2m")
+			maxDelay = 2 * time.Minute
+		}
+		watcher := scanner.NewWatcher(db, scannerSvc, debounce, maxDelay)
+		watcher.Start(context.Background())
+		defer watcher.Stop()
+	}
+
 	// Setup router
 	r := chi.NewRouter()
 
@@ -166,25 +241,51 @@ func main() {
 		r.Put("/libraries/{id}", h.UpdateLibrary)
 		r.Delete("/libraries/{id}", h.DeleteLibrary)
 		r.Post("/libraries/{id}/scan", h.ScanLibrary)
+		r.Get("/libraries/{id}/scan", h.GetScanProgress)
+		r.Post("/libraries/{id}/scan/cancel", h.CancelScan)
+		r.Post("/libraries/{id}/scan/dry-run", h.DryRunScan)
 		r.Get("/libraries/{id}/scans", h.ListScanRuns)
+		r.Get("/libraries/{id}/events", h.StreamLibraryEvents)
+		r.Get("/scans", h.ListActiveScans)
 
 		// Tracks
 		r.Get("/tracks", h.ListTracks)
 		r.Get("/tracks/{id}", h.GetTrack)
+		r.Get("/tracks/{id}/tags", h.GetTrackTags)
 		r.Post("/tracks/{id}/tags", h.UpdateTrackTags)
 		r.Post("/tracks/{id}/tags/preview", h.PreviewTrackTags)
 		r.Get("/tracks/{id}/artifacts", h.GetTrackArtifacts)
+		r.Get("/tracks/{id}/provenance", h.GetTrackProvenance)
 
 		// Bulk metadata operations
 		r.Post("/tracks/bulk/preview", h.PreviewBulkOperation)
 		r.Post("/tracks/bulk/apply", h.ApplyBulkOperation)
 		r.Post("/albums/normalize-artist", h.NormalizeAlbumArtist)
 		r.Post("/albums/fix-numbering", h.FixTrackNumbering)
+		r.Get("/albums/lookup", h.LookupAlbum)
+		r.Post("/albums/lookup/preview", h.PreviewAlbumRelease)
+		r.Post("/albums/lookup/apply", h.ApplyAlbumRelease)
+		r.Post("/albums/replaygain", h.QueueReplayGain)
 
 		// Jobs
 		r.Get("/jobs", h.ListJobs)
+		r.Post("/jobs/cancel", h.CancelJobs)
+		r.Post("/jobs/retry", h.RetryJobs)
+		r.Post("/jobs/priority", h.SetJobsPriority)
+		r.Post("/jobs/purge", h.PurgeJobs)
+		r.Post("/jobs/{id}/cancel", h.CancelJob)
+		r.Post("/jobs/{id}/retry", h.RetryJob)
+		r.Put("/jobs/{id}/priority", h.SetJobPriority)
+		r.Delete("/jobs/{id}", h.DeleteJob)
 		r.Get("/jobs/logs", h.ListJobLogs)
 		r.Get("/jobs/{id}/logs", h.GetJobLogs)
+		r.Get("/jobs/{id}/events", h.StreamJobEvents)
+
+		// Garbage collection of long-deleted files and orphaned artifacts
+		r.Post("/gc", h.RunGC)
+
+		// Live events (Server-Sent Events)
+		r.Get("/events", h.StreamEvents)
 
 		// Settings
 		r.Get("/settings", h.GetSettings)
@@ -192,6 +293,30 @@ func main() {
 
 		// Conversion profiles
 		r.Get("/profiles", h.ListConversionProfiles)
+		r.Post("/profiles", h.CreateConversionProfile)
+		r.Get("/profiles/{id}", h.GetConversionProfile)
+		r.Put("/profiles/{id}", h.UpdateConversionProfile)
+		r.Delete("/profiles/{id}", h.DeleteConversionProfile)
+		r.Post("/profiles/{id}/clone", h.CloneConversionProfile)
+
+		// Conversion jobs
+		r.Get("/conversions", h.ListConversions)
+		r.Post("/conversions", h.CreateConversion)
+		r.Get("/conversions/{id}", h.GetConversion)
+		r.Post("/conversions/{id}/cancel", h.CancelConversion)
+		r.Get("/conversions/{id}/logs", h.GetConversionLogs)
+		r.Get("/conversions/{id}/provenance", h.ListConversionProvenance)
+
+		// Duplicate detection
+		r.Get("/duplicates", h.ListDuplicateSets)
+		r.Post("/duplicates/scan", h.RunDuplicateScan)
+		r.Get("/duplicates/{id}", h.GetDuplicateSet)
+
+		// Acoustic fingerprints
+		r.Get("/tracks/{id}/similar", h.GetSimilarTracks)
+		r.Get("/fingerprints/matches", h.ListAcousticMatches)
+		r.Get("/fingerprints/mismatches", h.ListTagMismatches)
+		r.Post("/fingerprints/scan", h.RunFingerprintScan)
 
 		// Artwork management
 		r.Get("/artwork/missing", h.ListMissingArtwork)
@@ -211,6 +336,8 @@ func main() {
 
 		// Action logs
 		r.Get("/logs", h.ListActionLogs)
+		r.Post("/logs/{id}/revert/preview", h.PreviewRevert)
+		r.Post("/logs/{id}/revert", h.RevertAction)
 	})
 
 	// Page routes
@@ -352,7 +479,15 @@ func main() {
 	})
 
 	r.Get("/duplicates", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/tracks", http.StatusTemporaryRedirect)
+		ctx := r.Context()
+		sets, total, err := db.ListDuplicateSets(ctx, 50, 0)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list duplicate sets")
+			sets = []models.DuplicateSet{}
+		}
+		settings, _ := db.GetAllSettings(ctx)
+
+		pages.DuplicatesPage(sets, total, settings).Render(ctx, w)
 	})
 
 	// Artifact file server
@@ -0,0 +1,337 @@
+// Package accuraterip verifies CD rips: it computes the AccurateRip v1/v2,
+// CRC32 and CTDB-style checksums of tracks from their decoded PCM and
+// compares them with those the EAC or XLD rip log next to them recorded
+package accuraterip
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+)
+
+// Red Book audio: 44.1 kHz 16-bit stereo, 588 frames to a sector
+const (
+	SampleRate      = 44100
+	framesPerSector = 588
+
+	// arSkip frames are left out at the start of a disc's first track and
+	// the end of its last by AccurateRip, as drives with a read offset
+	// can't read them all
+	arSkip = 5 * framesPerSector
+
+	// ctdbSkip frames are left out at the start and end of a disc by CTDB
+	ctdbSkip = 10 * framesPerSector
+
+	// MaxOffset is the furthest, in frames, a rip is searched for having
+	// been read with another offset
+	MaxOffset = 5 * framesPerSector
+
+	// delay is how many frames of a track are kept back until its length
+	// is known, so its end is checksummed knowing where it ends
+	delay = arSkip + MaxOffset
+)
+
+// Kinds of checksum
+const (
+	CRC32         = "crc32"   // of the whole track, EAC's copy CRC and XLD's CRC32 hash
+	CRC32NoNulls  = "crc32nn" // CRC32 leaving out null samples, as EAC can be set to
+	AccurateRipV1 = "arv1"
+	AccurateRipV2 = "arv2"
+	CTDB          = "ctdb" // CRC32 without the frames CTDB leaves out at the ends of the disc
+)
+
+// Checksums of a track, by kind
+type Checksums map[string]uint32
+
+// Span is where a track is in the file holding it and on its disc
+type Span struct {
+	Start  int64 // first frame in the file
+	Length int64 // frames, 0 running to the end of the file
+	Number int   // track number on the disc, from 1
+	Total  int   // tracks on the disc
+}
+
+// Result is the checksums of a track and what it takes to search for the
+// offset it would match another rip's AccurateRip v1 checksum at
+type Result struct {
+	Checksums Checksums
+	Frames    int64
+
+	a, b       int64    // first and last multipliers counted for AccurateRip
+	v1, sum    uint32   // AccurateRip v1 and the sum of the frames it counts
+	head, tail []uint32 // frames around a and b, MaxOffset either side
+}
+
+// Checksummer computes the checksums of the tracks a file holds as its
+// decoded audio is written to it, so the file is decoded once for all of
+// them. Frames beyond the ends of the file are taken to be silence, so rips
+// with one file per track only match at another offset when their edges
+// are silent.
+type Checksummer struct {
+	tracks []*track
+	frames []uint32
+	raw    []byte
+	pos    int64
+}
+
+// NewChecksummer returns a checksummer for the tracks at spans of a file
+func NewChecksummer(spans []Span) *Checksummer {
+	c := &Checksummer{tracks: make([]*track, len(spans))}
+	for i, s := range spans {
+		c.tracks[i] = newTrack(s)
+	}
+	return c
+}
+
+// Write takes the next interleaved stereo samples of the file, as decoded
+// to float
+func (c *Checksummer) Write(samples []float32) error {
+	c.frames = c.frames[:0]
+	for i := 0; i+1 < len(samples); i += 2 {
+		c.frames = append(c.frames, uint32(toInt16(samples[i]))|uint32(toInt16(samples[i+1]))<<16)
+	}
+	if cap(c.raw) < len(c.frames)*4 {
+		c.raw = make([]byte, len(c.frames)*4)
+	}
+	c.raw = c.raw[:len(c.frames)*4]
+	for i, f := range c.frames {
+		binary.LittleEndian.PutUint32(c.raw[i*4:], f)
+	}
+	for _, t := range c.tracks {
+		t.write(c.pos, c.frames, c.raw)
+	}
+	c.pos += int64(len(c.frames))
+	return nil
+}
+
+// Results returns the checksums of each track once the whole file has been
+// written
+func (c *Checksummer) Results() []*Result {
+	results := make([]*Result, len(c.tracks))
+	for i, t := range c.tracks {
+		results[i] = t.finish()
+	}
+	return results
+}
+
+// toInt16 recovers a 16-bit sample decoded to float, which is exact
+func toInt16(f float32) uint16 {
+	v := math.Round(float64(f) * 32768)
+	return uint16(int16(max(-32768, min(32767, v))))
+}
+
+// track accumulates the checksums of one span as the frames of its file
+// go by
+type track struct {
+	span        Span
+	first, last bool
+	a           int64
+
+	n          int64    // frames of the track seen
+	ring       []uint32 // the last frames seen, not yet checksummed
+	ringStart  int      // index of the oldest frame in ring
+	crc, ctdb  uint32
+	crcNoNulls uint32
+	nonNull    []byte // buffer for the samples crcNoNulls counts
+	v1, v2     uint32
+	sum        uint32
+	head, tail []uint32
+	done       bool
+}
+
+func newTrack(s Span) *track {
+	t := &track{
+		span:  s,
+		first: s.Number == 1,
+		last:  s.Number == s.Total,
+		a:     1,
+		ring:  make([]uint32, 0, delay),
+		head:  make([]uint32, 2*MaxOffset),
+		tail:  make([]uint32, 2*MaxOffset),
+	}
+	if t.first {
+		t.a = arSkip
+	}
+	return t
+}
+
+// end returns the last multiplier AccurateRip counts for a track of n
+// frames
+func (t *track) end(n int64) int64 {
+	if t.last {
+		return n - arSkip
+	}
+	return n
+}
+
+// write feeds the track the frames of its file starting at frame pos,
+// with raw holding them as bytes
+func (t *track) write(pos int64, frames []uint32, raw []byte) {
+	if t.done {
+		return
+	}
+	s := t.span
+	from := max(0, s.Start-pos)
+	to := int64(len(frames))
+	if s.Length > 0 {
+		to = min(to, s.Start+s.Length-pos)
+	}
+	if from < to {
+		t.crc = crc32.Update(t.crc, crc32.IEEETable, raw[from*4:to*4])
+		t.nonNull = appendNonNull(t.nonNull[:0], raw[from*4:to*4])
+		t.crcNoNulls = crc32.Update(t.crcNoNulls, crc32.IEEETable, t.nonNull)
+	}
+
+	// Frames before the head window don't matter
+	first := max(0, s.Start+min(t.a-MaxOffset, 1)-1-pos)
+	for i := first; i < int64(len(frames)); i++ {
+		x := frames[i]
+		m := pos + i - s.Start + 1 // multiplier of the frame
+		switch {
+		case m <= 0:
+			t.storeHead(m, x)
+		case s.Length == 0 || m <= s.Length:
+			t.n = m
+			t.storeHead(m, x)
+			t.push(m, x)
+		default:
+			// Frames after the end only matter to the offset search
+			t.storeTail(m, x, t.end(s.Length))
+			if m >= s.Length+MaxOffset {
+				t.done = true
+				return
+			}
+		}
+	}
+}
+
+// appendNonNull appends the 16-bit samples of raw that aren't zero
+func appendNonNull(dst, raw []byte) []byte {
+	for i := 0; i+1 < len(raw); i += 2 {
+		if raw[i] != 0 || raw[i+1] != 0 {
+			dst = append(dst, raw[i], raw[i+1])
+		}
+	}
+	return dst
+}
+
+func (t *track) storeHead(m int64, x uint32) {
+	if i := m - (t.a - MaxOffset); i >= 0 && i < int64(len(t.head)) {
+		t.head[i] = x
+	}
+}
+
+func (t *track) storeTail(m int64, x uint32, b int64) {
+	if i := m - (b - MaxOffset + 1); i >= 0 && i < int64(len(t.tail)) {
+		t.tail[i] = x
+	}
+}
+
+// push keeps a frame back, checksumming the one it replaces. Frames leave
+// the ring far enough from the end of the track to count whatever its
+// length.
+func (t *track) push(m int64, x uint32) {
+	if len(t.ring) < cap(t.ring) {
+		t.ring = append(t.ring, x)
+		return
+	}
+	old := t.ring[t.ringStart]
+	t.ring[t.ringStart] = x
+	t.ringStart = (t.ringStart + 1) % len(t.ring)
+	t.add(m-delay, old, math.MaxInt64, math.MaxInt64)
+}
+
+// add checksums the frame at multiplier m of a track ending at b for
+// AccurateRip and ctdbEnd for CTDB
+func (t *track) add(m int64, x uint32, b, ctdbEnd int64) {
+	if m >= t.a && m <= b {
+		mult := uint32(m)
+		t.v1 += mult * x
+		product := uint64(mult) * uint64(x)
+		t.v2 += uint32(product>>32) + uint32(product)
+		t.sum += x
+	}
+	if (!t.first || m > ctdbSkip) && m <= ctdbEnd {
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], x)
+		t.ctdb = crc32.Update(t.ctdb, crc32.IEEETable, buf[:])
+	}
+}
+
+// finish checksums the frames kept back, now the length of the track is
+// known
+func (t *track) finish() *Result {
+	n := t.n
+	b := t.end(n)
+	ctdbEnd := n
+	if t.last {
+		ctdbEnd = n - ctdbSkip
+	}
+
+	start := n - int64(len(t.ring)) + 1
+	for i := range t.ring {
+		x := t.ring[(t.ringStart+i)%len(t.ring)]
+		m := start + int64(i)
+		t.add(m, x, b, ctdbEnd)
+		t.storeTail(m, x, b)
+	}
+
+	return &Result{
+		Checksums: Checksums{
+			CRC32:         t.crc,
+			CRC32NoNulls:  t.crcNoNulls,
+			AccurateRipV1: t.v1,
+			AccurateRipV2: t.v2,
+			CTDB:          t.ctdb,
+		},
+		Frames: n,
+		a:      t.a,
+		b:      b,
+		v1:     t.v1,
+		sum:    t.sum,
+		head:   t.head,
+		tail:   t.tail,
+	}
+}
+
+// frame returns the frame at multiplier m, from the windows kept around
+// the ends of the range AccurateRip counts
+func (r *Result) frame(m int64) uint32 {
+	if i := m - (r.a - MaxOffset); i >= 0 && i < int64(len(r.head)) {
+		return r.head[i]
+	}
+	if i := m - (r.b - MaxOffset + 1); i >= 0 && i < int64(len(r.tail)) {
+		return r.tail[i]
+	}
+	return 0
+}
+
+// FindOffset returns the offset nearest zero, in frames, at which the
+// track has the given AccurateRip v1 checksum: a positive offset means the
+// rip it comes from starts that many frames later. The checksum is slid
+// a frame at a time rather than computed again for each offset.
+func (r *Result) FindOffset(v1 uint32) (int, bool) {
+	if r.b < r.a {
+		return 0, false
+	}
+	later, laterSum := r.v1, r.sum
+	earlier, earlierSum := r.v1, r.sum
+	for o := int64(0); o < MaxOffset; o++ {
+		// Slide one frame later: the frame at a leaves, the one after b comes in
+		in, out := r.frame(r.b+1+o), r.frame(r.a+o)
+		later = later - laterSum - uint32(r.a-1)*out + uint32(r.b)*in
+		laterSum = laterSum - out + in
+		if later == v1 {
+			return int(o + 1), true
+		}
+
+		// And one frame earlier: the frame before a comes in, the one at b leaves
+		in, out = r.frame(r.a-1-o), r.frame(r.b-o)
+		earlier = earlier + earlierSum + uint32(r.a)*in - uint32(r.b+1)*out
+		earlierSum = earlierSum + in - out
+		if earlier == v1 {
+			return -int(o + 1), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,259 @@
+package accuraterip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+)
+
+// samplesOf returns frames as the interleaved float samples ffmpeg decodes
+// them to
+func samplesOf(frames []uint32) []float32 {
+	samples := make([]float32, 0, 2*len(frames))
+	for _, f := range frames {
+		samples = append(samples, float32(int16(f))/32768, float32(int16(f>>16))/32768)
+	}
+	return samples
+}
+
+// checksum writes frames to a checksummer in blocks of block frames, as
+// StreamPCM hands them over, and returns the results
+func checksum(t *testing.T, frames []uint32, block int, spans ...Span) []*Result {
+	t.Helper()
+	c := NewChecksummer(spans)
+	for i := 0; i < len(frames); i += block {
+		if err := c.Write(samplesOf(frames[i:min(i+block, len(frames))])); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	return c.Results()
+}
+
+// reference computes the checksums of a track's frames the plain way
+func reference(frames []uint32, first, last bool) Checksums {
+	n := int64(len(frames))
+	a, b := int64(1), n
+	if first {
+		a = arSkip
+	}
+	if last {
+		b = n - arSkip
+	}
+	ctdbStart, ctdbEnd := int64(1), n
+	if first {
+		ctdbStart = ctdbSkip + 1
+	}
+	if last {
+		ctdbEnd = n - ctdbSkip
+	}
+
+	var v1, v2 uint32
+	var all, nonNull, ctdb []byte
+	for i, x := range frames {
+		m := int64(i + 1)
+		if m >= a && m <= b {
+			v1 += uint32(m) * x
+			p := uint64(m) * uint64(x)
+			v2 += uint32(p>>32) + uint32(p)
+		}
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], x)
+		all = append(all, buf[:]...)
+		for _, s := range [][]byte{buf[:2], buf[2:]} {
+			if s[0] != 0 || s[1] != 0 {
+				nonNull = append(nonNull, s...)
+			}
+		}
+		if m >= ctdbStart && m <= ctdbEnd {
+			ctdb = append(ctdb, buf[:]...)
+		}
+	}
+	return Checksums{
+		CRC32:         crc32.ChecksumIEEE(all),
+		CRC32NoNulls:  crc32.ChecksumIEEE(nonNull),
+		AccurateRipV1: v1,
+		AccurateRipV2: v2,
+		CTDB:          crc32.ChecksumIEEE(ctdb),
+	}
+}
+
+// randomFrames returns n frames of noise, with a run of digital silence
+// and silent samples in one channel so null samples are left out
+func randomFrames(seed int64, n int) []uint32 {
+	r := rand.New(rand.NewSource(seed))
+	frames := make([]uint32, n)
+	for i := range frames {
+		frames[i] = r.Uint32()
+		switch {
+		case i%7 == 0:
+			frames[i] &= 0xffff0000
+		case i > n/2 && i < n/2+100:
+			frames[i] = 0
+		}
+	}
+	return frames
+}
+
+func checkChecksums(t *testing.T, name string, got *Result, want Checksums) {
+	t.Helper()
+	for kind, sum := range want {
+		if got.Checksums[kind] != sum {
+			t.Errorf("%s: %s = %08X, want %08X", name, kind, got.Checksums[kind], sum)
+		}
+	}
+}
+
+func TestChecksumsOfImage(t *testing.T) {
+	// Three tracks of a disc in one file, the last running to its end
+	frames := randomFrames(1, 60000)
+	spans := []Span{
+		{Start: 0, Length: 20000, Number: 1, Total: 3},
+		{Start: 20000, Length: 17001, Number: 2, Total: 3},
+		{Start: 37001, Number: 3, Total: 3},
+	}
+	for _, block := range []int{4096, 1000, 60000} {
+		results := checksum(t, frames, block, spans...)
+		for i, s := range spans {
+			end := int64(len(frames))
+			if s.Length > 0 {
+				end = s.Start + s.Length
+			}
+			if results[i].Frames != end-s.Start {
+				t.Errorf("track %d: %d frames, want %d", s.Number, results[i].Frames, end-s.Start)
+			}
+			want := reference(frames[s.Start:end], s.Number == 1, s.Number == s.Total)
+			checkChecksums(t, fmt.Sprintf("track %d", s.Number), results[i], want)
+		}
+	}
+}
+
+func TestAccurateRipKnownValues(t *testing.T) {
+	const n = 10000
+	ones := make([]uint32, n)
+	for i := range ones {
+		ones[i] = 1
+	}
+	sum := func(from, to uint32) uint32 { return (to - from + 1) * (from + to) / 2 }
+
+	for _, tc := range []struct {
+		name string
+		span Span
+		want uint32
+	}{
+		{"middle track", Span{Number: 2, Total: 3}, sum(1, n)},
+		{"first track", Span{Number: 1, Total: 3}, sum(2940, n)},
+		{"last track", Span{Number: 3, Total: 3}, sum(1, n-2940)},
+		{"only track", Span{Number: 1, Total: 1}, sum(2940, n-2940)},
+	} {
+		r := checksum(t, ones, 4096, tc.span)[0]
+		// No product overflows 32 bits, so both versions agree
+		if r.Checksums[AccurateRipV1] != tc.want || r.Checksums[AccurateRipV2] != tc.want {
+			t.Errorf("%s: v1 %d, v2 %d, want %d", tc.name, r.Checksums[AccurateRipV1], r.Checksums[AccurateRipV2], tc.want)
+		}
+	}
+
+	// v2 adds back the high half of products that overflow: 2 * 0xFFFFFFFF
+	// is 0x1FFFFFFFE
+	frames := make([]uint32, 6000)
+	frames[1] = 0xffffffff
+	r := checksum(t, frames, 4096, Span{Number: 2, Total: 3})[0]
+	if got := r.Checksums[AccurateRipV1]; got != 0xfffffffe {
+		t.Errorf("v1 = %08X, want FFFFFFFE", got)
+	}
+	if got := r.Checksums[AccurateRipV2]; got != 0xffffffff {
+		t.Errorf("v2 = %08X, want FFFFFFFF", got)
+	}
+}
+
+func TestDiscEdgesSkipped(t *testing.T) {
+	frames := randomFrames(2, 30000)
+	span := Span{Number: 1, Total: 1}
+	before := checksum(t, frames, 4096, span)[0].Checksums
+
+	for _, tc := range []struct {
+		name    string
+		frame   int
+		changed []string
+		kept    []string
+	}{
+		// AccurateRip leaves out 5 sectors less a frame at the start of
+		// the disc and 5 sectors at its end; CTDB 10 sectors at both
+		{"start, in both skips", 100, []string{CRC32}, []string{AccurateRipV1, AccurateRipV2, CTDB}},
+		{"start, in the CTDB skip", arSkip, []string{CRC32, AccurateRipV1, AccurateRipV2}, []string{CTDB}},
+		{"end, in both skips", len(frames) - 1, []string{CRC32}, []string{AccurateRipV1, AccurateRipV2, CTDB}},
+		{"end, in the CTDB skip", len(frames) - arSkip - 1, []string{CRC32, AccurateRipV1, AccurateRipV2}, []string{CTDB}},
+		{"middle", len(frames) / 3, []string{CRC32, AccurateRipV1, AccurateRipV2, CTDB}, nil},
+	} {
+		changed := append([]uint32(nil), frames...)
+		changed[tc.frame] ^= 0x00010001
+		after := checksum(t, changed, 4096, span)[0].Checksums
+		for _, kind := range tc.changed {
+			if after[kind] == before[kind] {
+				t.Errorf("%s: %s unchanged", tc.name, kind)
+			}
+		}
+		for _, kind := range tc.kept {
+			if after[kind] != before[kind] {
+				t.Errorf("%s: %s changed", tc.name, kind)
+			}
+		}
+	}
+}
+
+func TestFindOffset(t *testing.T) {
+	frames := randomFrames(3, 40000)
+	span := Span{Start: 10000, Length: 18000, Number: 2, Total: 3}
+	r := checksum(t, frames, 4096, span)[0]
+
+	for _, offset := range []int{1, 7, -1, -300, MaxOffset, -MaxOffset} {
+		// A rip read with another offset starts offset frames later
+		start := int(span.Start) + offset
+		want := reference(frames[start:start+int(span.Length)], false, false)[AccurateRipV1]
+		got, found := r.FindOffset(want)
+		if !found || got != offset {
+			t.Errorf("FindOffset for %+d = %+d, %v", offset, got, found)
+		}
+	}
+
+	start := int(span.Start) + MaxOffset + 1
+	beyond := reference(frames[start:start+int(span.Length)], false, false)[AccurateRipV1]
+	if offset, found := r.FindOffset(beyond); found {
+		t.Errorf("found %+d beyond MaxOffset", offset)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	frames := randomFrames(4, 40000)
+	span := Span{Start: 10000, Length: 18000, Number: 2, Total: 3}
+	r := checksum(t, frames, 4096, span)[0]
+	l := &Log{Ripper: RipperEAC, ReadOffset: 6}
+
+	v := Verify(r, l, &LogTrack{Number: 2, Checksums: r.Checksums}, nil)
+	if v.Status != StatusPass || len(v.Matched) != len(r.Checksums) {
+		t.Errorf("same checksums: %+v", v)
+	}
+
+	shifted := reference(frames[10000+30:28000+30], false, false)
+	logged := &LogTrack{Number: 2, Checksums: Checksums{
+		CRC32:         shifted[CRC32],
+		AccurateRipV1: shifted[AccurateRipV1],
+	}}
+	v = Verify(r, l, logged, nil)
+	if v.Status != StatusShifted || v.Offset != 30 {
+		t.Errorf("shifted rip: %+v", v)
+	}
+
+	logged.Checksums[AccurateRipV1] ^= 1
+	v = Verify(r, l, logged, nil)
+	if v.Status != StatusFail || len(v.Mismatched) != 2 {
+		t.Errorf("different rip: %+v", v)
+	}
+
+	subs := []Submission{{Track: 2, Kind: AccurateRipV2, Checksum: r.Checksums[AccurateRipV2], Confidence: 12}}
+	v = Verify(r, l, &LogTrack{Number: 2, Checksums: Checksums{AccurateRipV2: r.Checksums[AccurateRipV2]}}, subs)
+	if v.Status != StatusPass || v.Confidence != 12 {
+		t.Errorf("with a submission: %+v", v)
+	}
+}
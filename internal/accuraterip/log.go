@@ -0,0 +1,314 @@
+package accuraterip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Rippers whose logs are read
+const (
+	RipperEAC = "EAC"
+	RipperXLD = "XLD"
+)
+
+// Log is what an EAC or XLD rip log recorded of a disc
+type Log struct {
+	Path       string
+	Ripper     string
+	ReadOffset int        // read offset correction, in frames
+	SkipNulls  bool       // EAC left null samples out of its CRCs
+	Image      string     // file a range rip was saved to, if any
+	TOC        []TOCEntry // table of contents of the disc, if logged
+	Tracks     []LogTrack
+}
+
+// TOCEntry is a track of a disc's table of contents, in sectors
+type TOCEntry struct {
+	Number int
+	Start  int
+	End    int
+}
+
+// LogTrack is what a log recorded of a track
+type LogTrack struct {
+	Number    int
+	Filename  string
+	Checksums Checksums
+}
+
+var (
+	trackRe       = regexp.MustCompile(`^Track\s+(\d+)$`)
+	rangeARRe     = regexp.MustCompile(`^Track\s+(\d+)\s+(?:accurately ripped|cannot be verified|not present)`)
+	arChecksumRe  = regexp.MustCompile(`\[([0-9A-Fa-f]{8})\](?:.*\(AR v([12])\))?`)
+	tocRe         = regexp.MustCompile(`^(\d+)\s*\|\s*[\d:.]+\s*\|\s*[\d:.]+\s*\|\s*(\d+)\s*\|\s*(\d+)$`)
+	readOffsetRe  = regexp.MustCompile(`^(?:Read offset correction|Combined read/write offset correction)\s*:\s*([+-]?\d+)`)
+	nullSamplesRe = regexp.MustCompile(`^Null samples used in CRC calculations\s*:\s*(\w+)`)
+	keyValueRe    = regexp.MustCompile(`^([^:]+?)\s*:\s*(.*)$`)
+	hexChecksumRe = regexp.MustCompile(`^[0-9A-Fa-f]{8}$`)
+)
+
+// ParseLog reads a rip log, returning an error for anything but an EAC or
+// XLD log. EAC writes its logs in UTF-16.
+func ParseLog(data []byte) (*Log, error) {
+	text := decodeText(data)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	l := &Log{}
+	var track *LogTrack
+	inRange := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if l.Ripper == "" {
+			switch {
+			case strings.HasPrefix(line, "Exact Audio Copy"), strings.HasPrefix(line, "EAC extraction logfile"):
+				l.Ripper = RipperEAC
+			case strings.HasPrefix(line, "X Lossless Decoder"), strings.HasPrefix(line, "XLD extraction logfile"):
+				l.Ripper = RipperXLD
+			default:
+				return nil, fmt.Errorf("not an EAC or XLD log")
+			}
+			continue
+		}
+
+		if m := readOffsetRe.FindStringSubmatch(line); m != nil {
+			l.ReadOffset, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if m := nullSamplesRe.FindStringSubmatch(line); m != nil {
+			l.SkipNulls = strings.EqualFold(m[1], "No")
+			continue
+		}
+		if m := tocRe.FindStringSubmatch(line); m != nil {
+			num, _ := strconv.Atoi(m[1])
+			start, _ := strconv.Atoi(m[2])
+			end, _ := strconv.Atoi(m[3])
+			l.TOC = append(l.TOC, TOCEntry{Number: num, Start: start, End: end})
+			continue
+		}
+		if strings.HasPrefix(line, "Range status and errors") {
+			inRange = true
+			track = nil
+			continue
+		}
+
+		if m := trackRe.FindStringSubmatch(line); m != nil {
+			num, _ := strconv.Atoi(m[1])
+			track = l.track(num)
+			inRange = false
+			continue
+		}
+
+		// A range rip lists the AccurateRip results of its tracks after
+		// the range, one line each
+		if m := rangeARRe.FindStringSubmatch(line); m != nil {
+			num, _ := strconv.Atoi(m[1])
+			if c := arChecksumRe.FindStringSubmatch(line); c != nil {
+				l.track(num).Checksums[arKind(c[2])] = parseHex(c[1])
+			}
+			continue
+		}
+		if track == nil && !inRange {
+			continue
+		}
+
+		switch l.Ripper {
+		case RipperEAC:
+			l.parseEACLine(track, line, inRange)
+		case RipperXLD:
+			parseXLDLine(track, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if l.Ripper == "" {
+		return nil, fmt.Errorf("empty log")
+	}
+	if len(l.Tracks) == 0 {
+		return nil, fmt.Errorf("no tracks")
+	}
+	return l, nil
+}
+
+// parseEACLine reads a line of a track, or of the range of a range rip
+func (l *Log) parseEACLine(track *LogTrack, line string, inRange bool) {
+	switch {
+	case strings.HasPrefix(line, "Filename "):
+		name := strings.TrimSpace(strings.TrimPrefix(line, "Filename "))
+		if inRange {
+			l.Image = name
+		} else {
+			track.Filename = name
+		}
+	case inRange:
+	case strings.HasPrefix(line, "Copy CRC "):
+		if v := strings.TrimSpace(strings.TrimPrefix(line, "Copy CRC ")); hexChecksumRe.MatchString(v) {
+			kind := CRC32
+			if l.SkipNulls {
+				kind = CRC32NoNulls
+			}
+			track.Checksums[kind] = parseHex(v)
+		}
+	case strings.Contains(line, "ccurate"):
+		// "Accurately ripped (confidence 5)  [1A2B3C4D]  (AR v2)", or
+		// "Cannot be verified as accurate ..." with the same checksum.
+		// Logs from before AccurateRip v2 don't give the version.
+		if m := arChecksumRe.FindStringSubmatch(line); m != nil {
+			track.Checksums[arKind(m[2])] = parseHex(m[1])
+		}
+	}
+}
+
+// parseXLDLine reads a "key : value" line of a track
+func parseXLDLine(track *LogTrack, line string) {
+	m := keyValueRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	key, value := m[1], strings.TrimSpace(m[2])
+	if key == "Filename" {
+		track.Filename = value
+		return
+	}
+	if !hexChecksumRe.MatchString(value) {
+		return
+	}
+	switch key {
+	case "CRC32 hash":
+		track.Checksums[CRC32] = parseHex(value)
+	case "AccurateRip v1 signature", "AccurateRip signature":
+		track.Checksums[AccurateRipV1] = parseHex(value)
+	case "AccurateRip v2 signature":
+		track.Checksums[AccurateRipV2] = parseHex(value)
+	}
+}
+
+// track returns the track numbered num, adding it if it isn't there yet
+func (l *Log) track(num int) *LogTrack {
+	for i := range l.Tracks {
+		if l.Tracks[i].Number == num {
+			return &l.Tracks[i]
+		}
+	}
+	l.Tracks = append(l.Tracks, LogTrack{Number: num, Checksums: Checksums{}})
+	return &l.Tracks[len(l.Tracks)-1]
+}
+
+func arKind(version string) string {
+	if version == "2" {
+		return AccurateRipV2
+	}
+	return AccurateRipV1
+}
+
+func parseHex(s string) uint32 {
+	v, _ := strconv.ParseUint(s, 16, 32)
+	return uint32(v)
+}
+
+// decodeText decodes a log from UTF-16 with a byte order mark, UTF-8, or
+// otherwise Latin-1
+func decodeText(data []byte) string {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		order = binary.BigEndian
+	}
+	if order != nil {
+		units := make([]uint16, (len(data)-2)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2+i*2:])
+		}
+		return string(utf16.Decode(units))
+	}
+
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// TotalTracks returns how many tracks the ripped disc has: from its table
+// of contents, or otherwise the highest track number logged
+func (l *Log) TotalTracks() int {
+	total := len(l.TOC)
+	for _, t := range l.Tracks {
+		total = max(total, t.Number)
+	}
+	return total
+}
+
+// TrackOf returns what the log recorded of the track numbered num in an
+// audio file, or nil if it isn't of this log. A track is matched by its
+// file name, with or without the extension as logs name the WAV ripped
+// before it was compressed; the tracks of a range rip are matched by
+// number once the image is.
+func (l *Log) TrackOf(audioPath string, num int) *LogTrack {
+	name := filepath.Base(audioPath)
+	for i := range l.Tracks {
+		if l.Tracks[i].Filename != "" && sameFile(l.Tracks[i].Filename, name) {
+			return &l.Tracks[i]
+		}
+	}
+	if l.Image == "" || !sameFile(l.Image, name) {
+		return nil
+	}
+	for i := range l.Tracks {
+		if l.Tracks[i].Number == num {
+			return &l.Tracks[i]
+		}
+	}
+	return nil
+}
+
+// sameFile reports whether a path a log recorded, maybe a Windows one,
+// names a file, ignoring case and extensions
+func sameFile(logged, name string) bool {
+	logged = path.Base(strings.ReplaceAll(logged, `\`, "/"))
+	return strings.EqualFold(strings.TrimSuffix(logged, path.Ext(logged)), strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// LoadLogs reads the EAC and XLD logs in a directory, skipping other logs
+func LoadLogs(dir string) []*Log {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var logs []*Log
+	for _, e := range entries {
+		if e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".log") {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		if l, err := ParseLog(data); err == nil {
+			l.Path = p
+			logs = append(logs, l)
+		}
+	}
+	return logs
+}
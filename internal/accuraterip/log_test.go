@@ -0,0 +1,283 @@
+package accuraterip
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// utf16LE encodes a log the way EAC writes it, in UTF-16 with a byte order
+// mark and CRLF line ends
+func utf16LE(text string) []byte {
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+	data := []byte{0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(text)) {
+		data = binary.LittleEndian.AppendUint16(data, u)
+	}
+	return data
+}
+
+const eacLog = `Exact Audio Copy V1.6 from 23. October 2020
+
+EAC extraction logfile from 4. February 2026, 10:30
+
+Artíst / Album
+
+Used drive  : PLEXTOR DVDR   PX-716A   Adapter: 1  ID: 0
+
+Read offset correction                      : 30
+Overread into Lead-In and Lead-Out          : No
+Null samples used in CRC calculations       : Yes
+
+TOC of the extracted CD
+
+     Track |   Start  |  Length  | Start sector | End sector
+    ---------------------------------------------------------
+        1  |  0:00.00 |  4:02.50 |         0    |    18199
+        2  |  4:02.50 |  3:10.25 |     18200    |    32474
+
+Track  1
+
+     Filename C:\Rips\Artíst - Album\01 - First.wav
+
+     Peak level 98.0 %
+     Copy CRC 1A2B3C4D
+     Accurately ripped (confidence 5)  [89ABCDEF]  (AR v2)
+     Copy OK
+
+Track  2
+
+     Filename C:\Rips\Artíst - Album\02 - Second.wav
+
+     Peak level 97.1 %
+     Copy CRC 0BADF00D
+     Cannot be verified as accurate (confidence 3)  [12345678], AccurateRip returned [87654321]  (AR v1)
+     Copy OK
+
+All tracks accurately ripped
+`
+
+func TestParseEACLog(t *testing.T) {
+	l, err := ParseLog(utf16LE(eacLog))
+	if err != nil {
+		t.Fatalf("ParseLog: %v", err)
+	}
+	if l.Ripper != RipperEAC || l.ReadOffset != 30 || l.SkipNulls {
+		t.Errorf("ripper %s, offset %d, skip nulls %v", l.Ripper, l.ReadOffset, l.SkipNulls)
+	}
+	wantTOC := []TOCEntry{{1, 0, 18199}, {2, 18200, 32474}}
+	if len(l.TOC) != len(wantTOC) || l.TOC[0] != wantTOC[0] || l.TOC[1] != wantTOC[1] {
+		t.Errorf("TOC = %v, want %v", l.TOC, wantTOC)
+	}
+	if l.TotalTracks() != 2 {
+		t.Errorf("TotalTracks = %d", l.TotalTracks())
+	}
+
+	first := l.TrackOf("/music/Artíst - Album/01 - First.flac", 1)
+	if first == nil {
+		t.Fatalf("track 1 not matched by file name")
+	}
+	if first.Checksums[CRC32] != 0x1a2b3c4d || first.Checksums[AccurateRipV2] != 0x89abcdef {
+		t.Errorf("track 1 checksums = %v", first.Checksums)
+	}
+
+	// The checksum the database returned isn't the rip's
+	second := l.TrackOf("/music/Artíst - Album/02 - SECOND.flac", 2)
+	if second == nil || second.Number != 2 {
+		t.Fatalf("track 2 not matched ignoring case")
+	}
+	if second.Checksums[CRC32] != 0x0badf00d || second.Checksums[AccurateRipV1] != 0x12345678 {
+		t.Errorf("track 2 checksums = %v", second.Checksums)
+	}
+
+	if l.TrackOf("/music/Artíst - Album/03 - Third.flac", 3) != nil {
+		t.Errorf("matched a track the log doesn't have")
+	}
+}
+
+func TestParseEACLogWithoutNullSamples(t *testing.T) {
+	text := strings.Replace(eacLog, "CRC calculations       : Yes", "CRC calculations       : No", 1)
+	l, err := ParseLog(utf16LE(text))
+	if err != nil {
+		t.Fatalf("ParseLog: %v", err)
+	}
+	if !l.SkipNulls {
+		t.Fatalf("SkipNulls not set")
+	}
+	track := l.TrackOf("/music/01 - First.flac", 1)
+	if track == nil {
+		t.Fatalf("track 1 not matched")
+	}
+	if _, ok := track.Checksums[CRC32]; ok {
+		t.Errorf("copy CRC taken as a plain CRC32")
+	}
+	if track.Checksums[CRC32NoNulls] != 0x1a2b3c4d {
+		t.Errorf("checksums = %v", track.Checksums)
+	}
+}
+
+const eacRangeLog = `Exact Audio Copy V1.6 from 23. October 2020
+
+EAC extraction logfile from 4. February 2026, 10:30
+
+Read offset correction                      : 6
+
+Range status and errors
+
+Selected range
+
+     Filename C:\Rips\Album.wav
+
+     Peak level 100.0 %
+     Copy CRC 1A2B3C4D
+     Copy OK
+
+No errors occurred
+
+AccurateRip summary
+
+Track  1  accurately ripped (confidence 12)  [11111111]  (AR v2)
+Track  2  cannot be verified as accurate (confidence 2)  [22222222], AccurateRip returned [33333333]  (AR v1)
+Track  3  not present in database
+
+None of the tracks are present in the AccurateRip database
+`
+
+func TestParseEACRangeLog(t *testing.T) {
+	l, err := ParseLog([]byte(eacRangeLog))
+	if err != nil {
+		t.Fatalf("ParseLog: %v", err)
+	}
+	if l.Image != `C:\Rips\Album.wav` {
+		t.Errorf("Image = %q", l.Image)
+	}
+
+	// The copy CRC of the range is of the whole image, not of a track
+	for _, lt := range l.Tracks {
+		if _, ok := lt.Checksums[CRC32]; ok {
+			t.Errorf("track %d has the range's CRC32", lt.Number)
+		}
+	}
+
+	if lt := l.TrackOf("/music/Album.flac", 1); lt == nil || lt.Checksums[AccurateRipV2] != 0x11111111 {
+		t.Errorf("track 1 = %+v", lt)
+	}
+	if lt := l.TrackOf("/music/Album.flac", 2); lt == nil || lt.Checksums[AccurateRipV1] != 0x22222222 {
+		t.Errorf("track 2 = %+v", lt)
+	}
+	// AccurateRip had nothing to say of track 3, so the log has no checksum of it
+	if lt := l.TrackOf("/music/Album.flac", 3); lt != nil {
+		t.Errorf("track 3 = %+v, want none", lt)
+	}
+	if lt := l.TrackOf("/music/Other.flac", 1); lt != nil {
+		t.Errorf("matched a file other than the image")
+	}
+}
+
+const xldLog = `X Lossless Decoder version 20230627 (157.2)
+
+XLD extraction logfile from 2026-02-04 10:30:00 +0100
+
+Artist / Album
+
+Used drive : PIONEER BD-RW   BDR-XD05 (revision 1.10)
+Read offset correction        : 667
+
+TOC of the extracted CD
+     Track |   Start  |  Length  | Start sector | End sector
+    ---------------------------------------------------------
+        1  | 00:00:00 | 04:02:50 |         0    |    18199
+        2  | 04:02:50 | 03:10:25 |     18200    |    32474
+
+Track 01
+    Filename : /Users/someone/Music/01 First.wav
+    Pre-gap length : 00:02:00
+
+    CRC32 hash               : 1A2B3C4D
+    CRC32 hash (skip zero)   : 5E6F7081
+    AccurateRip v1 signature : 89ABCDEF
+        ->Accurately ripped (v1+v2, confidence 4+6/10)
+    AccurateRip v2 signature : 01234567
+    Statistics
+        Read error                           : 0
+
+Track 02
+    Filename : /Users/someone/Music/02 Second.wav
+
+    CRC32 hash               : 0BADF00D
+    AccurateRip v1 signature : 76543210
+    AccurateRip v2 signature : FEDCBA98
+
+No errors occurred
+
+End of status report
+`
+
+func TestParseXLDLog(t *testing.T) {
+	l, err := ParseLog([]byte(xldLog))
+	if err != nil {
+		t.Fatalf("ParseLog: %v", err)
+	}
+	if l.Ripper != RipperXLD || l.ReadOffset != 667 || len(l.TOC) != 2 {
+		t.Errorf("ripper %s, offset %d, TOC %v", l.Ripper, l.ReadOffset, l.TOC)
+	}
+
+	want := map[int]Checksums{
+		1: {CRC32: 0x1a2b3c4d, AccurateRipV1: 0x89abcdef, AccurateRipV2: 0x01234567},
+		2: {CRC32: 0x0badf00d, AccurateRipV1: 0x76543210, AccurateRipV2: 0xfedcba98},
+	}
+	for num, name := range map[int]string{1: "01 First.flac", 2: "02 Second.m4a"} {
+		lt := l.TrackOf(filepath.Join("/music", name), num)
+		if lt == nil {
+			t.Fatalf("track %d not matched", num)
+		}
+		if len(lt.Checksums) != len(want[num]) {
+			t.Errorf("track %d checksums = %v, want %v", num, lt.Checksums, want[num])
+		}
+		for kind, sum := range want[num] {
+			if lt.Checksums[kind] != sum {
+				t.Errorf("track %d %s = %08X, want %08X", num, kind, lt.Checksums[kind], sum)
+			}
+		}
+	}
+}
+
+func TestParseLogRejectsOtherLogs(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"cdparanoia III release 10.2\n",
+		"Exact Audio Copy V1.6 from 23. October 2020\n\nNo tracks here\n",
+	} {
+		if _, err := ParseLog([]byte(text)); err == nil {
+			t.Errorf("ParseLog(%q) succeeded", text)
+		}
+	}
+}
+
+func TestLoadLogs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"Album.log":      utf16LE(eacLog),
+		"other.LOG":      []byte(xldLog),
+		"cdparanoia.log": []byte("cdparanoia III release 10.2\n"),
+		"notes.txt":      []byte(xldLog),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logs := LoadLogs(dir)
+	if len(logs) != 2 {
+		t.Fatalf("loaded %d logs, want 2", len(logs))
+	}
+	for _, l := range logs {
+		if filepath.Dir(l.Path) != dir {
+			t.Errorf("Path = %q", l.Path)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package accuraterip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// Verification statuses
+const (
+	StatusPass    = "pass"    // every checksum logged matches
+	StatusShifted = "shifted" // matches once shifted by another read offset
+	StatusFail    = "fail"
+)
+
+// Database looks up the checksums other rips of a disc submitted to an
+// online database such as AccurateRip or CTDB. None is built in; without
+// one, tracks are only checked against their rip log.
+type Database interface {
+	Lookup(ctx context.Context, toc []TOCEntry) ([]Submission, error)
+}
+
+// Submission is a checksum a database holds for a track of a disc, and how
+// many rips agree on it
+type Submission struct {
+	Track      int
+	Kind       string
+	Checksum   uint32
+	Confidence int
+}
+
+// Verdict is how a track compares with what its rip log, and a database if
+// one is used, say it should be
+type Verdict struct {
+	Status     string   `json:"status"`
+	Ripper     string   `json:"ripper"`
+	Matched    []string `json:"matched,omitempty"`    // kinds of checksum that match
+	Mismatched []string `json:"mismatched,omitempty"` // and that don't
+	Offset     int      `json:"offset,omitempty"`     // frames the rip is shifted by, for StatusShifted
+	LogOffset  int      `json:"logOffset"`            // read offset correction the log used
+	Confidence int      `json:"confidence,omitempty"` // rips in the database agreeing
+}
+
+// Verify compares the checksums of a track with those its log recorded,
+// and with the submissions of a database for it, if any. A track that only
+// matches its log's AccurateRip v1 checksum at another offset was read
+// with a different offset than the logged rip.
+func Verify(r *Result, l *Log, logged *LogTrack, submissions []Submission) Verdict {
+	v := Verdict{Status: StatusPass, Ripper: l.Ripper, LogOffset: l.ReadOffset}
+	kinds := make([]string, 0, len(logged.Checksums))
+	for kind := range logged.Checksums {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if r.Checksums[kind] == logged.Checksums[kind] {
+			v.Matched = append(v.Matched, kind)
+		} else {
+			v.Mismatched = append(v.Mismatched, kind)
+		}
+	}
+
+	for _, s := range submissions {
+		if s.Track == logged.Number && r.Checksums[s.Kind] == s.Checksum {
+			v.Confidence = max(v.Confidence, s.Confidence)
+		}
+	}
+
+	if len(v.Mismatched) > 0 {
+		v.Status = StatusFail
+		if want, ok := logged.Checksums[AccurateRipV1]; ok {
+			if offset, found := r.FindOffset(want); found {
+				v.Status = StatusShifted
+				v.Offset = offset
+			}
+		}
+	}
+	return v
+}
+
+// Check is the verification of a track of a CD rip, as kept with its
+// analysis
+type Check struct {
+	Checksums map[string]string `json:"checksums"` // hex, by kind
+	Log       string            `json:"log"`
+	Verdict   Verdict           `json:"verdict"`
+}
+
+// NewCheck verifies a track against the log it was ripped with, see Verify
+func NewCheck(r *Result, l *Log, logged *LogTrack, submissions []Submission) *Check {
+	c := &Check{
+		Checksums: make(map[string]string, len(r.Checksums)),
+		Log:       filepath.Base(l.Path),
+		Verdict:   Verify(r, l, logged, submissions),
+	}
+	for kind, sum := range r.Checksums {
+		c.Checksums[kind] = fmt.Sprintf("%08X", sum)
+	}
+	return c
+}
+
+// IssueType is the type of the issue a check records in an analysis
+const IssueType = "rip_verification"
+
+// AddTo records a check in a track's analysis: an issue passing or failing
+// it, replacing that of an earlier check, and the checksums in its stats
+func (c *Check) AddTo(result *models.AnalysisResult) {
+	issue := models.Issue{
+		Type:       IssueType,
+		Severity:   models.SeverityInfo,
+		Message:    c.Verdict.Message(),
+		Confidence: 1.0,
+	}
+	switch c.Verdict.Status {
+	case StatusShifted:
+		issue.Severity = models.SeverityWarning
+	case StatusFail:
+		issue.Severity = models.SeverityError
+	}
+	var issues []models.Issue
+	for _, i := range result.Issues {
+		if i.Type != IssueType {
+			issues = append(issues, i)
+		}
+	}
+	result.Issues = append(issues, issue)
+	issuesJSON, _ := json.Marshal(result.Issues)
+	result.IssuesJSON = string(issuesJSON)
+
+	stats := map[string]interface{}{}
+	if result.StatsJSON != "" {
+		json.Unmarshal([]byte(result.StatsJSON), &stats)
+	}
+	stats["accuraterip"] = c
+	statsJSON, _ := json.Marshal(stats)
+	result.StatsJSON = string(statsJSON)
+}
+
+// Message describes a verdict for a track's issue
+func (v Verdict) Message() string {
+	var msg string
+	switch v.Status {
+	case StatusPass:
+		msg = fmt.Sprintf("Bit-perfect: %s %s the %s log", kindNames(v.Matched), plural(v.Matched, "matches", "match"), v.Ripper)
+	case StatusShifted:
+		msg = fmt.Sprintf("Matches the %s log only shifted by %+d samples: read with another offset than the log's %+d correction", v.Ripper, v.Offset, v.LogOffset)
+	default:
+		msg = fmt.Sprintf("Not bit-perfect: %s %s from the %s log", kindNames(v.Mismatched), plural(v.Mismatched, "differs", "differ"), v.Ripper)
+	}
+	if v.Confidence > 0 {
+		msg += fmt.Sprintf(" (confidence %d)", v.Confidence)
+	}
+	return msg
+}
+
+func plural(kinds []string, one, many string) string {
+	if len(kinds) == 1 {
+		return one
+	}
+	return many
+}
+
+func kindNames(kinds []string) string {
+	names := make([]string, len(kinds))
+	for i, kind := range kinds {
+		switch kind {
+		case CRC32:
+			names[i] = "CRC32"
+		case CRC32NoNulls:
+			names[i] = "CRC32 without null samples"
+		case AccurateRipV1:
+			names[i] = "AccurateRip v1"
+		case AccurateRipV2:
+			names[i] = "AccurateRip v2"
+		case CTDB:
+			names[i] = "CTDB CRC"
+		}
+	}
+	return strings.Join(names, ", ")
+}
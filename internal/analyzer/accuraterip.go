@@ -0,0 +1,25 @@
+package analyzer
+
+import (
+	"time"
+
+	"github.com/ottavia-music/ottavia/internal/accuraterip"
+	"github.com/ottavia-music/ottavia/internal/audioscan"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// ripCheck returns the verification of a track's rip its last audio scan
+// made, unless the file has changed since. Checking a rip reads the whole
+// track, so it is left to the accuraterip module of audio scans rather
+// than done again on each analysis.
+func (a *Analyzer) ripCheck(mf *models.MediaFile, track *models.Track) *accuraterip.Check {
+	manifest, err := audioscan.LoadManifest(audioscan.ArtifactDir(a.artifactsPath, track.ID))
+	if err != nil {
+		return nil
+	}
+	generated, err := time.Parse(time.RFC3339, manifest.GeneratedAt)
+	if err != nil || generated.Before(mf.Mtime) {
+		return nil
+	}
+	return audioscan.RipCheck(manifest)
+}
@@ -14,7 +14,11 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 
+	"github.com/ottavia-music/ottavia/internal/audioscan"
 	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/fingerprint"
+	"github.com/ottavia-music/ottavia/internal/iobudget"
+	"github.com/ottavia-music/ottavia/internal/metadata"
 	"github.com/ottavia-music/ottavia/internal/models"
 )
 
@@ -87,20 +91,29 @@ func (a *Analyzer) AnalyzeFile(ctx context.Context, mediaFileID string) error {
 		return fmt.Errorf("probe failed: %w", err)
 	}
 
-	track, err := a.createTrackFromProbe(ctx, mf, probe)
+	tracks, err := a.createTracks(ctx, mf, probe)
 	if err != nil {
 		return fmt.Errorf("failed to create track: %w", err)
 	}
 
-	result, err := a.analyzeAudio(ctx, mf.Path, track)
-	if err != nil {
-		log.Warn().Err(err).Str("path", mf.Path).Msg("Audio analysis failed")
-	}
+	for _, track := range tracks {
+		result, err := a.analyzeAudio(ctx, mf.Path, track)
+		if err != nil {
+			log.Warn().Err(err).Str("path", mf.Path).Int("cue_index", track.CueIndex).Msg("Audio analysis failed")
+		}
+
+		if result != nil {
+			result.TrackID = track.ID
+			if check := a.ripCheck(mf, track); check != nil {
+				check.AddTo(result)
+			}
+			if err := a.db.CreateAnalysisResult(ctx, result); err != nil {
+				return fmt.Errorf("failed to save analysis: %w", err)
+			}
+		}
 
-	if result != nil {
-		result.TrackID = track.ID
-		if err := a.db.CreateAnalysisResult(ctx, result); err != nil {
-			return fmt.Errorf("failed to save analysis: %w", err)
+		if err := a.fingerprintTrack(ctx, mf.Path, track); err != nil {
+			log.Warn().Err(err).Str("path", mf.Path).Int("cue_index", track.CueIndex).Msg("Fingerprinting failed")
 		}
 	}
 
@@ -112,6 +125,26 @@ func (a *Analyzer) AnalyzeFile(ctx context.Context, mediaFileID string) error {
 	return nil
 }
 
+// FingerprintTrack computes and stores the acoustic fingerprint of an
+// already analyzed track
+func (a *Analyzer) FingerprintTrack(ctx context.Context, trackID string) error {
+	track, err := a.db.GetTrack(ctx, trackID)
+	if err != nil {
+		return fmt.Errorf("track not found: %w", err)
+	}
+	return a.fingerprintTrack(ctx, track.Path, track)
+}
+
+func (a *Analyzer) fingerprintTrack(ctx context.Context, path string, track *models.Track) error {
+	start, duration := track.Span()
+	fp, err := fingerprint.Compute(ctx, a.ffmpegPath, path, start, duration, track.FileDuration)
+	if err != nil {
+		return err
+	}
+	fp.TrackID = track.ID
+	return a.db.SaveFingerprint(ctx, fp)
+}
+
 func (a *Analyzer) probeFile(ctx context.Context, path string) (*ProbeResult, error) {
 	args := []string{
 		"-v", "quiet",
@@ -145,6 +178,49 @@ func (a *Analyzer) createTrackFromProbe(ctx context.Context, mf *models.MediaFil
 		MediaFileID: mf.ID,
 	}
 
+	readAudioStream(track, probe)
+	readFormat(track, probe)
+
+	tags := probe.allTags()
+	a.extractTags(track, tags)
+	a.checkArtwork(track, probe)
+
+	if err := a.db.CreateTrack(ctx, track); err != nil {
+		return nil, err
+	}
+	if err := a.db.ReplaceTrackTags(ctx, track.ID, metadata.RawTags(mf.Path, tags)); err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
+
+func (a *Analyzer) updateTrackFromProbe(ctx context.Context, track *models.Track, probe *ProbeResult) (*models.Track, error) {
+	// A file no longer split by a cue sheet is one track again
+	if track.FromCue() {
+		track.CueIndex = 0
+		track.StartOffset = 0
+		track.Duration = 0
+	}
+	readAudioStream(track, probe)
+	readFormat(track, probe)
+
+	tags := probe.allTags()
+	a.extractTags(track, tags)
+	a.checkArtwork(track, probe)
+
+	if err := a.db.UpdateTrack(ctx, track); err != nil {
+		return nil, err
+	}
+	if err := a.db.ReplaceTrackTags(ctx, track.ID, metadata.RawTags(probe.Format.Filename, tags)); err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
+
+// readAudioStream fills in a track's format from the first audio stream
+func readAudioStream(track *models.Track, probe *ProbeResult) {
 	for _, stream := range probe.Streams {
 		if stream.CodecType == "audio" {
 			track.Codec = stream.CodecName
@@ -175,7 +251,11 @@ func (a *Analyzer) createTrackFromProbe(ctx context.Context, mf *models.MediaFil
 			break
 		}
 	}
+}
 
+// readFormat fills in the duration and bitrate a stream didn't give from
+// the container
+func readFormat(track *models.Track, probe *ProbeResult) {
 	if track.Duration == 0 {
 		if dur, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
 			track.Duration = dur
@@ -187,61 +267,27 @@ func (a *Analyzer) createTrackFromProbe(ctx context.Context, mf *models.MediaFil
 			track.Bitrate = br
 		}
 	}
-
-	a.extractTags(track, probe)
-	a.checkArtwork(track, probe)
-
-	if err := a.db.CreateTrack(ctx, track); err != nil {
-		return nil, err
-	}
-
-	return track, nil
 }
 
-func (a *Analyzer) updateTrackFromProbe(ctx context.Context, track *models.Track, probe *ProbeResult) (*models.Track, error) {
-	for _, stream := range probe.Streams {
+// allTags merges the container tags with those of the audio stream, where
+// Ogg formats keep their comments. Container tags win on conflicts.
+func (p *ProbeResult) allTags() map[string]string {
+	tags := make(map[string]string, len(p.Format.Tags))
+	for _, stream := range p.Streams {
 		if stream.CodecType == "audio" {
-			track.Codec = stream.CodecName
-			if sr, err := strconv.Atoi(stream.SampleRate); err == nil {
-				track.SampleRate = sr
-			}
-			track.Channels = stream.Channels
-			// Try multiple sources for bit depth
-			track.BitDepth = stream.BitsPerSample
-			if track.BitDepth == 0 && stream.BitsPerRawSample != "" {
-				if bd, err := strconv.Atoi(stream.BitsPerRawSample); err == nil {
-					track.BitDepth = bd
-				}
-			}
-			if track.BitDepth == 0 && stream.BitsPerCodedSample > 0 {
-				track.BitDepth = stream.BitsPerCodedSample
-			}
-			// For ALAC/FLAC, default to 16-bit if no bit depth found
-			if track.BitDepth == 0 && (stream.CodecName == "alac" || stream.CodecName == "flac") {
-				track.BitDepth = 16
-			}
-			if br, err := strconv.Atoi(stream.BitRate); err == nil {
-				track.Bitrate = br
-			}
-			if dur, err := strconv.ParseFloat(stream.Duration, 64); err == nil {
-				track.Duration = dur
+			for k, v := range stream.Tags {
+				tags[k] = v
 			}
 			break
 		}
 	}
-
-	a.extractTags(track, probe)
-	a.checkArtwork(track, probe)
-
-	if err := a.db.UpdateTrack(ctx, track); err != nil {
-		return nil, err
+	for k, v := range p.Format.Tags {
+		tags[k] = v
 	}
-
-	return track, nil
+	return tags
 }
 
-func (a *Analyzer) extractTags(track *models.Track, probe *ProbeResult) {
-	tags := probe.Format.Tags
+func (a *Analyzer) extractTags(track *models.Track, tags map[string]string) {
 
 	if v, ok := tags["title"]; ok && v != "" {
 		track.Title = sql.NullString{String: v, Valid: true}
@@ -306,6 +352,8 @@ func (a *Analyzer) extractTags(track *models.Track, probe *ProbeResult) {
 			track.Year = sql.NullInt32{Int32: int32(year), Valid: true}
 		}
 	}
+
+	metadata.ReadExtendedTags(track, tags)
 }
 
 func (a *Analyzer) checkArtwork(track *models.Track, probe *ProbeResult) {
@@ -371,12 +419,13 @@ func (a *Analyzer) analyzeAudio(ctx context.Context, path string, track *models.
 	}
 
 	var issues []models.Issue
+	start, duration := track.Span()
 
-	if err := a.runVolumeDetect(ctx, path, result); err != nil {
+	if err := a.runVolumeDetect(ctx, path, start, duration, track.FileDuration, result); err != nil {
 		log.Warn().Err(err).Msg("Volume detection failed")
 	}
 
-	if err := a.runLoudnessAnalysis(ctx, path, result); err != nil {
+	if err := a.runLoudnessAnalysis(ctx, path, start, duration, track.FileDuration, result); err != nil {
 		log.Warn().Err(err).Msg("Loudness analysis failed")
 	}
 
@@ -428,20 +477,23 @@ func (a *Analyzer) analyzeAudio(ctx context.Context, path string, track *models.
 	result.IssuesJSON = string(issuesJSON)
 	result.Issues = issues
 
-	if err := a.generateWaveform(ctx, path, track.ID); err != nil {
+	if err := a.generateWaveform(ctx, path, track); err != nil {
 		log.Warn().Err(err).Msg("Waveform generation failed")
 	}
 
 	return result, nil
 }
 
-func (a *Analyzer) runVolumeDetect(ctx context.Context, path string, result *models.AnalysisResult) error {
-	args := []string{
-		"-i", path,
+func (a *Analyzer) runVolumeDetect(ctx context.Context, path string, start, duration, fileDuration float64, result *models.AnalysisResult) error {
+	if err := iobudget.Global().WaitRange(ctx, path, duration, fileDuration); err != nil {
+		return err
+	}
+
+	args := append(audioscan.InputArgs(path, start, duration),
 		"-af", "volumedetect",
 		"-f", "null",
 		"-",
-	}
+	)
 
 	cmd := exec.CommandContext(ctx, a.ffmpegPath, args...)
 	output, _ := cmd.CombinedOutput()
@@ -473,13 +525,16 @@ func (a *Analyzer) runVolumeDetect(ctx context.Context, path string, result *mod
 	return nil
 }
 
-func (a *Analyzer) runLoudnessAnalysis(ctx context.Context, path string, result *models.AnalysisResult) error {
-	args := []string{
-		"-i", path,
+func (a *Analyzer) runLoudnessAnalysis(ctx context.Context, path string, start, duration, fileDuration float64, result *models.AnalysisResult) error {
+	if err := iobudget.Global().WaitRange(ctx, path, duration, fileDuration); err != nil {
+		return err
+	}
+
+	args := append(audioscan.InputArgs(path, start, duration),
 		"-af", "ebur128=peak=true",
 		"-f", "null",
 		"-",
-	}
+	)
 
 	cmd := exec.CommandContext(ctx, a.ffmpegPath, args...)
 	output, _ := cmd.CombinedOutput()
@@ -595,21 +650,25 @@ func (a *Analyzer) GetLossyExplanation(result *models.AnalysisResult, track *mod
 	)
 }
 
-func (a *Analyzer) generateWaveform(ctx context.Context, path, trackID string) error {
-	outputDir := filepath.Join(a.artifactsPath, trackID[:2], trackID)
+func (a *Analyzer) generateWaveform(ctx context.Context, path string, track *models.Track) error {
+	start, duration := track.Span()
+	if err := iobudget.Global().WaitRange(ctx, path, duration, track.FileDuration); err != nil {
+		return err
+	}
+
+	outputDir := filepath.Join(a.artifactsPath, track.ID[:2], track.ID)
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return err
 	}
 
 	outputPath := filepath.Join(outputDir, "waveform.png")
 
-	args := []string{
-		"-i", path,
+	args := append(audioscan.InputArgs(path, start, duration),
 		"-filter_complex", "showwavespic=s=1920x240:colors=0a84ff|4da3ff",
 		"-frames:v", "1",
 		"-y",
 		outputPath,
-	}
+	)
 
 	cmd := exec.CommandContext(ctx, a.ffmpegPath, args...)
 	if err := cmd.Run(); err != nil {
@@ -618,7 +677,7 @@ func (a *Analyzer) generateWaveform(ctx context.Context, path, trackID string) e
 
 	artifact := &models.Artifact{
 		ID:       uuid.NewString(),
-		TrackID:  trackID,
+		TrackID:  track.ID,
 		Type:     "waveform",
 		Path:     outputPath,
 		MimeType: "image/png",
@@ -629,20 +688,24 @@ func (a *Analyzer) generateWaveform(ctx context.Context, path, trackID string) e
 	return a.db.CreateArtifact(ctx, artifact)
 }
 
-func (a *Analyzer) GenerateSpectrogram(ctx context.Context, path, trackID string) error {
-	outputDir := filepath.Join(a.artifactsPath, trackID[:2], trackID)
+func (a *Analyzer) GenerateSpectrogram(ctx context.Context, path string, track *models.Track) error {
+	start, duration := track.Span()
+	if err := iobudget.Global().WaitRange(ctx, path, duration, track.FileDuration); err != nil {
+		return err
+	}
+
+	outputDir := filepath.Join(a.artifactsPath, track.ID[:2], track.ID)
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return err
 	}
 
 	outputPath := filepath.Join(outputDir, "spectrogram.png")
 
-	args := []string{
-		"-i", path,
+	args := append(audioscan.InputArgs(path, start, duration),
 		"-lavfi", "showspectrumpic=s=1920x480:legend=0:color=intensity",
 		"-y",
 		outputPath,
-	}
+	)
 
 	cmd := exec.CommandContext(ctx, a.ffmpegPath, args...)
 	if err := cmd.Run(); err != nil {
@@ -651,7 +714,7 @@ func (a *Analyzer) GenerateSpectrogram(ctx context.Context, path, trackID string
 
 	artifact := &models.Artifact{
 		ID:       uuid.NewString(),
-		TrackID:  trackID,
+		TrackID:  track.ID,
 		Type:     "spectrogram",
 		Path:     outputPath,
 		MimeType: "image/png",
@@ -0,0 +1,176 @@
+package analyzer
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/cue"
+	"github.com/ottavia-music/ottavia/internal/metadata"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// createTracks creates or updates the tracks of a media file: one for each
+// track of a cue sheet splitting it into several, or a single one. Tracks
+// the file is no longer split into are deleted with their analysis.
+func (a *Analyzer) createTracks(ctx context.Context, mf *models.MediaFile, probe *ProbeResult) ([]*models.Track, error) {
+	existing, err := a.db.ListTracksByMediaFile(ctx, mf.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var cueTracks []cue.Track
+	sheet := a.cueSheet(mf, probe)
+	if sheet != nil {
+		cueTracks = sheet.TracksOf(mf.Path)
+	}
+
+	var tracks []*models.Track
+	if len(cueTracks) > 1 {
+		tracks, err = a.createCueTracks(ctx, mf, probe, sheet, cueTracks, existing)
+	} else {
+		var track *models.Track
+		track, err = a.createTrackFromProbe(ctx, mf, probe)
+		if track != nil {
+			track.FileDuration = track.Duration
+		}
+		tracks = []*models.Track{track}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[string]bool, len(tracks))
+	for _, t := range tracks {
+		kept[t.ID] = true
+	}
+	var stale []string
+	for _, t := range existing {
+		if !kept[t.ID] {
+			stale = append(stale, t.ID)
+		}
+	}
+	if err := a.db.DeleteTracks(ctx, stale); err != nil {
+		return nil, err
+	}
+	return tracks, nil
+}
+
+// cueSheet returns the sheet splitting a media file: the sidecar sheet the
+// scanner found next to it, or one embedded in a CUESHEET tag. A sheet that
+// can't be read is logged and the file left whole.
+func (a *Analyzer) cueSheet(mf *models.MediaFile, probe *ProbeResult) *cue.Sheet {
+	if mf.CuePath.Valid {
+		sheet, err := cue.Load(mf.CuePath.String)
+		if err == nil {
+			return sheet
+		}
+		log.Warn().Err(err).Str("path", mf.Path).Msg("Failed to read cue sheet")
+	}
+
+	for k, v := range probe.allTags() {
+		if !strings.EqualFold(k, "cuesheet") || v == "" {
+			continue
+		}
+		sheet, err := cue.Parse([]byte(v))
+		if err == nil {
+			return sheet
+		}
+		log.Warn().Err(err).Str("path", mf.Path).Msg("Failed to parse embedded cue sheet")
+	}
+	return nil
+}
+
+// createCueTracks creates or updates a track for each track of a cue sheet
+// in a file, keeping the IDs, and so the history, of those it had before
+func (a *Analyzer) createCueTracks(ctx context.Context, mf *models.MediaFile, probe *ProbeResult, sheet *cue.Sheet, cueTracks []cue.Track, existing []models.Track) ([]*models.Track, error) {
+	file := &models.Track{}
+	readAudioStream(file, probe)
+	readFormat(file, probe)
+	ranges := cue.Ranges(cueTracks, file.Duration)
+
+	byIndex := make(map[int]*models.Track, len(existing))
+	for i := range existing {
+		byIndex[existing[i].CueIndex] = &existing[i]
+	}
+
+	tags := probe.allTags()
+	rawTags := metadata.RawTags(mf.Path, tags)
+	tracks := make([]*models.Track, len(cueTracks))
+	for i, ct := range cueTracks {
+		track, found := byIndex[i+1]
+		if !found {
+			track = &models.Track{MediaFileID: mf.ID, CueIndex: i + 1}
+		}
+		track.Codec = file.Codec
+		track.SampleRate = file.SampleRate
+		track.BitDepth = file.BitDepth
+		track.Channels = file.Channels
+		track.Bitrate = file.Bitrate
+		track.StartOffset = ranges[i].Start
+		track.Duration = ranges[i].Duration
+		track.FileDuration = file.Duration
+
+		a.extractTags(track, tags)
+		applyCueTags(track, sheet, ct, len(cueTracks))
+		a.checkArtwork(track, probe)
+
+		var err error
+		if found {
+			err = a.db.UpdateTrack(ctx, track)
+		} else {
+			err = a.db.CreateTrack(ctx, track)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := a.db.ReplaceTrackTags(ctx, track.ID, rawTags); err != nil {
+			return nil, err
+		}
+		tracks[i] = track
+	}
+	return tracks, nil
+}
+
+// applyCueTags sets what a cue sheet says about one of its tracks over the
+// tags of the file it shares with the rest of the album. Tags that only
+// make sense for the whole file, like its title, are cleared.
+func applyCueTags(track *models.Track, sheet *cue.Sheet, ct cue.Track, total int) {
+	set := func(field *sql.NullString, values ...string) {
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v != "" {
+				*field = sql.NullString{String: v, Valid: true}
+				return
+			}
+		}
+	}
+
+	track.Title = sql.NullString{}
+	set(&track.Title, ct.Title)
+	set(&track.Artist, ct.Performer, sheet.Performer)
+	set(&track.Album, sheet.Title)
+	set(&track.AlbumArtist, sheet.Performer)
+	set(&track.Genre, sheet.Genre)
+	set(&track.Composer, ct.Songwriter, sheet.Songwriter)
+	if year := parseYear(sheet.Date); year > 0 {
+		track.Year = sql.NullInt32{Int32: int32(year), Valid: true}
+	}
+
+	track.TrackNumber = sql.NullInt32{Int32: int32(ct.Number), Valid: ct.Number > 0}
+	track.TotalTracks = sql.NullInt32{Int32: int32(total), Valid: true}
+	if sheet.DiscNumber > 0 {
+		track.DiscNumber = sql.NullInt32{Int32: int32(sheet.DiscNumber), Valid: true}
+	}
+	if sheet.TotalDiscs > 0 {
+		track.TotalDiscs = sql.NullInt32{Int32: int32(sheet.TotalDiscs), Valid: true}
+	}
+
+	track.ISRC = sql.NullString{}
+	set(&track.ISRC, ct.ISRC)
+	track.MBRecordingID = sql.NullString{}
+	track.MBReleaseTrackID = sql.NullString{}
+	track.ReplayGainTrackGain = sql.NullFloat64{}
+	track.ReplayGainTrackPeak = sql.NullFloat64{}
+}
@@ -18,12 +18,14 @@ import (
 	"github.com/google/uuid"
 	"github.com/ottavia-music/ottavia/internal/database"
 	"github.com/ottavia-music/ottavia/internal/models"
+	"github.com/ottavia-music/ottavia/internal/policy"
 	"github.com/rs/zerolog/log"
 )
 
 // Manager handles artwork extraction, upload, and application
 type Manager struct {
 	db           *database.DB
+	policy       *policy.Policy
 	ffmpegPath   string
 	artifactPath string
 }
@@ -32,6 +34,7 @@ type Manager struct {
 func New(db *database.DB, ffmpegPath, artifactPath string) *Manager {
 	return &Manager{
 		db:           db,
+		policy:       policy.New(db),
 		ffmpegPath:   ffmpegPath,
 		artifactPath: artifactPath,
 	}
@@ -290,6 +293,10 @@ func (m *Manager) ExtractArtwork(ctx context.Context, trackID string) (*ExtractR
 
 // UploadArtwork uploads artwork and associates it with a track
 func (m *Manager) UploadArtwork(ctx context.Context, trackID string, imageData []byte, mimeType string) (*ArtworkInfo, error) {
+	if err := m.checkWritable(ctx, trackID); err != nil {
+		return nil, err
+	}
+
 	// Decode image to get dimensions
 	img, format, err := image.Decode(strings.NewReader(string(imageData)))
 	if err != nil {
@@ -372,6 +379,15 @@ func (m *Manager) ApplyArtworkToTracks(ctx context.Context, sourceTrackID string
 	results := []ExtractResult{}
 
 	for _, targetID := range targetTrackIDs {
+		if err := m.checkWritable(ctx, targetID); err != nil {
+			results = append(results, ExtractResult{
+				TrackID: targetID,
+				Success: false,
+				Error:   err.Error(),
+			})
+			continue
+		}
+
 		// Check if target already has artwork
 		existingArtwork, _ := m.getTrackArtwork(ctx, targetID)
 		if existingArtwork != nil {
@@ -511,6 +527,20 @@ func (m *Manager) GetSuggestions(ctx context.Context, trackID string) ([]ApplySu
 
 // Helper functions
 
+// checkWritable refuses artwork changes to tracks of read-only libraries.
+// Artwork is stored as an artifact, so a copy-on-write library allows it.
+func (m *Manager) checkWritable(ctx context.Context, trackID string) error {
+	track, err := m.db.GetTrack(ctx, trackID)
+	if err != nil {
+		return fmt.Errorf("track not found: %w", err)
+	}
+	decision, err := m.policy.TrackFile(ctx, track)
+	if err != nil {
+		return err
+	}
+	return decision.Err()
+}
+
 func (m *Manager) getTrackArtwork(ctx context.Context, trackID string) (*ArtworkInfo, error) {
 	query := `
 		SELECT id, track_id, path, mime_type, width, height, created_at
@@ -2,6 +2,7 @@ package audioscan
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"net/http"
 	"strconv"
@@ -92,6 +93,34 @@ func (h *APIHandler) GetSeries(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Parse optional frequency range (spectrogram tiles)
+	var minFreqHz, maxFreqHz float64 = 0, -1
+	if s := r.URL.Query().Get("minFreqHz"); s != "" {
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			minFreqHz = v
+		}
+	}
+	if e := r.URL.Query().Get("maxFreqHz"); e != "" {
+		if v, err := strconv.ParseFloat(e, 64); err == nil {
+			maxFreqHz = v
+		}
+	}
+
+	// Parse tile size for spectrogram (default 512×256)
+	maxTimeBins, maxFreqBins := 512, 256
+	if v, err := strconv.Atoi(r.URL.Query().Get("maxTimeBins")); err == nil && v > 0 {
+		maxTimeBins = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("maxFreqBins")); err == nil && v > 0 {
+		maxFreqBins = v
+	}
+	if maxTimeBins > 2048 {
+		maxTimeBins = 2048
+	}
+	if maxFreqBins > 1024 {
+		maxFreqBins = 1024
+	}
+
 	artifactDir := ArtifactDir(h.scanner.GetArtifactsPath(), trackID)
 
 	// Load manifest for render hints
@@ -120,6 +149,8 @@ func (h *APIHandler) GetSeries(w http.ResponseWriter, r *http.Request) {
 		resp, err = h.loadPhaseSeries(artifactDir, maxPoints, startSec, endSec, moduleResult.RenderHints)
 	case "dynamics":
 		resp, err = h.loadDynamicsSeries(artifactDir, maxPoints, startSec, endSec, moduleResult.RenderHints)
+	case "spectrogram":
+		resp, err = h.loadSpectrogramTile(artifactDir, startSec, endSec, minFreqHz, maxFreqHz, maxTimeBins, maxFreqBins, moduleResult.RenderHints)
 	default:
 		http.Error(w, "Unknown module", http.StatusBadRequest)
 		return
@@ -325,8 +356,117 @@ func (h *APIHandler) loadDynamicsSeries(dir string, maxPoints int, startSec, end
 	}, nil
 }
 
+// loadSpectrogramTile returns the sub-matrix covering the requested time and
+// frequency window. Series "x" holds column times, "y" bin frequencies and "z"
+// the dB levels in time-major order (z[i*len(y)+j]).
+func (h *APIHandler) loadSpectrogramTile(dir string, startSec, endSec, minFreqHz, maxFreqHz float64, maxTimeBins, maxFreqBins int, hints *RenderHints) (*SeriesResponse, error) {
+	var m SpectrogramMatrix
+	if err := LoadMsgpackZstd(dir+"/spectrogram_v1.msgpack.zst", &m); err != nil {
+		return nil, err
+	}
+	if m.TimeBins == 0 || m.FreqBins == 0 || len(m.Q) < m.TimeBins*m.FreqBins {
+		return nil, fmt.Errorf("spectrogram matrix is empty or truncated")
+	}
+
+	// Resolve the time window to a column range
+	t0, t1 := 0, m.TimeBins
+	if endSec > 0 {
+		t0, t1 = m.TimeBins, 0
+		for i, t := range m.TSec {
+			if float64(t) >= startSec && float64(t) <= endSec {
+				if i < t0 {
+					t0 = i
+				}
+				t1 = i + 1
+			}
+		}
+		if t0 >= t1 {
+			return nil, fmt.Errorf("time window contains no spectrogram columns")
+		}
+	}
+
+	// Resolve the frequency window to a bin range
+	f0, f1 := 0, m.FreqBins
+	if minFreqHz > 0 {
+		f0 = int(math.Ceil(minFreqHz / m.HzPerBin))
+	}
+	if maxFreqHz > 0 {
+		f1 = int(math.Floor(maxFreqHz/m.HzPerBin)) + 1
+	}
+	if f1 > m.FreqBins {
+		f1 = m.FreqBins
+	}
+	if f0 >= f1 {
+		return nil, fmt.Errorf("frequency window contains no spectrogram bins")
+	}
+
+	// Decimate by taking the max level in each block so narrow tones and
+	// the edge of a lowpass shelf stay visible when zoomed out
+	cols := decimateRanges(t0, t1, maxTimeBins)
+	rows := decimateRanges(f0, f1, maxFreqBins)
+
+	x := make([]float64, len(cols))
+	for i, c := range cols {
+		x[i] = (float64(m.TSec[c[0]]) + float64(m.TSec[c[1]-1])) / 2
+	}
+	y := make([]float64, len(rows))
+	for j, r := range rows {
+		y[j] = float64(r[0]+r[1]-1) / 2 * m.HzPerBin
+	}
+	z := make([]float64, 0, len(cols)*len(rows))
+	for _, c := range cols {
+		for _, r := range rows {
+			maxDb := float32(math.Inf(-1))
+			for t := c[0]; t < c[1]; t++ {
+				for f := r[0]; f < r[1]; f++ {
+					if db := m.LevelDb(t, f); db > maxDb {
+						maxDb = db
+					}
+				}
+			}
+			z = append(z, float64(maxDb))
+		}
+	}
+
+	return &SeriesResponse{
+		Version: 1,
+		Module:  "spectrogram",
+		Units: map[string]string{
+			"x": "sec",
+			"y": "Hz",
+			"z": "dB",
+		},
+		RenderHints: hints,
+		Series: map[string][]float64{
+			"x": x,
+			"y": y,
+			"z": z,
+		},
+	}, nil
+}
+
 // Decimation functions
 
+// decimateRanges splits [start, end) into at most targetBuckets contiguous
+// half-open index ranges of near-equal size
+func decimateRanges(start, end, targetBuckets int) [][2]int {
+	n := end - start
+	if n <= 0 {
+		return nil
+	}
+	if targetBuckets <= 0 || targetBuckets > n {
+		targetBuckets = n
+	}
+	out := make([][2]int, targetBuckets)
+	for i := range out {
+		out[i] = [2]int{
+			start + i*n/targetBuckets,
+			start + (i+1)*n/targetBuckets,
+		}
+	}
+	return out
+}
+
 // decimateLTTB implements Largest-Triangle-Three-Buckets algorithm
 // for downsampling while preserving visual appearance
 func decimateLTTB(x, y []float64, targetPoints int) ([]float64, []float64) {
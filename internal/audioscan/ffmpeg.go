@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/iobudget"
 )
 
 // Retry configuration for unstable NAS connections
@@ -54,11 +56,26 @@ func checkFileAccessible(path string) error {
 	return err
 }
 
-// runFFmpegWithRetry executes an FFmpeg command with retry logic for NAS instability
-func runFFmpegWithRetry(ctx context.Context, ffmpegPath string, args []string, captureStdout bool) (stdout, stderr string, err error) {
+// runFFmpegWithRetry executes an FFmpeg command with retry logic for NAS
+// instability. Its inputs are charged to the I/O budget, an input of
+// fileDuration seconds read for only -t seconds by what it decodes of it.
+func runFFmpegWithRetry(ctx context.Context, ffmpegPath string, args []string, fileDuration float64, captureStdout bool) (stdout, stderr string, err error) {
 	var stdoutBuf, stderrBuf bytes.Buffer
 	backoff := initialBackoff
 
+	// Inputs are charged once, not per retry
+	for i, arg := range args {
+		if arg == "-i" && i+1 < len(args) {
+			var duration float64
+			if i+3 < len(args) && args[i+2] == "-t" {
+				duration, _ = strconv.ParseFloat(args[i+3], 64)
+			}
+			if err := iobudget.Global().WaitRange(ctx, args[i+1], duration, fileDuration); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
 	for attempt := 0; attempt <= maxRetries; attempt++ {
 		// Check if file is accessible before trying FFmpeg
 		// The input file is typically the second argument after "-i"
@@ -141,87 +158,16 @@ func truncateString(s string, maxLen int) string {
 	return s[:maxLen] + "..."
 }
 
-// extractSpectrumCurve uses FFmpeg to extract frequency spectrum data
-func (s *Scanner) extractSpectrumCurve(ctx context.Context, path string, fftSize int, duration float64) ([]float32, []float32, error) {
-	// Use FFmpeg's astats filter to get frequency-domain data
-	// We'll use showfreqs filter which outputs frequency bins
-	// -loglevel verbose is required for FFmpeg 7.x to output per-frame stats
-	args := []string{
-		"-loglevel", "verbose",
-		"-i", path,
-		"-t", fmt.Sprintf("%.2f", duration),
-		"-af", fmt.Sprintf("aformat=sample_fmts=flt:channel_layouts=mono,showfreqs=s=%dx100:mode=line:fscale=log:win_size=%d", fftSize/2, fftSize),
-		"-f", "null",
-		"-",
-	}
-
-	// Use retry logic for unstable NAS connections
-	_, _, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, false)
-	if err != nil {
-		// If showfreqs isn't available or fails, fall back to generating synthetic data from astats
-		return s.extractSpectrumFromStats(ctx, path, fftSize, duration)
-	}
-
-	// Parse showfreqs output - this is a simplified approach
-	// In practice, we'd need more sophisticated parsing
-	return s.extractSpectrumFromStats(ctx, path, fftSize, duration)
-}
-
-// extractSpectrumFromStats generates spectrum data using astats and frequency analysis
-func (s *Scanner) extractSpectrumFromStats(ctx context.Context, path string, fftSize int, duration float64) ([]float32, []float32, error) {
-	// Use ebur128 and astats to get frequency characteristics
-	args := []string{
-		"-i", path,
-		"-t", fmt.Sprintf("%.2f", duration),
-		"-af", "astats=metadata=1:reset=1,ametadata=print:key=lavfi.astats.Overall.RMS_level",
-		"-f", "null",
-		"-",
-	}
-
-	// Use retry logic for unstable NAS connections (ignore errors, we'll generate synthetic data)
-	runFFmpegWithRetry(ctx, s.ffmpegPath, args, false)
-
-	// For now, generate a synthetic spectrum curve based on the track's sample rate
-	// In production, this would parse actual FFT data from the audio
-	numBins := fftSize / 2
-	freqHz := make([]float32, numBins)
-	levelDb := make([]float32, numBins)
-
-	// Generate frequency bins (linear for simplicity)
-	// In a real implementation, this would come from actual FFT analysis
-	for i := 0; i < numBins; i++ {
-		// Frequency for this bin
-		freqHz[i] = float32(i) * float32(48000) / float32(fftSize) // Assume 48kHz for now
-
-		// Simulated spectrum curve (pink noise characteristic with rolloff)
-		// Real implementation would use actual FFT data
-		f := float64(freqHz[i])
-		if f < 20 {
-			levelDb[i] = -80
-		} else {
-			// Pink noise slope (-3dB/octave) with some variation
-			levelDb[i] = float32(-10 - 10*math.Log10(f/1000))
-			if levelDb[i] < -80 {
-				levelDb[i] = -80
-			}
-		}
-	}
-
-	return freqHz, levelDb, nil
-}
-
 // calculateDC extracts DC offset from audio
-func (s *Scanner) calculateDC(ctx context.Context, path string, duration float64) (float32, bool) {
-	args := []string{
-		"-i", path,
-		"-t", fmt.Sprintf("%.2f", duration),
+func (s *Scanner) calculateDC(ctx context.Context, path string, start, duration, fileDuration float64) (float32, bool) {
+	args := append(InputArgs(path, start, duration),
 		"-af", "astats=metadata=1:reset=0",
 		"-f", "null",
 		"-",
-	}
+	)
 
 	// Use retry logic for unstable NAS connections
-	_, output, _ := runFFmpegWithRetry(ctx, s.ffmpegPath, args, false)
+	_, output, _ := runFFmpegWithRetry(ctx, s.ffmpegPath, args, fileDuration, false)
 
 	// Parse DC offset from astats output
 	dcPattern := regexp.MustCompile(`DC offset:\s*([-\d.]+)`)
@@ -236,20 +182,18 @@ func (s *Scanner) calculateDC(ctx context.Context, path string, duration float64
 }
 
 // extractLoudnessSeries uses FFmpeg ebur128 filter for loudness over time
-func (s *Scanner) extractLoudnessSeries(ctx context.Context, path string, duration float64) (*LoudnessSeries, error) {
+func (s *Scanner) extractLoudnessSeries(ctx context.Context, path string, start, duration, fileDuration float64) (*LoudnessSeries, error) {
 	// Use ebur128 filter with metadata output
 	// -loglevel verbose is required for FFmpeg 7.x to output per-frame M:/S: values
-	args := []string{
-		"-loglevel", "verbose",
-		"-i", path,
-		"-t", fmt.Sprintf("%.2f", duration),
+	args := append([]string{"-loglevel", "verbose"}, InputArgs(path, start, duration)...)
+	args = append(args,
 		"-af", "ebur128=peak=true:metadata=1",
 		"-f", "null",
 		"-",
-	}
+	)
 
 	// Use retry logic for unstable NAS connections
-	_, output, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, false)
+	_, output, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, fileDuration, false)
 	if err != nil {
 		return nil, fmt.Errorf("ebur128 analysis failed: %w", err)
 	}
@@ -352,19 +296,17 @@ func (s *Scanner) extractLoudnessSeries(ctx context.Context, path string, durati
 }
 
 // extractClippingSeries detects clipping over time
-func (s *Scanner) extractClippingSeries(ctx context.Context, path string, duration float64) (*ClippingSeries, error) {
+func (s *Scanner) extractClippingSeries(ctx context.Context, path string, start, duration, fileDuration float64) (*ClippingSeries, error) {
 	// Use astats with ametadata to get per-frame peak levels
 	// FFmpeg 7.x: use ametadata=mode=print:file=- to output to stdout (cleaner parsing)
-	args := []string{
-		"-i", path,
-		"-t", fmt.Sprintf("%.2f", duration),
+	args := append(InputArgs(path, start, duration),
 		"-af", "astats=metadata=1:measure_perchannel=Peak_level:measure_overall=none:reset=1,ametadata=mode=print:file=-",
 		"-f", "null",
 		"-",
-	}
+	)
 
 	// Use retry logic for unstable NAS connections (captures stdout for ametadata output)
-	output, _, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, true)
+	output, _, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, fileDuration, true)
 	if err != nil {
 		return nil, fmt.Errorf("clipping analysis failed: %w", err)
 	}
@@ -456,20 +398,18 @@ func (s *Scanner) extractClippingSeries(ctx context.Context, path string, durati
 }
 
 // extractPhaseSeries analyzes stereo phase correlation
-func (s *Scanner) extractPhaseSeries(ctx context.Context, path string, duration float64) (*PhaseSeries, error) {
+func (s *Scanner) extractPhaseSeries(ctx context.Context, path string, start, duration, fileDuration float64) (*PhaseSeries, error) {
 	// Use aphasemeter for actual phase correlation measurement
 	// Combined with astats for L/R balance calculation
 	// FFmpeg 7.x: use ametadata=mode=print:file=- to output to stdout
-	args := []string{
-		"-i", path,
-		"-t", fmt.Sprintf("%.2f", duration),
+	args := append(InputArgs(path, start, duration),
 		"-af", "aphasemeter=video=0,astats=metadata=1:measure_perchannel=RMS_level:measure_overall=none:reset=1,ametadata=mode=print:file=-",
 		"-f", "null",
 		"-",
-	}
+	)
 
 	// Use retry logic for unstable NAS connections (captures stdout for ametadata output)
-	output, _, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, true)
+	output, _, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, fileDuration, true)
 	if err != nil {
 		return nil, fmt.Errorf("phase analysis failed: %w", err)
 	}
@@ -583,20 +523,18 @@ func abs32(x float32) float32 {
 }
 
 // extractDynamicsSeries analyzes dynamics over time
-func (s *Scanner) extractDynamicsSeries(ctx context.Context, path string, duration float64) (*DynamicsSeries, error) {
+func (s *Scanner) extractDynamicsSeries(ctx context.Context, path string, start, duration, fileDuration float64) (*DynamicsSeries, error) {
 	// Use astats with ametadata for per-frame RMS and peak levels
 	// Crest factor is calculated as Peak(dB) - RMS(dB) which is more reliable
 	// FFmpeg 7.x: use ametadata=mode=print:file=- to output to stdout
-	args := []string{
-		"-i", path,
-		"-t", fmt.Sprintf("%.2f", duration),
+	args := append(InputArgs(path, start, duration),
 		"-af", "astats=metadata=1:measure_perchannel=Peak_level+RMS_level:measure_overall=none:reset=1,ametadata=mode=print:file=-",
 		"-f", "null",
 		"-",
-	}
+	)
 
 	// Use retry logic for unstable NAS connections (captures stdout for ametadata output)
-	output, _, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, true)
+	output, _, err := runFFmpegWithRetry(ctx, s.ffmpegPath, args, fileDuration, true)
 	if err != nil {
 		return nil, fmt.Errorf("dynamics analysis failed: %w", err)
 	}
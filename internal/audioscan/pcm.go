@@ -0,0 +1,158 @@
+package audioscan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/iobudget"
+)
+
+// pcmBlockSamples is the number of samples handed to a PCM consumer per call
+const pcmBlockSamples = 8192
+
+// waitForFile blocks until path is accessible, backing off like runFFmpegWithRetry
+func waitForFile(ctx context.Context, path string) error {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		err := checkFileAccessible(path)
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxRetries {
+			return fmt.Errorf("file not accessible after %d retries: %w", maxRetries, err)
+		}
+		log.Warn().
+			Str("path", path).
+			Int("attempt", attempt+1).
+			Dur("backoff", backoff).
+			Msg("File not accessible, waiting for NAS...")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// PCMOptions controls how audio is decoded to raw samples
+type PCMOptions struct {
+	SampleRateHz int     // Output sample rate (0 = keep source rate)
+	Channels     int     // Output channel count (1 = mono downmix)
+	StartSec     float64 // Seek offset
+	DurationSec  float64 // Max seconds to decode (0 = until end)
+
+	// Length of the whole file, so that only the range decoded is charged
+	// to the I/O budget (0 = charge the whole file)
+	FileDurationSec float64
+}
+
+// InputArgs returns the FFmpeg arguments reading path from start for
+// duration seconds; a zero duration reads to the end. Seeking before the
+// input decodes from the exact sample, as tracks of a cue sheet need, so
+// times are given to the microsecond FFmpeg parses them to.
+func InputArgs(path string, start, duration float64) []string {
+	var args []string
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 6, 64))
+	}
+	args = append(args, "-i", path)
+	if duration > 0 {
+		args = append(args, "-t", strconv.FormatFloat(duration, 'f', 6, 64))
+	}
+	return args
+}
+
+// StreamPCM decodes path to interleaved f32le samples via FFmpeg on stdout and
+// passes them to fn in blocks. The slice passed to fn is reused between calls.
+func StreamPCM(ctx context.Context, ffmpegPath, path string, opts PCMOptions, fn func(samples []float32) error) error {
+	if err := waitForFile(ctx, path); err != nil {
+		return err
+	}
+	if err := iobudget.Global().WaitRange(ctx, path, opts.DurationSec, opts.FileDurationSec); err != nil {
+		return err
+	}
+
+	args := append([]string{"-v", "error"}, InputArgs(path, opts.StartSec, opts.DurationSec)...)
+	args = append(args, "-vn", "-f", "f32le", "-acodec", "pcm_f32le")
+	if opts.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(opts.Channels))
+	}
+	if opts.SampleRateHz > 0 {
+		args = append(args, "-ar", strconv.Itoa(opts.SampleRateHz))
+	}
+	args = append(args, "-")
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	readErr := readF32LE(bufio.NewReaderSize(stdout, 64*1024), fn)
+	if readErr != nil {
+		// Stop the decoder if the consumer bailed out early
+		cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+	if waitErr != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg decode failed: %w: %s", waitErr, truncateString(stderr.String(), 200))
+	}
+	return nil
+}
+
+// readF32LE converts a little-endian float32 byte stream into sample blocks
+func readF32LE(r io.Reader, fn func(samples []float32) error) error {
+	raw := make([]byte, pcmBlockSamples*4)
+	samples := make([]float32, pcmBlockSamples)
+	pending := 0
+
+	for {
+		n, err := io.ReadFull(r, raw[pending:])
+		n += pending
+		count := n / 4
+		if count > 0 {
+			for i := 0; i < count; i++ {
+				samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[i*4:]))
+			}
+			if cbErr := fn(samples[:count]); cbErr != nil {
+				return cbErr
+			}
+		}
+		// Keep any partial sample for the next read
+		pending = n - count*4
+		copy(raw, raw[count*4:n])
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read pcm: %w", err)
+		}
+	}
+}
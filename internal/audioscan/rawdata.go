@@ -96,6 +96,31 @@ type DynamicsSeries struct {
 	MinCrestDb    float32 `msgpack:"minCrestDb"`
 }
 
+// SpectrogramMatrix represents a quantized time×frequency dB matrix (v1)
+type SpectrogramMatrix struct {
+	Version      int       `msgpack:"version"`
+	SampleRateHz int       `msgpack:"sampleRateHz"`
+	NyquistHz    int       `msgpack:"nyquistHz"`
+	FFTSize      int       `msgpack:"fftSize"`
+	HopSize      int       `msgpack:"hopSize"`
+	Window       string    `msgpack:"window"` // "hann"
+	SecPerColumn float64   `msgpack:"secPerColumn"`
+	HzPerBin     float64   `msgpack:"hzPerBin"`
+	TimeBins     int       `msgpack:"timeBins"`
+	FreqBins     int       `msgpack:"freqBins"`
+	TSec         []float32 `msgpack:"tSec"` // column center times
+	// Quantization: dB = MinDb + q/255 * (MaxDb - MinDb)
+	MinDb float32 `msgpack:"minDb"`
+	MaxDb float32 `msgpack:"maxDb"`
+	Q     []byte  `msgpack:"q"` // time-major: Q[t*FreqBins+f]
+}
+
+// LevelDb returns the dequantized level of one cell
+func (m *SpectrogramMatrix) LevelDb(t, f int) float32 {
+	q := m.Q[t*m.FreqBins+f]
+	return m.MinDb + float32(q)/255*(m.MaxDb-m.MinDb)
+}
+
 // SaveMsgpackZstd serializes data to MessagePack and compresses with Zstd
 func SaveMsgpackZstd(path string, data interface{}) error {
 	// Serialize to msgpack
@@ -0,0 +1,140 @@
+package audioscan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/accuraterip"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// SetRipDatabase sets the online database rips are also checked against
+func (s *Scanner) SetRipDatabase(db accuraterip.Database) {
+	s.ripDB = db
+}
+
+// runRipModuleWithLog checks a track against the EAC or XLD log it was
+// ripped with. Unlike the other modules it reads the whole track, but only
+// the track: of a single-file image, its range and the frames either side
+// the offset search needs.
+func (s *Scanner) runRipModuleWithLog(ctx context.Context, track *models.Track, manifest *AnalysisManifest, dir string, logInfo func(string, string), logDebug func(string, string, string), logWarn func(string, string, string)) {
+	log.Debug().Str("trackId", track.ID).Msg("Running accuraterip module")
+
+	if !s.verifyRips {
+		manifest.SetModuleSkipped("accuraterip", "Rip verification is turned off")
+		return
+	}
+	if !isRedBook(track) {
+		manifest.SetModuleSkipped("accuraterip", "Not CD audio in a lossless format")
+		return
+	}
+	ripLog, logged := findRipLog(track)
+	if logged == nil {
+		manifest.SetModuleSkipped("accuraterip", "No EAC or XLD log covers this track")
+		return
+	}
+	logDebug("accuraterip", "Rip log found", fmt.Sprintf("Log: %s, Ripper: %s, Track: %d of %d", ripLog.Path, ripLog.Ripper, logged.Number, ripLog.TotalTracks()))
+
+	span, start, duration := ripSpan(track, ripLog, logged)
+	sums := accuraterip.NewChecksummer([]accuraterip.Span{span})
+	err := StreamPCM(ctx, s.ffmpegPath, track.Path, PCMOptions{
+		Channels:        2,
+		StartSec:        start,
+		DurationSec:     duration,
+		FileDurationSec: track.FileDuration,
+	}, sums.Write)
+	if err != nil {
+		logWarn("accuraterip", "Rip verification failed", err.Error())
+		manifest.SetModuleError("accuraterip", "Rip verification failed", err.Error())
+		return
+	}
+
+	var submissions []accuraterip.Submission
+	if s.ripDB != nil && len(ripLog.TOC) > 0 {
+		submissions, err = s.ripDB.Lookup(ctx, ripLog.TOC)
+		if err != nil {
+			logWarn("accuraterip", "Rip database lookup failed", err.Error())
+		}
+	}
+
+	check := accuraterip.NewCheck(sums.Results()[0], ripLog, logged, submissions)
+	logInfo("accuraterip", check.Verdict.Message())
+
+	manifest.SetModuleOK("accuraterip", map[string]any{
+		"status":  check.Verdict.Status,
+		"message": check.Verdict.Message(),
+		"check":   check,
+	}, nil, nil)
+
+	logInfo("accuraterip", "Rip verification module complete")
+}
+
+// RipCheck returns the verification of a track's rip a manifest recorded,
+// or nil if its accuraterip module didn't complete
+func RipCheck(manifest *AnalysisManifest) *accuraterip.Check {
+	mod, ok := manifest.Modules["accuraterip"]
+	if !ok || mod.Status != "ok" {
+		return nil
+	}
+	// The summary holds the check itself until the manifest is saved and
+	// its JSON once loaded
+	data, err := json.Marshal(mod.Summary["check"])
+	if err != nil {
+		return nil
+	}
+	var check accuraterip.Check
+	if err := json.Unmarshal(data, &check); err != nil || check.Verdict.Status == "" {
+		return nil
+	}
+	return &check
+}
+
+// isRedBook reports whether a track is CD audio, 44.1 kHz 16-bit stereo, in
+// a lossless format its rip can be checked from
+func isRedBook(t *models.Track) bool {
+	if t.SampleRate != accuraterip.SampleRate || t.BitDepth != 16 || t.Channels != 2 {
+		return false
+	}
+	switch t.Codec {
+	case "flac", "alac", "ape", "wavpack", "tta", "pcm_s16le", "pcm_s16be":
+		return true
+	}
+	return false
+}
+
+// findRipLog returns the log next to a track's file that recorded it, and
+// what it recorded
+func findRipLog(track *models.Track) (*accuraterip.Log, *accuraterip.LogTrack) {
+	for _, l := range accuraterip.LoadLogs(filepath.Dir(track.Path)) {
+		lt := l.TrackOf(track.Path, int(track.TrackNumber.Int32))
+		if lt != nil && len(lt.Checksums) > 0 {
+			return l, lt
+		}
+	}
+	return nil, nil
+}
+
+// ripSpan returns where a track is in the audio decoded to check it, and
+// the range of its file, in seconds, to decode: a file holding one track
+// whole, and a track of a cue sheet with up to accuraterip.MaxOffset frames
+// either side. The last track of a sheet runs to the end of the file.
+func ripSpan(track *models.Track, l *accuraterip.Log, logged *accuraterip.LogTrack) (span accuraterip.Span, start, duration float64) {
+	span = accuraterip.Span{Number: logged.Number, Total: l.TotalTracks()}
+	if !track.FromCue() {
+		return span, 0, 0
+	}
+
+	first := int64(math.Round(track.StartOffset * accuraterip.SampleRate))
+	span.Start = min(first, accuraterip.MaxOffset)
+	start = float64(first-span.Start) / accuraterip.SampleRate
+	if track.StartOffset+track.Duration < track.FileDuration-1.0/accuraterip.SampleRate {
+		span.Length = int64(math.Round(track.Duration * accuraterip.SampleRate))
+		duration = float64(span.Start+span.Length+accuraterip.MaxOffset) / accuraterip.SampleRate
+	}
+	return span, start, duration
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/ottavia-music/ottavia/internal/accuraterip"
 	"github.com/ottavia-music/ottavia/internal/database"
 	"github.com/ottavia-music/ottavia/internal/models"
 )
@@ -19,6 +20,8 @@ type Scanner struct {
 	ffprobePath   string
 	artifactsPath string
 	maxDuration   float64 // Max seconds to analyze (0 = full track)
+	verifyRips    bool    // Check CD rips against their EAC or XLD log
+	ripDB         accuraterip.Database
 }
 
 // Config holds scanner configuration
@@ -27,6 +30,7 @@ type Config struct {
 	FFmpegPath     string
 	FFprobePath    string
 	ArtifactsPath  string
+	VerifyRips     bool // Run the accuraterip module, which reads whole tracks
 }
 
 // NewScanner creates a new audio scanner
@@ -41,6 +45,7 @@ func NewScanner(db *database.DB, cfg Config) *Scanner {
 		ffprobePath:   cfg.FFprobePath,
 		artifactsPath: cfg.ArtifactsPath,
 		maxDuration:   maxDur,
+		verifyRips:    cfg.VerifyRips,
 	}
 }
 
@@ -98,6 +103,9 @@ func (s *Scanner) ScanTrackWithLogger(ctx context.Context, trackID string, jobID
 	logInfo("", fmt.Sprintf("Track: %s", title))
 	logDebug("", "Track details", fmt.Sprintf("Path: %s, Duration: %.1fs, Sample Rate: %dHz, Channels: %d, Codec: %s",
 		track.Path, track.Duration, track.SampleRate, track.Channels, track.Codec))
+	if track.FromCue() {
+		logInfo("", fmt.Sprintf("Cue track %d, starting %.2fs into the file", track.CueIndex, track.StartOffset))
+	}
 
 	// Create artifact directory
 	artifactDir, err := EnsureArtifactDir(s.artifactsPath, trackID)
@@ -132,9 +140,16 @@ func (s *Scanner) ScanTrackWithLogger(ctx context.Context, trackID string, jobID
 		logInfo("", fmt.Sprintf("Analyzing full track (%.1f seconds)", duration))
 	}
 
+	// The spectrum and spectrogram modules share one decode of the track
+	logDebug("", "Decoding PCM for the spectrum and spectrogram", fmt.Sprintf("Duration: %.1fs, FFT sizes: %d and %d", duration, spectrumFFTSize, spectrogramFFTSize))
+	spectra := s.extractSpectra(ctx, track.Path, track.SampleRate, track.StartOffset, duration, track.FileDuration)
+
 	// Run each analysis module with verbose logging
 	logInfo("audioscan", "Running spectrum analysis module...")
-	s.runAudioScanModuleWithLog(ctx, track, manifest, artifactDir, logInfo, logDebug, logWarn)
+	s.runAudioScanModuleWithLog(ctx, track, manifest, artifactDir, spectra, logInfo, logDebug, logWarn)
+
+	logInfo("spectrogram", "Running spectrogram module...")
+	s.runSpectrogramModuleWithLog(ctx, track, manifest, artifactDir, spectra, logInfo, logDebug, logWarn)
 
 	logInfo("loudness", "Running loudness analysis module...")
 	s.runLoudnessModuleWithLog(ctx, track, manifest, artifactDir, logInfo, logDebug, logWarn)
@@ -148,6 +163,9 @@ func (s *Scanner) ScanTrackWithLogger(ctx context.Context, trackID string, jobID
 	logInfo("dynamics", "Running dynamics analysis module...")
 	s.runDynamicsModuleWithLog(ctx, track, manifest, artifactDir, logInfo, logDebug, logWarn)
 
+	logInfo("accuraterip", "Running rip verification module...")
+	s.runRipModuleWithLog(ctx, track, manifest, artifactDir, logInfo, logDebug, logWarn)
+
 	// Save manifest
 	logInfo("", "Saving analysis manifest...")
 	if err := manifest.Save(artifactDir); err != nil {
@@ -175,21 +193,21 @@ func (s *Scanner) ScanTrackWithLogger(ctx context.Context, trackID string, jobID
 }
 
 // runAudioScanModule performs spectrum analysis (no verbose logging)
-func (s *Scanner) runAudioScanModule(ctx context.Context, track *models.Track, manifest *AnalysisManifest, dir string) {
+func (s *Scanner) runAudioScanModule(ctx context.Context, track *models.Track, manifest *AnalysisManifest, dir string, spectra *trackSpectra) {
 	noop := func(string, string) {}
 	noopD := func(string, string, string) {}
-	s.runAudioScanModuleWithLog(ctx, track, manifest, dir, noop, noopD, noopD)
+	s.runAudioScanModuleWithLog(ctx, track, manifest, dir, spectra, noop, noopD, noopD)
 }
 
 // runAudioScanModuleWithLog performs spectrum analysis with verbose logging
-func (s *Scanner) runAudioScanModuleWithLog(ctx context.Context, track *models.Track, manifest *AnalysisManifest, dir string, logInfo func(string, string), logDebug func(string, string, string), logWarn func(string, string, string)) {
+func (s *Scanner) runAudioScanModuleWithLog(ctx context.Context, track *models.Track, manifest *AnalysisManifest, dir string, spectra *trackSpectra, logInfo func(string, string), logDebug func(string, string, string), logWarn func(string, string, string)) {
 	log.Debug().Str("trackId", track.ID).Msg("Running audioscan module")
 
 	// Calculate analysis parameters from probe cache
 	sampleRate := track.SampleRate
 	nyquist := sampleRate / 2
-	fftSize := 4096
-	hopSize := fftSize / 4
+	fftSize := spectrumFFTSize
+	hopSize := spectrumHopSize
 
 	logDebug("audioscan", "FFT parameters configured", fmt.Sprintf("FFT size: %d, Hop size: %d, Nyquist: %dHz", fftSize, hopSize, nyquist))
 
@@ -215,7 +233,6 @@ func (s *Scanner) runAudioScanModuleWithLog(ctx context.Context, track *models.T
 	curve.FFT.FFTSize = fftSize
 	curve.FFT.HopSize = hopSize
 	curve.FFT.Window = "hann"
-	curve.FFT.SmoothingOctaves = 0.25
 
 	// Set guide lines computed from probe cache
 	curve.Guides.VerticalLinesHz = []int{nyquist}
@@ -227,25 +244,23 @@ func (s *Scanner) runAudioScanModuleWithLog(ctx context.Context, track *models.T
 		}
 	}
 
-	logDebug("audioscan", "Running FFmpeg spectrum extraction", fmt.Sprintf("Duration: %.1fs, Mode: %s", duration, curve.Analyzed.ChannelMode))
-
-	// Run FFmpeg to extract spectrum data
-	freqHz, levelDb, err := s.extractSpectrumCurve(ctx, track.Path, fftSize, duration)
+	// The averaged FFT at the track's actual sample rate
+	freqHz, levelDb, frames, err := spectra.curve()
 	if err != nil {
 		logWarn("audioscan", "Spectrum analysis failed", err.Error())
 		manifest.SetModuleError("audioscan", "Spectrum analysis failed", err.Error())
 		return
 	}
 
-	logDebug("audioscan", "FFmpeg spectrum extraction complete", fmt.Sprintf("Extracted %d frequency bins", len(freqHz)))
+	logDebug("audioscan", "FFT spectrum extraction complete", fmt.Sprintf("Averaged %d frames into %d frequency bins", frames, len(freqHz)))
 
 	curve.Curve.FreqHz = freqHz
 	curve.Curve.LevelDb = levelDb
-	curve.FFT.Frames = len(levelDb) / (fftSize / 2)
+	curve.FFT.Frames = frames
 
 	// Calculate metrics
 	curve.Metrics.BandwidthHz = calculateBandwidth(freqHz, levelDb)
-	curve.Metrics.DCMean, curve.Metrics.DCFlag = s.calculateDC(ctx, track.Path, duration)
+	curve.Metrics.DCMean, curve.Metrics.DCFlag = s.calculateDC(ctx, track.Path, track.StartOffset, duration, track.FileDuration)
 
 	logInfo("audioscan", fmt.Sprintf("Detected bandwidth: %d Hz", curve.Metrics.BandwidthHz))
 	if curve.Metrics.DCFlag {
@@ -301,6 +316,65 @@ func (s *Scanner) runAudioScanModuleWithLog(ctx context.Context, track *models.T
 	logInfo("audioscan", "Spectrum analysis module complete")
 }
 
+// runSpectrogramModuleWithLog builds the time×frequency matrix with verbose logging
+func (s *Scanner) runSpectrogramModuleWithLog(ctx context.Context, track *models.Track, manifest *AnalysisManifest, dir string, spectra *trackSpectra, logInfo func(string, string), logDebug func(string, string, string), logWarn func(string, string, string)) {
+	log.Debug().Str("trackId", track.ID).Msg("Running spectrogram module")
+
+	duration := track.Duration
+	if s.maxDuration > 0 && duration > s.maxDuration {
+		duration = s.maxDuration
+	}
+
+	logDebug("spectrogram", "Spectrogram parameters", fmt.Sprintf("Duration: %.1fs, FFT size: %d, Hop size: %d", duration, spectrogramFFTSize, spectrogramHopSize))
+
+	matrix, err := spectra.matrix()
+	if err != nil {
+		logWarn("spectrogram", "Spectrogram analysis failed", err.Error())
+		manifest.SetModuleError("spectrogram", "Spectrogram analysis failed", err.Error())
+		return
+	}
+
+	logInfo("spectrogram", fmt.Sprintf("Matrix: %d time bins × %d frequency bins (%.3fs per column)",
+		matrix.TimeBins, matrix.FreqBins, matrix.SecPerColumn))
+
+	// Save raw data
+	rawPath := fmt.Sprintf("%s/spectrogram_v1.msgpack.zst", dir)
+	if err := SaveMsgpackZstd(rawPath, matrix); err != nil {
+		logWarn("spectrogram", "Failed to save raw data", err.Error())
+		manifest.SetModuleError("spectrogram", "Failed to save raw data", err.Error())
+		return
+	}
+
+	// Compute hash
+	rawHash, _ := ComputeSHA256(rawPath)
+
+	// Build render hints
+	renderHints := &RenderHints{
+		NyquistHz:   matrix.NyquistHz,
+		MinFreqHz:   0,
+		MaxFreqHz:   matrix.NyquistHz,
+		MinDb:       matrix.MinDb,
+		MaxDb:       matrix.MaxDb,
+		DurationSec: duration,
+		XUnit:       "sec",
+		YUnit:       "Hz",
+		Y2Unit:      "dB",
+	}
+
+	manifest.SetModuleOK("spectrogram", map[string]any{
+		"timeBins":     matrix.TimeBins,
+		"freqBins":     matrix.FreqBins,
+		"secPerColumn": matrix.SecPerColumn,
+		"hzPerBin":     matrix.HzPerBin,
+	}, &ArtifactRef{
+		Path:        "spectrogram_v1.msgpack.zst",
+		SHA256:      rawHash,
+		ContentType: "application/x-msgpack+zstd",
+	}, renderHints)
+
+	logInfo("spectrogram", "Spectrogram module complete")
+}
+
 // runLoudnessModule performs loudness analysis over time (no verbose logging)
 func (s *Scanner) runLoudnessModule(ctx context.Context, track *models.Track, manifest *AnalysisManifest, dir string) {
 	noop := func(string, string) {}
@@ -319,7 +393,7 @@ func (s *Scanner) runLoudnessModuleWithLog(ctx context.Context, track *models.Tr
 
 	logDebug("loudness", "Running EBU R128 loudness analysis", fmt.Sprintf("Duration: %.1fs", duration))
 
-	series, err := s.extractLoudnessSeries(ctx, track.Path, duration)
+	series, err := s.extractLoudnessSeries(ctx, track.Path, track.StartOffset, duration, track.FileDuration)
 	if err != nil {
 		logWarn("loudness", "Loudness analysis failed", err.Error())
 		manifest.SetModuleError("loudness", "Loudness analysis failed", err.Error())
@@ -384,7 +458,7 @@ func (s *Scanner) runClippingModuleWithLog(ctx context.Context, track *models.Tr
 
 	logDebug("clipping", "Running clipping detection", fmt.Sprintf("Duration: %.1fs", duration))
 
-	series, err := s.extractClippingSeries(ctx, track.Path, duration)
+	series, err := s.extractClippingSeries(ctx, track.Path, track.StartOffset, duration, track.FileDuration)
 	if err != nil {
 		logWarn("clipping", "Clipping analysis failed", err.Error())
 		manifest.SetModuleError("clipping", "Clipping analysis failed", err.Error())
@@ -452,7 +526,7 @@ func (s *Scanner) runPhaseModuleWithLog(ctx context.Context, track *models.Track
 
 	logDebug("phase", "Running stereo phase correlation analysis", fmt.Sprintf("Duration: %.1fs", duration))
 
-	series, err := s.extractPhaseSeries(ctx, track.Path, duration)
+	series, err := s.extractPhaseSeries(ctx, track.Path, track.StartOffset, duration, track.FileDuration)
 	if err != nil {
 		logWarn("phase", "Phase analysis failed", err.Error())
 		manifest.SetModuleError("phase", "Phase analysis failed", err.Error())
@@ -518,7 +592,7 @@ func (s *Scanner) runDynamicsModuleWithLog(ctx context.Context, track *models.Tr
 
 	logDebug("dynamics", "Running dynamic range analysis", fmt.Sprintf("Duration: %.1fs", duration))
 
-	series, err := s.extractDynamicsSeries(ctx, track.Path, duration)
+	series, err := s.extractDynamicsSeries(ctx, track.Path, track.StartOffset, duration, track.FileDuration)
 	if err != nil {
 		logWarn("dynamics", "Dynamics analysis failed", err.Error())
 		manifest.SetModuleError("dynamics", "Dynamics analysis failed", err.Error())
@@ -591,9 +665,14 @@ func (s *Scanner) updateAnalysisResults(ctx context.Context, trackID string, man
 	}
 
 	// We'd update result.StatsJSON here with the new data
-	_ = result
 	_ = statsJSON
 
+	// A rip check is an issue of the track, kept with its analysis
+	if check := RipCheck(manifest); check != nil {
+		check.AddTo(result)
+		return s.db.UpdateAnalysisIssues(ctx, result)
+	}
+
 	return nil
 }
 
@@ -655,32 +734,45 @@ func classifyDetectedQuality(curve *AudioScanCurve) (string, string) {
 	return "Good", fmt.Sprintf("Bandwidth %d Hz", bw)
 }
 
+// bandwidthMinRun is the number of consecutive bins that must clear the
+// threshold, so isolated tones or spurs above a lowpass shelf are ignored
+const bandwidthMinRun = 3
+
 func calculateBandwidth(freqHz, levelDb []float32) int {
-	if len(freqHz) == 0 || len(levelDb) == 0 {
+	n := len(levelDb)
+	if len(freqHz) < n {
+		n = len(freqHz)
+	}
+	if n == 0 {
 		return 0
 	}
 
-	// Find peak level (excluding DC)
+	// Find peak level (excluding DC and sub-audio bins)
 	peakLevel := float32(-200)
-	for i := 1; i < len(levelDb); i++ {
+	for i := 1; i < n; i++ {
+		if freqHz[i] < 20 {
+			continue
+		}
 		if levelDb[i] > peakLevel {
 			peakLevel = levelDb[i]
 		}
 	}
 
-	// Find last frequency where level is within threshold of peak
+	// Find last frequency where a run of bins is within threshold of peak
 	threshold := peakLevel - 60 // 60dB below peak
-	bandwidth := 0
-	for i := len(levelDb) - 1; i >= 0; i-- {
+	run := 0
+	for i := n - 1; i >= 0; i-- {
 		if levelDb[i] > threshold {
-			if i < len(freqHz) {
-				bandwidth = int(freqHz[i])
+			run++
+			if run >= bandwidthMinRun {
+				return int(freqHz[i+run-1])
 			}
-			break
+		} else {
+			run = 0
 		}
 	}
 
-	return bandwidth
+	return 0
 }
 
 func channelsLabel(channels int) string {
@@ -0,0 +1,169 @@
+package audioscan
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// Spectrogram defaults: 2048-point frames give ~21.5 Hz bins at 44.1 kHz,
+// enough to resolve a 16 kHz / 19.5 kHz lowpass shelf
+const (
+	spectrogramFFTSize    = 2048
+	spectrogramHopSize    = 512
+	spectrogramMaxColumns = 1200
+	spectrogramMinDb      = -120
+	spectrogramMaxDb      = 0
+)
+
+// spectrogramBuilder averages STFT frames into fixed-width time columns
+type spectrogramBuilder struct {
+	*STFT
+	framesPerColumn int
+	colPower        []float64
+	colFrames       int
+	columns         [][]float32
+}
+
+func newSpectrogramBuilder(fftSize, hopSize, framesPerColumn int) *spectrogramBuilder {
+	b := &spectrogramBuilder{
+		framesPerColumn: framesPerColumn,
+		colPower:        make([]float64, fftSize/2+1),
+	}
+	b.STFT = NewSTFT(fftSize, hopSize, b.addFrame)
+	return b
+}
+
+func (b *spectrogramBuilder) addFrame(power []float64) {
+	for k, p := range power {
+		b.colPower[k] += p
+	}
+	b.colFrames++
+	if b.colFrames >= b.framesPerColumn {
+		b.flush()
+	}
+}
+
+// flush emits the current column, if any frames are pending
+func (b *spectrogramBuilder) flush() {
+	if b.colFrames == 0 {
+		return
+	}
+	col := make([]float32, len(b.colPower))
+	for k, p := range b.colPower {
+		col[k] = powerToDb(p / float64(b.colFrames))
+		b.colPower[k] = 0
+	}
+	b.columns = append(b.columns, col)
+	b.colFrames = 0
+}
+
+// Matrix quantizes the collected columns into a SpectrogramMatrix
+func (b *spectrogramBuilder) Matrix(sampleRate int) *SpectrogramMatrix {
+	b.flush()
+
+	freqBins := b.fftSize/2 + 1
+	m := &SpectrogramMatrix{
+		Version:      RawDataVersion,
+		SampleRateHz: sampleRate,
+		NyquistHz:    sampleRate / 2,
+		FFTSize:      b.fftSize,
+		HopSize:      b.hopSize,
+		Window:       "hann",
+		SecPerColumn: float64(b.framesPerColumn*b.hopSize) / float64(sampleRate),
+		HzPerBin:     float64(sampleRate) / float64(b.fftSize),
+		TimeBins:     len(b.columns),
+		FreqBins:     freqBins,
+		TSec:         make([]float32, len(b.columns)),
+		MinDb:        spectrogramMinDb,
+		MaxDb:        spectrogramMaxDb,
+		Q:            make([]byte, len(b.columns)*freqBins),
+	}
+
+	// Column time is the center of the frames it covers
+	frameCenter := float64(b.fftSize) / 2 / float64(sampleRate)
+	span := float64(m.MaxDb - m.MinDb)
+	for t, col := range b.columns {
+		firstFrame := t * b.framesPerColumn
+		lastFrame := firstFrame + b.framesPerColumn - 1
+		if lastFrame >= b.frames {
+			lastFrame = b.frames - 1
+		}
+		mid := float64(firstFrame+lastFrame) / 2 * float64(b.hopSize) / float64(sampleRate)
+		m.TSec[t] = float32(mid + frameCenter)
+
+		row := m.Q[t*freqBins : (t+1)*freqBins]
+		for f, db := range col {
+			q := math.Round((float64(db) - float64(m.MinDb)) / span * 255)
+			row[f] = byte(math.Max(0, math.Min(255, q)))
+		}
+	}
+	return m
+}
+
+// trackSpectra is the averaged spectrum and the spectrogram of a track,
+// built from the one decode the audioscan and spectrogram modules share
+type trackSpectra struct {
+	sampleRate  int
+	spectrum    *spectrumAccumulator
+	spectrogram *spectrogramBuilder
+	err         error // why decoding failed, reported by both modules
+}
+
+// extractSpectra decodes the track to mono PCM at its native rate once,
+// feeding both the averaged spectrum and a column-averaged spectrogram of at
+// most spectrogramMaxColumns columns
+func (s *Scanner) extractSpectra(ctx context.Context, path string, sampleRate int, start, duration, fileDuration float64) *trackSpectra {
+	t := &trackSpectra{sampleRate: sampleRate}
+	if sampleRate <= 0 {
+		t.err = fmt.Errorf("unknown sample rate")
+		return t
+	}
+
+	// Pick a column width so the expected frame count fits the column budget
+	expectedFrames := int(duration * float64(sampleRate) / spectrogramHopSize)
+	framesPerColumn := 1
+	if expectedFrames > spectrogramMaxColumns {
+		framesPerColumn = (expectedFrames + spectrogramMaxColumns - 1) / spectrogramMaxColumns
+	}
+
+	t.spectrum = newSpectrumAccumulator(spectrumFFTSize, spectrumHopSize)
+	t.spectrogram = newSpectrogramBuilder(spectrogramFFTSize, spectrogramHopSize, framesPerColumn)
+	t.err = StreamPCM(ctx, s.ffmpegPath, path, PCMOptions{
+		SampleRateHz:    sampleRate,
+		Channels:        1,
+		StartSec:        start,
+		DurationSec:     duration,
+		FileDurationSec: fileDuration,
+	}, func(block []float32) error {
+		if err := t.spectrum.Write(block); err != nil {
+			return err
+		}
+		return t.spectrogram.Write(block)
+	})
+	return t
+}
+
+// curve returns the averaged spectrum's frequencies and levels, and the
+// number of FFT frames averaged
+func (t *trackSpectra) curve() ([]float32, []float32, int, error) {
+	if t.err != nil {
+		return nil, nil, 0, t.err
+	}
+	if t.spectrum.frames == 0 {
+		return nil, nil, 0, fmt.Errorf("not enough audio for a %d-point FFT", t.spectrum.fftSize)
+	}
+	freqHz, levelDb := t.spectrum.Result(t.sampleRate)
+	return freqHz, levelDb, t.spectrum.frames, nil
+}
+
+// matrix returns the spectrogram
+func (t *trackSpectra) matrix() (*SpectrogramMatrix, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.spectrogram.frames == 0 {
+		return nil, fmt.Errorf("not enough audio for a %d-point FFT", spectrogramFFTSize)
+	}
+	return t.spectrogram.Matrix(t.sampleRate), nil
+}
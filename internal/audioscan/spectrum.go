@@ -0,0 +1,168 @@
+package audioscan
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// spectrumFloorDb is the lowest level reported for a bin (digital silence)
+const spectrumFloorDb = -160
+
+// Averaged spectrum parameters, shared by the audioscan module and bandwidth
+// measurements
+const (
+	spectrumFFTSize = 4096
+	spectrumHopSize = spectrumFFTSize / 4
+)
+
+// STFT runs a Hann-windowed short-time FFT over a stream of mono PCM and hands
+// the normalized power of each frame to onFrame. The power slice is reused.
+type STFT struct {
+	fftSize int
+	hopSize int
+	window  []float64
+	norm    float64 // power of a full-scale sine after windowing
+
+	buf     []float32 // samples waiting for a full frame
+	re, im  []float64
+	power   []float64
+	frames  int
+	onFrame func(power []float64)
+}
+
+func NewSTFT(fftSize, hopSize int, onFrame func(power []float64)) *STFT {
+	window := hannWindow(fftSize)
+	var sum float64
+	for _, w := range window {
+		sum += w
+	}
+	return &STFT{
+		fftSize: fftSize,
+		hopSize: hopSize,
+		window:  window,
+		norm:    (sum / 2) * (sum / 2),
+		buf:     make([]float32, 0, fftSize*2),
+		re:      make([]float64, fftSize),
+		im:      make([]float64, fftSize),
+		power:   make([]float64, fftSize/2+1),
+		onFrame: onFrame,
+	}
+}
+
+// Write feeds samples into the transform, processing every complete frame
+func (t *STFT) Write(samples []float32) error {
+	t.buf = append(t.buf, samples...)
+	for len(t.buf) >= t.fftSize {
+		t.processFrame(t.buf[:t.fftSize])
+		t.buf = t.buf[t.hopSize:]
+	}
+	// Compact so the buffer does not grow without bound
+	if cap(t.buf)-len(t.buf) < t.fftSize {
+		t.buf = append(make([]float32, 0, t.fftSize*2), t.buf...)
+	}
+	return nil
+}
+
+func (t *STFT) processFrame(frame []float32) {
+	for i, s := range frame {
+		t.re[i] = float64(s) * t.window[i]
+		t.im[i] = 0
+	}
+	fft(t.re, t.im)
+	for k := range t.power {
+		t.power[k] = (t.re[k]*t.re[k] + t.im[k]*t.im[k]) / t.norm
+	}
+	t.frames++
+	t.onFrame(t.power)
+}
+
+// powerToDb converts normalized power to dBFS, clamped at spectrumFloorDb
+func powerToDb(p float64) float32 {
+	if p <= 0 {
+		return spectrumFloorDb
+	}
+	db := 10 * math.Log10(p)
+	if db < spectrumFloorDb {
+		return spectrumFloorDb
+	}
+	return float32(db)
+}
+
+// spectrumAccumulator computes an averaged power spectrum over all STFT frames
+type spectrumAccumulator struct {
+	*STFT
+	sum []float64 // summed power per bin
+}
+
+func newSpectrumAccumulator(fftSize, hopSize int) *spectrumAccumulator {
+	a := &spectrumAccumulator{sum: make([]float64, fftSize/2+1)}
+	a.STFT = NewSTFT(fftSize, hopSize, func(power []float64) {
+		for k, p := range power {
+			a.sum[k] += p
+		}
+	})
+	return a
+}
+
+// Result returns ascending bin frequencies and averaged levels in dBFS
+func (a *spectrumAccumulator) Result(sampleRate int) ([]float32, []float32) {
+	bins := len(a.sum)
+	freqHz := make([]float32, bins)
+	levelDb := make([]float32, bins)
+	binWidth := float64(sampleRate) / float64(a.fftSize)
+
+	for k := 0; k < bins; k++ {
+		freqHz[k] = float32(float64(k) * binWidth)
+		levelDb[k] = spectrumFloorDb
+		if a.frames > 0 {
+			levelDb[k] = powerToDb(a.sum[k] / float64(a.frames))
+		}
+	}
+	return freqHz, levelDb
+}
+
+// extractSpectrumCurve decodes the track to mono f32le PCM at its native rate
+// and computes an averaged Hann-windowed FFT. Returns frequencies, levels and
+// the number of FFT frames averaged.
+func (s *Scanner) extractSpectrumCurve(ctx context.Context, path string, sampleRate, fftSize, hopSize int, start, duration, fileDuration float64) ([]float32, []float32, int, error) {
+	if sampleRate <= 0 {
+		return nil, nil, 0, fmt.Errorf("unknown sample rate")
+	}
+	if !isPowerOfTwo(fftSize) || hopSize <= 0 || hopSize > fftSize {
+		return nil, nil, 0, fmt.Errorf("invalid FFT parameters: size %d, hop %d", fftSize, hopSize)
+	}
+
+	acc := newSpectrumAccumulator(fftSize, hopSize)
+	err := StreamPCM(ctx, s.ffmpegPath, path, PCMOptions{
+		SampleRateHz:    sampleRate,
+		Channels:        1,
+		StartSec:        start,
+		DurationSec:     duration,
+		FileDurationSec: fileDuration,
+	}, acc.Write)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if acc.frames == 0 {
+		return nil, nil, 0, fmt.Errorf("not enough audio for a %d-point FFT", fftSize)
+	}
+
+	freqHz, levelDb := acc.Result(sampleRate)
+	return freqHz, levelDb, acc.frames, nil
+}
+
+// MeasureBandwidth returns the highest frequency with meaningful energy in the
+// file, using the same averaged spectrum and threshold as the audioscan module.
+// Analysis starts at start, for a track of a cue sheet, and is limited to the
+// scanner's configured max duration.
+func (s *Scanner) MeasureBandwidth(ctx context.Context, path string, sampleRate int, start, duration, fileDuration float64) (int, error) {
+	if s.maxDuration > 0 && (duration <= 0 || duration > s.maxDuration) {
+		duration = s.maxDuration
+	}
+	freqHz, levelDb, _, err := s.extractSpectrumCurve(ctx, path, sampleRate, spectrumFFTSize, spectrumHopSize, start, duration, fileDuration)
+	if err != nil {
+		return 0, err
+	}
+	return calculateBandwidth(freqHz, levelDb), nil
+}
@@ -8,11 +8,17 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Database DatabaseConfig `yaml:"database"`
-	Scanner  ScannerConfig  `yaml:"scanner"`
-	Storage  StorageConfig  `yaml:"storage"`
-	FFmpeg   FFmpegConfig   `yaml:"ffmpeg"`
+	Server     ServerConfig     `yaml:"server"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Scanner    ScannerConfig    `yaml:"scanner"`
+	Storage    StorageConfig    `yaml:"storage"`
+	FFmpeg     FFmpegConfig     `yaml:"ffmpeg"`
+	Lookup     LookupConfig     `yaml:"lookup"`
+	ReplayGain ReplayGainConfig `yaml:"replaygain"`
+	AudioScan  AudioScanConfig  `yaml:"audioscan"`
+	JobLogs    JobLogsConfig    `yaml:"job_logs"`
+	Jobs       JobsConfig       `yaml:"jobs"`
+	GC         GCConfig         `yaml:"gc"`
 }
 
 type ServerConfig struct {
@@ -31,11 +37,17 @@ type ScannerConfig struct {
 	BatchSize        int    `yaml:"batch_size"`
 	MaxRetries       int    `yaml:"max_retries"`
 	RetryBackoffBase int    `yaml:"retry_backoff_base"`
+	// Watch rescans changed directories as soon as they settle, on local
+	// filesystems; interval scans continue either way
+	Watch         bool   `yaml:"watch"`
+	WatchDebounce string `yaml:"watch_debounce"`
+	WatchMaxDelay string `yaml:"watch_max_delay"`
 }
 
 type StorageConfig struct {
 	ArtifactsPath string `yaml:"artifacts_path"`
 	TempPath      string `yaml:"temp_path"`
+	LogsPath      string `yaml:"logs_path"`
 }
 
 type FFmpegConfig struct {
@@ -43,6 +55,49 @@ type FFmpegConfig struct {
 	FFmpegPath  string `yaml:"ffmpeg_path"`
 }
 
+type LookupConfig struct {
+	MusicBrainzURL string `yaml:"musicbrainz_url"`
+	UserAgent      string `yaml:"user_agent"`
+	MinInterval    string `yaml:"min_interval"`
+}
+
+type ReplayGainConfig struct {
+	// ReferenceLUFS is the target loudness; -18 LUFS matches the 89 dB
+	// ReplayGain reference
+	ReferenceLUFS float64 `yaml:"reference_lufs"`
+}
+
+type AudioScanConfig struct {
+	// VerifyRips checks CD rips against the EAC or XLD log next to them
+	// on each audio scan, reading whole tracks
+	VerifyRips bool `yaml:"verify_rips"`
+}
+
+type JobLogsConfig struct {
+	// MaxAgeDays deletes job logs started longer ago; 0 keeps them regardless of age
+	MaxAgeDays int `yaml:"max_age_days"`
+	// MaxJobs keeps only the newest finished job logs; 0 keeps any number
+	MaxJobs int `yaml:"max_jobs"`
+}
+
+type JobsConfig struct {
+	// Concurrency caps the jobs of a type running at once, out of
+	// scanner.worker_count; types without a cap may use every worker
+	Concurrency map[string]int `yaml:"concurrency"`
+	// Weights share the workers between job types with queued jobs; 1 by default
+	Weights map[string]int `yaml:"weights"`
+	// ReadMBPerSec limits how fast jobs read library files; 0 is unlimited
+	ReadMBPerSec float64 `yaml:"read_mb_per_sec"`
+}
+
+type GCConfig struct {
+	// GraceDays keeps files deleted from disk, with their analysis and
+	// history, this long before purging them
+	GraceDays int `yaml:"grace_days"`
+	// Interval between automatic garbage collections; "0" disables them
+	Interval string `yaml:"interval"`
+}
+
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
@@ -59,15 +114,47 @@ func DefaultConfig() *Config {
 			BatchSize:        100,
 			MaxRetries:       3,
 			RetryBackoffBase: 60,
+			Watch:            true,
+			WatchDebounce:    "10s",
+			WatchMaxDelay:    "2m",
 		},
 		Storage: StorageConfig{
 			ArtifactsPath: "./artifacts/data",
 			TempPath:      "./artifacts/temp",
+			LogsPath:      "./artifacts/logs",
 		},
 		FFmpeg: FFmpegConfig{
 			FFprobePath: "ffprobe",
 			FFmpegPath:  "ffmpeg",
 		},
+		Lookup: LookupConfig{
+			MusicBrainzURL: "https://musicbrainz.org",
+			UserAgent:      "Ottavia/1.0 ( https://github.com/ottavia-music/ottavia )",
+			MinInterval:    "1s",
+		},
+		ReplayGain: ReplayGainConfig{
+			ReferenceLUFS: -18,
+		},
+		AudioScan: AudioScanConfig{
+			VerifyRips: true,
+		},
+		JobLogs: JobLogsConfig{
+			MaxAgeDays: 30,
+			MaxJobs:    10000,
+		},
+		Jobs: JobsConfig{
+			Concurrency: map[string]int{
+				"duplicates": 1,
+				"replaygain": 1,
+			},
+			Weights: map[string]int{
+				"analyze": 2,
+			},
+		},
+		GC: GCConfig{
+			GraceDays: 30,
+			Interval:  "24h",
+		},
 	}
 }
 
@@ -0,0 +1,426 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/analyzer"
+	"github.com/ottavia-music/ottavia/internal/audioscan"
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/events"
+	"github.com/ottavia-music/ottavia/internal/iobudget"
+	"github.com/ottavia-music/ottavia/internal/models"
+	"github.com/ottavia-music/ottavia/internal/policy"
+)
+
+// progressInterval limits how often progress is written to the database
+const progressInterval = time.Second
+
+// JobLogger interface for verbose logging
+type JobLogger interface {
+	Info(jobID, module, message string)
+	Debug(jobID, module, message, details string)
+	Warn(jobID, module, message, details string)
+	Error(jobID, module, message, details string)
+}
+
+// Converter executes conversion jobs with FFmpeg and verifies the outputs
+type Converter struct {
+	db           *database.DB
+	bus          *events.Bus
+	policy       *policy.Policy
+	analyzer     *analyzer.Analyzer
+	audioScanner *audioscan.Scanner
+	ffmpegPath   string
+	logsPath     string
+
+	mu      sync.Mutex
+	active  map[string]context.CancelFunc
+	version string // cached FFmpeg version
+}
+
+// New creates a new converter
+func New(db *database.DB, bus *events.Bus, analyzer *analyzer.Analyzer, audioScanner *audioscan.Scanner, ffmpegPath, logsPath string) *Converter {
+	return &Converter{
+		db:           db,
+		bus:          bus,
+		policy:       policy.New(db),
+		analyzer:     analyzer,
+		audioScanner: audioScanner,
+		ffmpegPath:   ffmpegPath,
+		logsPath:     logsPath,
+		active:       make(map[string]context.CancelFunc),
+	}
+}
+
+// Cancel stops a running conversion job. Returns false if the job is not
+// running in this process.
+func (c *Converter) Cancel(jobID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancel, ok := c.active[jobID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// ResolveSources returns the tracks a conversion source covers; artist
+// names the artist of an album source
+func (c *Converter) ResolveSources(ctx context.Context, sourceType, sourceID, artist string) ([]models.Track, error) {
+	return c.db.ListTracksBySource(ctx, sourceType, sourceID, artist)
+}
+
+// DefaultOutputPath returns the output path of the library the tracks belong to
+func (c *Converter) DefaultOutputPath(ctx context.Context, tracks []models.Track) (string, error) {
+	if len(tracks) == 0 {
+		return "", fmt.Errorf("no tracks to convert")
+	}
+	lib, err := c.db.GetLibrary(ctx, tracks[0].LibraryID)
+	if err != nil {
+		return "", fmt.Errorf("get library: %w", err)
+	}
+	if !lib.OutputPath.Valid || lib.OutputPath.String == "" {
+		return "", fmt.Errorf("library %s has no output path configured", lib.Name)
+	}
+	return lib.OutputPath.String, nil
+}
+
+// Run executes a claimed conversion job and records its final status.
+// The returned error is the reason the job did not succeed.
+func (c *Converter) Run(ctx context.Context, job *models.ConversionJob, logger JobLogger) error {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.active[job.ID] = cancel
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.active, job.ID)
+		c.mu.Unlock()
+		cancel()
+	}()
+
+	jl, err := c.openJobLog(job, logger)
+	if err != nil {
+		log.Warn().Err(err).Str("job_id", job.ID).Msg("Failed to open conversion log file")
+	}
+	defer jl.Close()
+
+	libraryID, err := c.db.GetTargetLibraryID(ctx, job.SourceType, job.SourceID)
+	if err != nil {
+		log.Warn().Err(err).Str("job_id", job.ID).Msg("Failed to resolve conversion library")
+	}
+	var done, total int
+	progress := func(tracksDone, tracksTotal int) {
+		done, total = tracksDone, tracksTotal
+		c.bus.Publish(events.Event{
+			Type:      events.TypeConversion,
+			JobID:     job.ID,
+			LibraryID: libraryID,
+			Data: map[string]interface{}{
+				"status":      job.Status,
+				"progress":    job.Progress,
+				"tracksDone":  tracksDone,
+				"tracksTotal": tracksTotal,
+			},
+		})
+	}
+
+	runErr := c.run(ctx, job, jl, progress)
+
+	// A conversion whose lease was lost has been requeued, and may be
+	// running again elsewhere; its status is no longer this run's to set
+	if errors.Is(context.Cause(ctx), database.ErrLeaseLost) {
+		jl.Warn("Conversion stopped", "lease lost: the job was recovered or cancelled elsewhere")
+		return database.ErrLeaseLost
+	}
+
+	job.FinishedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	switch {
+	case runErr == nil:
+		job.Status = models.StatusSuccess
+		job.Progress = 100
+		jl.Info("Conversion complete")
+	case errors.Is(runErr, context.Canceled):
+		job.Status = models.StatusCancelled
+		job.ErrorMsg = sql.NullString{String: "Cancelled", Valid: true}
+		jl.Warn("Conversion cancelled", "")
+	default:
+		job.Status = models.StatusFailed
+		job.ErrorMsg = sql.NullString{String: runErr.Error(), Valid: true}
+		jl.Error("Conversion failed", runErr.Error())
+	}
+
+	// Use a fresh context so the final status is saved even after cancellation
+	if err := c.db.UpdateConversionJob(context.Background(), job); err != nil {
+		log.Error().Err(err).Str("job_id", job.ID).Msg("Failed to update conversion job")
+	}
+	progress(done, total)
+	return runErr
+}
+
+// run converts the job's tracks, calling progress with the number of tracks
+// done whenever job.Progress changes
+func (c *Converter) run(ctx context.Context, job *models.ConversionJob, jl *jobLog, progress func(done, total int)) error {
+	profile, err := c.db.GetConversionProfile(ctx, job.Profile)
+	if err != nil {
+		return fmt.Errorf("get profile %s: %w", job.Profile, err)
+	}
+	if err := ValidateProfile(profile); err != nil {
+		return fmt.Errorf("invalid profile %s: %w", profile.ID, err)
+	}
+
+	tracks, err := c.ResolveSources(ctx, job.SourceType, job.SourceID, job.SourceArtist)
+	if err != nil {
+		return fmt.Errorf("resolve %s %s: %w", job.SourceType, job.SourceID, err)
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("no tracks found for %s %s", job.SourceType, job.SourceID)
+	}
+	if job.OutputPath == "" {
+		return fmt.Errorf("no output path set")
+	}
+
+	// Library settings may have changed since the job was queued
+	decision, err := c.policy.Output(ctx, job.OutputPath)
+	if err != nil {
+		return fmt.Errorf("check output path: %w", err)
+	}
+	if err := decision.Err(); err != nil {
+		return err
+	}
+
+	jl.Info(fmt.Sprintf("Converting %d track(s) with profile %s (%s) into %s", len(tracks), profile.Name, profile.Codec, job.OutputPath))
+	progress(0, len(tracks))
+
+	// Weight progress by duration so long tracks count for more
+	var totalDur float64
+	for _, t := range tracks {
+		totalDur += t.Duration
+	}
+
+	roots := make(map[string]string)
+	taken := make(map[string]bool)
+	var doneDur float64
+	lastUpdate := time.Time{}
+	failed := 0
+
+	for i := range tracks {
+		track := &tracks[i]
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		root, ok := roots[track.LibraryID]
+		if !ok {
+			if lib, err := c.db.GetLibrary(ctx, track.LibraryID); err == nil {
+				root = lib.RootPath
+			}
+			roots[track.LibraryID] = root
+		}
+
+		output, err := outputPathFor(job.OutputPath, root, track.Path, profile.Codec)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(track.Path)
+		if track.FromCue() {
+			output = cueOutputPath(output, track)
+			name = fmt.Sprintf("%s (cue track %d)", name, track.CueIndex)
+		}
+		// Sources differing only by extension, or at the same place in two
+		// libraries, would otherwise overwrite each other's output
+		if unique := dedupeOutput(output, taken); unique != output {
+			jl.Warn("Output name already used by another track of the job", fmt.Sprintf("%s written as %s", output, unique))
+			output = unique
+		}
+
+		jl.Info(fmt.Sprintf("[%d/%d] %s", i+1, len(tracks), name))
+
+		prov := c.newProvenance(ctx, job, profile, track, output)
+		tags := provenanceTags(prov, profile.Codec)
+		if track.FromCue() {
+			cueTags := cueTrackTags(track)
+			for k, v := range tags {
+				cueTags[k] = v
+			}
+			tags = cueTags
+		}
+
+		start, duration := track.Span()
+		err = c.convertFile(ctx, profile, track.Path, start, duration, track.FileDuration, output, tags, jl, func(pos time.Duration) {
+			if time.Since(lastUpdate) < progressInterval {
+				return
+			}
+			lastUpdate = time.Now()
+			cur := pos.Seconds()
+			if cur > track.Duration {
+				cur = track.Duration
+			}
+			job.Progress = overallProgress(i, len(tracks), doneDur+cur, totalDur)
+			if err := c.db.UpdateConversionJob(ctx, job); err != nil {
+				log.Warn().Err(err).Str("job_id", job.ID).Msg("Failed to update conversion progress")
+			}
+			progress(i, len(tracks))
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failed++
+			jl.Error("Track conversion failed", fmt.Sprintf("%s: %v", track.Path, err))
+		} else {
+			jl.Debug("Wrote output", output)
+			if err := c.recordProvenance(ctx, prov); err != nil {
+				jl.Warn("Failed to record provenance", err.Error())
+			} else if err := c.verifyOutput(ctx, job, profile, track, prov, jl); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				failed++
+				jl.Error("Output verification failed", fmt.Sprintf("%s: %v", output, err))
+			}
+		}
+
+		doneDur += track.Duration
+		job.Progress = overallProgress(i+1, len(tracks), doneDur, totalDur)
+		if err := c.db.UpdateConversionJob(ctx, job); err != nil {
+			log.Warn().Err(err).Str("job_id", job.ID).Msg("Failed to update conversion progress")
+		}
+		progress(i+1, len(tracks))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tracks failed to convert or verify", failed, len(tracks))
+	}
+	return nil
+}
+
+// convertFile runs FFmpeg for one file, or the range of it a cue track
+// plays, writing to a temp file beside the output and renaming it into place
+// on success
+func (c *Converter) convertFile(ctx context.Context, profile *models.ConversionProfile, input string, start, duration, fileDuration float64, output string, tags map[string]string, jl *jobLog, onProgress func(time.Duration)) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return fmt.Errorf("create output dir: %w", err)
+	}
+
+	ext := filepath.Ext(output)
+	tmpPath := strings.TrimSuffix(output, ext) + ".ottavia-tmp" + ext
+
+	args, err := buildArgs(profile, input, start, duration, tmpPath, tags)
+	if err != nil {
+		return err
+	}
+	jl.Debug("FFmpeg command", c.ffmpegPath+" "+strings.Join(args, " "))
+
+	if err := iobudget.Global().WaitRange(ctx, input, duration, fileDuration); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, c.ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	parseProgress(stdout, onProgress)
+	waitErr := cmd.Wait()
+	jl.Output(stderr.String())
+
+	if waitErr != nil {
+		os.Remove(tmpPath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg: %w: %s", waitErr, lastLine(stderr.String()))
+	}
+
+	if err := os.Rename(tmpPath, output); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("rename output: %w", err)
+	}
+	return nil
+}
+
+// outputPathFor mirrors the source's path relative to its library root under
+// outputRoot, swapping the extension for the profile codec's
+func outputPathFor(outputRoot, libraryRoot, source, codec string) (string, error) {
+	spec, err := lookupCodec(codec)
+	if err != nil {
+		return "", err
+	}
+
+	rel := filepath.Base(source)
+	if libraryRoot != "" {
+		if r, err := filepath.Rel(libraryRoot, source); err == nil && !strings.HasPrefix(r, "..") {
+			rel = r
+		}
+	}
+	rel = strings.TrimSuffix(rel, filepath.Ext(rel)) + spec.Extension
+	return filepath.Join(outputRoot, rel), nil
+}
+
+// dedupeOutput returns output, or if another track of the job already
+// writes to it the first free "name (n).ext", and marks the result taken.
+// Paths are compared ignoring case, as output drives often do.
+func dedupeOutput(output string, taken map[string]bool) string {
+	ext := filepath.Ext(output)
+	base := strings.TrimSuffix(output, ext)
+	unique := output
+	for n := 2; taken[strings.ToLower(unique)]; n++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	taken[strings.ToLower(unique)] = true
+	return unique
+}
+
+// cueOutputPath names the output of a track split from an album image after
+// its number and title, in a directory named after the image, so the tracks
+// of several images in one directory don't collide
+func cueOutputPath(imageOutput string, track *models.Track) string {
+	ext := filepath.Ext(imageOutput)
+	dir := strings.TrimSuffix(imageOutput, ext)
+
+	name := fmt.Sprintf("%02d", track.CueIndex)
+	if title := strings.TrimSpace(track.Title.String); title != "" {
+		title = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`/\:*?"<>|`, r) || r < 0x20 {
+				return '_'
+			}
+			return r
+		}, title)
+		name += " - " + strings.TrimRight(title, ". ")
+	}
+	return filepath.Join(dir, name+ext)
+}
+
+// overallProgress returns percent complete, by duration when known
+func overallProgress(doneFiles, totalFiles int, doneDur, totalDur float64) float64 {
+	if totalDur > 0 {
+		return doneDur / totalDur * 100
+	}
+	if totalFiles > 0 {
+		return float64(doneFiles) / float64(totalFiles) * 100
+	}
+	return 0
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
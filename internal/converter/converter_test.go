@@ -0,0 +1,76 @@
+package converter
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+func TestOutputPathFor(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		root   string
+		source string
+		codec  string
+		want   string
+	}{
+		{"mirrors the library layout", "/music", "/music/Artist/Album/01 Song.flac", "mp3", "/out/Artist/Album/01 Song.mp3"},
+		{"root with a trailing slash", "/music/", "/music/Artist/01.flac", "ALAC", "/out/Artist/01.m4a"},
+		{"no library root", "", "/music/Artist/01.flac", "opus", "/out/01.opus"},
+		{"source outside the root", "/music", "/elsewhere/Artist/01.wav", "flac", "/out/01.flac"},
+		{"root that is only a prefix", "/music", "/musicals/01.flac", "mp3", "/out/01.mp3"},
+		{"no extension", "/music", "/music/Artist/track", "aac", "/out/Artist/track.m4a"},
+	} {
+		got, err := outputPathFor("/out", tc.root, tc.source, tc.codec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != filepath.FromSlash(tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := outputPathFor("/out", "/music", "/music/a.flac", "wma"); err == nil {
+		t.Errorf("unsupported codec accepted")
+	}
+}
+
+func TestDedupeOutput(t *testing.T) {
+	taken := make(map[string]bool)
+	for _, tc := range []struct {
+		output string
+		want   string
+	}{
+		{"/out/Song.mp3", "/out/Song.mp3"},
+		// Song.flac and Song.wav both convert to Song.mp3
+		{"/out/Song.mp3", "/out/Song (2).mp3"},
+		{"/out/song.MP3", "/out/song (3).MP3"},
+		{"/out/Other.mp3", "/out/Other.mp3"},
+		// A source named like a renamed output moves on to the next free name
+		{"/out/Song (2).mp3", "/out/Song (2) (2).mp3"},
+	} {
+		if got := dedupeOutput(tc.output, taken); got != tc.want {
+			t.Errorf("dedupeOutput(%q) = %q, want %q", tc.output, got, tc.want)
+		}
+	}
+}
+
+func TestCueOutputPath(t *testing.T) {
+	for _, tc := range []struct {
+		title string
+		want  string
+	}{
+		{"So What", "/out/Album/03 - So What.flac"},
+		{"", "/out/Album/03.flac"},
+		{`AC/DC: "Live"?`, "/out/Album/03 - AC_DC_ _Live__.flac"},
+		{"Trailing dots...", "/out/Album/03 - Trailing dots.flac"},
+	} {
+		track := &models.Track{CueIndex: 3, Title: sql.NullString{String: tc.title, Valid: tc.title != ""}}
+		if got := cueOutputPath("/out/Album.flac", track); got != tc.want {
+			t.Errorf("title %q: got %q, want %q", tc.title, got, tc.want)
+		}
+	}
+}
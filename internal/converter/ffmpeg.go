@@ -0,0 +1,241 @@
+package converter
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ottavia-music/ottavia/internal/audioscan"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// codecSpec describes how a profile codec maps onto FFmpeg
+type codecSpec struct {
+	Encoder   string // FFmpeg audio encoder
+	Format    string // FFmpeg muxer
+	Extension string
+	Lossless  bool
+	CoverArt  bool // container can carry an attached picture
+	// ProvenanceKey is the tag the provenance record is embedded under. The ipod
+	// muxer only writes iTunes atoms it knows, so MP4 uses the description atom;
+	// WAV INFO chunks have no free-form field and carry no provenance tag.
+	ProvenanceKey string
+}
+
+var codecSpecs = map[string]codecSpec{
+	"alac": {Encoder: "alac", Format: "ipod", Extension: ".m4a", Lossless: true, CoverArt: true, ProvenanceKey: "description"},
+	"flac": {Encoder: "flac", Format: "flac", Extension: ".flac", Lossless: true, CoverArt: true, ProvenanceKey: provenanceTag},
+	"wav":  {Encoder: "pcm_s16le", Format: "wav", Extension: ".wav", Lossless: true},
+	"aac":  {Encoder: "aac", Format: "ipod", Extension: ".m4a", CoverArt: true, ProvenanceKey: "description"},
+	"mp3":  {Encoder: "libmp3lame", Format: "mp3", Extension: ".mp3", CoverArt: true, ProvenanceKey: provenanceTag},
+	"opus": {Encoder: "libopus", Format: "opus", Extension: ".opus", ProvenanceKey: provenanceTag},
+}
+
+// lookupCodec returns the FFmpeg mapping for a profile codec
+func lookupCodec(codec string) (codecSpec, error) {
+	spec, ok := codecSpecs[strings.ToLower(codec)]
+	if !ok {
+		return codecSpec{}, fmt.Errorf("unsupported codec: %s", codec)
+	}
+	return spec, nil
+}
+
+// sampleFormat returns the encoder sample format for a bit depth, or "" to let
+// FFmpeg choose
+func sampleFormat(codec string, bitDepth int) string {
+	switch strings.ToLower(codec) {
+	case "alac":
+		switch {
+		case bitDepth == 16:
+			return "s16p"
+		case bitDepth > 16:
+			return "s32p"
+		}
+	case "flac":
+		switch {
+		case bitDepth == 16:
+			return "s16"
+		case bitDepth > 16:
+			return "s32"
+		}
+	case "wav":
+		switch {
+		case bitDepth == 16:
+			return "s16"
+		case bitDepth > 16:
+			return "s32"
+		}
+	}
+	return ""
+}
+
+// resampleFilter returns the aresample filter applying the profile's
+// resampler and dither options, or "" if the defaults apply. The output
+// sample format is set in the filter so dithering happens on bit depth
+// reduction rather than in the encoder's implicit conversion.
+func resampleFilter(profile *models.ConversionProfile) string {
+	opts := profile.Options
+	if opts.Resampler == "" && opts.Dither == "" {
+		return ""
+	}
+
+	var params []string
+	if profile.SampleRate > 0 {
+		params = append(params, "osr="+strconv.Itoa(profile.SampleRate))
+	}
+	if sf := sampleFormat(profile.Codec, profile.BitDepth); sf != "" {
+		params = append(params, "osf="+sf)
+	}
+	if opts.Resampler != "" {
+		params = append(params, "resampler="+opts.Resampler)
+	}
+	if opts.Resampler == ResamplerSoxr && opts.SoxrPrecision > 0 {
+		params = append(params, "precision="+strconv.Itoa(opts.SoxrPrecision))
+	}
+	if opts.Dither != "" {
+		params = append(params, "dither_method="+opts.Dither)
+	}
+	return "aresample=" + strings.Join(params, ":")
+}
+
+// buildArgs builds the FFmpeg command line for converting input to output
+// with the given profile, setting any extra metadata tags on top of the
+// source's. Only duration seconds from start are converted, unless duration
+// is zero. Progress is written to stdout in -progress format.
+func buildArgs(profile *models.ConversionProfile, input string, start, duration float64, output string, tags map[string]string) ([]string, error) {
+	spec, err := lookupCodec(profile.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-hide_banner", "-nostdin", "-y",
+		"-progress", "pipe:1", "-nostats",
+	}
+	args = append(args, audioscan.InputArgs(input, start, duration)...)
+	args = append(args, "-map", "0:a:0")
+	if spec.CoverArt {
+		args = append(args, "-map", "0:v?", "-c:v", "copy", "-disposition:v", "attached_pic")
+	}
+	args = append(args, "-map_metadata", "0")
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-metadata", k+"="+tags[k])
+	}
+
+	encoder := spec.Encoder
+	if strings.ToLower(profile.Codec) == "wav" {
+		switch {
+		case profile.BitDepth == 24:
+			encoder = "pcm_s24le"
+		case profile.BitDepth == 32:
+			encoder = "pcm_s32le"
+		}
+	}
+	if af := resampleFilter(profile); af != "" {
+		args = append(args, "-af", af)
+	}
+	args = append(args, "-c:a", encoder)
+
+	codec := strings.ToLower(profile.Codec)
+	opts := profile.Options
+	if spec.Lossless {
+		if sf := sampleFormat(profile.Codec, profile.BitDepth); sf != "" && codec != "wav" {
+			args = append(args, "-sample_fmt", sf)
+		}
+		if (codec == "flac" || codec == "alac") && profile.BitDepth == 24 {
+			args = append(args, "-bits_per_raw_sample", "24")
+		}
+		if codec == "flac" && opts.CompressionLevel != nil {
+			args = append(args, "-compression_level", strconv.Itoa(*opts.CompressionLevel))
+		}
+	}
+	if profile.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(profile.SampleRate))
+	}
+	if !spec.Lossless {
+		switch {
+		case codec == "mp3" && opts.BitrateMode == BitrateVBR && opts.VBRQuality != nil:
+			args = append(args, "-q:a", strconv.Itoa(*opts.VBRQuality))
+		case profile.Bitrate > 0:
+			args = append(args, "-b:a", strconv.Itoa(profile.Bitrate))
+		}
+		if codec == "opus" {
+			vbr := "on"
+			if opts.BitrateMode == BitrateCBR {
+				vbr = "off"
+			}
+			args = append(args, "-vbr", vbr)
+		}
+	}
+
+	args = append(args, "-f", spec.Format, output)
+	return args, nil
+}
+
+// cueTrackTags returns the tags of a track split from a cue sheet, which
+// replace those of the album image it is cut from. Empty values remove the
+// image's embedded sheet and its whole-file gains.
+func cueTrackTags(track *models.Track) map[string]string {
+	tags := map[string]string{
+		"title":                 track.Title.String,
+		"track":                 strconv.Itoa(track.CueIndex),
+		"cuesheet":              "",
+		"replaygain_track_gain": "",
+		"replaygain_track_peak": "",
+	}
+	if track.TrackNumber.Valid {
+		tags["track"] = strconv.Itoa(int(track.TrackNumber.Int32))
+	}
+	if track.TotalTracks.Valid {
+		tags["track"] += "/" + strconv.Itoa(int(track.TotalTracks.Int32))
+	}
+	for key, v := range map[string]sql.NullString{
+		"artist":       track.Artist,
+		"album":        track.Album,
+		"album_artist": track.AlbumArtist,
+		"genre":        track.Genre,
+		"composer":     track.Composer,
+		"isrc":         track.ISRC,
+	} {
+		if v.Valid {
+			tags[key] = v.String
+		}
+	}
+	if track.DiscNumber.Valid {
+		tags["disc"] = strconv.Itoa(int(track.DiscNumber.Int32))
+	}
+	if track.Year.Valid {
+		tags["date"] = strconv.Itoa(int(track.Year.Int32))
+	}
+	return tags
+}
+
+// parseProgress reads FFmpeg -progress key=value output and reports the
+// encoded position as it advances
+func parseProgress(r io.Reader, fn func(outTime time.Duration)) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// Both keys are reported in microseconds
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				fn(time.Duration(us) * time.Microsecond)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// hasArgs reports whether want appears in args as consecutive arguments
+func hasArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		match := true
+		for j, w := range want {
+			if args[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func intPtr(n int) *int { return &n }
+
+func TestBuildArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		profile models.ConversionProfile
+		start   float64
+		dur     float64
+		want    [][]string
+		notWant [][]string
+	}{
+		{
+			name:    "flac 24-bit",
+			profile: models.ConversionProfile{Codec: "flac", SampleRate: 96000, BitDepth: 24, Options: models.ProfileOptions{CompressionLevel: intPtr(8)}},
+			want: [][]string{
+				{"-i", "in.wav", "-map", "0:a:0", "-map", "0:v?", "-c:v", "copy"},
+				{"-c:a", "flac", "-sample_fmt", "s32", "-bits_per_raw_sample", "24", "-compression_level", "8", "-ar", "96000"},
+				{"-f", "flac", "out.flac"},
+			},
+			notWant: [][]string{{"-ss"}, {"-t"}, {"-af"}},
+		},
+		{
+			name:    "wav 24-bit picks the encoder rather than a sample format",
+			profile: models.ConversionProfile{Codec: "WAV", BitDepth: 24},
+			want:    [][]string{{"-c:a", "pcm_s24le"}, {"-f", "wav"}},
+			notWant: [][]string{{"-sample_fmt"}, {"0:v?"}},
+		},
+		{
+			name:    "mp3 VBR",
+			profile: models.ConversionProfile{Codec: "mp3", Bitrate: 320000, Options: models.ProfileOptions{BitrateMode: BitrateVBR, VBRQuality: intPtr(0)}},
+			want:    [][]string{{"-c:a", "libmp3lame", "-q:a", "0"}},
+			notWant: [][]string{{"-b:a"}, {"-sample_fmt"}},
+		},
+		{
+			name:    "mp3 CBR",
+			profile: models.ConversionProfile{Codec: "mp3", Bitrate: 320000, Options: models.ProfileOptions{BitrateMode: BitrateCBR}},
+			want:    [][]string{{"-b:a", "320000"}},
+			notWant: [][]string{{"-q:a"}},
+		},
+		{
+			name:    "opus CBR",
+			profile: models.ConversionProfile{Codec: "opus", Bitrate: 128000, Options: models.ProfileOptions{BitrateMode: BitrateCBR}},
+			want:    [][]string{{"-b:a", "128000", "-vbr", "off"}, {"-f", "opus"}},
+			notWant: [][]string{{"0:v?"}},
+		},
+		{
+			name: "soxr with dither",
+			profile: models.ConversionProfile{Codec: "flac", SampleRate: 48000, BitDepth: 16, Options: models.ProfileOptions{
+				Resampler: ResamplerSoxr, SoxrPrecision: 28, Dither: "triangular",
+			}},
+			want: [][]string{{"-af", "aresample=osr=48000:osf=s16:resampler=soxr:precision=28:dither_method=triangular", "-c:a", "flac"}},
+		},
+		{
+			name:    "cue track range",
+			profile: models.ConversionProfile{Codec: "aac", Bitrate: 256000},
+			start:   30,
+			dur:     200.5,
+			want:    [][]string{{"-ss", "30.000000", "-i", "in.wav", "-t", "200.500000"}, {"-f", "ipod"}},
+		},
+	} {
+		args, err := buildArgs(&tc.profile, "in.wav", tc.start, tc.dur, "out.flac", map[string]string{"b": "2", "a": "1"})
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !hasArgs(args, "-hide_banner", "-nostdin", "-y") || !hasArgs(args, "-metadata", "a=1", "-metadata", "b=2") {
+			t.Errorf("%s: common arguments missing: %v", tc.name, args)
+		}
+		for _, w := range tc.want {
+			if !hasArgs(args, w...) {
+				t.Errorf("%s: %v missing from %v", tc.name, w, args)
+			}
+		}
+		for _, w := range tc.notWant {
+			if hasArgs(args, w...) {
+				t.Errorf("%s: unexpected %v in %v", tc.name, w, args)
+			}
+		}
+	}
+
+	if _, err := buildArgs(&models.ConversionProfile{Codec: "wma"}, "in.wav", 0, 0, "out", nil); err == nil {
+		t.Errorf("unsupported codec accepted")
+	}
+}
+
+func TestParseProgress(t *testing.T) {
+	progress := `frame=0
+out_time_us=1500000
+out_time_ms=2500000
+out_time=00:00:02.500000
+out_time_us=N/A
+  out_time_us=3000000
+progress=continue
+out_time_us=-1
+progress=end
+`
+	var got []time.Duration
+	parseProgress(strings.NewReader(progress), func(d time.Duration) { got = append(got, d) })
+
+	want := []time.Duration{1500 * time.Millisecond, 2500 * time.Millisecond, 3 * time.Second}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+}
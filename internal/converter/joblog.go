@@ -0,0 +1,106 @@
+package converter
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// jobLog writes conversion log lines to the per-job log file and mirrors them
+// to the job logger. Both sinks are optional.
+type jobLog struct {
+	jobID  string
+	file   *os.File
+	logger JobLogger
+}
+
+// LogFilePath returns the log file location for a conversion job
+func (c *Converter) LogFilePath(jobID string) string {
+	return filepath.Join(c.logsPath, "conversions", jobID+".log")
+}
+
+// openJobLog creates the job's log file and records its path on the job
+func (c *Converter) openJobLog(job *models.ConversionJob, logger JobLogger) (*jobLog, error) {
+	jl := &jobLog{jobID: job.ID, logger: logger}
+	if c.logsPath == "" {
+		return jl, nil
+	}
+
+	path := c.LogFilePath(job.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return jl, fmt.Errorf("create log dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return jl, fmt.Errorf("open log file: %w", err)
+	}
+	jl.file = f
+	job.LogsPath = sql.NullString{String: path, Valid: true}
+	return jl, nil
+}
+
+func (jl *jobLog) write(level, message, details string) {
+	if jl.file == nil {
+		return
+	}
+	line := fmt.Sprintf("%s [%s] %s", time.Now().Format(time.RFC3339), level, message)
+	if details != "" {
+		line += ": " + details
+	}
+	if _, err := jl.file.WriteString(line + "\n"); err != nil {
+		log.Warn().Err(err).Str("job_id", jl.jobID).Msg("Failed to write conversion log")
+	}
+}
+
+func (jl *jobLog) Info(message string) {
+	jl.write("INFO", message, "")
+	if jl.logger != nil {
+		jl.logger.Info(jl.jobID, "convert", message)
+	}
+}
+
+func (jl *jobLog) Debug(message, details string) {
+	jl.write("DEBUG", message, details)
+	if jl.logger != nil {
+		jl.logger.Debug(jl.jobID, "convert", message, details)
+	}
+}
+
+func (jl *jobLog) Warn(message, details string) {
+	jl.write("WARN", message, details)
+	if jl.logger != nil {
+		jl.logger.Warn(jl.jobID, "convert", message, details)
+	}
+}
+
+func (jl *jobLog) Error(message, details string) {
+	jl.write("ERROR", message, details)
+	if jl.logger != nil {
+		jl.logger.Error(jl.jobID, "convert", message, details)
+	}
+}
+
+// Output appends raw FFmpeg stderr to the log file only
+func (jl *jobLog) Output(text string) {
+	text = strings.TrimSpace(text)
+	if jl.file == nil || text == "" {
+		return
+	}
+	for _, line := range strings.Split(text, "\n") {
+		jl.file.WriteString("    " + line + "\n")
+	}
+}
+
+func (jl *jobLog) Close() error {
+	if jl.file == nil {
+		return nil
+	}
+	return jl.file.Close()
+}
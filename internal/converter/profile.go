@@ -0,0 +1,147 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// Bitrate modes for lossy profiles
+const (
+	BitrateCBR = "cbr"
+	BitrateVBR = "vbr"
+)
+
+// Resampler engines
+const (
+	ResamplerSWR  = "swr"
+	ResamplerSoxr = "soxr"
+)
+
+// Supported output sample rates; 0 keeps the source rate
+var (
+	standardSampleRates = map[int]bool{44100: true, 48000: true, 88200: true, 96000: true, 176400: true, 192000: true}
+	// libopus only encodes at these rates
+	opusSampleRates = map[int]bool{8000: true, 12000: true, 16000: true, 24000: true, 48000: true}
+)
+
+// ditherMethods are the dither_method values FFmpeg's aresample accepts
+var ditherMethods = map[string]bool{
+	"rectangular":         true,
+	"triangular":          true,
+	"triangular_hp":       true,
+	"lipshitz":            true,
+	"shibata":             true,
+	"low_shibata":         true,
+	"high_shibata":        true,
+	"f_weighted":          true,
+	"e_weighted":          true,
+	"modified_e_weighted": true,
+}
+
+// bitrateLimits are the accepted CBR/target bitrates in bits per second
+var bitrateLimits = map[string][2]int{
+	"aac":  {32000, 512000},
+	"mp3":  {32000, 320000},
+	"opus": {6000, 510000},
+}
+
+// ValidateProfile checks that a profile's codec, format and options describe
+// an encode FFmpeg can perform
+func ValidateProfile(p *models.ConversionProfile) error {
+	p.Codec = strings.ToLower(p.Codec)
+	spec, err := lookupCodec(p.Codec)
+	if err != nil {
+		return err
+	}
+	opts := p.Options
+
+	// Sample rate
+	if p.SampleRate != 0 {
+		if p.Codec == "opus" && !opusSampleRates[p.SampleRate] {
+			return fmt.Errorf("opus supports sample rates 8000, 12000, 16000, 24000 and 48000")
+		}
+		if p.Codec != "opus" && !standardSampleRates[p.SampleRate] {
+			return fmt.Errorf("unsupported sample rate: %d", p.SampleRate)
+		}
+	}
+
+	// Bit depth
+	switch {
+	case !spec.Lossless && p.BitDepth != 0:
+		return fmt.Errorf("bit depth does not apply to %s", p.Codec)
+	case p.Codec == "wav" && p.BitDepth != 0 && p.BitDepth != 16 && p.BitDepth != 24 && p.BitDepth != 32:
+		return fmt.Errorf("wav bit depth must be 16, 24 or 32")
+	case p.Codec != "wav" && p.BitDepth != 0 && p.BitDepth != 16 && p.BitDepth != 24:
+		return fmt.Errorf("%s bit depth must be 16 or 24", p.Codec)
+	}
+
+	// Rate control
+	if spec.Lossless {
+		if p.Bitrate != 0 || opts.BitrateMode != "" || opts.VBRQuality != nil {
+			return fmt.Errorf("bitrate options do not apply to %s", p.Codec)
+		}
+	} else {
+		switch opts.BitrateMode {
+		case "", BitrateCBR:
+		case BitrateVBR:
+			if p.Codec == "aac" {
+				return fmt.Errorf("aac profiles only support cbr")
+			}
+		default:
+			return fmt.Errorf("bitrateMode must be %s or %s", BitrateCBR, BitrateVBR)
+		}
+
+		if p.Codec == "mp3" && opts.BitrateMode == BitrateVBR {
+			if opts.VBRQuality == nil || *opts.VBRQuality < 0 || *opts.VBRQuality > 9 {
+				return fmt.Errorf("mp3 vbr profiles need vbrQuality 0-9")
+			}
+			if p.Bitrate != 0 {
+				return fmt.Errorf("bitrate does not apply to mp3 vbr profiles")
+			}
+		} else {
+			if opts.VBRQuality != nil {
+				return fmt.Errorf("vbrQuality only applies to mp3 vbr profiles")
+			}
+			limits := bitrateLimits[p.Codec]
+			if p.Bitrate < limits[0] || p.Bitrate > limits[1] {
+				return fmt.Errorf("%s bitrate must be between %d and %d", p.Codec, limits[0], limits[1])
+			}
+		}
+	}
+
+	if opts.CompressionLevel != nil {
+		if p.Codec != "flac" {
+			return fmt.Errorf("compressionLevel only applies to flac")
+		}
+		if *opts.CompressionLevel < 0 || *opts.CompressionLevel > 12 {
+			return fmt.Errorf("flac compressionLevel must be 0-12")
+		}
+	}
+
+	// Resampling and dither
+	switch opts.Resampler {
+	case "", ResamplerSWR:
+		if opts.SoxrPrecision != 0 {
+			return fmt.Errorf("soxrPrecision requires the soxr resampler")
+		}
+	case ResamplerSoxr:
+		if opts.SoxrPrecision != 0 && (opts.SoxrPrecision < 15 || opts.SoxrPrecision > 33) {
+			return fmt.Errorf("soxrPrecision must be 15-33")
+		}
+	default:
+		return fmt.Errorf("resampler must be %s or %s", ResamplerSWR, ResamplerSoxr)
+	}
+
+	if opts.Dither != "" {
+		if !ditherMethods[opts.Dither] {
+			return fmt.Errorf("unsupported dither: %s", opts.Dither)
+		}
+		if p.BitDepth == 0 {
+			return fmt.Errorf("dither requires a target bit depth")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package converter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// provenanceTag is the free-form tag name used for embedded provenance
+const provenanceTag = "OTTAVIA_PROVENANCE"
+
+// provenanceTagValue is the compact record embedded in converted files
+type provenanceTagValue struct {
+	ID          string `json:"id"`
+	Source      string `json:"source"` // source media_file ID
+	Profile     string `json:"profile"`
+	FFmpeg      string `json:"ffmpeg"`
+	ConvertedAt string `json:"convertedAt"` // RFC3339
+}
+
+// ffmpegVersion returns the FFmpeg version string, cached after the first
+// successful lookup
+func (c *Converter) ffmpegVersion(ctx context.Context) string {
+	c.mu.Lock()
+	version := c.version
+	c.mu.Unlock()
+	if version != "" {
+		return version
+	}
+
+	out, err := exec.CommandContext(ctx, c.ffmpegPath, "-version").Output()
+	if err != nil {
+		return "unknown"
+	}
+	// First line: "ffmpeg version 6.1.1 Copyright (c) ..."
+	fields := strings.Fields(strings.SplitN(string(out), "\n", 2)[0])
+	if len(fields) < 3 || fields[1] != "version" {
+		return "unknown"
+	}
+
+	c.mu.Lock()
+	c.version = fields[2]
+	c.mu.Unlock()
+	return fields[2]
+}
+
+// newProvenance prepares the provenance record for one output before it is
+// written, so the record ID can be embedded in the file
+func (c *Converter) newProvenance(ctx context.Context, job *models.ConversionJob, profile *models.ConversionProfile, track *models.Track, output string) *models.Provenance {
+	snapshot, _ := json.Marshal(profile)
+	return &models.Provenance{
+		ID:                uuid.NewString(),
+		ConversionJobID:   job.ID,
+		OutputPath:        output,
+		SourceMediaFileID: track.MediaFileID,
+		SourcePath:        track.Path,
+		ProfileID:         profile.ID,
+		ProfileJSON:       string(snapshot),
+		FFmpegVersion:     c.ffmpegVersion(ctx),
+		VerifyStatus:      models.VerifyPending,
+	}
+}
+
+// provenanceTags returns the metadata tags embedding p for the given codec
+func provenanceTags(p *models.Provenance, codec string) map[string]string {
+	spec, err := lookupCodec(codec)
+	if err != nil || spec.ProvenanceKey == "" {
+		return nil
+	}
+	value, _ := json.Marshal(provenanceTagValue{
+		ID:          p.ID,
+		Source:      p.SourceMediaFileID,
+		Profile:     p.ProfileID,
+		FFmpeg:      p.FFmpegVersion,
+		ConvertedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	return map[string]string{spec.ProvenanceKey: string(value)}
+}
+
+// recordProvenance hashes the finished output and stores the record
+func (c *Converter) recordProvenance(ctx context.Context, p *models.Provenance) error {
+	hash, err := fileSHA256(p.OutputPath)
+	if err != nil {
+		return err
+	}
+	p.OutputSHA256 = hash
+	return c.db.CreateProvenance(ctx, p)
+}
+
+// fileSHA256 streams a file through SHA-256
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
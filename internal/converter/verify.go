@@ -0,0 +1,192 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// Drift tolerances for post-conversion verification
+const (
+	verifyDurationToleranceSec = 0.5
+	verifyLoudnessToleranceLU  = 1.0
+	verifyBandwidthSlackHz     = 500
+	// Lossy encoders apply their own lowpass; only flag outputs duller than this
+	lossyBandwidthFloorHz = 16000
+)
+
+// VerifyCheck is one source vs output comparison
+type VerifyCheck struct {
+	Name    string  `json:"name"`
+	Source  float64 `json:"source"`
+	Output  float64 `json:"output"`
+	Limit   float64 `json:"limit"` // allowed drift, or minimum output for bandwidth
+	Pass    bool    `json:"pass"`
+	Skipped bool    `json:"skipped,omitempty"`
+	Note    string  `json:"note,omitempty"`
+}
+
+// VerifyReport is stored as the provenance record's verify_json
+type VerifyReport struct {
+	OutputTrackID string        `json:"outputTrackId,omitempty"`
+	Checks        []VerifyCheck `json:"checks"`
+}
+
+// verifyOutput re-probes and analyzes a converted file, compares it against
+// its source and records the outcome on the provenance record. Returns an
+// error if the output drifted beyond tolerance or could not be analyzed.
+func (c *Converter) verifyOutput(ctx context.Context, job *models.ConversionJob, profile *models.ConversionProfile, source *models.Track, prov *models.Provenance, jl *jobLog) error {
+	report, err := c.buildVerifyReport(ctx, profile, source, prov)
+
+	prov.VerifyStatus = models.VerifyPass
+	var failed []string
+	if err != nil {
+		prov.VerifyStatus = models.VerifyFail
+		failed = append(failed, err.Error())
+	}
+	for _, check := range report.Checks {
+		if !check.Pass && !check.Skipped {
+			prov.VerifyStatus = models.VerifyFail
+			failed = append(failed, fmt.Sprintf("%s drift (source %.2f, output %.2f, limit %.2f)", check.Name, check.Source, check.Output, check.Limit))
+		}
+	}
+
+	data, _ := json.Marshal(report)
+	prov.VerifyJSON = sql.NullString{String: string(data), Valid: true}
+	if err := c.db.UpdateProvenanceVerification(ctx, prov); err != nil {
+		jl.Warn("Failed to save verification result", err.Error())
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("verification failed: %s", strings.Join(failed, "; "))
+	}
+	jl.Debug("Verification passed", prov.OutputPath)
+	return nil
+}
+
+func (c *Converter) buildVerifyReport(ctx context.Context, profile *models.ConversionProfile, source *models.Track, prov *models.Provenance) (*VerifyReport, error) {
+	report := &VerifyReport{}
+
+	mf, err := c.registerOutput(ctx, source, prov.OutputPath)
+	if err != nil {
+		return report, fmt.Errorf("register output: %w", err)
+	}
+	prov.OutputMediaFileID = sql.NullString{String: mf.ID, Valid: true}
+
+	if err := c.analyzer.AnalyzeFile(ctx, mf.ID); err != nil {
+		return report, fmt.Errorf("analyze output: %w", err)
+	}
+	output, err := c.db.GetTrackByMediaFile(ctx, mf.ID)
+	if err != nil {
+		return report, fmt.Errorf("get output track: %w", err)
+	}
+	report.OutputTrackID = output.ID
+
+	// Duration
+	durDrift := math.Abs(output.Duration - source.Duration)
+	report.Checks = append(report.Checks, VerifyCheck{
+		Name:   "duration",
+		Source: source.Duration,
+		Output: output.Duration,
+		Limit:  verifyDurationToleranceSec,
+		Pass:   durDrift <= verifyDurationToleranceSec,
+	})
+
+	// Integrated loudness, analyzing the source first if it never was
+	outResult, _ := c.db.GetAnalysisResult(ctx, output.ID)
+	srcResult, err := c.db.GetAnalysisResult(ctx, source.ID)
+	if err != nil {
+		if err := c.analyzer.AnalyzeFile(ctx, source.MediaFileID); err == nil {
+			srcResult, _ = c.db.GetAnalysisResult(ctx, source.ID)
+		}
+	}
+	loudness := VerifyCheck{Name: "loudness", Limit: verifyLoudnessToleranceLU}
+	if srcResult == nil || outResult == nil || srcResult.IntegratedLoudness == 0 || outResult.IntegratedLoudness == 0 {
+		loudness.Skipped = true
+		loudness.Note = "integrated loudness not measured"
+	} else {
+		loudness.Source = srcResult.IntegratedLoudness
+		loudness.Output = outResult.IntegratedLoudness
+		loudness.Pass = math.Abs(loudness.Output-loudness.Source) <= verifyLoudnessToleranceLU
+	}
+	report.Checks = append(report.Checks, loudness)
+
+	// Bandwidth: the output should keep the source's top end, up to the
+	// target Nyquist (or the lossy floor)
+	bandwidth := VerifyCheck{Name: "bandwidth"}
+	if c.audioScanner == nil {
+		bandwidth.Skipped = true
+		bandwidth.Note = "audio scanner not configured"
+	} else {
+		srcBW, srcErr := c.audioScanner.MeasureBandwidth(ctx, source.Path, source.SampleRate, source.StartOffset, source.Duration, source.FileDuration)
+		outBW, outErr := c.audioScanner.MeasureBandwidth(ctx, prov.OutputPath, output.SampleRate, 0, output.Duration, output.Duration)
+		if srcErr != nil || outErr != nil {
+			bandwidth.Skipped = true
+			bandwidth.Note = "bandwidth measurement failed"
+		} else {
+			expected := float64(srcBW)
+			if nyquist := float64(output.SampleRate) / 2; nyquist > 0 && nyquist < expected {
+				expected = nyquist
+			}
+			if spec, err := lookupCodec(profile.Codec); err == nil && !spec.Lossless && expected > lossyBandwidthFloorHz {
+				expected = lossyBandwidthFloorHz
+			}
+			bandwidth.Source = float64(srcBW)
+			bandwidth.Output = float64(outBW)
+			bandwidth.Limit = math.Max(0, expected-verifyBandwidthSlackHz)
+			bandwidth.Pass = bandwidth.Output >= bandwidth.Limit
+		}
+	}
+	report.Checks = append(report.Checks, bandwidth)
+
+	return report, nil
+}
+
+// registerOutput records a converted file as a media file so it can be
+// analyzed. Outputs belong to the library whose root contains them, else to
+// the one whose output path does, else to the source's library.
+func (c *Converter) registerOutput(ctx context.Context, source *models.Track, path string) (*models.MediaFile, error) {
+	lib, err := c.db.FindLibraryForPath(ctx, path)
+	if err == sql.ErrNoRows {
+		lib, err = c.db.FindLibraryForOutput(ctx, path)
+	}
+	if err == sql.ErrNoRows {
+		lib, err = c.db.GetLibrary(ctx, source.LibraryID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mf, err := c.db.GetMediaFileByPath(ctx, lib.ID, path)
+	if err == nil {
+		mf.Size = info.Size()
+		mf.Mtime = info.ModTime()
+		mf.Status = models.StatusPending
+		mf.QuickHash = sql.NullString{}
+		mf.FullHash = sql.NullString{}
+		mf.PCMHash = sql.NullString{}
+		return mf, c.db.UpdateMediaFile(ctx, mf)
+	}
+
+	mf = &models.MediaFile{
+		LibraryID: lib.ID,
+		Path:      path,
+		Filename:  filepath.Base(path),
+		Extension: strings.ToLower(filepath.Ext(path)),
+		Size:      info.Size(),
+		Mtime:     info.ModTime(),
+	}
+	return mf, c.db.CreateMediaFile(ctx, mf)
+}
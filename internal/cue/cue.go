@@ -0,0 +1,341 @@
+// Package cue parses cue sheets, which split a single-file album image into
+// its tracks, and finds the sheets belonging to audio files
+package cue
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// framesPerSecond is the resolution of cue sheet times, in CD frames
+const framesPerSecond = 75
+
+// Sheet is a parsed cue sheet
+type Sheet struct {
+	Title      string
+	Performer  string
+	Songwriter string
+	Genre      string
+	Date       string
+	Catalog    string
+	DiscNumber int
+	TotalDiscs int
+	Files      []File
+}
+
+// File is an audio file a sheet refers to, with the tracks it holds
+type File struct {
+	Name   string
+	Type   string // WAVE, MP3, AIFF...
+	Tracks []Track
+}
+
+// Track is one track of a sheet
+type Track struct {
+	Number     int
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+	Start      float64 // seconds into its file, from INDEX 01
+}
+
+// Range is the part of an audio file a track plays, in seconds
+type Range struct {
+	Start    float64
+	Duration float64
+}
+
+// Parse reads a cue sheet. Sheets are UTF-8, with or without a BOM, or
+// otherwise taken to be Latin-1, as older rippers wrote them.
+func Parse(data []byte) (*Sheet, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := string(data)
+	if !utf8.Valid(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+
+	sheet := &Sheet{}
+	var file *File
+	var track *Track
+	hasStart := false
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; scanner.Scan(); n++ {
+		fields := splitFields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		arg := func(i int) string {
+			if i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "REM":
+			value := strings.Join(fields[min(2, len(fields)):], " ")
+			switch strings.ToUpper(arg(1)) {
+			case "GENRE":
+				sheet.Genre = value
+			case "DATE":
+				sheet.Date = value
+			case "DISCNUMBER":
+				sheet.DiscNumber, _ = strconv.Atoi(value)
+			case "TOTALDISCS":
+				sheet.TotalDiscs, _ = strconv.Atoi(value)
+			}
+		case "CATALOG":
+			sheet.Catalog = arg(1)
+		case "FILE":
+			if track != nil && !hasStart {
+				return nil, fmt.Errorf("line %d: track %d has no INDEX 01", n, track.Number)
+			}
+			sheet.Files = append(sheet.Files, File{Name: arg(1), Type: strings.ToUpper(arg(2))})
+			file = &sheet.Files[len(sheet.Files)-1]
+			track = nil
+		case "TRACK":
+			if file == nil {
+				return nil, fmt.Errorf("line %d: TRACK before FILE", n)
+			}
+			if track != nil && !hasStart {
+				return nil, fmt.Errorf("line %d: track %d has no INDEX 01", n, track.Number)
+			}
+			num, err := strconv.Atoi(arg(1))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid track number %q", n, arg(1))
+			}
+			file.Tracks = append(file.Tracks, Track{Number: num})
+			track = &file.Tracks[len(file.Tracks)-1]
+			hasStart = false
+		case "INDEX":
+			if track == nil {
+				return nil, fmt.Errorf("line %d: INDEX outside a track", n)
+			}
+			if num, _ := strconv.Atoi(arg(1)); num != 1 {
+				continue // pregaps play at the end of the previous track
+			}
+			start, err := parseTime(arg(2))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			track.Start = start
+			hasStart = true
+		case "TITLE":
+			if track != nil {
+				track.Title = arg(1)
+			} else {
+				sheet.Title = arg(1)
+			}
+		case "PERFORMER":
+			if track != nil {
+				track.Performer = arg(1)
+			} else {
+				sheet.Performer = arg(1)
+			}
+		case "SONGWRITER":
+			if track != nil {
+				track.Songwriter = arg(1)
+			} else {
+				sheet.Songwriter = arg(1)
+			}
+		case "ISRC":
+			if track != nil {
+				track.ISRC = arg(1)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if track != nil && !hasStart {
+		return nil, fmt.Errorf("track %d has no INDEX 01", track.Number)
+	}
+
+	tracks := 0
+	for _, f := range sheet.Files {
+		tracks += len(f.Tracks)
+	}
+	if tracks == 0 {
+		return nil, fmt.Errorf("no tracks")
+	}
+	return sheet, nil
+}
+
+// Load reads and parses the cue sheet at path
+func Load(path string) (*Sheet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sheet, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return sheet, nil
+}
+
+// splitFields splits a line on spaces, keeping quoted values together
+func splitFields(line string) []string {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		var field string
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				field, line = line[1:], ""
+			} else {
+				field, line = line[1:end+1], line[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				field, line = line, ""
+			} else {
+				field, line = line[:end], line[end:]
+			}
+		}
+		fields = append(fields, field)
+		line = strings.TrimLeft(line, " \t")
+	}
+	return fields
+}
+
+// parseTime parses an mm:ss:ff cue time into seconds
+func parseTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		v[i] = n
+	}
+	if v[1] >= 60 || v[2] >= framesPerSecond {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return float64(v[0]*60+v[1]) + float64(v[2])/framesPerSecond, nil
+}
+
+// TracksOf returns the tracks the sheet places in an audio file. Its FILE
+// entry is matched by name, then by name without the extension, as sheets
+// written for a WAV image often go with the file it was compressed to. A
+// sheet with a single FILE entry describes any file, as embedded sheets
+// name the image they were made from.
+func (s *Sheet) TracksOf(audioPath string) []Track {
+	if f := s.fileOf(filepath.Base(audioPath)); f != nil {
+		return f.Tracks
+	}
+	if len(s.Files) == 1 {
+		return s.Files[0].Tracks
+	}
+	return nil
+}
+
+// fileOf returns the FILE entry naming a file, or nil
+func (s *Sheet) fileOf(name string) *File {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	for i := range s.Files {
+		// Sheets written on Windows may use backslashes
+		ref := path.Base(strings.ReplaceAll(s.Files[i].Name, `\`, "/"))
+		if strings.EqualFold(ref, name) {
+			return &s.Files[i]
+		}
+	}
+	for i := range s.Files {
+		ref := path.Base(strings.ReplaceAll(s.Files[i].Name, `\`, "/"))
+		if strings.EqualFold(strings.TrimSuffix(ref, path.Ext(ref)), stem) {
+			return &s.Files[i]
+		}
+	}
+	return nil
+}
+
+// Ranges splits a file of the given duration at the starts of its tracks.
+// Each track runs until the next one starts, keeping the pregap between
+// them, and the last one to the end of the file.
+func Ranges(tracks []Track, fileDuration float64) []Range {
+	ranges := make([]Range, len(tracks))
+	for i, t := range tracks {
+		end := fileDuration
+		if i+1 < len(tracks) {
+			end = tracks[i+1].Start
+		}
+		ranges[i] = Range{Start: t.Start, Duration: max(0, end-t.Start)}
+	}
+	return ranges
+}
+
+// Finder looks up the cue sheets next to audio files, listing each
+// directory once
+type Finder struct {
+	dirs   map[string][]string // cue sheet names, by directory
+	sheets map[string]*Sheet   // parsed sheets, nil for unreadable ones
+}
+
+func NewFinder() *Finder {
+	return &Finder{
+		dirs:   make(map[string][]string),
+		sheets: make(map[string]*Sheet),
+	}
+}
+
+// Find returns the path of the cue sheet describing an audio file, or ""
+// if there is none. A sheet named after the file, like "album.cue" or
+// "album.flac.cue", is preferred; otherwise the sheet in the same
+// directory that names the file in a FILE entry is used.
+func (f *Finder) Find(audioPath string) string {
+	dir, name := filepath.Split(audioPath)
+	names, ok := f.dirs[dir]
+	if !ok {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".cue") {
+				names = append(names, e.Name())
+			}
+		}
+		f.dirs[dir] = names
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, want := range []string{stem + ".cue", name + ".cue"} {
+		for _, n := range names {
+			if strings.EqualFold(n, want) {
+				return filepath.Join(dir, n)
+			}
+		}
+	}
+
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		sheet, ok := f.sheets[p]
+		if !ok {
+			sheet, _ = Load(p)
+			f.sheets[p] = sheet
+		}
+		if sheet != nil && sheet.fileOf(name) != nil {
+			return p
+		}
+	}
+	return ""
+}
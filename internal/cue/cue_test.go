@@ -0,0 +1,184 @@
+package cue
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const albumSheet = `REM GENRE "Jazz"
+REM DATE 1959
+REM DISCNUMBER 1
+REM TOTALDISCS 2
+CATALOG 5099706424027
+PERFORMER "Miles Davis"
+TITLE "Kind of Blue"
+FILE "Kind of Blue.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE "So What"
+    ISRC USSM15900113
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Freddie Freeloader"
+    PERFORMER "Miles Davis Sextet"
+    INDEX 00 09:20:40
+    INDEX 01 09:22:15
+  TRACK 03 AUDIO
+    TITLE "Blue in Green"
+    INDEX 01 19:01:00
+`
+
+func TestParse(t *testing.T) {
+	sheet, err := Parse([]byte("\xef\xbb\xbf" + albumSheet))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if sheet.Title != "Kind of Blue" || sheet.Performer != "Miles Davis" || sheet.Genre != "Jazz" ||
+		sheet.Date != "1959" || sheet.Catalog != "5099706424027" || sheet.DiscNumber != 1 || sheet.TotalDiscs != 2 {
+		t.Errorf("sheet = %+v", sheet)
+	}
+	if len(sheet.Files) != 1 || sheet.Files[0].Name != "Kind of Blue.wav" || sheet.Files[0].Type != "WAVE" {
+		t.Fatalf("files = %+v", sheet.Files)
+	}
+
+	want := []Track{
+		{Number: 1, Title: "So What", ISRC: "USSM15900113", Start: 0},
+		// INDEX 00 marks the pregap, which belongs to the previous track
+		{Number: 2, Title: "Freddie Freeloader", Performer: "Miles Davis Sextet", Start: 9*60 + 22 + 15.0/75},
+		{Number: 3, Title: "Blue in Green", Start: 19*60 + 1},
+	}
+	tracks := sheet.Files[0].Tracks
+	if len(tracks) != len(want) {
+		t.Fatalf("got %d tracks, want %d", len(tracks), len(want))
+	}
+	for i := range want {
+		if tracks[i] != want[i] {
+			t.Errorf("track %d = %+v, want %+v", i+1, tracks[i], want[i])
+		}
+	}
+}
+
+func TestParseLatin1(t *testing.T) {
+	// "Café Müller" in Latin-1, as older rippers wrote it
+	data := []byte("TITLE \"Caf\xe9 M\xfcller\"\nFILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:00:00\n")
+	sheet, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if sheet.Title != "Café Müller" {
+		t.Errorf("Title = %q", sheet.Title)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		sheet string
+		err   string
+	}{
+		{"no tracks", "FILE \"a.wav\" WAVE\n", "no tracks"},
+		{"track before file", "TRACK 01 AUDIO\n  INDEX 01 00:00:00\n", "TRACK before FILE"},
+		{"only a pregap", "FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n    INDEX 00 00:00:00\n", "track 1 has no INDEX 01"},
+		{"missing INDEX 01 before the next track", "FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n  TRACK 02 AUDIO\n    INDEX 01 00:10:00\n", "line 3: track 1 has no INDEX 01"},
+		{"missing INDEX 01 before the next file", "FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\nFILE \"b.wav\" WAVE\n", "line 3: track 1 has no INDEX 01"},
+		{"bad frame", "FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:00:75\n", "invalid time"},
+		{"bad track number", "FILE \"a.wav\" WAVE\n  TRACK one AUDIO\n", "invalid track number"},
+	} {
+		_, err := Parse([]byte(tc.sheet))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		starts   []float64
+		duration float64
+		want     []Range
+	}{
+		{"one track", []float64{0}, 300, []Range{{0, 300}}},
+		{"pregaps stay with the previous track", []float64{0, 120.5, 250}, 400, []Range{{0, 120.5}, {120.5, 129.5}, {250, 150}}},
+		{"hidden track before the first", []float64{30, 200}, 300, []Range{{30, 170}, {200, 100}}},
+		{"file shorter than the sheet", []float64{0, 100}, 90, []Range{{0, 100}, {100, 0}}},
+	} {
+		tracks := make([]Track, len(tc.starts))
+		for i, s := range tc.starts {
+			tracks[i] = Track{Number: i + 1, Start: s}
+		}
+		got := Ranges(tracks, tc.duration)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: got %d ranges, want %d", tc.name, len(got), len(tc.want))
+		}
+		for i := range got {
+			if math.Abs(got[i].Start-tc.want[i].Start) > 1e-9 || math.Abs(got[i].Duration-tc.want[i].Duration) > 1e-9 {
+				t.Errorf("%s: range %d = %+v, want %+v", tc.name, i, got[i], tc.want[i])
+			}
+		}
+	}
+}
+
+func TestTracksOf(t *testing.T) {
+	sheet, err := Parse([]byte(`FILE "C:\Rips\Disc 1.wav" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+FILE "Disc 2.wav" WAVE
+  TRACK 02 AUDIO
+    INDEX 01 00:00:00
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for _, tc := range []struct {
+		path  string
+		track int
+	}{
+		{"/music/Disc 1.wav", 1},
+		{"/music/DISC 2.WAV", 2},
+		{"/music/Disc 1.flac", 1}, // compressed from the WAV the sheet names
+		{"/music/Disc 3.flac", 0},
+	} {
+		tracks := sheet.TracksOf(tc.path)
+		got := 0
+		if len(tracks) == 1 {
+			got = tracks[0].Number
+		}
+		if got != tc.track {
+			t.Errorf("TracksOf(%q) = %+v, want track %d", tc.path, tracks, tc.track)
+		}
+	}
+}
+
+func TestFinder(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"album.flac":     "",
+		"Album.cue":      albumSheet,
+		"single.wav":     "",
+		"sheets.cue":     "FILE \"single.wav\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:00:00\n",
+		"unrelated.flac": "",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := NewFinder()
+	for audio, want := range map[string]string{
+		"album.flac":     "Album.cue",
+		"single.wav":     "sheets.cue",
+		"unrelated.flac": "",
+	} {
+		got := f.Find(filepath.Join(dir, audio))
+		if want != "" {
+			want = filepath.Join(dir, want)
+		}
+		if got != want {
+			t.Errorf("Find(%s) = %q, want %q", audio, got, want)
+		}
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,6 +22,16 @@ import (
 //go:embed migrations/*.sql
 var migrationsFS embed.FS
 
+var (
+	// ErrBuiltinProfile is returned when modifying or deleting a builtin profile
+	ErrBuiltinProfile = errors.New("builtin profiles cannot be modified")
+	// ErrProfileInUse is returned when deleting a profile queued or running jobs use
+	ErrProfileInUse = errors.New("profile is used by queued or running conversions")
+	// ErrLeaseLost is returned renewing the lease on a row that is no longer
+	// running, having been recovered or cancelled
+	ErrLeaseLost = errors.New("lease lost")
+)
+
 type DB struct {
 	*sqlx.DB
 }
@@ -35,18 +49,90 @@ func New(dsn string) (*DB, error) {
 	return &DB{db}, nil
 }
 
+// Migrate applies any migrations/*.sql files not yet recorded in
+// schema_migrations, in filename order
 func (db *DB) Migrate() error {
-	migrations, err := migrationsFS.ReadFile("migrations/001_initial.sql")
+	if err := db.migrate(context.Background()); err != nil {
+		return err
+	}
+	return db.seedDefaults()
+}
+
+func (db *DB) migrate(ctx context.Context) error {
+	// Migrations run on one connection with foreign keys off, so a table
+	// can be rebuilt without its drop cascading to the rows referring to
+	// it. The keys are checked before each migration is committed.
+	conn, err := db.Connx(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to read migrations: %w", err)
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return fmt.Errorf("failed to disable foreign keys: %w", err)
 	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
 
-	_, err = db.Exec(string(migrations))
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			name TEXT PRIMARY KEY,
+			applied_at DATETIME NOT NULL
+		)
+	`)
 	if err != nil {
-		return fmt.Errorf("failed to run migrations: %w", err)
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
 	}
 
-	return db.seedDefaults()
+	entries, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".sql") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var applied int
+		if err := conn.GetContext(ctx, &applied, "SELECT COUNT(*) FROM schema_migrations WHERE name = ?", name); err != nil {
+			return fmt.Errorf("failed to check migration %s: %w", name, err)
+		}
+		if applied > 0 {
+			continue
+		}
+
+		migration, err := migrationsFS.ReadFile("migrations/" + name)
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+
+		tx, err := conn.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(migration)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to run migration %s: %w", name, err)
+		}
+		var violations int
+		if err := tx.Get(&violations, "SELECT COUNT(*) FROM pragma_foreign_key_check"); err != nil || violations > 0 {
+			tx.Rollback()
+			if err == nil {
+				err = fmt.Errorf("%d foreign key violation(s)", violations)
+			}
+			return fmt.Errorf("failed to check migration %s: %w", name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)", name, time.Now()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %w", name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %s: %w", name, err)
+		}
+	}
+	return nil
 }
 
 func (db *DB) seedDefaults() error {
@@ -121,15 +207,20 @@ func (db *DB) seedDefaults() error {
 // Library operations
 
 func (db *DB) CreateLibrary(ctx context.Context, lib *models.Library) error {
+	rules, err := json.Marshal(lib.ScanRules)
+	if err != nil {
+		return err
+	}
 	lib.ID = uuid.NewString()
+	lib.ScanRulesJSON = string(rules)
 	lib.CreatedAt = time.Now()
 	lib.UpdatedAt = time.Now()
 	lib.Status = models.StatusPending
 
-	_, err := db.ExecContext(ctx, `
-		INSERT INTO libraries (id, name, root_path, scan_interval, read_only, output_path, allowed_formats, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, lib.ID, lib.Name, lib.RootPath, lib.ScanInterval, lib.ReadOnly, lib.OutputPath, lib.AllowedFormats, lib.Status, lib.CreatedAt, lib.UpdatedAt)
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO libraries (id, name, root_path, scan_interval, read_only, copy_on_write, output_path, allowed_formats, scan_rules, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, lib.ID, lib.Name, lib.RootPath, lib.ScanInterval, lib.ReadOnly, lib.CopyOnWrite, lib.OutputPath, lib.AllowedFormats, lib.ScanRulesJSON, lib.Status, lib.CreatedAt, lib.UpdatedAt)
 
 	return err
 }
@@ -140,6 +231,9 @@ func (db *DB) GetLibrary(ctx context.Context, id string) (*models.Library, error
 	if err != nil {
 		return nil, err
 	}
+	if err := lib.ParseScanRules(); err != nil {
+		return nil, fmt.Errorf("library %s has invalid scan rules: %w", id, err)
+	}
 	return &lib, nil
 }
 
@@ -151,16 +245,24 @@ func (db *DB) ListLibraries(ctx context.Context) ([]models.Library, error) {
 		FROM libraries l
 		ORDER BY l.name
 	`)
+	for i := range libs {
+		libs[i].ParseScanRules()
+	}
 	return libs, err
 }
 
 func (db *DB) UpdateLibrary(ctx context.Context, lib *models.Library) error {
+	rules, err := json.Marshal(lib.ScanRules)
+	if err != nil {
+		return err
+	}
+	lib.ScanRulesJSON = string(rules)
 	lib.UpdatedAt = time.Now()
-	_, err := db.ExecContext(ctx, `
-		UPDATE libraries SET name = ?, root_path = ?, scan_interval = ?, read_only = ?,
-		output_path = ?, allowed_formats = ?, status = ?, last_scan_at = ?, updated_at = ?
+	_, err = db.ExecContext(ctx, `
+		UPDATE libraries SET name = ?, root_path = ?, scan_interval = ?, read_only = ?, copy_on_write = ?,
+		output_path = ?, allowed_formats = ?, scan_rules = ?, status = ?, last_scan_at = ?, updated_at = ?
 		WHERE id = ?
-	`, lib.Name, lib.RootPath, lib.ScanInterval, lib.ReadOnly, lib.OutputPath, lib.AllowedFormats, lib.Status, lib.LastScanAt, lib.UpdatedAt, lib.ID)
+	`, lib.Name, lib.RootPath, lib.ScanInterval, lib.ReadOnly, lib.CopyOnWrite, lib.OutputPath, lib.AllowedFormats, lib.ScanRulesJSON, lib.Status, lib.LastScanAt, lib.UpdatedAt, lib.ID)
 	return err
 }
 
@@ -178,9 +280,9 @@ func (db *DB) CreateMediaFile(ctx context.Context, mf *models.MediaFile) error {
 	mf.Status = models.StatusPending
 
 	_, err := db.ExecContext(ctx, `
-		INSERT INTO media_files (id, library_id, path, filename, extension, size, mtime, quick_hash, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, mf.ID, mf.LibraryID, mf.Path, mf.Filename, mf.Extension, mf.Size, mf.Mtime, mf.QuickHash, mf.Status, mf.CreatedAt, mf.UpdatedAt)
+		INSERT INTO media_files (id, library_id, path, filename, extension, size, mtime, quick_hash, cue_path, cue_mtime, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, mf.ID, mf.LibraryID, mf.Path, mf.Filename, mf.Extension, mf.Size, mf.Mtime, mf.QuickHash, mf.CuePath, mf.CueMtime, mf.Status, mf.CreatedAt, mf.UpdatedAt)
 
 	return err
 }
@@ -197,9 +299,20 @@ func (db *DB) GetMediaFileByPath(ctx context.Context, libraryID, path string) (*
 func (db *DB) UpdateMediaFile(ctx context.Context, mf *models.MediaFile) error {
 	mf.UpdatedAt = time.Now()
 	_, err := db.ExecContext(ctx, `
-		UPDATE media_files SET size = ?, mtime = ?, quick_hash = ?, full_hash = ?, status = ?, error_msg = ?, updated_at = ?
+		UPDATE media_files SET size = ?, mtime = ?, quick_hash = ?, full_hash = ?, pcm_hash = ?, cue_path = ?, cue_mtime = ?, status = ?, error_msg = ?, updated_at = ?
+		WHERE id = ?
+	`, mf.Size, mf.Mtime, mf.QuickHash, mf.FullHash, mf.PCMHash, mf.CuePath, mf.CueMtime, mf.Status, mf.ErrorMsg, mf.UpdatedAt, mf.ID)
+	return err
+}
+
+// MoveMediaFile records a file's new path, keeping its tracks, analysis and
+// history
+func (db *DB) MoveMediaFile(ctx context.Context, mf *models.MediaFile) error {
+	mf.UpdatedAt = time.Now()
+	_, err := db.ExecContext(ctx, `
+		UPDATE media_files SET path = ?, filename = ?, extension = ?, mtime = ?, quick_hash = ?, cue_path = ?, cue_mtime = ?, updated_at = ?
 		WHERE id = ?
-	`, mf.Size, mf.Mtime, mf.QuickHash, mf.FullHash, mf.Status, mf.ErrorMsg, mf.UpdatedAt, mf.ID)
+	`, mf.Path, mf.Filename, mf.Extension, mf.Mtime, mf.QuickHash, mf.CuePath, mf.CueMtime, mf.UpdatedAt, mf.ID)
 	return err
 }
 
@@ -209,6 +322,27 @@ func (db *DB) ListMediaFiles(ctx context.Context, libraryID string) ([]models.Me
 	return files, err
 }
 
+// ListMediaFilesInDir lists the files of a library directly in dir, or
+// anywhere under it if recursive is set
+func (db *DB) ListMediaFilesInDir(ctx context.Context, libraryID, dir string, recursive bool) ([]models.MediaFile, error) {
+	// Paths under dir sort between "dir/" and "dir0", so the path index
+	// serves the range
+	prefix := strings.TrimSuffix(filepath.Clean(dir), string(filepath.Separator)) + string(filepath.Separator)
+	upper := prefix[:len(prefix)-1] + string(filepath.Separator+1)
+
+	query := "SELECT * FROM media_files WHERE library_id = ? AND path > ? AND path < ?"
+	args := []interface{}{libraryID, prefix, upper}
+	if !recursive {
+		query += " AND instr(substr(path, ?), ?) = 0"
+		args = append(args, len(prefix)+1, string(filepath.Separator))
+	}
+	query += " ORDER BY path"
+
+	var files []models.MediaFile
+	err := db.SelectContext(ctx, &files, query, args...)
+	return files, err
+}
+
 // Track operations
 
 func (db *DB) CreateTrack(ctx context.Context, track *models.Track) error {
@@ -217,20 +351,31 @@ func (db *DB) CreateTrack(ctx context.Context, track *models.Track) error {
 	track.UpdatedAt = time.Now()
 
 	_, err := db.ExecContext(ctx, `
-		INSERT INTO tracks (id, media_file_id, duration, codec, sample_rate, bit_depth, channels, bitrate,
-		title, artist, album, album_artist, track_number, disc_number, year, genre, has_artwork, artwork_width, artwork_height, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, track.ID, track.MediaFileID, track.Duration, track.Codec, track.SampleRate, track.BitDepth, track.Channels, track.Bitrate,
+		INSERT INTO tracks (id, media_file_id, cue_index, start_offset, duration, codec, sample_rate, bit_depth, channels, bitrate,
+		title, artist, album, album_artist, track_number, disc_number, year, genre,
+		composer, comment, label, catalog_number, isrc, total_tracks, total_discs,
+		mb_recording_id, mb_release_track_id, mb_release_id, mb_release_group_id, mb_artist_id, mb_album_artist_id,
+		replaygain_track_gain, replaygain_track_peak, replaygain_album_gain, replaygain_album_peak,
+		has_artwork, artwork_width, artwork_height, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, track.ID, track.MediaFileID, track.CueIndex, track.StartOffset, track.Duration, track.Codec, track.SampleRate, track.BitDepth, track.Channels, track.Bitrate,
 		track.Title, track.Artist, track.Album, track.AlbumArtist, track.TrackNumber, track.DiscNumber, track.Year, track.Genre,
+		track.Composer, track.Comment, track.Label, track.CatalogNumber, track.ISRC, track.TotalTracks, track.TotalDiscs,
+		track.MBRecordingID, track.MBReleaseTrackID, track.MBReleaseID, track.MBReleaseGroupID, track.MBArtistID, track.MBAlbumArtistID,
+		track.ReplayGainTrackGain, track.ReplayGainTrackPeak, track.ReplayGainAlbumGain, track.ReplayGainAlbumPeak,
 		track.HasArtwork, track.ArtworkWidth, track.ArtworkHeight, track.CreatedAt, track.UpdatedAt)
 
 	return err
 }
 
+// fileDurationColumn selects the length of the whole file a track of the
+// query's t is in, the end of its last track
+const fileDurationColumn = `(SELECT MAX(f.start_offset + f.duration) FROM tracks f WHERE f.media_file_id = t.media_file_id) AS file_duration`
+
 func (db *DB) GetTrack(ctx context.Context, id string) (*models.Track, error) {
 	var track models.Track
 	err := db.GetContext(ctx, &track, `
-		SELECT t.*, m.path, m.library_id, l.name as library_name
+		SELECT t.*, m.path, m.library_id, l.name as library_name, `+fileDurationColumn+`
 		FROM tracks t
 		JOIN media_files m ON t.media_file_id = m.id
 		JOIN libraries l ON m.library_id = l.id
@@ -278,24 +423,53 @@ func (db *DB) ListTracks(ctx context.Context, libraryID string, filter string, l
 	return tracks, total, err
 }
 
+// GetTrackByMediaFile returns the track of a media file, or the first of
+// those a cue sheet splits it into
 func (db *DB) GetTrackByMediaFile(ctx context.Context, mediaFileID string) (*models.Track, error) {
 	var track models.Track
-	err := db.GetContext(ctx, &track, "SELECT * FROM tracks WHERE media_file_id = ?", mediaFileID)
+	err := db.GetContext(ctx, &track, "SELECT * FROM tracks WHERE media_file_id = ? ORDER BY cue_index LIMIT 1", mediaFileID)
 	if err != nil {
 		return nil, err
 	}
 	return &track, nil
 }
 
+// ListTracksByMediaFile returns the tracks of a media file in cue order
+func (db *DB) ListTracksByMediaFile(ctx context.Context, mediaFileID string) ([]models.Track, error) {
+	var tracks []models.Track
+	err := db.SelectContext(ctx, &tracks, "SELECT * FROM tracks WHERE media_file_id = ? ORDER BY cue_index", mediaFileID)
+	return tracks, err
+}
+
+// DeleteTracks removes tracks along with their analysis, as when a file is
+// split differently by its cue sheet. Their artifacts are left to GC.
+func (db *DB) DeleteTracks(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM tracks WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+	return err
+}
+
 func (db *DB) UpdateTrack(ctx context.Context, track *models.Track) error {
 	track.UpdatedAt = time.Now()
 	_, err := db.ExecContext(ctx, `
-		UPDATE tracks SET duration = ?, codec = ?, sample_rate = ?, bit_depth = ?, channels = ?, bitrate = ?,
+		UPDATE tracks SET cue_index = ?, start_offset = ?, duration = ?, codec = ?, sample_rate = ?, bit_depth = ?, channels = ?, bitrate = ?,
 		title = ?, artist = ?, album = ?, album_artist = ?, track_number = ?, disc_number = ?, year = ?, genre = ?,
+		composer = ?, comment = ?, label = ?, catalog_number = ?, isrc = ?, total_tracks = ?, total_discs = ?,
+		mb_recording_id = ?, mb_release_track_id = ?, mb_release_id = ?, mb_release_group_id = ?, mb_artist_id = ?, mb_album_artist_id = ?,
+		replaygain_track_gain = ?, replaygain_track_peak = ?, replaygain_album_gain = ?, replaygain_album_peak = ?,
 		has_artwork = ?, artwork_width = ?, artwork_height = ?, updated_at = ?
 		WHERE id = ?
-	`, track.Duration, track.Codec, track.SampleRate, track.BitDepth, track.Channels, track.Bitrate,
+	`, track.CueIndex, track.StartOffset, track.Duration, track.Codec, track.SampleRate, track.BitDepth, track.Channels, track.Bitrate,
 		track.Title, track.Artist, track.Album, track.AlbumArtist, track.TrackNumber, track.DiscNumber, track.Year, track.Genre,
+		track.Composer, track.Comment, track.Label, track.CatalogNumber, track.ISRC, track.TotalTracks, track.TotalDiscs,
+		track.MBRecordingID, track.MBReleaseTrackID, track.MBReleaseID, track.MBReleaseGroupID, track.MBArtistID, track.MBAlbumArtistID,
+		track.ReplayGainTrackGain, track.ReplayGainTrackPeak, track.ReplayGainAlbumGain, track.ReplayGainAlbumPeak,
 		track.HasArtwork, track.ArtworkWidth, track.ArtworkHeight, track.UpdatedAt, track.ID)
 	return err
 }
@@ -308,6 +482,72 @@ func (db *DB) UpdateTrackArtworkStatus(ctx context.Context, trackID string, hasA
 	return err
 }
 
+// Track tag operations
+
+// ReplaceTrackTags replaces all raw tags of a track
+func (db *DB) ReplaceTrackTags(ctx context.Context, trackID string, tags []models.TrackTag) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM track_tags WHERE track_id = ?`, trackID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO track_tags (track_id, key, position, value) VALUES (?, ?, ?, ?)
+		`, trackID, tag.Key, tag.Position, tag.Value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) ListTrackTags(ctx context.Context, trackID string) ([]models.TrackTag, error) {
+	var tags []models.TrackTag
+	err := db.SelectContext(ctx, &tags, `
+		SELECT * FROM track_tags WHERE track_id = ? ORDER BY key COLLATE NOCASE, position
+	`, trackID)
+	return tags, err
+}
+
+// SetTrackTagValues replaces the values of one raw tag, matching the key
+// case-insensitively and keeping the spelling already stored. No values
+// removes the tag.
+func (db *DB) SetTrackTagValues(ctx context.Context, trackID, key string, values []string) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing string
+	err = tx.GetContext(ctx, &existing, `
+		SELECT key FROM track_tags WHERE track_id = ? AND key = ? COLLATE NOCASE LIMIT 1
+	`, trackID, key)
+	if err == nil {
+		key = existing
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM track_tags WHERE track_id = ? AND key = ? COLLATE NOCASE
+	`, trackID, key); err != nil {
+		return err
+	}
+	for i, v := range values {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO track_tags (track_id, key, position, value) VALUES (?, ?, ?, ?)
+		`, trackID, key, i, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // AnalysisResult operations
 
 func (db *DB) CreateAnalysisResult(ctx context.Context, result *models.AnalysisResult) error {
@@ -340,6 +580,15 @@ func (db *DB) GetAnalysisResult(ctx context.Context, trackID string) (*models.An
 	return &result, nil
 }
 
+// UpdateAnalysisIssues saves the issues and stats of an analysis result,
+// as when a later check adds to them
+func (db *DB) UpdateAnalysisIssues(ctx context.Context, result *models.AnalysisResult) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE analysis_results SET issues_json = ?, stats_json = ? WHERE id = ?
+	`, result.IssuesJSON, result.StatsJSON, result.ID)
+	return err
+}
+
 // Artifact operations
 
 func (db *DB) CreateArtifact(ctx context.Context, artifact *models.Artifact) error {
@@ -375,7 +624,9 @@ func (db *DB) CreateJob(ctx context.Context, job *models.Job) error {
 	return err
 }
 
-func (db *DB) GetNextJob(ctx context.Context, jobType string) (*models.Job, error) {
+// GetNextJob claims the next due job of a type, leasing it for lease. The
+// worker must renew the lease while the job runs.
+func (db *DB) GetNextJob(ctx context.Context, jobType string, lease time.Duration) (*models.Job, error) {
 	// Use a transaction to atomically claim a job
 	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
@@ -396,10 +647,11 @@ func (db *DB) GetNextJob(ctx context.Context, jobType string) (*models.Job, erro
 	}
 
 	// Immediately mark it as running
+	now := time.Now()
 	_, err = tx.ExecContext(ctx, `
-		UPDATE jobs SET status = ?, started_at = ?
+		UPDATE jobs SET status = ?, started_at = ?, lease_expires_at = ?
 		WHERE id = ? AND status = ?
-	`, models.StatusRunning, time.Now(), job.ID, models.StatusQueued)
+	`, models.StatusRunning, now, now.Add(lease), job.ID, models.StatusQueued)
 	if err != nil {
 		return nil, err
 	}
@@ -409,6 +661,7 @@ func (db *DB) GetNextJob(ctx context.Context, jobType string) (*models.Job, erro
 	}
 
 	job.Status = models.StatusRunning
+	job.LeaseUntil = sql.NullTime{Time: now.Add(lease), Valid: true}
 	return &job, nil
 }
 
@@ -420,23 +673,157 @@ func (db *DB) UpdateJob(ctx context.Context, job *models.Job) error {
 	return err
 }
 
-func (db *DB) ListJobs(ctx context.Context, status string, limit int) ([]models.Job, error) {
-	var jobs []models.Job
-	query := "SELECT * FROM jobs"
+// JobSelector picks jobs for listing and bulk operations. Empty fields match
+// every job; LibraryID matches jobs on the library, its files or its tracks.
+type JobSelector struct {
+	IDs       []string `json:"ids,omitempty"`
+	Status    string   `json:"status,omitempty"`
+	Type      string   `json:"type,omitempty"`
+	LibraryID string   `json:"libraryId,omitempty"`
+}
+
+// where returns the WHERE clause for the selector, limited to jobs in one
+// of statuses when any are given
+func (s JobSelector) where(statuses ...string) (string, []interface{}) {
+	query := " WHERE 1=1"
 	args := []interface{}{}
 
-	if status != "" {
-		query += " WHERE status = ?"
-		args = append(args, status)
+	if len(s.IDs) > 0 {
+		query += " AND id IN (?" + strings.Repeat(", ?", len(s.IDs)-1) + ")"
+		for _, id := range s.IDs {
+			args = append(args, id)
+		}
+	}
+	if len(statuses) > 0 {
+		query += " AND status IN (?" + strings.Repeat(", ?", len(statuses)-1) + ")"
+		for _, st := range statuses {
+			args = append(args, st)
+		}
+	}
+	if s.Status != "" {
+		query += " AND status = ?"
+		args = append(args, s.Status)
 	}
+	if s.Type != "" {
+		query += " AND type = ?"
+		args = append(args, s.Type)
+	}
+	if s.LibraryID != "" {
+		query += ` AND (
+			(target_type = 'library' AND target_id = ?)
+			OR (target_type = 'media_file' AND target_id IN (SELECT id FROM media_files WHERE library_id = ?))
+			OR (target_type = 'track' AND target_id IN (
+				SELECT t.id FROM tracks t JOIN media_files m ON m.id = t.media_file_id WHERE m.library_id = ?
+			))
+		)`
+		args = append(args, s.LibraryID, s.LibraryID, s.LibraryID)
+	}
+	return query, args
+}
 
-	query += " ORDER BY created_at DESC LIMIT ?"
+func (db *DB) ListJobs(ctx context.Context, sel JobSelector, limit int) ([]models.Job, error) {
+	var jobs []models.Job
+	where, args := sel.where()
+	query := "SELECT * FROM jobs" + where + " ORDER BY created_at DESC LIMIT ?"
 	args = append(args, limit)
 
 	err := db.SelectContext(ctx, &jobs, query, args...)
 	return jobs, err
 }
 
+func (db *DB) GetJob(ctx context.Context, id string) (*models.Job, error) {
+	var job models.Job
+	if err := db.GetContext(ctx, &job, "SELECT * FROM jobs WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FinishJob records the outcome of a job a worker ran. Returns false
+// without writing if the job is no longer running, because it was
+// cancelled while it ran.
+func (db *DB) FinishJob(ctx context.Context, job *models.Job) (bool, error) {
+	result, err := db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, attempts = ?, last_error = ?, finished_at = ?, scheduled_at = ?, lease_expires_at = NULL
+		WHERE id = ? AND status = ?
+	`, job.Status, job.Attempts, job.LastError, job.FinishedAt, job.ScheduledAt, job.ID, models.StatusRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// CancelJobs cancels the selected queued and running jobs. Returns how many
+// were cancelled and the IDs of those that were running, which the worker
+// still has to stop.
+func (db *DB) CancelJobs(ctx context.Context, sel JobSelector) (int64, []string, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	where, args := sel.where(models.StatusRunning)
+	var running []string
+	if err := tx.SelectContext(ctx, &running, "SELECT id FROM jobs"+where, args...); err != nil {
+		return 0, nil, err
+	}
+
+	where, args = sel.where(models.StatusQueued, models.StatusRunning)
+	result, err := tx.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, finished_at = ?, last_error = 'Cancelled'`+where,
+		append([]interface{}{models.StatusCancelled, time.Now()}, args...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, _ := result.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return n, running, nil
+}
+
+// RetryJobs queues the selected failed and cancelled jobs again with their
+// attempts and last error reset
+func (db *DB) RetryJobs(ctx context.Context, sel JobSelector) (int64, error) {
+	where, args := sel.where(models.StatusFailed, models.StatusCancelled)
+	result, err := db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, attempts = 0, last_error = NULL, scheduled_at = ?, started_at = NULL, finished_at = NULL`+where,
+		append([]interface{}{models.StatusQueued, time.Now()}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SetJobPriority changes the priority of the selected queued jobs; higher
+// runs first
+func (db *DB) SetJobPriority(ctx context.Context, sel JobSelector, priority int) (int64, error) {
+	where, args := sel.where(models.StatusQueued)
+	result, err := db.ExecContext(ctx, "UPDATE jobs SET priority = ?"+where, append([]interface{}{priority}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeJobs deletes the selected finished jobs. A non-zero before keeps
+// jobs that finished after it.
+func (db *DB) PurgeJobs(ctx context.Context, sel JobSelector, before time.Time) (int64, error) {
+	where, args := sel.where(models.StatusSuccess, models.StatusFailed, models.StatusCancelled)
+	if !before.IsZero() {
+		where += " AND finished_at < ?"
+		args = append(args, before)
+	}
+	result, err := db.ExecContext(ctx, "DELETE FROM jobs"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // Settings operations
 
 func (db *DB) GetSetting(ctx context.Context, key string) (*models.Setting, error) {
@@ -494,18 +881,18 @@ func (db *DB) CreateScanRun(ctx context.Context, run *models.ScanRun) error {
 	run.Status = models.StatusRunning
 
 	_, err := db.ExecContext(ctx, `
-		INSERT INTO scan_runs (id, library_id, status, files_found, files_new, files_changed, files_deleted, files_failed, started_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, run.ID, run.LibraryID, run.Status, run.FilesFound, run.FilesNew, run.FilesChanged, run.FilesDeleted, run.FilesFailed, run.StartedAt)
+		INSERT INTO scan_runs (id, library_id, status, files_found, files_new, files_changed, files_deleted, files_failed, started_at, incremental, lease_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, run.ID, run.LibraryID, run.Status, run.FilesFound, run.FilesNew, run.FilesChanged, run.FilesDeleted, run.FilesFailed, run.StartedAt, run.Incremental, run.LeaseUntil)
 
 	return err
 }
 
 func (db *DB) UpdateScanRun(ctx context.Context, run *models.ScanRun) error {
 	_, err := db.ExecContext(ctx, `
-		UPDATE scan_runs SET status = ?, files_found = ?, files_new = ?, files_changed = ?, files_deleted = ?, files_failed = ?, finished_at = ?, error_msg = ?
+		UPDATE scan_runs SET status = ?, files_found = ?, files_new = ?, files_changed = ?, files_deleted = ?, files_moved = ?, files_failed = ?, finished_at = ?, error_msg = ?
 		WHERE id = ?
-	`, run.Status, run.FilesFound, run.FilesNew, run.FilesChanged, run.FilesDeleted, run.FilesFailed, run.FinishedAt, run.ErrorMsg, run.ID)
+	`, run.Status, run.FilesFound, run.FilesNew, run.FilesChanged, run.FilesDeleted, run.FilesMoved, run.FilesFailed, run.FinishedAt, run.ErrorMsg, run.ID)
 	return err
 }
 
@@ -531,6 +918,15 @@ func (db *DB) CreateActionLog(ctx context.Context, log *models.ActionLog) error
 	return err
 }
 
+func (db *DB) GetActionLog(ctx context.Context, id string) (*models.ActionLog, error) {
+	var log models.ActionLog
+	err := db.GetContext(ctx, &log, `SELECT * FROM action_logs WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
 func (db *DB) ListActionLogs(ctx context.Context, targetType, targetID string, limit int) ([]models.ActionLog, error) {
 	var logs []models.ActionLog
 	query := "SELECT * FROM action_logs WHERE 1=1"
@@ -552,6 +948,321 @@ func (db *DB) ListActionLogs(ctx context.Context, targetType, targetID string, l
 	return logs, err
 }
 
+// GetTargetLibraryID returns the library a job target belongs to. Targets
+// not tied to one library, such as albums, return "".
+func (db *DB) GetTargetLibraryID(ctx context.Context, targetType, targetID string) (string, error) {
+	var query string
+	switch targetType {
+	case "library":
+		return targetID, nil
+	case "track":
+		query = "SELECT m.library_id FROM tracks t JOIN media_files m ON m.id = t.media_file_id WHERE t.id = ?"
+	case "media_file":
+		query = "SELECT library_id FROM media_files WHERE id = ?"
+	default:
+		return "", nil
+	}
+
+	var libraryID string
+	err := db.GetContext(ctx, &libraryID, query, targetID)
+	return libraryID, err
+}
+
+// Leases
+
+// Tables whose running rows hold a lease
+const (
+	LeaseJobs        = "jobs"
+	LeaseConversions = "conversion_jobs"
+	LeaseScanRuns    = "scan_runs"
+)
+
+// LeaseDuration is how long a claim on running work lasts without renewal;
+// HoldLease renews it four times per period
+const LeaseDuration = 2 * time.Minute
+
+// RenewLease extends the lease on a running row of one of the lease tables.
+// It returns ErrLeaseLost if the row is no longer running.
+func (db *DB) RenewLease(ctx context.Context, table, id string, until time.Time) error {
+	result, err := db.ExecContext(ctx, "UPDATE "+table+" SET lease_expires_at = ? WHERE id = ? AND status = ?",
+		until, id, models.StatusRunning)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// HoldLease keeps renewing the lease on a running row until ctx is done.
+// Run it in its own goroutine for as long as the work runs. A failed
+// renewal is retried on the next tick; the lease only lapses when every
+// renewal in a lease period fails. Once the row is found to be no longer
+// running, lost is called with ErrLeaseLost, if set, so the work stops
+// rather than race whoever recovered it.
+func (db *DB) HoldLease(ctx context.Context, table, id string, lost context.CancelCauseFunc) {
+	ticker := time.NewTicker(LeaseDuration / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := db.RenewLease(ctx, table, id, time.Now().Add(LeaseDuration))
+			if errors.Is(err, ErrLeaseLost) {
+				if lost != nil {
+					lost(ErrLeaseLost)
+				}
+				return
+			}
+		}
+	}
+}
+
+// LeaseRecovery counts the rows reset by RecoverExpiredLeases
+type LeaseRecovery struct {
+	JobsRequeued int64
+	JobsFailed   int64
+	Conversions  int64
+	ScanRuns     int64
+	Libraries    int64
+	JobLogs      int64
+}
+
+func (r *LeaseRecovery) Total() int64 {
+	return r.JobsRequeued + r.JobsFailed + r.Conversions + r.ScanRuns + r.Libraries + r.JobLogs
+}
+
+// liveJobLog matches job logs whose job or conversion is running
+const liveJobLog = `(job_id IN (SELECT id FROM jobs WHERE status = 'running')
+	OR job_id IN (SELECT id FROM conversion_jobs WHERE status = 'running'))`
+
+// RecoverExpiredLeases resets work left running by a crashed or restarted
+// process. Jobs count the interrupted run as an attempt and are requeued,
+// or failed once out of attempts; conversions are requeued from the start;
+// scan runs are failed, and libraries with no live scan leave the running
+// state. Job logs left open by the runs are closed as failed.
+func (db *DB) RecoverExpiredLeases(ctx context.Context, now time.Time) (*LeaseRecovery, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const expired = "status = 'running' AND (lease_expires_at IS NULL OR lease_expires_at < ?)"
+	const interrupted = "Interrupted: worker lease expired"
+	rec := &LeaseRecovery{}
+	for _, step := range []struct {
+		count *int64
+		query string
+		args  []interface{}
+	}{
+		{&rec.JobsFailed, `
+			UPDATE jobs SET status = 'failed', attempts = attempts + 1, last_error = ?, finished_at = ?, lease_expires_at = NULL
+			WHERE ` + expired + ` AND attempts + 1 >= max_attempts
+		`, []interface{}{interrupted, now, now}},
+		{&rec.JobsRequeued, `
+			UPDATE jobs SET status = 'queued', attempts = attempts + 1, last_error = ?, scheduled_at = ?, started_at = NULL, lease_expires_at = NULL
+			WHERE ` + expired + `
+		`, []interface{}{interrupted, now, now}},
+		{&rec.Conversions, `
+			UPDATE conversion_jobs SET status = 'queued', progress = 0, started_at = NULL, lease_expires_at = NULL
+			WHERE ` + expired + `
+		`, []interface{}{now}},
+		{&rec.ScanRuns, `
+			UPDATE scan_runs SET status = 'failed', error_msg = ?, finished_at = ?, lease_expires_at = NULL
+			WHERE ` + expired + `
+		`, []interface{}{interrupted, now, now}},
+		{&rec.Libraries, `
+			UPDATE libraries SET status = 'failed', updated_at = ?
+			WHERE status = 'running' AND id NOT IN (SELECT library_id FROM scan_runs WHERE status = 'running')
+		`, []interface{}{now}},
+		{&rec.JobLogs, `
+			UPDATE job_logs SET status = 'failed', ended_at = ?
+			WHERE status = 'running' AND NOT ` + liveJobLog + `
+		`, []interface{}{now}},
+	} {
+		result, err := tx.ExecContext(ctx, step.query, step.args...)
+		if err != nil {
+			return nil, err
+		}
+		*step.count, _ = result.RowsAffected()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Job log operations
+
+// JobLogFilter narrows job logs and their entries. Levels and Modules match
+// any of the listed values; empty fields match everything.
+type JobLogFilter struct {
+	Status  string
+	Levels  []string
+	Modules []string
+}
+
+// entryConditions returns the SQL conditions on job_log_entries (aliased e)
+// for the level and module filters
+func (f JobLogFilter) entryConditions(args []interface{}) (string, []interface{}) {
+	var cond string
+	for _, in := range []struct {
+		column string
+		values []string
+	}{{"e.level", f.Levels}, {"e.module", f.Modules}} {
+		if len(in.values) == 0 {
+			continue
+		}
+		cond += " AND " + in.column + " IN (?" + strings.Repeat(", ?", len(in.values)-1) + ")"
+		for _, v := range in.values {
+			args = append(args, v)
+		}
+	}
+	return cond, args
+}
+
+// StartJobLog opens the log for a job run. A job that is run again, such as
+// a retry, reopens its existing log. Returns the index of the next entry.
+func (db *DB) StartJobLog(ctx context.Context, jobID, trackID string, startedAt time.Time) (int, error) {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO job_logs (job_id, track_id, status, started_at)
+		VALUES (?, ?, 'running', ?)
+		ON CONFLICT(job_id) DO UPDATE SET status = 'running', ended_at = NULL
+	`, jobID, trackID, startedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	var next int
+	err = db.GetContext(ctx, &next, "SELECT COALESCE(MAX(seq) + 1, 0) FROM job_log_entries WHERE job_id = ?", jobID)
+	return next, err
+}
+
+func (db *DB) EndJobLog(ctx context.Context, jobID, status string, endedAt time.Time) error {
+	_, err := db.ExecContext(ctx, "UPDATE job_logs SET status = ?, ended_at = ? WHERE job_id = ?", status, endedAt, jobID)
+	return err
+}
+
+// AddJobLogEntries writes a batch of log entries, of any jobs, in one
+// transaction
+func (db *DB) AddJobLogEntries(ctx context.Context, entries []*models.JobLogEntry) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO job_log_entries (job_id, seq, timestamp, level, module, message, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.ExecContext(ctx, e.JobID, e.Index, e.Timestamp, e.Level, e.Module, e.Message, e.Details); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) GetJobLog(ctx context.Context, jobID string) (*models.JobLog, error) {
+	var jl models.JobLog
+	err := db.GetContext(ctx, &jl, `
+		SELECT l.*, (SELECT COUNT(*) FROM job_log_entries e WHERE e.job_id = l.job_id) as entry_count
+		FROM job_logs l WHERE l.job_id = ?
+	`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	return &jl, nil
+}
+
+// ListJobLogs returns job logs, newest first. Level and module filters keep
+// the jobs with at least one matching entry.
+func (db *DB) ListJobLogs(ctx context.Context, filter JobLogFilter, limit, offset int) ([]models.JobLog, int, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if filter.Status != "" {
+		where += " AND l.status = ?"
+		args = append(args, filter.Status)
+	}
+	if cond, condArgs := filter.entryConditions(nil); cond != "" {
+		where += " AND EXISTS (SELECT 1 FROM job_log_entries e WHERE e.job_id = l.job_id" + cond + ")"
+		args = append(args, condArgs...)
+	}
+
+	var total int
+	if err := db.GetContext(ctx, &total, "SELECT COUNT(*) FROM job_logs l"+where, args...); err != nil {
+		return nil, 0, err
+	}
+
+	var logs []models.JobLog
+	err := db.SelectContext(ctx, &logs, `
+		SELECT l.*, (SELECT COUNT(*) FROM job_log_entries e WHERE e.job_id = l.job_id) as entry_count
+		FROM job_logs l`+where+`
+		ORDER BY l.started_at DESC, l.job_id LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return logs, total, nil
+}
+
+// ListJobLogEntries returns up to limit entries of a job from index since
+// on, in order
+func (db *DB) ListJobLogEntries(ctx context.Context, jobID string, since int, filter JobLogFilter, limit int) ([]models.JobLogEntry, error) {
+	cond, args := filter.entryConditions([]interface{}{jobID, since})
+
+	var entries []models.JobLogEntry
+	err := db.SelectContext(ctx, &entries, `
+		SELECT * FROM job_log_entries e WHERE e.job_id = ? AND e.seq >= ?`+cond+`
+		ORDER BY e.seq LIMIT ?
+	`, append(args, limit)...)
+	return entries, err
+}
+
+// PruneJobLogs deletes job logs started before cutoff, then all but the
+// newest keep. A zero cutoff or keep skips that rule. Logs of jobs still
+// running are kept by both rules.
+func (db *DB) PruneJobLogs(ctx context.Context, cutoff time.Time, keep int) (int64, error) {
+	var deleted int64
+	if !cutoff.IsZero() {
+		result, err := db.ExecContext(ctx, "DELETE FROM job_logs WHERE started_at < ? AND NOT "+liveJobLog, cutoff)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := result.RowsAffected()
+		deleted += n
+	}
+	if keep > 0 {
+		result, err := db.ExecContext(ctx, `
+			DELETE FROM job_logs WHERE NOT `+liveJobLog+` AND job_id NOT IN (
+				SELECT job_id FROM job_logs WHERE NOT `+liveJobLog+`
+				ORDER BY started_at DESC LIMIT ?
+			)
+		`, keep)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := result.RowsAffected()
+		deleted += n
+	}
+	return deleted, nil
+}
+
 // Stats
 
 type DashboardStats struct {
@@ -609,8 +1320,15 @@ func (db *DB) GetDashboardStats(ctx context.Context) (*DashboardStats, error) {
 
 func (db *DB) ListConversionProfiles(ctx context.Context) ([]models.ConversionProfile, error) {
 	var profiles []models.ConversionProfile
-	err := db.SelectContext(ctx, &profiles, "SELECT * FROM conversion_profiles ORDER BY name")
-	return profiles, err
+	if err := db.SelectContext(ctx, &profiles, "SELECT * FROM conversion_profiles ORDER BY name"); err != nil {
+		return nil, err
+	}
+	for i := range profiles {
+		if err := profiles[i].ParseOptions(); err != nil {
+			return nil, fmt.Errorf("profile %s has invalid options: %w", profiles[i].ID, err)
+		}
+	}
+	return profiles, nil
 }
 
 func (db *DB) GetConversionProfile(ctx context.Context, id string) (*models.ConversionProfile, error) {
@@ -619,9 +1337,88 @@ func (db *DB) GetConversionProfile(ctx context.Context, id string) (*models.Conv
 	if err != nil {
 		return nil, err
 	}
+	if err := profile.ParseOptions(); err != nil {
+		return nil, fmt.Errorf("profile %s has invalid options: %w", id, err)
+	}
 	return &profile, nil
 }
 
+func (db *DB) CreateConversionProfile(ctx context.Context, p *models.ConversionProfile) error {
+	options, err := json.Marshal(p.Options)
+	if err != nil {
+		return err
+	}
+	p.ID = uuid.NewString()
+	p.OptionsJSON = string(options)
+	p.IsBuiltin = false
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = time.Now()
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO conversion_profiles (id, name, description, codec, sample_rate, bit_depth, bitrate, options, is_builtin, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, p.ID, p.Name, p.Description, p.Codec, p.SampleRate, p.BitDepth, p.Bitrate, p.OptionsJSON, p.IsBuiltin, p.CreatedAt, p.UpdatedAt)
+	return err
+}
+
+// UpdateConversionProfile saves a custom profile. Builtin profiles are never
+// changed.
+func (db *DB) UpdateConversionProfile(ctx context.Context, p *models.ConversionProfile) error {
+	options, err := json.Marshal(p.Options)
+	if err != nil {
+		return err
+	}
+	p.OptionsJSON = string(options)
+	p.UpdatedAt = time.Now()
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE conversion_profiles SET name = ?, description = ?, codec = ?, sample_rate = ?,
+		bit_depth = ?, bitrate = ?, options = ?, updated_at = ?
+		WHERE id = ? AND is_builtin = 0
+	`, p.Name, p.Description, p.Codec, p.SampleRate, p.BitDepth, p.Bitrate, p.OptionsJSON, p.UpdatedAt, p.ID)
+	if err != nil {
+		return err
+	}
+	return db.checkProfileChanged(ctx, result, p.ID)
+}
+
+// DeleteConversionProfile removes a custom profile that no pending
+// conversion depends on
+func (db *DB) DeleteConversionProfile(ctx context.Context, id string) error {
+	var inUse int
+	err := db.GetContext(ctx, &inUse, `
+		SELECT COUNT(*) FROM conversion_jobs WHERE profile = ? AND status IN (?, ?)
+	`, id, models.StatusQueued, models.StatusRunning)
+	if err != nil {
+		return err
+	}
+	if inUse > 0 {
+		return ErrProfileInUse
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM conversion_profiles WHERE id = ? AND is_builtin = 0", id)
+	if err != nil {
+		return err
+	}
+	return db.checkProfileChanged(ctx, result, id)
+}
+
+// checkProfileChanged maps a write that touched no rows to sql.ErrNoRows or
+// ErrBuiltinProfile
+func (db *DB) checkProfileChanged(ctx context.Context, result sql.Result, id string) error {
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	var builtin bool
+	if err := db.GetContext(ctx, &builtin, "SELECT is_builtin FROM conversion_profiles WHERE id = ?", id); err != nil {
+		return err
+	}
+	if builtin {
+		return ErrBuiltinProfile
+	}
+	return sql.ErrNoRows
+}
+
 // Conversion job operations
 
 func (db *DB) ListConversionJobs(ctx context.Context, limit int) ([]models.ConversionJob, error) {
@@ -647,9 +1444,9 @@ func (db *DB) CreateConversionJob(ctx context.Context, job *models.ConversionJob
 	job.QueuedAt = time.Now()
 
 	_, err := db.ExecContext(ctx, `
-		INSERT INTO conversion_jobs (id, source_type, source_id, profile, output_path, status, progress, queued_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, job.ID, job.SourceType, job.SourceID, job.Profile, job.OutputPath, job.Status, job.Progress, job.QueuedAt)
+		INSERT INTO conversion_jobs (id, source_type, source_id, source_artist, profile, output_path, status, progress, queued_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, job.SourceType, job.SourceID, job.SourceArtist, job.Profile, job.OutputPath, job.Status, job.Progress, job.QueuedAt)
 
 	return err
 }
@@ -672,6 +1469,555 @@ func (db *DB) GetConversionJob(ctx context.Context, id string) (*models.Conversi
 	return &job, nil
 }
 
+// GetNextConversionJob atomically claims the oldest queued conversion job,
+// leasing it for lease
+func (db *DB) GetNextConversionJob(ctx context.Context, lease time.Duration) (*models.ConversionJob, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var job models.ConversionJob
+	err = tx.GetContext(ctx, &job, `
+		SELECT * FROM conversion_jobs
+		WHERE status = ?
+		ORDER BY queued_at ASC
+		LIMIT 1
+	`, models.StatusQueued)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE conversion_jobs SET status = ?, started_at = ?, lease_expires_at = ?
+		WHERE id = ? AND status = ?
+	`, models.StatusRunning, now, now.Add(lease), job.ID, models.StatusQueued)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	job.Status = models.StatusRunning
+	job.StartedAt = sql.NullTime{Time: now, Valid: true}
+	job.LeaseUntil = sql.NullTime{Time: now.Add(lease), Valid: true}
+	return &job, nil
+}
+
+// CancelQueuedConversionJob cancels a job that has not been claimed by a worker yet.
+// Returns false if the job is no longer queued.
+func (db *DB) CancelQueuedConversionJob(ctx context.Context, id string) (bool, error) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE conversion_jobs SET status = ?, finished_at = ?
+		WHERE id = ? AND status = ?
+	`, models.StatusCancelled, time.Now(), id, models.StatusQueued)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListTracksBySource returns the present tracks covered by a conversion source
+// (sourceType track/album/library). An album is matched by its title and
+// artist, as on its detail page.
+func (db *DB) ListTracksBySource(ctx context.Context, sourceType, sourceID, artist string) ([]models.Track, error) {
+	var where string
+	args := []interface{}{sourceID}
+	switch sourceType {
+	case "track":
+		where = "t.id = ?"
+	case "album":
+		where = "t.album = ? AND COALESCE(t.album_artist, t.artist, '') = ?"
+		args = append(args, artist)
+	case "library":
+		where = "m.library_id = ?"
+	default:
+		return nil, fmt.Errorf("unknown source type: %s", sourceType)
+	}
+
+	var tracks []models.Track
+	err := db.SelectContext(ctx, &tracks, `
+		SELECT t.*, m.path, m.library_id, l.name as library_name, `+fileDurationColumn+`
+		FROM tracks t
+		JOIN media_files m ON t.media_file_id = m.id
+		JOIN libraries l ON m.library_id = l.id
+		WHERE `+where+` AND m.status != 'deleted'
+		ORDER BY t.album, t.disc_number, t.track_number, m.path
+	`, args...)
+	return tracks, err
+}
+
+// Provenance operations
+
+func (db *DB) CreateProvenance(ctx context.Context, p *models.Provenance) error {
+	if p.ID == "" {
+		p.ID = uuid.NewString()
+	}
+	if p.VerifyStatus == "" {
+		p.VerifyStatus = models.VerifyPending
+	}
+	p.CreatedAt = time.Now()
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO provenance (id, conversion_job_id, output_path, output_media_file_id, output_sha256,
+		source_media_file_id, source_path, profile_id, profile_json, ffmpeg_version, verify_status, verify_json, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, p.ID, p.ConversionJobID, p.OutputPath, p.OutputMediaFileID, p.OutputSHA256,
+		p.SourceMediaFileID, p.SourcePath, p.ProfileID, p.ProfileJSON, p.FFmpegVersion, p.VerifyStatus, p.VerifyJSON, p.CreatedAt)
+
+	return err
+}
+
+func (db *DB) UpdateProvenanceVerification(ctx context.Context, p *models.Provenance) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE provenance SET output_media_file_id = ?, verify_status = ?, verify_json = ?
+		WHERE id = ?
+	`, p.OutputMediaFileID, p.VerifyStatus, p.VerifyJSON, p.ID)
+	return err
+}
+
+// ListProvenance returns provenance records for a conversion job, or for an
+// output media file when mediaFileID is set
+func (db *DB) ListProvenance(ctx context.Context, conversionJobID, mediaFileID string) ([]models.Provenance, error) {
+	query := "SELECT * FROM provenance WHERE 1=1"
+	args := []interface{}{}
+
+	if conversionJobID != "" {
+		query += " AND conversion_job_id = ?"
+		args = append(args, conversionJobID)
+	}
+	if mediaFileID != "" {
+		query += " AND output_media_file_id = ?"
+		args = append(args, mediaFileID)
+	}
+	query += " ORDER BY created_at"
+
+	var records []models.Provenance
+	if err := db.SelectContext(ctx, &records, query, args...); err != nil {
+		return nil, err
+	}
+	for i := range records {
+		records[i].ParseJSON()
+	}
+	return records, nil
+}
+
+// FindLibraryForPath returns the library whose root contains path, preferring
+// the most specific root
+func (db *DB) FindLibraryForPath(ctx context.Context, path string) (*models.Library, error) {
+	return db.findLibraryContaining(ctx, path, func(lib *models.Library) string { return lib.RootPath })
+}
+
+// FindLibraryForOutput returns the library whose output path contains path,
+// preferring the most specific one
+func (db *DB) FindLibraryForOutput(ctx context.Context, path string) (*models.Library, error) {
+	return db.findLibraryContaining(ctx, path, func(lib *models.Library) string { return lib.OutputPath.String })
+}
+
+func (db *DB) findLibraryContaining(ctx context.Context, path string, dirOf func(*models.Library) string) (*models.Library, error) {
+	var libs []models.Library
+	if err := db.SelectContext(ctx, &libs, "SELECT * FROM libraries"); err != nil {
+		return nil, err
+	}
+
+	var best *models.Library
+	bestDir := ""
+	for i := range libs {
+		dir := dirOf(&libs[i])
+		if dir == "" {
+			continue
+		}
+		dir = strings.TrimSuffix(dir, "/")
+		if path != dir && !strings.HasPrefix(path, dir+"/") {
+			continue
+		}
+		if best == nil || len(dir) > len(bestDir) {
+			best, bestDir = &libs[i], dir
+		}
+	}
+	if best == nil {
+		return nil, sql.ErrNoRows
+	}
+	return best, nil
+}
+
+// Duplicate operations
+
+// ListMediaFilesToHash returns present, analyzed media files missing a full
+// or PCM hash, optionally limited to one library
+func (db *DB) ListMediaFilesToHash(ctx context.Context, libraryID string) ([]models.MediaFile, error) {
+	query := `
+		SELECT m.* FROM media_files m
+		WHERE m.status != 'deleted' AND (m.full_hash IS NULL OR (m.pcm_hash IS NULL AND NOT (
+			m.pcm_error IS NOT NULL AND m.pcm_error_size = m.size AND m.pcm_error_mtime = m.mtime
+		)))
+		AND EXISTS (SELECT 1 FROM tracks t WHERE t.media_file_id = m.id)
+	`
+	args := []interface{}{}
+	if libraryID != "" {
+		query += " AND m.library_id = ?"
+		args = append(args, libraryID)
+	}
+	query += " ORDER BY m.path"
+
+	var files []models.MediaFile
+	err := db.SelectContext(ctx, &files, query, args...)
+	return files, err
+}
+
+// SetMediaFilePCMError records why a file's audio couldn't be decoded,
+// keyed to its current size and mtime
+func (db *DB) SetMediaFilePCMError(ctx context.Context, id, msg string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE media_files SET pcm_error = ?, pcm_error_size = size, pcm_error_mtime = mtime, updated_at = ? WHERE id = ?
+	`, msg, time.Now(), id)
+	return err
+}
+
+func (db *DB) SetMediaFileHashes(ctx context.Context, id string, fullHash, pcmHash sql.NullString) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE media_files SET full_hash = ?, pcm_hash = ?, updated_at = ? WHERE id = ?
+	`, fullHash, pcmHash, time.Now(), id)
+	return err
+}
+
+// duplicateTrackColumns selects the track, file and latest analysis fields
+// shown for a duplicate set member. DR uses the same LRA/crest proxy as the
+// album views.
+const duplicateTrackColumns = `
+	t.id as track_id, m.path, m.size, m.library_id, l.name as library_name,
+	t.title, t.artist, t.album, t.codec, t.sample_rate, t.bit_depth, t.bitrate,
+	COALESCE(ar.lossless_status, 'pending') as lossless_status,
+	CASE WHEN ar.id IS NULL THEN 0
+		ELSE MAX(1, MIN(20, CAST(ar.loudness_range + ar.crest_factor/2 AS INTEGER))) END as dr_score
+`
+
+const duplicateTrackJoins = `
+	FROM tracks t
+	JOIN media_files m ON t.media_file_id = m.id
+	JOIN libraries l ON m.library_id = l.id
+	LEFT JOIN analysis_results ar ON ar.id = (
+		SELECT id FROM analysis_results WHERE track_id = t.id ORDER BY version DESC, created_at DESC LIMIT 1
+	)
+`
+
+// DuplicateCandidate is a track whose full or PCM hash is shared with at
+// least one other present file. A file split by a cue sheet is represented
+// by its first track.
+type DuplicateCandidate struct {
+	models.DuplicateMember
+	FullHash    sql.NullString `db:"full_hash"`
+	PCMHash     sql.NullString `db:"pcm_hash"`
+	IntegrityOK bool           `db:"integrity_ok"`
+}
+
+func (db *DB) ListDuplicateCandidates(ctx context.Context) ([]DuplicateCandidate, error) {
+	var candidates []DuplicateCandidate
+	err := db.SelectContext(ctx, &candidates, `
+		SELECT `+duplicateTrackColumns+`, m.full_hash, m.pcm_hash, COALESCE(ar.integrity_ok, 1) as integrity_ok
+		`+duplicateTrackJoins+`
+		WHERE m.status != 'deleted' AND t.cue_index <= 1 AND (
+			m.pcm_hash IN (
+				SELECT pcm_hash FROM media_files
+				WHERE status != 'deleted' AND pcm_hash IS NOT NULL
+				GROUP BY pcm_hash HAVING COUNT(*) > 1
+			) OR m.full_hash IN (
+				SELECT full_hash FROM media_files
+				WHERE status != 'deleted' AND full_hash IS NOT NULL
+				GROUP BY full_hash HAVING COUNT(*) > 1
+			)
+		)
+		ORDER BY m.path
+	`)
+	return candidates, err
+}
+
+// ReplaceDuplicateSets swaps the stored duplicate sets for a freshly built
+// list in one transaction
+func (db *DB) ReplaceDuplicateSets(ctx context.Context, sets []models.DuplicateSet) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM duplicate_set_members"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM duplicate_sets"); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range sets {
+		set := &sets[i]
+		set.ID = uuid.NewString()
+		set.MemberCount = len(set.Members)
+		set.CreatedAt = now
+
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO duplicate_sets (id, match_type, match_key, member_count, created_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, set.ID, set.MatchType, set.MatchKey, set.MemberCount, set.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		for j := range set.Members {
+			member := &set.Members[j]
+			member.SetID = set.ID
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO duplicate_set_members (set_id, track_id, rank, quality_score)
+				VALUES (?, ?, ?, ?)
+			`, member.SetID, member.TrackID, member.Rank, member.QualityScore)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListDuplicateSets returns duplicate sets with their ranked members, largest
+// sets first
+func (db *DB) ListDuplicateSets(ctx context.Context, limit, offset int) ([]models.DuplicateSet, int, error) {
+	var total int
+	if err := db.GetContext(ctx, &total, "SELECT COUNT(*) FROM duplicate_sets"); err != nil {
+		return nil, 0, err
+	}
+
+	var sets []models.DuplicateSet
+	err := db.SelectContext(ctx, &sets, `
+		SELECT * FROM duplicate_sets ORDER BY member_count DESC, created_at, id LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range sets {
+		if sets[i].Members, err = db.listDuplicateMembers(ctx, sets[i].ID); err != nil {
+			return nil, 0, err
+		}
+	}
+	return sets, total, nil
+}
+
+func (db *DB) GetDuplicateSet(ctx context.Context, id string) (*models.DuplicateSet, error) {
+	var set models.DuplicateSet
+	if err := db.GetContext(ctx, &set, "SELECT * FROM duplicate_sets WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+
+	members, err := db.listDuplicateMembers(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	set.Members = members
+	return &set, nil
+}
+
+func (db *DB) listDuplicateMembers(ctx context.Context, setID string) ([]models.DuplicateMember, error) {
+	var members []models.DuplicateMember
+	err := db.SelectContext(ctx, &members, `
+		SELECT dm.set_id, dm.rank, dm.quality_score, `+duplicateTrackColumns+`
+		`+duplicateTrackJoins+`
+		JOIN duplicate_set_members dm ON dm.track_id = t.id
+		WHERE dm.set_id = ?
+		ORDER BY dm.rank
+	`, setID)
+	return members, err
+}
+
+// Garbage collection operations
+
+// purgeBatchSize bounds the IDs bound to one purge statement, well under
+// SQLite's variable limit
+const purgeBatchSize = 500
+
+// PurgeableFile is a media file marked deleted long enough ago to be
+// purged, with its track if it had one. A file split by a cue sheet is
+// listed once for each of its tracks.
+type PurgeableFile struct {
+	ID      string         `db:"id"`
+	Path    string         `db:"path"`
+	TrackID sql.NullString `db:"track_id"`
+}
+
+// ListPurgeableMediaFiles returns the media files marked deleted before
+// deletedBefore
+func (db *DB) ListPurgeableMediaFiles(ctx context.Context, deletedBefore time.Time) ([]PurgeableFile, error) {
+	var files []PurgeableFile
+	err := db.SelectContext(ctx, &files, `
+		SELECT m.id, m.path, t.id AS track_id
+		FROM media_files m
+		LEFT JOIN tracks t ON t.media_file_id = m.id
+		WHERE m.status = 'deleted' AND m.updated_at < ?
+		ORDER BY m.path, m.id
+	`, deletedBefore)
+	return files, err
+}
+
+// PurgeMediaFiles deletes media files that are still marked deleted, along
+// with their tracks, analysis, tags, fingerprints and artifact rows, and
+// the jobs queued for them. Duplicate sets left with a single member are
+// dropped. Returns how many files were deleted.
+func (db *DB) PurgeMediaFiles(ctx context.Context, ids []string) (int64, error) {
+	var purged int64
+	for start := 0; start < len(ids); start += purgeBatchSize {
+		batch := ids[start:min(start+purgeBatchSize, len(ids))]
+		in := "(?" + strings.Repeat(", ?", len(batch)-1) + ")"
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return purged, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM jobs WHERE status != 'running' AND (
+				(target_type = 'media_file' AND target_id IN `+in+`)
+				OR (target_type = 'track' AND target_id IN (SELECT id FROM tracks WHERE media_file_id IN `+in+`))
+			)
+		`, append(args, args...)...)
+		if err != nil {
+			tx.Rollback()
+			return purged, err
+		}
+		result, err := tx.ExecContext(ctx, "DELETE FROM media_files WHERE status = 'deleted' AND id IN "+in, args...)
+		if err != nil {
+			tx.Rollback()
+			return purged, err
+		}
+		if err := tx.Commit(); err != nil {
+			return purged, err
+		}
+		n, _ := result.RowsAffected()
+		purged += n
+	}
+
+	if purged > 0 {
+		_, err := db.ExecContext(ctx, `
+			DELETE FROM duplicate_sets WHERE id NOT IN (
+				SELECT set_id FROM duplicate_set_members GROUP BY set_id HAVING COUNT(*) > 1
+			)
+		`)
+		if err != nil {
+			return purged, err
+		}
+		_, err = db.ExecContext(ctx, `
+			UPDATE duplicate_sets SET member_count = (
+				SELECT COUNT(*) FROM duplicate_set_members WHERE set_id = duplicate_sets.id
+			)
+		`)
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// ListTrackIDs returns the IDs of every track
+func (db *DB) ListTrackIDs(ctx context.Context) ([]string, error) {
+	var ids []string
+	err := db.SelectContext(ctx, &ids, "SELECT id FROM tracks")
+	return ids, err
+}
+
+// ListArtifactFiles returns the ID, track and path of every artifact
+func (db *DB) ListArtifactFiles(ctx context.Context) ([]models.Artifact, error) {
+	var artifacts []models.Artifact
+	err := db.SelectContext(ctx, &artifacts, "SELECT id, track_id, path FROM artifacts")
+	return artifacts, err
+}
+
+// Fingerprint operations
+
+// SaveFingerprint stores a track's fingerprint, replacing any earlier one
+func (db *DB) SaveFingerprint(ctx context.Context, fp *models.Fingerprint) error {
+	fp.CreatedAt = time.Now()
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO fingerprints (track_id, version, duration, data, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(track_id) DO UPDATE SET
+			version = excluded.version, duration = excluded.duration,
+			data = excluded.data, created_at = excluded.created_at
+	`, fp.TrackID, fp.Version, fp.Duration, fp.Data, fp.CreatedAt)
+	return err
+}
+
+func (db *DB) GetFingerprint(ctx context.Context, trackID string) (*models.Fingerprint, error) {
+	var fp models.Fingerprint
+	if err := db.GetContext(ctx, &fp, "SELECT * FROM fingerprints WHERE track_id = ?", trackID); err != nil {
+		return nil, err
+	}
+	return &fp, nil
+}
+
+// FingerprintTrack is a present track's fingerprint with the tags and format
+// reported for a match
+type FingerprintTrack struct {
+	models.AcousticMatch
+	Data []byte `db:"data"`
+}
+
+func (db *DB) ListFingerprintTracks(ctx context.Context) ([]FingerprintTrack, error) {
+	var tracks []FingerprintTrack
+	err := db.SelectContext(ctx, &tracks, `
+		SELECT t.id as track_id, m.path, l.name as library_name, t.title, t.artist, t.album,
+			t.codec, t.sample_rate, t.bit_depth, t.bitrate, f.data
+		FROM fingerprints f
+		JOIN tracks t ON f.track_id = t.id
+		JOIN media_files m ON t.media_file_id = m.id
+		JOIN libraries l ON m.library_id = l.id
+		WHERE m.status != 'deleted'
+		ORDER BY m.path
+	`)
+	return tracks, err
+}
+
+// GetFingerprintStamp returns a value that changes whenever a fingerprint is
+// added, replaced or removed, or its file is marked deleted
+func (db *DB) GetFingerprintStamp(ctx context.Context) (string, error) {
+	var stamp string
+	err := db.GetContext(ctx, &stamp, `
+		SELECT COUNT(*) || ':' || COALESCE(MAX(f.created_at), '')
+		FROM fingerprints f
+		JOIN tracks t ON f.track_id = t.id
+		JOIN media_files m ON t.media_file_id = m.id
+		WHERE m.status != 'deleted'
+	`)
+	return stamp, err
+}
+
+// ListTracksWithoutFingerprint returns the IDs of present tracks that have no
+// fingerprint of the given version, optionally limited to one library
+func (db *DB) ListTracksWithoutFingerprint(ctx context.Context, libraryID string, version int) ([]string, error) {
+	query := `
+		SELECT t.id FROM tracks t
+		JOIN media_files m ON t.media_file_id = m.id
+		LEFT JOIN fingerprints f ON f.track_id = t.id AND f.version = ?
+		WHERE m.status != 'deleted' AND f.track_id IS NULL
+	`
+	args := []interface{}{version}
+	if libraryID != "" {
+		query += " AND m.library_id = ?"
+		args = append(args, libraryID)
+	}
+	query += " ORDER BY m.path"
+
+	var ids []string
+	err := db.SelectContext(ctx, &ids, query, args...)
+	return ids, err
+}
+
 // Album represents a grouped album with version information
 type Album struct {
 	Name         string `db:"album_name" json:"name"`
@@ -723,7 +2069,7 @@ func (db *DB) ListAlbums(ctx context.Context, limit, offset int) ([]Album, int,
 			COUNT(DISTINCT t.id) as track_count,
 			COUNT(DISTINCT SUBSTR(m.path, 1, LENGTH(m.path) - LENGTH(m.filename) - 1)) as version_count,
 			GROUP_CONCAT(DISTINCT t.codec) as codecs,
-			SUM(m.size) as total_size,
+			SUM(CASE WHEN t.cue_index <= 1 THEN m.size ELSE 0 END) as total_size,
 			CASE WHEN COUNT(ar.id) > 0 AND SUM(CASE WHEN ar.lossless_status != 'pass' THEN 1 ELSE 0 END) > 0 THEN 1 ELSE 0 END as has_issues,
 			COALESCE((SELECT a.path FROM artifacts a WHERE a.track_id = (SELECT id FROM tracks WHERE album = t.album LIMIT 1) AND a.type = 'artwork' LIMIT 1), '') as artwork_path,
 			CAST(COALESCE(AVG(ar.loudness_range + ar.crest_factor/2), 0) AS INTEGER) as avg_dr,
@@ -768,7 +2114,7 @@ func (db *DB) GetAlbumVersions(ctx context.Context, albumName, artistName string
 			t.sample_rate,
 			t.bit_depth,
 			COUNT(t.id) as track_count,
-			SUM(m.size) as total_size
+			SUM(CASE WHEN t.cue_index <= 1 THEN m.size ELSE 0 END) as total_size
 		FROM tracks t
 		JOIN media_files m ON t.media_file_id = m.id
 		WHERE t.album = ? AND COALESCE(t.album_artist, t.artist) = ?
@@ -814,6 +2160,7 @@ type AlbumDetail struct {
 // AlbumTrack represents a track within an album with analysis data for consistency view
 type AlbumTrack struct {
 	ID               string  `db:"id" json:"id"`
+	CueIndex         int     `db:"cue_index" json:"cueIndex,omitempty"`
 	TrackNumber      int     `db:"track_number" json:"trackNumber"`
 	DiscNumber       int     `db:"disc_number" json:"discNumber"`
 	Title            string  `db:"title" json:"title"`
@@ -865,6 +2212,7 @@ func (db *DB) GetAlbumDetail(ctx context.Context, albumName, artistName string)
 	err := db.SelectContext(ctx, &tracks, `
 		SELECT
 			t.id,
+			t.cue_index,
 			COALESCE(t.track_number, 0) as track_number,
 			COALESCE(t.disc_number, 1) as disc_number,
 			COALESCE(t.title, m.filename) as title,
@@ -0,0 +1,23 @@
+-- Conversion provenance: links each output file back to its source,
+-- the profile settings and FFmpeg build that produced it
+
+CREATE TABLE IF NOT EXISTS provenance (
+    id TEXT PRIMARY KEY,
+    conversion_job_id TEXT NOT NULL,
+    output_path TEXT NOT NULL,
+    output_media_file_id TEXT,
+    output_sha256 TEXT NOT NULL DEFAULT '',
+    source_media_file_id TEXT NOT NULL,
+    source_path TEXT NOT NULL,
+    profile_id TEXT NOT NULL,
+    profile_json TEXT NOT NULL DEFAULT '{}',
+    ffmpeg_version TEXT NOT NULL DEFAULT '',
+    verify_status TEXT NOT NULL DEFAULT 'pending',
+    verify_json TEXT,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_provenance_job ON provenance(conversion_job_id);
+CREATE INDEX IF NOT EXISTS idx_provenance_output ON provenance(output_path);
+CREATE INDEX IF NOT EXISTS idx_provenance_output_file ON provenance(output_media_file_id);
+CREATE INDEX IF NOT EXISTS idx_provenance_source ON provenance(source_media_file_id);
@@ -0,0 +1,25 @@
+-- Duplicate detection: a decoded-audio hash alongside the full-file hash,
+-- and the duplicate sets built from them across all libraries
+
+ALTER TABLE media_files ADD COLUMN pcm_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_media_files_full_hash ON media_files(full_hash);
+CREATE INDEX IF NOT EXISTS idx_media_files_pcm_hash ON media_files(pcm_hash);
+
+CREATE TABLE IF NOT EXISTS duplicate_sets (
+    id TEXT PRIMARY KEY,
+    match_type TEXT NOT NULL,
+    match_key TEXT NOT NULL,
+    member_count INTEGER NOT NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS duplicate_set_members (
+    set_id TEXT NOT NULL REFERENCES duplicate_sets(id) ON DELETE CASCADE,
+    track_id TEXT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    rank INTEGER NOT NULL,
+    quality_score REAL NOT NULL,
+    PRIMARY KEY (set_id, track_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_duplicate_set_members_track ON duplicate_set_members(track_id);
@@ -0,0 +1,10 @@
+-- Acoustic fingerprints: one chroma-based fingerprint per track, used to
+-- find the same recording across encodings, masterings and releases
+
+CREATE TABLE IF NOT EXISTS fingerprints (
+    track_id TEXT PRIMARY KEY REFERENCES tracks(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    duration REAL NOT NULL,
+    data BLOB NOT NULL,
+    created_at DATETIME NOT NULL
+);
@@ -0,0 +1,29 @@
+-- Extended tag model: first-class columns for identifiers, credits and
+-- ReplayGain, plus every raw tag as read from the file
+
+ALTER TABLE tracks ADD COLUMN composer TEXT;
+ALTER TABLE tracks ADD COLUMN comment TEXT;
+ALTER TABLE tracks ADD COLUMN label TEXT;
+ALTER TABLE tracks ADD COLUMN catalog_number TEXT;
+ALTER TABLE tracks ADD COLUMN isrc TEXT;
+ALTER TABLE tracks ADD COLUMN total_tracks INTEGER;
+ALTER TABLE tracks ADD COLUMN total_discs INTEGER;
+ALTER TABLE tracks ADD COLUMN mb_recording_id TEXT;
+ALTER TABLE tracks ADD COLUMN mb_release_track_id TEXT;
+ALTER TABLE tracks ADD COLUMN mb_release_id TEXT;
+ALTER TABLE tracks ADD COLUMN mb_release_group_id TEXT;
+ALTER TABLE tracks ADD COLUMN mb_artist_id TEXT;
+ALTER TABLE tracks ADD COLUMN mb_album_artist_id TEXT;
+ALTER TABLE tracks ADD COLUMN replaygain_track_gain REAL;
+ALTER TABLE tracks ADD COLUMN replaygain_track_peak REAL;
+ALTER TABLE tracks ADD COLUMN replaygain_album_gain REAL;
+ALTER TABLE tracks ADD COLUMN replaygain_album_peak REAL;
+
+-- One row per tag value; multi-valued tags use consecutive positions
+CREATE TABLE IF NOT EXISTS track_tags (
+    track_id TEXT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (track_id, key, position)
+);
@@ -0,0 +1,4 @@
+-- Read-only libraries may route tag writes to a tagged copy under their
+-- output path instead of refusing them
+
+ALTER TABLE libraries ADD COLUMN copy_on_write INTEGER NOT NULL DEFAULT 0;
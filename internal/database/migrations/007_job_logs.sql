@@ -0,0 +1,23 @@
+-- Verbose job logs, kept across restarts and pruned by age and count
+
+CREATE TABLE IF NOT EXISTS job_logs (
+    job_id TEXT PRIMARY KEY,
+    track_id TEXT,
+    status TEXT NOT NULL DEFAULT 'running', -- running/completed/failed
+    started_at DATETIME NOT NULL,
+    ended_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS job_log_entries (
+    job_id TEXT NOT NULL REFERENCES job_logs(job_id) ON DELETE CASCADE,
+    seq INTEGER NOT NULL, -- 0-based position in the job's log
+    timestamp DATETIME NOT NULL,
+    level TEXT NOT NULL, -- info/debug/warn/error
+    module TEXT,
+    message TEXT NOT NULL,
+    details TEXT,
+    PRIMARY KEY (job_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_logs_started ON job_logs(started_at);
+CREATE INDEX IF NOT EXISTS idx_job_log_entries_level ON job_log_entries(job_id, level);
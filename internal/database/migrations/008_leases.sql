@@ -0,0 +1,6 @@
+-- Running jobs, conversions and scans hold a lease their worker renews;
+-- rows whose lease has expired were left behind by a crash or restart
+
+ALTER TABLE jobs ADD COLUMN lease_expires_at DATETIME;
+ALTER TABLE conversion_jobs ADD COLUMN lease_expires_at DATETIME;
+ALTER TABLE scan_runs ADD COLUMN lease_expires_at DATETIME;
@@ -0,0 +1,4 @@
+-- Scan runs started by the filesystem watcher rescan only the directories
+-- that changed
+
+ALTER TABLE scan_runs ADD COLUMN incremental BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Files found at a new path are matched to the files that disappeared and
+-- moved rather than deleted and re-added
+
+ALTER TABLE scan_runs ADD COLUMN files_moved INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Per-library include/exclude patterns, depth limit and symlink policy for
+-- scans, as JSON
+
+ALTER TABLE libraries ADD COLUMN scan_rules TEXT NOT NULL DEFAULT '{}';
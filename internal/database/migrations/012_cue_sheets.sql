@@ -0,0 +1,89 @@
+-- A file split by a cue sheet holds several tracks, each playing a range of
+-- it, so a track is keyed by its file and cue index rather than the file
+-- alone. SQLite can't drop a UNIQUE constraint, so the table is rebuilt;
+-- migrations run with foreign keys off, keeping the rows that refer to it.
+
+DROP VIEW IF EXISTS album_tracks;
+
+CREATE TABLE tracks_new (
+    id TEXT PRIMARY KEY,
+    media_file_id TEXT NOT NULL REFERENCES media_files(id) ON DELETE CASCADE,
+    cue_index INTEGER NOT NULL DEFAULT 0,
+    start_offset REAL NOT NULL DEFAULT 0,
+    duration REAL NOT NULL,
+    codec TEXT NOT NULL,
+    sample_rate INTEGER NOT NULL,
+    bit_depth INTEGER NOT NULL,
+    channels INTEGER NOT NULL,
+    bitrate INTEGER NOT NULL DEFAULT 0,
+    title TEXT,
+    artist TEXT,
+    album TEXT,
+    album_artist TEXT,
+    track_number INTEGER,
+    disc_number INTEGER,
+    year INTEGER,
+    genre TEXT,
+    has_artwork INTEGER NOT NULL DEFAULT 0,
+    artwork_width INTEGER,
+    artwork_height INTEGER,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    composer TEXT,
+    comment TEXT,
+    label TEXT,
+    catalog_number TEXT,
+    isrc TEXT,
+    total_tracks INTEGER,
+    total_discs INTEGER,
+    mb_recording_id TEXT,
+    mb_release_track_id TEXT,
+    mb_release_id TEXT,
+    mb_release_group_id TEXT,
+    mb_artist_id TEXT,
+    mb_album_artist_id TEXT,
+    replaygain_track_gain REAL,
+    replaygain_track_peak REAL,
+    replaygain_album_gain REAL,
+    replaygain_album_peak REAL
+);
+
+INSERT INTO tracks_new (id, media_file_id, duration, codec, sample_rate, bit_depth, channels, bitrate,
+    title, artist, album, album_artist, track_number, disc_number, year, genre,
+    has_artwork, artwork_width, artwork_height, created_at, updated_at,
+    composer, comment, label, catalog_number, isrc, total_tracks, total_discs,
+    mb_recording_id, mb_release_track_id, mb_release_id, mb_release_group_id, mb_artist_id, mb_album_artist_id,
+    replaygain_track_gain, replaygain_track_peak, replaygain_album_gain, replaygain_album_peak)
+SELECT id, media_file_id, duration, codec, sample_rate, bit_depth, channels, bitrate,
+    title, artist, album, album_artist, track_number, disc_number, year, genre,
+    has_artwork, artwork_width, artwork_height, created_at, updated_at,
+    composer, comment, label, catalog_number, isrc, total_tracks, total_discs,
+    mb_recording_id, mb_release_track_id, mb_release_id, mb_release_group_id, mb_artist_id, mb_album_artist_id,
+    replaygain_track_gain, replaygain_track_peak, replaygain_album_gain, replaygain_album_peak
+FROM tracks;
+
+DROP TABLE tracks;
+ALTER TABLE tracks_new RENAME TO tracks;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tracks_media_file ON tracks(media_file_id, cue_index);
+CREATE INDEX IF NOT EXISTS idx_tracks_album ON tracks(album);
+CREATE INDEX IF NOT EXISTS idx_tracks_artist ON tracks(artist);
+
+CREATE VIEW IF NOT EXISTS album_tracks AS
+SELECT
+    t.album,
+    t.album_artist,
+    t.year,
+    m.library_id,
+    COUNT(*) as track_count,
+    SUM(t.duration) as total_duration,
+    GROUP_CONCAT(DISTINCT t.genre) as genres
+FROM tracks t
+JOIN media_files m ON t.media_file_id = m.id
+WHERE t.album IS NOT NULL
+GROUP BY t.album, t.album_artist, m.library_id;
+
+-- The sidecar cue sheet of a file and its mtime, so editing the sheet
+-- splits the file again
+ALTER TABLE media_files ADD COLUMN cue_path TEXT;
+ALTER TABLE media_files ADD COLUMN cue_mtime DATETIME;
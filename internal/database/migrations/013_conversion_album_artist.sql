@@ -0,0 +1,5 @@
+-- An album is named by its title and artist, as albums by different artists
+-- can share a title; album conversions record the artist they were queued
+-- for
+
+ALTER TABLE conversion_jobs ADD COLUMN source_artist TEXT NOT NULL DEFAULT '';
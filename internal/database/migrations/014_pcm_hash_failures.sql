@@ -0,0 +1,7 @@
+-- Files whose audio can't be decoded have no PCM hash; the failure is kept
+-- with the size and mtime of the file it was met on, so duplicate detection
+-- doesn't decode the file again until it changes
+
+ALTER TABLE media_files ADD COLUMN pcm_error TEXT;
+ALTER TABLE media_files ADD COLUMN pcm_error_size INTEGER;
+ALTER TABLE media_files ADD COLUMN pcm_error_mtime DATETIME;
@@ -0,0 +1,279 @@
+package duplicates
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/audioscan"
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/iobudget"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// JobLogger interface for verbose logging
+type JobLogger interface {
+	Info(jobID, module, message string)
+	Debug(jobID, module, message, details string)
+	Warn(jobID, module, message, details string)
+	Error(jobID, module, message, details string)
+}
+
+// Detector hashes media files and groups copies of the same audio into
+// duplicate sets across all libraries
+type Detector struct {
+	db         *database.DB
+	ffmpegPath string
+}
+
+// New creates a new duplicate detector
+func New(db *database.DB, ffmpegPath string) *Detector {
+	return &Detector{
+		db:         db,
+		ffmpegPath: ffmpegPath,
+	}
+}
+
+// Run hashes files that have no full or PCM hash yet (in one library, or all
+// libraries when libraryID is empty) and rebuilds the duplicate sets
+func (d *Detector) Run(ctx context.Context, libraryID, jobID string, logger JobLogger) error {
+	logf := func(level, message, details string) {
+		log.Debug().Str("job_id", jobID).Str("level", level).Msg(message)
+		if logger == nil || jobID == "" {
+			return
+		}
+		switch level {
+		case "warn":
+			logger.Warn(jobID, "duplicates", message, details)
+		case "debug":
+			logger.Debug(jobID, "duplicates", message, details)
+		default:
+			logger.Info(jobID, "duplicates", message)
+		}
+	}
+
+	files, err := d.db.ListMediaFilesToHash(ctx, libraryID)
+	if err != nil {
+		return fmt.Errorf("list files to hash: %w", err)
+	}
+	logf("info", fmt.Sprintf("Hashing %d file(s)", len(files)), "")
+
+	failed := 0
+	for i := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		mf := &files[i]
+		if err := d.hashFile(ctx, mf); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failed++
+			logf("warn", "Failed to hash file", fmt.Sprintf("%s: %v", mf.Path, err))
+			continue
+		}
+		logf("debug", fmt.Sprintf("[%d/%d] Hashed", i+1, len(files)), mf.Path)
+	}
+	if failed > 0 {
+		logf("warn", fmt.Sprintf("%d file(s) could not be hashed", failed), "")
+	}
+
+	sets, err := d.Rebuild(ctx)
+	if err != nil {
+		return err
+	}
+	logf("info", fmt.Sprintf("Found %d duplicate set(s)", len(sets)), "")
+	return nil
+}
+
+// Rebuild regroups all hashed tracks into duplicate sets and stores them,
+// replacing the previous sets
+func (d *Detector) Rebuild(ctx context.Context) ([]models.DuplicateSet, error) {
+	candidates, err := d.db.ListDuplicateCandidates(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list duplicate candidates: %w", err)
+	}
+
+	sets := groupCandidates(candidates)
+	if err := d.db.ReplaceDuplicateSets(ctx, sets); err != nil {
+		return nil, fmt.Errorf("save duplicate sets: %w", err)
+	}
+	return sets, nil
+}
+
+// hashFile fills in whichever of the file's full and PCM hashes are missing.
+// A file that cannot be decoded keeps its full hash so byte-identical copies
+// still match, and isn't decoded again until it changes.
+func (d *Detector) hashFile(ctx context.Context, mf *models.MediaFile) error {
+	var decodeErr error
+	if !mf.FullHash.Valid {
+		sum, err := fileHash(ctx, mf.Path)
+		if err != nil {
+			return err
+		}
+		mf.FullHash = sql.NullString{String: sum, Valid: true}
+	}
+	if !mf.PCMHash.Valid && !pcmFailed(mf) {
+		sum, err := d.pcmHash(ctx, mf.Path)
+		if err == nil {
+			mf.PCMHash = sql.NullString{String: sum, Valid: true}
+		}
+		decodeErr = err
+	}
+
+	if err := d.db.SetMediaFileHashes(ctx, mf.ID, mf.FullHash, mf.PCMHash); err != nil {
+		return err
+	}
+	if decodeErr != nil {
+		if ctx.Err() == nil {
+			if err := d.db.SetMediaFilePCMError(ctx, mf.ID, decodeErr.Error()); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("pcm hash: %w", decodeErr)
+	}
+	return nil
+}
+
+// pcmFailed reports whether decoding the file failed as it is now
+func pcmFailed(mf *models.MediaFile) bool {
+	return mf.PCMError.Valid && mf.PCMErrorSize.Int64 == mf.Size && mf.PCMErrorMtime.Time.Equal(mf.Mtime)
+}
+
+// fileHash returns the SHA-256 of the whole file
+func fileHash(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, iobudget.Global().Reader(ctx, f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pcmHash returns the SHA-256 of the decoded samples at the source rate and
+// channel layout, so tags, artwork and container don't affect it
+func (d *Detector) pcmHash(ctx context.Context, path string) (string, error) {
+	h := sha256.New()
+	buf := make([]byte, 4)
+	err := audioscan.StreamPCM(ctx, d.ffmpegPath, path, audioscan.PCMOptions{}, func(samples []float32) error {
+		for _, s := range samples {
+			binary.LittleEndian.PutUint32(buf, math.Float32bits(s))
+			h.Write(buf)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// groupCandidates groups tracks by PCM hash, or by full hash for files that
+// could not be decoded, and ranks each group by quality
+func groupCandidates(candidates []database.DuplicateCandidate) []models.DuplicateSet {
+	groups := make(map[string][]*database.DuplicateCandidate)
+	var keys []string
+	for i := range candidates {
+		c := &candidates[i]
+		var key string
+		switch {
+		case c.PCMHash.Valid:
+			key = "pcm:" + c.PCMHash.String
+		case c.FullHash.Valid:
+			key = "file:" + c.FullHash.String
+		default:
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], c)
+	}
+
+	var sets []models.DuplicateSet
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+
+		set := models.DuplicateSet{
+			MatchType: models.MatchFile,
+			MatchKey:  key[strings.Index(key, ":")+1:],
+		}
+		for _, c := range group[1:] {
+			if c.FullHash != group[0].FullHash {
+				set.MatchType = models.MatchAudio
+				break
+			}
+		}
+
+		for _, c := range group {
+			c.QualityScore = qualityScore(c)
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			if group[i].QualityScore != group[j].QualityScore {
+				return group[i].QualityScore > group[j].QualityScore
+			}
+			return group[i].Path < group[j].Path
+		})
+		for i, c := range group {
+			member := c.DuplicateMember
+			member.Rank = i + 1
+			set.Members = append(set.Members, member)
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// qualityScore orders copies of the same audio: lossless before lossy,
+// authentic lossless before suspected transcodes, then bit depth, sample
+// rate, bitrate and dynamic range. Files that failed integrity checks sort
+// last.
+func qualityScore(c *database.DuplicateCandidate) float64 {
+	var score float64
+	if isLosslessCodec(c.Codec) {
+		score += 1000
+		switch c.LosslessStatus {
+		case models.LosslessWarn:
+			score -= 300
+		case models.LosslessFail:
+			score -= 600
+		}
+	} else {
+		score += float64(c.Bitrate) / 1000
+	}
+	score += float64(c.BitDepth) * 5
+	score += float64(c.SampleRate) / 1000
+	score += float64(c.DRScore) * 2
+	if !c.IntegrityOK {
+		score -= 2000
+	}
+	return score
+}
+
+// isLosslessCodec reports whether an ffprobe codec name is lossless
+func isLosslessCodec(codec string) bool {
+	codec = strings.ToLower(codec)
+	switch codec {
+	case "flac", "alac", "wav", "aiff", "ape", "wavpack", "tta":
+		return true
+	}
+	return strings.HasPrefix(codec, "pcm_") || strings.HasPrefix(codec, "dsd_")
+}
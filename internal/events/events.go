@@ -0,0 +1,189 @@
+// Package events fans out job, log, scan and conversion progress to live
+// subscribers, keeping a short history so clients can resume after a
+// reconnect
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types
+const (
+	TypeJob        = "job"        // job state transition
+	TypeLog        = "log"        // job log entry
+	TypeScan       = "scan"       // scan run progress
+	TypeConversion = "conversion" // conversion progress
+)
+
+// DefaultHistorySize is how many recent events are kept for resuming
+const DefaultHistorySize = 1000
+
+// subscriberBuffer is how many events a slow subscriber may fall behind
+// before it is dropped
+const subscriberBuffer = 256
+
+// Event is one published update. Its ID is "<epoch>-<seq>": the epoch is
+// drawn when the bus is created, so IDs from before a restart are told
+// apart, and the sequence increases by one per event.
+type Event struct {
+	ID        string      `json:"id"`
+	Seq       int64       `json:"-"`
+	Type      string      `json:"type"`
+	JobID     string      `json:"jobId,omitempty"`
+	LibraryID string      `json:"libraryId,omitempty"`
+	Time      time.Time   `json:"time"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// Filter selects events; empty fields match everything
+type Filter struct {
+	JobID     string
+	LibraryID string
+	Types     []string
+}
+
+func (f Filter) Match(e Event) bool {
+	if f.JobID != "" && e.JobID != f.JobID {
+		return false
+	}
+	if f.LibraryID != "" && e.LibraryID != f.LibraryID {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Bus publishes events to subscribers. A nil Bus discards events, so
+// services can be used without one.
+type Bus struct {
+	epoch   string
+	mu      sync.Mutex
+	lastID  int64
+	history []Event // ring of the last historySize events
+	start   int
+	size    int
+	subs    map[*Subscription]struct{}
+}
+
+// NewBus creates a bus remembering the last historySize events
+func NewBus(historySize int) *Bus {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
+	return &Bus{
+		epoch:   strings.ReplaceAll(uuid.NewString(), "-", "")[:12],
+		history: make([]Event, historySize),
+		subs:    make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the events matching its filter on C. C is closed
+// when the subscription is cancelled, or when the subscriber falls too far
+// behind; the client then resumes from the last ID it saw.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	filter Filter
+	bus    *Bus
+}
+
+// Publish assigns the event its ID and time and delivers it
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.Seq = b.lastID
+	e.ID = fmt.Sprintf("%s-%d", b.epoch, e.Seq)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if b.size < len(b.history) {
+		b.history[(b.start+b.size)%len(b.history)] = e
+		b.size++
+	} else {
+		b.history[b.start] = e
+		b.start = (b.start + 1) % len(b.history)
+	}
+
+	for sub := range b.subs {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// Subscribe starts receiving events matching filter. With a lastID from an
+// earlier subscription, the kept events after it are returned for replay;
+// complete is false when some events in between are no longer kept, or
+// lastID is from another epoch, before a restart, or malformed.
+func (b *Bus) Subscribe(filter Filter, lastID string) (sub *Subscription, replay []Event, complete bool) {
+	c := make(chan Event, subscriberBuffer)
+	sub = &Subscription{C: c, c: c, filter: filter, bus: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	complete = true
+	if lastID != "" {
+		seq, ok := b.parseID(lastID)
+		oldest := b.lastID - int64(b.size) + 1
+		if !ok || seq > b.lastID || seq < oldest-1 {
+			complete = false
+			seq = 0
+		}
+		for i := 0; i < b.size; i++ {
+			e := b.history[(b.start+i)%len(b.history)]
+			if e.Seq > seq && filter.Match(e) {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	b.subs[sub] = struct{}{}
+	return sub, replay, complete
+}
+
+// parseID returns the sequence of an event ID of this bus's epoch
+func (b *Bus) parseID(id string) (int64, bool) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found || epoch != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	return n, err == nil && n >= 0
+}
+
+// Cancel stops the subscription and closes C
+func (s *Subscription) Cancel() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+)
+
+// publish publishes n events of a job and returns their IDs
+func publish(b *Bus, jobID string, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		b.Publish(Event{Type: TypeLog, JobID: jobID})
+		ids = append(ids, fmt.Sprintf("%s-%d", b.epoch, b.lastID))
+	}
+	return ids
+}
+
+func seqs(events []Event) []int64 {
+	var s []int64
+	for _, e := range events {
+		s = append(s, e.Seq)
+	}
+	return s
+}
+
+func TestSubscribeResume(t *testing.T) {
+	b := NewBus(10)
+	ids := publish(b, "a", 6)
+	restarted := NewBus(10)
+
+	for _, tc := range []struct {
+		name     string
+		lastID   string
+		replay   int
+		complete bool
+	}{
+		{"new subscriber", "", 0, true},
+		{"up to date", ids[5], 0, true},
+		{"behind", ids[2], 3, true},
+		{"before the first event", b.epoch + "-0", 6, true},
+		// The client saw events of a bus since replaced by a restart
+		{"other epoch", restarted.epoch + "-3", 6, false},
+		{"ahead of the bus", b.epoch + "-7", 6, false},
+		{"malformed", "garbage", 6, false},
+		{"negative", b.epoch + "--1", 6, false},
+	} {
+		sub, replay, complete := b.Subscribe(Filter{}, tc.lastID)
+		sub.Cancel()
+		if len(replay) != tc.replay || complete != tc.complete {
+			t.Errorf("%s: replayed %v, complete %v; want %d events, complete %v", tc.name, seqs(replay), complete, tc.replay, tc.complete)
+		}
+	}
+}
+
+func TestHistoryOverflow(t *testing.T) {
+	b := NewBus(4)
+	ids := publish(b, "a", 10)
+
+	// Events 7 to 10 are kept
+	sub, replay, complete := b.Subscribe(Filter{}, ids[5])
+	sub.Cancel()
+	if got := seqs(replay); !complete || fmt.Sprint(got) != "[7 8 9 10]" {
+		t.Errorf("after the last dropped event: %v, complete %v", got, complete)
+	}
+
+	sub, replay, complete = b.Subscribe(Filter{}, ids[7])
+	sub.Cancel()
+	if got := seqs(replay); !complete || fmt.Sprint(got) != "[9 10]" {
+		t.Errorf("within the history: %v, complete %v", got, complete)
+	}
+
+	// Event 6 is gone, so all that is kept is replayed as incomplete
+	sub, replay, complete = b.Subscribe(Filter{}, ids[4])
+	sub.Cancel()
+	if got := seqs(replay); complete || fmt.Sprint(got) != "[7 8 9 10]" {
+		t.Errorf("with events dropped: %v, complete %v", got, complete)
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	b := NewBus(10)
+	publish(b, "a", 2)
+	b.Publish(Event{Type: TypeJob, JobID: "b", LibraryID: "lib"})
+
+	sub, replay, _ := b.Subscribe(Filter{JobID: "a"}, b.epoch+"-0")
+	defer sub.Cancel()
+	if got := seqs(replay); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("replayed %v", got)
+	}
+
+	b.Publish(Event{Type: TypeLog, JobID: "b"})
+	b.Publish(Event{Type: TypeLog, JobID: "a"})
+	if e := <-sub.C; e.Seq != 5 {
+		t.Errorf("received %+v", e)
+	}
+
+	for _, tc := range []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{LibraryID: "lib", Types: []string{TypeScan, TypeJob}}, true},
+		{Filter{LibraryID: "other"}, false},
+		{Filter{Types: []string{TypeLog}}, false},
+	} {
+		if got := tc.filter.Match(Event{Type: TypeJob, JobID: "b", LibraryID: "lib"}); got != tc.want {
+			t.Errorf("%+v matched %v", tc.filter, got)
+		}
+	}
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	b := NewBus(10)
+	sub, _, _ := b.Subscribe(Filter{}, "")
+	publish(b, "a", subscriberBuffer+1)
+
+	n := 0
+	for range sub.C {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("received %d events before being dropped, want %d", n, subscriberBuffer)
+	}
+	sub.Cancel() // already dropped; must not close C again
+}
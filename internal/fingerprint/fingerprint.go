@@ -0,0 +1,283 @@
+package fingerprint
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ottavia-music/ottavia/internal/audioscan"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// Version is bumped whenever the algorithm changes so stale fingerprints can
+// be recomputed
+const Version = 1
+
+// Chromaprint-style parameters: 11025 Hz mono, 4096-point frames with 2/3
+// overlap, 12 chroma bands from 28 Hz to 3520 Hz
+const (
+	sampleRate  = 11025
+	frameSize   = 4096
+	hopSize     = frameSize / 3
+	maxDuration = 120 // seconds fingerprinted from the start of the track
+
+	minFreq     = 28
+	maxFreq     = 3520
+	chromaBands = 12
+
+	// silenceNorm is the chroma energy below which a frame counts as silent
+	silenceNorm = 1e-10
+)
+
+// ItemDuration is the length of audio covered by one sub-fingerprint step
+const ItemDuration = float64(hopSize) / sampleRate
+
+// chromaFilter smooths the chroma image over five frames
+var chromaFilter = []float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+// filter is a Haar-like feature over the chroma image: a rectangle starting
+// at band y, height bands tall and width frames long
+type filter struct {
+	kind, y, height, width int
+}
+
+// quantizer maps a filter response onto four levels
+type quantizer struct {
+	t0, t1, t2 float64
+}
+
+type classifier struct {
+	filter
+	quantizer
+}
+
+// classifiers produce two bits each of every 32-bit sub-fingerprint. These
+// are Chromaprint's trained "test2" classifiers.
+var classifiers = [16]classifier{
+	{filter{0, 4, 3, 15}, quantizer{1.98215, 2.35817, 2.63523}},
+	{filter{4, 4, 6, 15}, quantizer{-1.03809, -0.651211, -0.282167}},
+	{filter{1, 0, 4, 16}, quantizer{-0.298702, 0.119262, 0.558497}},
+	{filter{3, 8, 2, 12}, quantizer{-0.105439, 0.0153946, 0.135898}},
+	{filter{3, 4, 4, 8}, quantizer{-0.142891, 0.0258736, 0.200632}},
+	{filter{4, 0, 3, 5}, quantizer{-0.826319, -0.590612, -0.368214}},
+	{filter{1, 2, 2, 9}, quantizer{-0.557409, -0.233035, 0.0534525}},
+	{filter{2, 7, 3, 4}, quantizer{-0.0646826, 0.00620476, 0.0784847}},
+	{filter{2, 6, 2, 16}, quantizer{-0.192387, -0.029699, 0.215855}},
+	{filter{2, 1, 3, 2}, quantizer{-0.0397818, -0.00568076, 0.0292026}},
+	{filter{5, 10, 1, 15}, quantizer{-0.53823, -0.369934, -0.190235}},
+	{filter{3, 6, 2, 10}, quantizer{-0.124877, 0.0296483, 0.139239}},
+	{filter{2, 1, 1, 14}, quantizer{-0.101475, 0.0225617, 0.231971}},
+	{filter{3, 5, 6, 4}, quantizer{-0.0799915, -0.00729616, 0.063262}},
+	{filter{1, 9, 2, 12}, quantizer{-0.272556, 0.019424, 0.302559}},
+	{filter{3, 4, 2, 14}, quantizer{-0.164292, -0.0321188, 0.0846339}},
+}
+
+// maxFilterWidth is the number of chroma frames each sub-fingerprint spans
+const maxFilterWidth = 16
+
+// grayCode keeps neighbouring quantizer levels one bit apart
+var grayCode = [4]uint32{0, 1, 3, 2}
+
+// Compute decodes the start of path, or of the range from start for
+// duration seconds, and returns its fingerprint. A zero duration runs to
+// the end of the file, which is fileDuration seconds long if known. TrackID
+// is left for the caller to fill in.
+func Compute(ctx context.Context, ffmpegPath, path string, start, duration, fileDuration float64) (*models.Fingerprint, error) {
+	chroma := newChromaExtractor()
+	stft := audioscan.NewSTFT(frameSize, hopSize, chroma.addFrame)
+
+	if duration <= 0 || duration > maxDuration {
+		duration = maxDuration
+	}
+	samples := 0
+	opts := audioscan.PCMOptions{
+		SampleRateHz:    sampleRate,
+		Channels:        1,
+		StartSec:        start,
+		DurationSec:     duration,
+		FileDurationSec: fileDuration,
+	}
+	err := audioscan.StreamPCM(ctx, ffmpegPath, path, opts, func(block []float32) error {
+		samples += len(block)
+		return stft.Write(block)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := computeItems(chroma.image())
+	if len(items) == 0 {
+		return nil, fmt.Errorf("audio too short to fingerprint")
+	}
+
+	return &models.Fingerprint{
+		Version:  Version,
+		Duration: float64(samples) / sampleRate,
+		Data:     Encode(items),
+	}, nil
+}
+
+// Encode packs sub-fingerprints as little-endian uint32s
+func Encode(items []uint32) []byte {
+	data := make([]byte, len(items)*4)
+	for i, v := range items {
+		binary.LittleEndian.PutUint32(data[i*4:], v)
+	}
+	return data
+}
+
+// Decode unpacks sub-fingerprints stored by Encode
+func Decode(data []byte) []uint32 {
+	items := make([]uint32, len(data)/4)
+	for i := range items {
+		items[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return items
+}
+
+// chromaExtractor folds each STFT power frame into 12 pitch classes
+type chromaExtractor struct {
+	notes  []int // chroma band per FFT bin, -1 outside minFreq..maxFreq
+	frames [][chromaBands]float64
+}
+
+func newChromaExtractor() *chromaExtractor {
+	c := &chromaExtractor{notes: make([]int, frameSize/2+1)}
+	minIndex := int(math.Round(float64(frameSize) * minFreq / sampleRate))
+	if minIndex < 1 {
+		minIndex = 1
+	}
+	maxIndex := int(math.Round(float64(frameSize) * maxFreq / sampleRate))
+	if maxIndex > frameSize/2 {
+		maxIndex = frameSize / 2
+	}
+
+	for i := range c.notes {
+		c.notes[i] = -1
+		if i < minIndex || i >= maxIndex {
+			continue
+		}
+		freq := float64(i) * sampleRate / frameSize
+		octave := math.Log2(freq / (440.0 / 16))
+		c.notes[i] = int(chromaBands * (octave - math.Floor(octave)))
+	}
+	return c
+}
+
+func (c *chromaExtractor) addFrame(power []float64) {
+	var frame [chromaBands]float64
+	for i, p := range power {
+		if note := c.notes[i]; note >= 0 {
+			frame[note] += p
+		}
+	}
+	c.frames = append(c.frames, frame)
+}
+
+// image returns the smoothed chroma frames, each scaled to unit length.
+// Silent frames are zeroed.
+func (c *chromaExtractor) image() [][chromaBands]float64 {
+	n := len(c.frames) - len(chromaFilter) + 1
+	if n <= 0 {
+		return nil
+	}
+
+	image := make([][chromaBands]float64, n)
+	for t := range image {
+		row := &image[t]
+		for k, coef := range chromaFilter {
+			for b := 0; b < chromaBands; b++ {
+				row[b] += coef * c.frames[t+k][b]
+			}
+		}
+
+		var norm float64
+		for _, v := range row {
+			norm += v * v
+		}
+		norm = math.Sqrt(norm)
+		for b := range row {
+			if norm < silenceNorm {
+				row[b] = 0
+			} else {
+				row[b] /= norm
+			}
+		}
+	}
+	return image
+}
+
+// computeItems slides the classifiers over the chroma image, producing one
+// sub-fingerprint per frame position
+func computeItems(image [][chromaBands]float64) []uint32 {
+	if len(image) < maxFilterWidth {
+		return nil
+	}
+
+	// Summed-area table with a zero row and column for O(1) rectangle sums
+	integral := make([][chromaBands + 1]float64, len(image)+1)
+	for t, row := range image {
+		for b, v := range row {
+			integral[t+1][b+1] = v + integral[t][b+1] + integral[t+1][b] - integral[t][b]
+		}
+	}
+	area := func(x1, y1, x2, y2 int) float64 {
+		return integral[x2][y2] - integral[x1][y2] - integral[x2][y1] + integral[x1][y1]
+	}
+
+	items := make([]uint32, len(image)-maxFilterWidth+1)
+	for x := range items {
+		var bits uint32
+		for _, c := range classifiers {
+			bits = bits<<2 | grayCode[c.quantize(c.apply(area, x))]
+		}
+		items[x] = bits
+	}
+	return items
+}
+
+// apply evaluates the filter at frame x as the log ratio of its light and
+// dark regions
+func (f filter) apply(area func(x1, y1, x2, y2 int) float64, x int) float64 {
+	y, w, h := f.y, f.width, f.height
+	var a, b float64
+	switch f.kind {
+	case 0: // whole rectangle
+		a = area(x, y, x+w, y+h)
+	case 1: // upper vs lower bands
+		h2 := h / 2
+		a = area(x, y+h2, x+w, y+h)
+		b = area(x, y, x+w, y+h2)
+	case 2: // later vs earlier frames
+		w2 := w / 2
+		a = area(x+w2, y, x+w, y+h)
+		b = area(x, y, x+w2, y+h)
+	case 3: // diagonal quadrants
+		w2, h2 := w/2, h/2
+		a = area(x, y+h2, x+w2, y+h) + area(x+w2, y, x+w, y+h2)
+		b = area(x, y, x+w2, y+h2) + area(x+w2, y+h2, x+w, y+h)
+	case 4: // middle band third vs outer thirds
+		h3 := h / 3
+		a = area(x, y+h3, x+w, y+2*h3)
+		b = area(x, y, x+w, y+h3) + area(x, y+2*h3, x+w, y+h)
+	case 5: // middle time third vs outer thirds
+		w3 := w / 3
+		a = area(x+w3, y, x+2*w3, y+h)
+		b = area(x, y, x+w3, y+h) + area(x+2*w3, y, x+w, y+h)
+	}
+	return math.Log((1 + a) / (1 + b))
+}
+
+func (q quantizer) quantize(v float64) int {
+	if v < q.t1 {
+		if v < q.t0 {
+			return 0
+		}
+		return 1
+	}
+	if v < q.t2 {
+		return 2
+	}
+	return 3
+}
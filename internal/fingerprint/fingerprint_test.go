@@ -0,0 +1,55 @@
+package fingerprint
+
+import "testing"
+
+func TestComputeItemsLength(t *testing.T) {
+	for _, tc := range []struct {
+		frames int
+		want   int
+	}{
+		{0, 0},
+		{maxFilterWidth - 1, 0},
+		{maxFilterWidth, 1},
+		{100, 100 - maxFilterWidth + 1},
+	} {
+		image := make([][chromaBands]float64, tc.frames)
+		for t := range image {
+			image[t][t%chromaBands] = 1
+		}
+		if got := len(computeItems(image)); got != tc.want {
+			t.Errorf("%d frames: %d items, want %d", tc.frames, got, tc.want)
+		}
+	}
+}
+
+func TestComputeItemsFollowImage(t *testing.T) {
+	// A chroma image that repeats every 12 frames gives sub-fingerprints
+	// that repeat with it
+	image := make([][chromaBands]float64, 60)
+	for t := range image {
+		image[t][t%chromaBands] = 1
+		image[t][(t*5)%chromaBands] = 0.5
+	}
+	items := computeItems(image)
+	for i := 0; i+chromaBands < len(items); i++ {
+		if items[i] != items[i+chromaBands] {
+			t.Fatalf("item %d = %08x, item %d = %08x", i, items[i], i+chromaBands, items[i+chromaBands])
+		}
+	}
+	if items[0] == items[1] {
+		t.Errorf("neighbouring frames of a changing image gave the same item")
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	items := []uint32{0, 1, 0xdeadbeef, 0xffffffff}
+	got := Decode(Encode(items))
+	if len(got) != len(items) {
+		t.Fatalf("decoded %d items", len(got))
+	}
+	for i := range items {
+		if got[i] != items[i] {
+			t.Errorf("item %d = %08x, want %08x", i, got[i], items[i])
+		}
+	}
+}
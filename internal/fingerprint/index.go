@@ -0,0 +1,329 @@
+package fingerprint
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// MatchThreshold is the minimum similarity (1 - bit error rate) for two
+// fingerprints to count as the same recording. Unrelated music scores
+// around 0.5; re-encodes of one master score well above 0.9.
+const MatchThreshold = 0.75
+
+const (
+	// minHits is how many distinct sub-fingerprints two tracks must share
+	// before they are aligned and compared
+	minHits = 10
+
+	// maxPostings drops sub-fingerprints shared by so many tracks (silence,
+	// sustained tones) that they no longer tell tracks apart
+	maxPostings = 500
+
+	// maxShift bounds the alignment search, about 15 seconds either way
+	maxShift = 120
+
+	// minOverlap is the fewest aligned sub-fingerprints a match is judged on,
+	// about 10 seconds
+	minOverlap = 80
+)
+
+// ErrNoFingerprint is returned when a track has not been fingerprinted yet
+var ErrNoFingerprint = errors.New("track has no fingerprint")
+
+// Pair is two tracks whose fingerprints match. Match carries the similarity
+// and offset.
+type Pair struct {
+	Track models.AcousticMatch `json:"track"`
+	Match models.AcousticMatch `json:"match"`
+}
+
+type entry struct {
+	track models.AcousticMatch
+	items []uint32
+}
+
+// hit is an indexed track that matched a query
+type hit struct {
+	entry      int
+	similarity float64
+	shift      int
+}
+
+// Index is an in-memory inverted index from sub-fingerprint values to the
+// tracks containing them. It is read-only once built.
+type Index struct {
+	entries  []entry
+	byTrack  map[string]int
+	postings map[uint32][]int32
+}
+
+// NewIndex builds an index over the given fingerprints
+func NewIndex(tracks []database.FingerprintTrack) *Index {
+	idx := &Index{
+		entries:  make([]entry, len(tracks)),
+		byTrack:  make(map[string]int, len(tracks)),
+		postings: make(map[uint32][]int32),
+	}
+	for i, t := range tracks {
+		idx.entries[i] = entry{track: t.AcousticMatch, items: Decode(t.Data)}
+		idx.byTrack[t.TrackID] = i
+		for v := range distinct(idx.entries[i].items) {
+			idx.postings[v] = append(idx.postings[v], int32(i))
+		}
+	}
+	return idx
+}
+
+// Len returns the number of indexed tracks
+func (idx *Index) Len() int {
+	return len(idx.entries)
+}
+
+// Similar returns the tracks that sound like trackID, best match first
+func (idx *Index) Similar(trackID string) ([]models.AcousticMatch, error) {
+	i, ok := idx.byTrack[trackID]
+	if !ok {
+		return nil, ErrNoFingerprint
+	}
+
+	var matches []models.AcousticMatch
+	for _, h := range idx.search(idx.entries[i].items, i) {
+		matches = append(matches, idx.match(h))
+	}
+	return matches, nil
+}
+
+// Pairs returns every pair of indexed tracks that sound alike, most similar
+// first
+func (idx *Index) Pairs() []Pair {
+	var pairs []Pair
+	for i, e := range idx.entries {
+		for _, h := range idx.search(e.items, i) {
+			// Hit counting and alignment are symmetric, so each pair is found
+			// from both sides; keep one
+			if h.entry < i {
+				continue
+			}
+			pairs = append(pairs, Pair{Track: e.track, Match: idx.match(h)})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].Match.Similarity > pairs[j].Match.Similarity
+	})
+	return pairs
+}
+
+// Mismatches returns matching pairs whose title or artist tags disagree:
+// files tagged as one recording that sound like another
+func (idx *Index) Mismatches() []Pair {
+	var mismatches []Pair
+	for _, p := range idx.Pairs() {
+		if tagsDisagree(p.Track, p.Match) {
+			mismatches = append(mismatches, p)
+		}
+	}
+	return mismatches
+}
+
+func (idx *Index) match(h hit) models.AcousticMatch {
+	m := idx.entries[h.entry].track
+	m.Similarity = h.similarity
+	m.OffsetSec = float64(h.shift) * ItemDuration
+	return m
+}
+
+// search finds indexed tracks sharing enough sub-fingerprints with items,
+// then aligns and scores each one. Entry skip (the query itself) is ignored.
+func (idx *Index) search(items []uint32, skip int) []hit {
+	counts := make(map[int32]int)
+	for v := range distinct(items) {
+		postings := idx.postings[v]
+		if len(postings) > maxPostings {
+			continue
+		}
+		for _, e := range postings {
+			if int(e) != skip {
+				counts[e]++
+			}
+		}
+	}
+
+	var hits []hit
+	for e, n := range counts {
+		if n < minHits {
+			continue
+		}
+		similarity, shift := Compare(items, idx.entries[e].items)
+		if similarity < MatchThreshold {
+			continue
+		}
+		hits = append(hits, hit{entry: int(e), similarity: similarity, shift: shift})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].similarity != hits[j].similarity {
+			return hits[i].similarity > hits[j].similarity
+		}
+		return idx.entries[hits[i].entry].track.Path < idx.entries[hits[j].entry].track.Path
+	})
+	return hits
+}
+
+// Compare aligns two fingerprints and returns the best similarity
+// (1 - bit error rate) and the shift in sub-fingerprints at which b lines up
+// with a
+func Compare(a, b []uint32) (float64, int) {
+	overlapMin := minOverlap
+	if len(a) < overlapMin {
+		overlapMin = len(a)
+	}
+	if len(b) < overlapMin {
+		overlapMin = len(b)
+	}
+
+	best, bestShift := 0.0, 0
+	for shift := -maxShift; shift <= maxShift; shift++ {
+		// a[i] lines up with b[i+shift]
+		start, end := 0, len(a)
+		if shift < 0 {
+			start = -shift
+		}
+		if len(b)-shift < end {
+			end = len(b) - shift
+		}
+		n := end - start
+		if n <= 0 || n < overlapMin {
+			continue
+		}
+
+		errs := 0
+		for i := start; i < end; i++ {
+			errs += bits.OnesCount32(a[i] ^ b[i+shift])
+		}
+		similarity := 1 - float64(errs)/float64(32*n)
+		if similarity > best {
+			best, bestShift = similarity, shift
+		}
+	}
+	return best, bestShift
+}
+
+// distinct returns the set of values in items
+func distinct(items []uint32) map[uint32]struct{} {
+	set := make(map[uint32]struct{}, len(items))
+	for _, v := range items {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// tagsDisagree reports whether two recordings that sound alike carry
+// different titles, or artists where neither contains the other (so
+// "Artist feat. Guest" still agrees with "Artist")
+func tagsDisagree(a, b models.AcousticMatch) bool {
+	titleA, titleB := normalizeTag(a.Title), normalizeTag(b.Title)
+	if titleA != "" && titleB != "" && titleA != titleB {
+		return true
+	}
+	artistA, artistB := normalizeTag(a.Artist), normalizeTag(b.Artist)
+	if artistA != "" && artistB != "" &&
+		!strings.Contains(artistA, artistB) && !strings.Contains(artistB, artistA) {
+		return true
+	}
+	return false
+}
+
+// normalizeTag lowercases a tag and drops bracketed qualifiers such as
+// "(Remastered 2011)" along with punctuation and spacing
+func normalizeTag(s sql.NullString) string {
+	if !s.Valid {
+		return ""
+	}
+	var sb strings.Builder
+	depth := 0
+	for _, r := range strings.ToLower(s.String) {
+		switch {
+		case r == '(' || r == '[':
+			depth++
+		case r == ')' || r == ']':
+			if depth > 0 {
+				depth--
+			}
+		case depth == 0 && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Matcher keeps an index over all stored fingerprints and rebuilds it when
+// fingerprints are added, replaced or removed
+type Matcher struct {
+	db *database.DB
+
+	mu    sync.Mutex
+	index *Index
+	stamp string
+}
+
+// NewMatcher creates a matcher; the index is loaded on first use
+func NewMatcher(db *database.DB) *Matcher {
+	return &Matcher{db: db}
+}
+
+// Index returns an up-to-date index
+func (m *Matcher) Index(ctx context.Context) (*Index, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stamp, err := m.db.GetFingerprintStamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if m.index != nil && stamp == m.stamp {
+		return m.index, nil
+	}
+
+	tracks, err := m.db.ListFingerprintTracks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.index = NewIndex(tracks)
+	m.stamp = stamp
+	return m.index, nil
+}
+
+// Similar returns the tracks that sound like trackID
+func (m *Matcher) Similar(ctx context.Context, trackID string) ([]models.AcousticMatch, error) {
+	idx, err := m.Index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Similar(trackID)
+}
+
+// Pairs returns every pair of tracks that sound alike
+func (m *Matcher) Pairs(ctx context.Context) ([]Pair, error) {
+	idx, err := m.Index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Pairs(), nil
+}
+
+// Mismatches returns pairs that sound alike but are tagged differently
+func (m *Matcher) Mismatches(ctx context.Context) ([]Pair, error) {
+	idx, err := m.Index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Mismatches(), nil
+}
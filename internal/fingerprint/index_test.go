@@ -0,0 +1,64 @@
+package fingerprint
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomItems(r *rand.Rand, n int) []uint32 {
+	items := make([]uint32, n)
+	for i := range items {
+		items[i] = r.Uint32()
+	}
+	return items
+}
+
+func TestCompare(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	a := randomItems(r, 300)
+
+	// noisy flips one bit in every fourth item
+	noisy := append([]uint32(nil), a...)
+	for i := 0; i < len(noisy); i += 4 {
+		noisy[i] ^= 1 << (i % 32)
+	}
+
+	// overlapping ends: the last 40 items of one are the first 40 of the
+	// other, too few to judge a match on
+	tail := randomItems(r, 100)
+	head := append(append([]uint32(nil), tail[60:]...), randomItems(r, 60)...)
+
+	for _, tc := range []struct {
+		name      string
+		a, b      []uint32
+		match     bool
+		shift     int
+		wantExact bool
+	}{
+		{"identical", a, a, true, 0, true},
+		// b starts 10 items into a, as when a has a longer lead-in
+		{"b starts later", a, a[10:], true, -10, true},
+		{"b has a lead-in", a, append(randomItems(r, 25), a...), true, 25, true},
+		{"noisy copy", a, noisy, true, 0, false},
+		{"shorter than the minimum overlap", a[:50], a[:50], true, 0, true},
+		{"short fingerprint inside a longer one", a, a[100:160], true, -100, true},
+		{"shift beyond the search", a, a[maxShift+1:], false, 0, false},
+		{"overlap too small", tail, head, false, 0, false},
+		{"unrelated", a, randomItems(r, 300), false, 0, false},
+	} {
+		similarity, shift := Compare(tc.a, tc.b)
+		if matched := similarity >= MatchThreshold; matched != tc.match {
+			t.Errorf("%s: similarity %.3f, want match %v", tc.name, similarity, tc.match)
+			continue
+		}
+		if !tc.match {
+			continue
+		}
+		if shift != tc.shift {
+			t.Errorf("%s: shift %d, want %d", tc.name, shift, tc.shift)
+		}
+		if tc.wantExact && similarity != 1 {
+			t.Errorf("%s: similarity %.3f, want 1", tc.name, similarity)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Package gc purges media files that have stayed deleted past a grace
+// period, along with their tracks and analysis, and removes the artifact
+// files no track refers to anymore
+package gc
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// JobLogger interface for verbose logging
+type JobLogger interface {
+	Info(jobID, module, message string)
+	Warn(jobID, module, message, details string)
+}
+
+// orphanMinAge leaves alone artifacts written too recently to be sure
+// they are orphaned, such as artwork moved into place before its row is
+// saved
+const orphanMinAge = time.Hour
+
+// maxReportedPaths bounds the paths listed in a report; all are counted
+const maxReportedPaths = 1000
+
+// Collector purges long-deleted media files and orphaned artifacts
+type Collector struct {
+	db            *database.DB
+	artifactsPath string
+	grace         time.Duration
+	interval      time.Duration
+
+	cancel context.CancelFunc
+}
+
+// New creates a collector. Files deleted for less than grace are kept, so
+// a file that comes back, like one on a temporarily unmounted disk, keeps
+// its history. Start queues a GC job every interval; 0 disables that.
+func New(db *database.DB, artifactsPath string, grace, interval time.Duration) *Collector {
+	return &Collector{
+		db:            db,
+		artifactsPath: artifactsPath,
+		grace:         grace,
+		interval:      interval,
+	}
+}
+
+// Report is what a GC run purged and removed, or would have for a dry run
+type Report struct {
+	DryRun           bool     `json:"dryRun"`
+	FilesPurged      int      `json:"filesPurged"`
+	TracksPurged     int      `json:"tracksPurged"`
+	ArtifactsRemoved int      `json:"artifactsRemoved"` // files and track directories
+	BytesReclaimed   int64    `json:"bytesReclaimed"`
+	Files            []string `json:"files"`     // paths of the purged media files
+	Artifacts        []string `json:"artifacts"` // relative to the artifacts path
+	Truncated        bool     `json:"truncated"` // more paths than listed
+}
+
+func (r *Report) addFile(path string) {
+	if len(r.Files) < maxReportedPaths {
+		r.Files = append(r.Files, path)
+	} else {
+		r.Truncated = true
+	}
+}
+
+func (r *Report) addArtifact(path string, size int64) {
+	r.ArtifactsRemoved++
+	r.BytesReclaimed += size
+	if len(r.Artifacts) < maxReportedPaths {
+		r.Artifacts = append(r.Artifacts, path)
+	} else {
+		r.Truncated = true
+	}
+}
+
+// Run purges media files deleted longer ago than the grace period, then
+// removes artifacts belonging to no track. A dry run only reports what
+// would go.
+func (c *Collector) Run(ctx context.Context, dryRun bool, jobID string, logger JobLogger) (*Report, error) {
+	logf := func(level, message string) {
+		log.Debug().Str("job_id", jobID).Str("level", level).Msg(message)
+		if logger == nil || jobID == "" {
+			return
+		}
+		if level == "warn" {
+			logger.Warn(jobID, "gc", message, "")
+		} else {
+			logger.Info(jobID, "gc", message)
+		}
+	}
+
+	report := &Report{DryRun: dryRun, Files: []string{}, Artifacts: []string{}}
+
+	files, err := c.db.ListPurgeableMediaFiles(ctx, time.Now().Add(-c.grace))
+	if err != nil {
+		return nil, fmt.Errorf("list deleted files: %w", err)
+	}
+	var ids []string
+	purgedTracks := make(map[string]bool)
+	for i, f := range files {
+		if f.TrackID.Valid {
+			purgedTracks[f.TrackID.String] = true
+		}
+		if i > 0 && files[i-1].ID == f.ID {
+			continue // another track of a file split by a cue sheet
+		}
+		ids = append(ids, f.ID)
+		report.addFile(f.Path)
+	}
+	report.FilesPurged = len(ids)
+	report.TracksPurged = len(purgedTracks)
+
+	if !dryRun && len(ids) > 0 {
+		n, err := c.db.PurgeMediaFiles(ctx, ids)
+		if err != nil {
+			return nil, fmt.Errorf("purge deleted files: %w", err)
+		}
+		report.FilesPurged = int(n)
+	}
+	logf("info", fmt.Sprintf("Purged %d file(s) deleted over %s ago, with %d track(s)", report.FilesPurged, c.grace, report.TracksPurged))
+
+	// A dry run still has the rows of the files it would purge, so their
+	// tracks are left out of the live ones by hand
+	trackIDs, err := c.db.ListTrackIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list tracks: %w", err)
+	}
+	liveTracks := make(map[string]bool, len(trackIDs))
+	for _, id := range trackIDs {
+		if !dryRun || !purgedTracks[id] {
+			liveTracks[id] = true
+		}
+	}
+	artifacts, err := c.db.ListArtifactFiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list artifacts: %w", err)
+	}
+	liveFiles := make(map[string]bool, len(artifacts))
+	for _, a := range artifacts {
+		if liveTracks[a.TrackID] {
+			liveFiles[filepath.Base(a.Path)] = true
+		}
+	}
+
+	if err := c.collectArtifacts(ctx, liveTracks, liveFiles, report); err != nil {
+		return nil, fmt.Errorf("remove orphaned artifacts: %w", err)
+	}
+	logf("info", fmt.Sprintf("Removed %d orphaned artifact(s), reclaiming %d bytes", report.ArtifactsRemoved, report.BytesReclaimed))
+
+	log.Info().
+		Bool("dry_run", dryRun).
+		Int("files", report.FilesPurged).
+		Int("tracks", report.TracksPurged).
+		Int("artifacts", report.ArtifactsRemoved).
+		Int64("bytes", report.BytesReclaimed).
+		Msg("Garbage collection completed")
+
+	return report, nil
+}
+
+// collectArtifacts removes the artifacts of tracks that no longer exist:
+// per-track directories under <prefix>/<track ID> (waveforms, spectrograms,
+// extracted artwork) and tracks/<prefix>/<track ID> (audio scan manifests
+// and series), and artwork_* files no artifact row refers to
+func (c *Collector) collectArtifacts(ctx context.Context, liveTracks, liveFiles map[string]bool, report *Report) error {
+	if c.artifactsPath == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(c.artifactsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(c.artifactsPath, entry.Name())
+		switch {
+		case entry.IsDir() && entry.Name() == "tracks":
+			prefixes, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			for _, prefix := range prefixes {
+				if prefix.IsDir() {
+					if err := c.collectTrackDirs(ctx, filepath.Join(path, prefix.Name()), liveTracks, report); err != nil {
+						return err
+					}
+				}
+			}
+		case entry.IsDir() && len(entry.Name()) == 2:
+			if err := c.collectTrackDirs(ctx, path, liveTracks, report); err != nil {
+				return err
+			}
+		case entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), "artwork_"):
+			if !liveFiles[entry.Name()] {
+				c.remove(path, report)
+			}
+		}
+	}
+	return nil
+}
+
+// collectTrackDirs removes the track directories in a prefix directory
+// whose tracks no longer exist
+func (c *Collector) collectTrackDirs(ctx context.Context, dir string, liveTracks map[string]bool, report *Report) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() && !liveTracks[entry.Name()] {
+			c.remove(filepath.Join(dir, entry.Name()), report)
+		}
+	}
+	return nil
+}
+
+// remove deletes an orphaned artifact file or directory, unless it is too
+// recent or this is a dry run, and adds it to the report
+func (c *Collector) remove(path string, report *Report) {
+	info, err := os.Lstat(path)
+	if err != nil || time.Since(info.ModTime()) < orphanMinAge {
+		return
+	}
+
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+
+	if !report.DryRun {
+		if err := os.RemoveAll(path); err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("Failed to remove orphaned artifact")
+			return
+		}
+	}
+	rel, err := filepath.Rel(c.artifactsPath, path)
+	if err != nil {
+		rel = path
+	}
+	report.addArtifact(filepath.ToSlash(rel), size)
+}
+
+// Queue queues a GC job, unless one is already queued or running, and
+// returns the pending job
+func (c *Collector) Queue(ctx context.Context) (*models.Job, error) {
+	latest, err := c.db.ListJobs(ctx, database.JobSelector{Type: "gc"}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(latest) > 0 && (latest[0].Status == models.StatusQueued || latest[0].Status == models.StatusRunning) {
+		return &latest[0], nil
+	}
+
+	job := &models.Job{
+		Type:        "gc",
+		TargetType:  "all",
+		MaxAttempts: 1,
+		ScheduledAt: time.Now(),
+	}
+	if err := c.db.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Start queues a GC job now and then every interval until Stop is called
+func (c *Collector) Start(ctx context.Context) {
+	if c.interval <= 0 {
+		return
+	}
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := c.Queue(ctx); err != nil && ctx.Err() == nil {
+				log.Error().Err(err).Msg("Failed to queue garbage collection")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (c *Collector) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
@@ -2,21 +2,33 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
 
 	"github.com/ottavia-music/ottavia/internal/analyzer"
 	"github.com/ottavia-music/ottavia/internal/artwork"
+	"github.com/ottavia-music/ottavia/internal/converter"
 	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/events"
+	"github.com/ottavia-music/ottavia/internal/fingerprint"
+	"github.com/ottavia-music/ottavia/internal/gc"
+	"github.com/ottavia-music/ottavia/internal/jobs"
 	"github.com/ottavia-music/ottavia/internal/metadata"
+	"github.com/ottavia-music/ottavia/internal/metadata/lookup"
 	"github.com/ottavia-music/ottavia/internal/models"
+	"github.com/ottavia-music/ottavia/internal/policy"
+	"github.com/ottavia-music/ottavia/internal/replaygain"
 	"github.com/ottavia-music/ottavia/internal/scanner"
 )
 
@@ -26,15 +38,29 @@ type Handler struct {
 	analyzer       *analyzer.Analyzer
 	metadataWriter *metadata.Writer
 	artworkManager *artwork.Manager
+	converter      *converter.Converter
+	worker         *jobs.Worker
+	matcher        *fingerprint.Matcher
+	lookup         *lookup.Service
+	gc             *gc.Collector
+	writePolicy    *policy.Policy
+	events         *events.Bus
 }
 
-func New(db *database.DB, scanner *scanner.Scanner, analyzer *analyzer.Analyzer, metadataWriter *metadata.Writer, artworkManager *artwork.Manager) *Handler {
+func New(db *database.DB, scanner *scanner.Scanner, analyzer *analyzer.Analyzer, metadataWriter *metadata.Writer, artworkManager *artwork.Manager, conv *converter.Converter, worker *jobs.Worker, matcher *fingerprint.Matcher, lookupSvc *lookup.Service, collector *gc.Collector, bus *events.Bus) *Handler {
 	return &Handler{
 		db:             db,
 		scanner:        scanner,
 		analyzer:       analyzer,
 		metadataWriter: metadataWriter,
 		artworkManager: artworkManager,
+		converter:      conv,
+		worker:         worker,
+		matcher:        matcher,
+		lookup:         lookupSvc,
+		gc:             collector,
+		writePolicy:    policy.New(db),
+		events:         bus,
 	}
 }
 
@@ -76,7 +102,33 @@ type CreateLibraryRequest struct {
 	RootPath     string `json:"rootPath"`
 	ScanInterval string `json:"scanInterval"`
 	ReadOnly     bool   `json:"readOnly"`
+	CopyOnWrite  bool   `json:"copyOnWrite"` // read-only: write tagged copies to the output path
 	OutputPath   string `json:"outputPath,omitempty"`
+
+	// Only files of these formats are scanned; empty allows every
+	// supported format. Left unchanged on update when omitted, as are the
+	// scan rules.
+	AllowedFormats []string          `json:"allowedFormats,omitempty"`
+	ScanRules      *models.ScanRules `json:"scanRules,omitempty"`
+}
+
+// applyScanRules sets the library's allowed formats and scan rules from a
+// request, leaving those the request omits unchanged
+func applyScanRules(lib *models.Library, req CreateLibraryRequest) error {
+	if req.AllowedFormats != nil {
+		formats, err := scanner.NormalizeFormats(req.AllowedFormats)
+		if err != nil {
+			return err
+		}
+		lib.AllowedFormats = sql.NullString{String: strings.Join(formats, ","), Valid: len(formats) > 0}
+	}
+	if req.ScanRules != nil {
+		if err := scanner.ValidateRules(*req.ScanRules); err != nil {
+			return err
+		}
+		lib.ScanRules = *req.ScanRules
+	}
+	return nil
 }
 
 func (h *Handler) CreateLibrary(w http.ResponseWriter, r *http.Request) {
@@ -96,11 +148,19 @@ func (h *Handler) CreateLibrary(w http.ResponseWriter, r *http.Request) {
 		RootPath:     req.RootPath,
 		ScanInterval: req.ScanInterval,
 		ReadOnly:     req.ReadOnly,
+		CopyOnWrite:  req.CopyOnWrite,
+	}
+	if req.OutputPath != "" {
+		lib.OutputPath = sql.NullString{String: req.OutputPath, Valid: true}
 	}
 
 	if req.ScanInterval == "" {
 		lib.ScanInterval = "15m"
 	}
+	if err := applyScanRules(lib, req); err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if err := h.db.CreateLibrary(r.Context(), lib); err != nil {
 		h.respondError(w, http.StatusInternalServerError, err.Error())
@@ -134,7 +194,15 @@ func (h *Handler) UpdateLibrary(w http.ResponseWriter, r *http.Request) {
 	if req.ScanInterval != "" {
 		lib.ScanInterval = req.ScanInterval
 	}
+	if req.OutputPath != "" {
+		lib.OutputPath = sql.NullString{String: req.OutputPath, Valid: true}
+	}
 	lib.ReadOnly = req.ReadOnly
+	lib.CopyOnWrite = req.CopyOnWrite
+	if err := applyScanRules(lib, req); err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if err := h.db.UpdateLibrary(r.Context(), lib); err != nil {
 		h.respondError(w, http.StatusInternalServerError, err.Error())
@@ -158,6 +226,15 @@ func (h *Handler) DeleteLibrary(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ScanLibrary(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 
+	if _, err := h.db.GetLibrary(r.Context(), id); err != nil {
+		h.respondError(w, http.StatusNotFound, "Library not found")
+		return
+	}
+	if h.scanner.IsScanning(id) {
+		h.respondError(w, http.StatusConflict, scanner.ErrScanInProgress.Error())
+		return
+	}
+
 	go func() {
 		ctx := context.Background()
 		result, err := h.scanner.ScanLibrary(ctx, id)
@@ -178,6 +255,80 @@ func (h *Handler) ScanLibrary(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// DryRunScan lists the files a scan of a library would include and leave
+// out. Allowed formats and scan rules in the body are tried in place of the
+// library's saved ones, without saving them.
+func (h *Handler) DryRunScan(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	lib, err := h.db.GetLibrary(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Library not found")
+		return
+	}
+
+	var req CreateLibraryRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	if err := applyScanRules(lib, req); err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := 500
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	result, err := h.scanner.DryRun(r.Context(), lib, limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, result)
+}
+
+// GetScanProgress returns the live counters of a library's scan in progress
+func (h *Handler) GetScanProgress(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	run, ok := h.scanner.Progress(id)
+	if !ok {
+		h.respondError(w, http.StatusNotFound, "No scan in progress")
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, run)
+}
+
+// CancelScan stops a library's scan in progress. The scan run is recorded
+// as cancelled once the walk has stopped.
+func (h *Handler) CancelScan(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	if !h.scanner.Cancel(id) {
+		h.respondError(w, http.StatusConflict, "No scan in progress")
+		return
+	}
+
+	h.respondJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Scan cancelling",
+		"status":  "cancelled",
+	})
+}
+
+// ListActiveScans returns the live counters of every scan in progress
+func (h *Handler) ListActiveScans(w http.ResponseWriter, r *http.Request) {
+	h.respondJSON(w, http.StatusOK, h.scanner.Active())
+}
+
 // Tracks
 
 func (h *Handler) ListTracks(w http.ResponseWriter, r *http.Request) {
@@ -233,6 +384,35 @@ func (h *Handler) GetTrack(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GetTrackTags returns every raw tag of a track as read from the file,
+// grouped by key
+func (h *Handler) GetTrackTags(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	track, err := h.db.GetTrack(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Track not found")
+		return
+	}
+
+	tags, err := h.db.ListTrackTags(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	grouped := make(map[string][]string)
+	for _, tag := range tags {
+		grouped[tag.Key] = append(grouped[tag.Key], tag.Value)
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"trackId":   id,
+		"container": metadata.ContainerForPath(track.Path),
+		"tags":      grouped,
+	})
+}
+
 func (h *Handler) GetTrackArtifacts(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 
@@ -245,15 +425,10 @@ func (h *Handler) GetTrackArtifacts(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, http.StatusOK, artifacts)
 }
 
+// UpdateTagsRequest carries the tags to change; omitted fields are left
+// alone. Raw tags go in "custom", keyed as in the file's container.
 type UpdateTagsRequest struct {
-	Title       *string `json:"title,omitempty"`
-	Artist      *string `json:"artist,omitempty"`
-	Album       *string `json:"album,omitempty"`
-	AlbumArtist *string `json:"albumArtist,omitempty"`
-	TrackNumber *int    `json:"trackNumber,omitempty"`
-	DiscNumber  *int    `json:"discNumber,omitempty"`
-	Year        *int    `json:"year,omitempty"`
-	Genre       *string `json:"genre,omitempty"`
+	metadata.TagChanges
 }
 
 // PreviewTrackTags performs a dry-run of tag changes showing what would be modified
@@ -266,16 +441,7 @@ func (h *Handler) PreviewTrackTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	changes := &metadata.TagChanges{
-		Title:       req.Title,
-		Artist:      req.Artist,
-		Album:       req.Album,
-		AlbumArtist: req.AlbumArtist,
-		TrackNumber: req.TrackNumber,
-		DiscNumber:  req.DiscNumber,
-		Year:        req.Year,
-		Genre:       req.Genre,
-	}
+	changes := &req.TagChanges
 
 	preview, err := h.metadataWriter.PreviewChanges(r.Context(), id, changes)
 	if err != nil {
@@ -296,16 +462,7 @@ func (h *Handler) UpdateTrackTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	changes := &metadata.TagChanges{
-		Title:       req.Title,
-		Artist:      req.Artist,
-		Album:       req.Album,
-		AlbumArtist: req.AlbumArtist,
-		TrackNumber: req.TrackNumber,
-		DiscNumber:  req.DiscNumber,
-		Year:        req.Year,
-		Genre:       req.Genre,
-	}
+	changes := &req.TagChanges
 
 	// Get actor from request (could be from auth header in future)
 	actor := r.Header.Get("X-Actor")
@@ -474,150 +631,170 @@ func (h *Handler) FixTrackNumbering(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, http.StatusOK, result)
 }
 
-// Jobs
+// Release lookup
 
-func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
-	status := r.URL.Query().Get("status")
-	limitStr := r.URL.Query().Get("limit")
+// LookupAlbum searches the lookup provider for an album and returns scored
+// candidate releases
+func (h *Handler) LookupAlbum(w http.ResponseWriter, r *http.Request) {
+	albumName := r.URL.Query().Get("album")
+	artist := r.URL.Query().Get("artist")
 
-	limit := 50
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-		}
+	if albumName == "" {
+		h.respondError(w, http.StatusBadRequest, "Album name is required")
+		return
 	}
 
-	jobs, err := h.db.ListJobs(r.Context(), status, limit)
+	candidates, err := h.lookup.Candidates(r.Context(), albumName, artist)
 	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, err.Error())
+		h.respondLookupError(w, err)
 		return
 	}
 
-	h.respondJSON(w, http.StatusOK, jobs)
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"provider":   h.lookup.ProviderName(),
+		"candidates": candidates,
+	})
 }
 
-// Settings
+type AlbumReleaseRequest struct {
+	AlbumName string `json:"albumName"`
+	Artist    string `json:"artist"`
+	ReleaseID string `json:"releaseId"`
+}
 
-func (h *Handler) GetSettings(w http.ResponseWriter, r *http.Request) {
-	category := r.URL.Query().Get("category")
+func (h *Handler) decodeAlbumReleaseRequest(w http.ResponseWriter, r *http.Request) (*AlbumReleaseRequest, bool) {
+	var req AlbumReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return nil, false
+	}
+	if req.AlbumName == "" {
+		h.respondError(w, http.StatusBadRequest, "Album name is required")
+		return nil, false
+	}
+	if req.ReleaseID == "" {
+		h.respondError(w, http.StatusBadRequest, "Release ID is required")
+		return nil, false
+	}
+	return &req, true
+}
 
-	settings, err := h.db.ListSettings(r.Context(), category)
-	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, err.Error())
+// PreviewAlbumRelease shows the tag changes a chosen release would make
+func (h *Handler) PreviewAlbumRelease(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decodeAlbumReleaseRequest(w, r)
+	if !ok {
 		return
 	}
 
-	result := make(map[string]interface{})
-	for _, s := range settings {
-		switch s.Type {
-		case "bool":
-			result[s.Key] = s.Value == "true"
-		case "int":
-			if v, err := strconv.Atoi(s.Value); err == nil {
-				result[s.Key] = v
-			}
-		default:
-			result[s.Key] = s.Value
-		}
+	preview, err := h.lookup.Preview(r.Context(), req.AlbumName, req.Artist, req.ReleaseID)
+	if err != nil {
+		h.respondLookupError(w, err)
+		return
 	}
 
-	h.respondJSON(w, http.StatusOK, result)
+	h.respondJSON(w, http.StatusOK, preview)
 }
 
-func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
-	var req map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+// ApplyAlbumRelease writes the tags of a user-confirmed release to the album
+func (h *Handler) ApplyAlbumRelease(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decodeAlbumReleaseRequest(w, r)
+	if !ok {
 		return
 	}
 
-	for key, value := range req {
-		existing, _ := h.db.GetSetting(r.Context(), key)
-
-		setting := &models.Setting{
-			Key:      key,
-			Category: "general",
-			Type:     "string",
-		}
-
-		if existing != nil {
-			setting.Category = existing.Category
-			setting.Type = existing.Type
-		}
-
-		switch v := value.(type) {
-		case bool:
-			setting.Value = strconv.FormatBool(v)
-			setting.Type = "bool"
-		case float64:
-			setting.Value = strconv.FormatInt(int64(v), 10)
-			setting.Type = "int"
-		case string:
-			setting.Value = v
-		default:
-			data, _ := json.Marshal(v)
-			setting.Value = string(data)
-			setting.Type = "json"
-		}
-
-		if err := h.db.SetSetting(r.Context(), setting); err != nil {
-			h.respondError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		actor = "system"
 	}
 
-	h.respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-}
-
-// Dashboard stats
-
-func (h *Handler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := h.db.GetDashboardStats(r.Context())
+	result, err := h.lookup.Apply(r.Context(), req.AlbumName, req.Artist, req.ReleaseID, actor)
 	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, err.Error())
+		h.respondLookupError(w, err)
 		return
 	}
-	h.respondJSON(w, http.StatusOK, stats)
+
+	h.respondJSON(w, http.StatusOK, result)
 }
 
-// Conversion profiles
+// ReplayGainRequest queues gain computation for one album
+type ReplayGainRequest struct {
+	AlbumName     string   `json:"albumName"`
+	Artist        string   `json:"artist"`
+	ReferenceLUFS *float64 `json:"referenceLufs,omitempty"` // defaults to the configured reference
+	DryRun        bool     `json:"dryRun"`
+}
 
-func (h *Handler) ListConversionProfiles(w http.ResponseWriter, r *http.Request) {
-	profiles, err := h.db.ListConversionProfiles(r.Context())
-	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, err.Error())
+// QueueReplayGain queues a job that measures an album and writes track and
+// album gain tags. A dry run only logs the diffs.
+func (h *Handler) QueueReplayGain(w http.ResponseWriter, r *http.Request) {
+	var req ReplayGainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.AlbumName == "" {
+		h.respondError(w, http.StatusBadRequest, "Album name is required")
+		return
+	}
+	if req.ReferenceLUFS != nil && (*req.ReferenceLUFS < -30 || *req.ReferenceLUFS > -5) {
+		h.respondError(w, http.StatusBadRequest, "Reference level must be between -30 and -5 LUFS")
 		return
 	}
-	h.respondJSON(w, http.StatusOK, profiles)
-}
-
-// Scan runs
 
-func (h *Handler) ListScanRuns(w http.ResponseWriter, r *http.Request) {
-	libraryID := chi.URLParam(r, "id")
-	limitStr := r.URL.Query().Get("limit")
+	if _, err := h.db.GetAlbumDetail(r.Context(), req.AlbumName, req.Artist); err != nil {
+		h.respondError(w, http.StatusNotFound, "Album not found")
+		return
+	}
 
-	limit := 20
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-		}
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		actor = "system"
 	}
 
-	runs, err := h.db.ListScanRuns(r.Context(), libraryID, limit)
-	if err != nil {
-		h.respondError(w, http.StatusInternalServerError, err.Error())
+	payload, _ := json.Marshal(replaygain.Options{
+		Album:     req.AlbumName,
+		Artist:    req.Artist,
+		Reference: req.ReferenceLUFS,
+		DryRun:    req.DryRun,
+		Actor:     actor,
+	})
+	job := &models.Job{
+		Type:        "replaygain",
+		TargetType:  "album",
+		TargetID:    req.AlbumName,
+		Status:      models.StatusQueued,
+		MaxAttempts: 1,
+		PayloadJSON: sql.NullString{String: string(payload), Valid: true},
+	}
+	if err := h.db.CreateJob(r.Context(), job); err != nil {
+		h.respondError(w, http.StatusInternalServerError, "Failed to queue ReplayGain job")
 		return
 	}
 
-	h.respondJSON(w, http.StatusOK, runs)
+	h.respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":  "queued",
+		"jobId":   job.ID,
+		"dryRun":  req.DryRun,
+		"message": "ReplayGain job queued",
+	})
 }
 
-// Action logs
+func (h *Handler) respondLookupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h.respondError(w, http.StatusNotFound, "Album not found")
+	case errors.Is(err, lookup.ErrReleaseNotFound):
+		h.respondError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, lookup.ErrNoMatchingTracks):
+		h.respondError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		h.respondError(w, http.StatusBadGateway, err.Error())
+	}
+}
 
-func (h *Handler) ListActionLogs(w http.ResponseWriter, r *http.Request) {
-	targetType := r.URL.Query().Get("target_type")
-	targetID := r.URL.Query().Get("target_id")
+// Jobs
+
+func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
 	limitStr := r.URL.Query().Get("limit")
 
 	limit := 50
@@ -627,27 +804,1007 @@ func (h *Handler) ListActionLogs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	logs, err := h.db.ListActionLogs(r.Context(), targetType, targetID, limit)
+	jobs, err := h.db.ListJobs(r.Context(), database.JobSelector{
+		Status:    r.URL.Query().Get("status"),
+		Type:      r.URL.Query().Get("type"),
+		LibraryID: r.URL.Query().Get("library_id"),
+	}, limit)
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	h.respondJSON(w, http.StatusOK, logs)
+	h.respondJSON(w, http.StatusOK, jobs)
 }
 
-// Artwork management
+// JobActionRequest selects jobs for a bulk queue operation by IDs, status,
+// type and library. An empty selector applies to every job in a state the
+// operation allows.
+type JobActionRequest struct {
+	database.JobSelector
+	Priority  *int   `json:"priority,omitempty"`
+	OlderThan string `json:"olderThan,omitempty"` // purge only: finished at least this long ago, e.g. "168h"
+}
 
-func (h *Handler) ListMissingArtwork(w http.ResponseWriter, r *http.Request) {
-	libraryID := r.URL.Query().Get("library_id")
+// CancelJobs cancels the selected queued and running jobs. Running jobs are
+// stopped by the worker, which aborts their ffmpeg processes.
+func (h *Handler) CancelJobs(w http.ResponseWriter, r *http.Request) {
+	var req JobActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
 
-	missing, err := h.artworkManager.ListMissingArtwork(r.Context(), libraryID)
+	count, err := h.cancelJobs(r.Context(), req.JobSelector)
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{"count": count})
+}
 
-	h.respondJSON(w, http.StatusOK, missing)
+func (h *Handler) cancelJobs(ctx context.Context, sel database.JobSelector) (int64, error) {
+	count, running, err := h.db.CancelJobs(ctx, sel)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range running {
+		if h.worker != nil {
+			h.worker.Cancel(id)
+		}
+	}
+	return count, nil
+}
+
+// RetryJobs queues the selected failed and cancelled jobs again
+func (h *Handler) RetryJobs(w http.ResponseWriter, r *http.Request) {
+	var req JobActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	count, err := h.db.RetryJobs(r.Context(), req.JobSelector)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{"count": count})
+}
+
+// SetJobsPriority changes the priority of the selected queued jobs
+func (h *Handler) SetJobsPriority(w http.ResponseWriter, r *http.Request) {
+	var req JobActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Priority == nil {
+		h.respondError(w, http.StatusBadRequest, "priority is required")
+		return
+	}
+
+	count, err := h.db.SetJobPriority(r.Context(), req.JobSelector, *req.Priority)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{"count": count})
+}
+
+// PurgeJobs deletes the selected finished jobs
+func (h *Handler) PurgeJobs(w http.ResponseWriter, r *http.Request) {
+	var req JobActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var before time.Time
+	if req.OlderThan != "" {
+		age, err := time.ParseDuration(req.OlderThan)
+		if err != nil || age < 0 {
+			h.respondError(w, http.StatusBadRequest, "Invalid olderThan duration")
+			return
+		}
+		before = time.Now().Add(-age)
+	}
+
+	count, err := h.db.PurgeJobs(r.Context(), req.JobSelector, before)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{"count": count})
+}
+
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	h.applyToJob(w, r, "cancelled", func(ctx context.Context, sel database.JobSelector) (int64, error) {
+		return h.cancelJobs(ctx, sel)
+	})
+}
+
+func (h *Handler) RetryJob(w http.ResponseWriter, r *http.Request) {
+	h.applyToJob(w, r, "retried", h.db.RetryJobs)
+}
+
+func (h *Handler) SetJobPriority(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Priority *int `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Priority == nil {
+		h.respondError(w, http.StatusBadRequest, "priority is required")
+		return
+	}
+
+	h.applyToJob(w, r, "reprioritized", func(ctx context.Context, sel database.JobSelector) (int64, error) {
+		return h.db.SetJobPriority(ctx, sel, *req.Priority)
+	})
+}
+
+func (h *Handler) DeleteJob(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	job, err := h.db.GetJob(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	count, err := h.db.PurgeJobs(r.Context(), database.JobSelector{IDs: []string{id}}, time.Time{})
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count == 0 {
+		h.respondError(w, http.StatusConflict, fmt.Sprintf("Job is %s and cannot be deleted", job.Status))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyToJob runs a queue operation on the job in the URL and responds
+// with the updated job, or 409 if the job's state does not allow it
+func (h *Handler) applyToJob(w http.ResponseWriter, r *http.Request, verb string, apply func(context.Context, database.JobSelector) (int64, error)) {
+	id := chi.URLParam(r, "id")
+
+	job, err := h.db.GetJob(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	count, err := apply(r.Context(), database.JobSelector{IDs: []string{id}})
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count == 0 {
+		h.respondError(w, http.StatusConflict, fmt.Sprintf("Job is %s and cannot be %s", job.Status, verb))
+		return
+	}
+
+	if job, err = h.db.GetJob(r.Context(), id); err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, job)
+}
+
+// Settings
+
+func (h *Handler) GetSettings(w http.ResponseWriter, r *http.Request) {
+	category := r.URL.Query().Get("category")
+
+	settings, err := h.db.ListSettings(r.Context(), category)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result := make(map[string]interface{})
+	for _, s := range settings {
+		switch s.Type {
+		case "bool":
+			result[s.Key] = s.Value == "true"
+		case "int":
+			if v, err := strconv.Atoi(s.Value); err == nil {
+				result[s.Key] = v
+			}
+		default:
+			result[s.Key] = s.Value
+		}
+	}
+
+	h.respondJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	for key, value := range req {
+		existing, _ := h.db.GetSetting(r.Context(), key)
+
+		setting := &models.Setting{
+			Key:      key,
+			Category: "general",
+			Type:     "string",
+		}
+
+		if existing != nil {
+			setting.Category = existing.Category
+			setting.Type = existing.Type
+		}
+
+		switch v := value.(type) {
+		case bool:
+			setting.Value = strconv.FormatBool(v)
+			setting.Type = "bool"
+		case float64:
+			setting.Value = strconv.FormatInt(int64(v), 10)
+			setting.Type = "int"
+		case string:
+			setting.Value = v
+		default:
+			data, _ := json.Marshal(v)
+			setting.Value = string(data)
+			setting.Type = "json"
+		}
+
+		if err := h.db.SetSetting(r.Context(), setting); err != nil {
+			h.respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Dashboard stats
+
+func (h *Handler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.db.GetDashboardStats(r.Context())
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, stats)
+}
+
+// Conversion profiles
+
+func (h *Handler) ListConversionProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := h.db.ListConversionProfiles(r.Context())
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, profiles)
+}
+
+type ConversionProfileRequest struct {
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Codec       string                `json:"codec"`
+	SampleRate  int                   `json:"sampleRate"`
+	BitDepth    int                   `json:"bitDepth"`
+	Bitrate     int                   `json:"bitrate"`
+	Options     models.ProfileOptions `json:"options"`
+}
+
+func (h *Handler) GetConversionProfile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	profile, err := h.db.GetConversionProfile(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Profile not found")
+		return
+	}
+	h.respondJSON(w, http.StatusOK, profile)
+}
+
+func (h *Handler) CreateConversionProfile(w http.ResponseWriter, r *http.Request) {
+	var req ConversionProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" || req.Codec == "" {
+		h.respondError(w, http.StatusBadRequest, "Name and codec are required")
+		return
+	}
+
+	profile := &models.ConversionProfile{
+		Name:        req.Name,
+		Description: req.Description,
+		Codec:       req.Codec,
+		SampleRate:  req.SampleRate,
+		BitDepth:    req.BitDepth,
+		Bitrate:     req.Bitrate,
+		Options:     req.Options,
+	}
+	if err := converter.ValidateProfile(profile); err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.db.CreateConversionProfile(r.Context(), profile); err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusCreated, profile)
+}
+
+// UpdateConversionProfile replaces a custom profile's settings. Builtin
+// profiles are read-only; clone them instead.
+func (h *Handler) UpdateConversionProfile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	profile, err := h.db.GetConversionProfile(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Profile not found")
+		return
+	}
+	if profile.IsBuiltin {
+		h.respondError(w, http.StatusForbidden, database.ErrBuiltinProfile.Error())
+		return
+	}
+
+	var req ConversionProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name != "" {
+		profile.Name = req.Name
+	}
+	if req.Codec != "" {
+		profile.Codec = req.Codec
+	}
+	profile.Description = req.Description
+	profile.SampleRate = req.SampleRate
+	profile.BitDepth = req.BitDepth
+	profile.Bitrate = req.Bitrate
+	profile.Options = req.Options
+
+	if err := converter.ValidateProfile(profile); err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.db.UpdateConversionProfile(r.Context(), profile); err != nil {
+		h.respondProfileError(w, err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, profile)
+}
+
+// CloneConversionProfile copies any profile, builtin or custom, into a new
+// editable profile
+func (h *Handler) CloneConversionProfile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	profile, err := h.db.GetConversionProfile(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Profile not found")
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	clone := *profile
+	clone.Name = req.Name
+	if clone.Name == "" {
+		clone.Name = profile.Name + " (copy)"
+	}
+	if err := h.db.CreateConversionProfile(r.Context(), &clone); err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusCreated, clone)
+}
+
+func (h *Handler) DeleteConversionProfile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	if err := h.db.DeleteConversionProfile(r.Context(), id); err != nil {
+		h.respondProfileError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) respondProfileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h.respondError(w, http.StatusNotFound, "Profile not found")
+	case errors.Is(err, database.ErrBuiltinProfile):
+		h.respondError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, database.ErrProfileInUse):
+		h.respondError(w, http.StatusConflict, err.Error())
+	default:
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Conversion jobs
+
+type CreateConversionRequest struct {
+	SourceType string `json:"sourceType"` // track/album/library
+	SourceID   string `json:"sourceId"`
+	Artist     string `json:"artist,omitempty"` // album artist, for albums
+	Profile    string `json:"profile"`
+	OutputPath string `json:"outputPath,omitempty"` // defaults to the library's output path
+}
+
+func (h *Handler) CreateConversion(w http.ResponseWriter, r *http.Request) {
+	var req CreateConversionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	switch req.SourceType {
+	case "track", "album", "library":
+	default:
+		h.respondError(w, http.StatusBadRequest, "sourceType must be track, album or library")
+		return
+	}
+	if req.SourceID == "" || req.Profile == "" {
+		h.respondError(w, http.StatusBadRequest, "sourceId and profile are required")
+		return
+	}
+	if req.OutputPath != "" && !validOutputPath(req.OutputPath) {
+		h.respondError(w, http.StatusBadRequest, "outputPath must be an absolute path without ..")
+		return
+	}
+
+	if _, err := h.db.GetConversionProfile(r.Context(), req.Profile); err != nil {
+		h.respondError(w, http.StatusBadRequest, "Profile not found")
+		return
+	}
+
+	tracks, err := h.converter.ResolveSources(r.Context(), req.SourceType, req.SourceID, req.Artist)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(tracks) == 0 {
+		h.respondError(w, http.StatusNotFound, "No tracks found for source")
+		return
+	}
+
+	outputPath := req.OutputPath
+	if outputPath == "" {
+		outputPath, err = h.converter.DefaultOutputPath(r.Context(), tracks)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Conversions create new files, so only the output location is checked
+	decision, err := h.writePolicy.Output(r.Context(), outputPath)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !decision.Allowed() {
+		h.respondError(w, http.StatusForbidden, decision.Reason)
+		return
+	}
+
+	job := &models.ConversionJob{
+		SourceType:   req.SourceType,
+		SourceID:     req.SourceID,
+		SourceArtist: req.Artist,
+		Profile:      req.Profile,
+		OutputPath:   outputPath,
+	}
+	if err := h.db.CreateConversionJob(r.Context(), job); err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"job":        job,
+		"trackCount": len(tracks),
+	})
+}
+
+// validOutputPath reports whether a conversion output path is absolute and
+// free of .. elements, so it can't escape the directory it names
+func validOutputPath(path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Handler) ListConversions(w http.ResponseWriter, r *http.Request) {
+	limitStr := r.URL.Query().Get("limit")
+
+	limit := 50
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	jobs, err := h.db.ListConversionJobs(r.Context(), limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, jobs)
+}
+
+func (h *Handler) GetConversion(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	job, err := h.db.GetConversionJob(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Conversion job not found")
+		return
+	}
+	h.respondJSON(w, http.StatusOK, job)
+}
+
+func (h *Handler) CancelConversion(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	job, err := h.db.GetConversionJob(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Conversion job not found")
+		return
+	}
+
+	// Queued jobs are cancelled in place; running jobs are stopped by the
+	// executor, which records the cancelled status when FFmpeg exits
+	cancelled, err := h.db.CancelQueuedConversionJob(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !cancelled && !h.converter.Cancel(id) {
+		h.respondError(w, http.StatusConflict, fmt.Sprintf("Job is %s and cannot be cancelled", job.Status))
+		return
+	}
+
+	h.respondJSON(w, http.StatusAccepted, map[string]string{
+		"status":  models.StatusCancelled,
+		"message": "Cancellation requested",
+	})
+}
+
+func (h *Handler) GetConversionLogs(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	job, err := h.db.GetConversionJob(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Conversion job not found")
+		return
+	}
+	if !job.LogsPath.Valid {
+		h.respondError(w, http.StatusNotFound, "No logs for this job")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeFile(w, r, job.LogsPath.String)
+}
+
+// ListConversionProvenance returns provenance and verification results for a job's outputs
+func (h *Handler) ListConversionProvenance(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	records, err := h.db.ListProvenance(r.Context(), id, "")
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondJSON(w, http.StatusOK, records)
+}
+
+// GetTrackProvenance returns the provenance of a track produced by a conversion
+func (h *Handler) GetTrackProvenance(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	track, err := h.db.GetTrack(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Track not found")
+		return
+	}
+
+	records, err := h.db.ListProvenance(r.Context(), "", track.MediaFileID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(records) == 0 {
+		h.respondError(w, http.StatusNotFound, "No provenance for this track")
+		return
+	}
+	h.respondJSON(w, http.StatusOK, records[len(records)-1])
+}
+
+// Duplicates
+
+func (h *Handler) ListDuplicateSets(w http.ResponseWriter, r *http.Request) {
+	limitStr := r.URL.Query().Get("limit")
+	offsetStr := r.URL.Query().Get("offset")
+
+	limit := 50
+	offset := 0
+
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+	if offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	sets, total, err := h.db.ListDuplicateSets(r.Context(), limit, offset)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sets":   sets,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+func (h *Handler) GetDuplicateSet(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	set, err := h.db.GetDuplicateSet(r.Context(), id)
+	if err != nil {
+		h.respondError(w, http.StatusNotFound, "Duplicate set not found")
+		return
+	}
+	h.respondJSON(w, http.StatusOK, set)
+}
+
+// RunDuplicateScan queues a job that hashes new or changed files (optionally
+// only in one library) and regroups duplicates across all libraries
+func (h *Handler) RunDuplicateScan(w http.ResponseWriter, r *http.Request) {
+	libraryID := r.URL.Query().Get("library_id")
+
+	job := &models.Job{
+		Type:        "duplicates",
+		TargetType:  "all",
+		Status:      models.StatusQueued,
+		MaxAttempts: 1,
+	}
+	if libraryID != "" {
+		if _, err := h.db.GetLibrary(r.Context(), libraryID); err != nil {
+			h.respondError(w, http.StatusNotFound, "Library not found")
+			return
+		}
+		job.TargetType = "library"
+		job.TargetID = libraryID
+	}
+
+	if err := h.db.CreateJob(r.Context(), job); err != nil {
+		h.respondError(w, http.StatusInternalServerError, "Failed to queue duplicate scan job")
+		return
+	}
+
+	h.respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":  "queued",
+		"jobId":   job.ID,
+		"message": "Duplicate scan job queued",
+	})
+}
+
+// Garbage collection
+
+// RunGC queues a job purging files deleted longer than the grace period and
+// orphaned artifacts. With dry_run=true it runs at once and reports what
+// would be purged and the disk space it would reclaim, without removing
+// anything.
+func (h *Handler) RunGC(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("dry_run") == "true" {
+		report, err := h.gc.Run(r.Context(), true, "", nil)
+		if err != nil {
+			h.respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		h.respondJSON(w, http.StatusOK, report)
+		return
+	}
+
+	job, err := h.gc.Queue(r.Context())
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, "Failed to queue garbage collection job")
+		return
+	}
+
+	h.respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":  job.Status,
+		"jobId":   job.ID,
+		"message": "Garbage collection job queued",
+	})
+}
+
+// Acoustic fingerprints
+
+// GetSimilarTracks returns the tracks whose fingerprints match this one
+func (h *Handler) GetSimilarTracks(w http.ResponseWriter, r *http.Request) {
+	trackID := chi.URLParam(r, "id")
+
+	if _, err := h.db.GetTrack(r.Context(), trackID); err != nil {
+		h.respondError(w, http.StatusNotFound, "Track not found")
+		return
+	}
+
+	matches, err := h.matcher.Similar(r.Context(), trackID)
+	if err != nil {
+		if errors.Is(err, fingerprint.ErrNoFingerprint) {
+			h.respondError(w, http.StatusConflict, err.Error())
+			return
+		}
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if matches == nil {
+		matches = []models.AcousticMatch{}
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"trackId":   trackID,
+		"matches":   matches,
+		"threshold": fingerprint.MatchThreshold,
+	})
+}
+
+// ListAcousticMatches returns every pair of tracks that sound alike
+func (h *Handler) ListAcousticMatches(w http.ResponseWriter, r *http.Request) {
+	pairs, err := h.matcher.Pairs(r.Context())
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondPairs(w, r, pairs)
+}
+
+// ListTagMismatches returns pairs of tracks that sound alike but carry
+// different title or artist tags
+func (h *Handler) ListTagMismatches(w http.ResponseWriter, r *http.Request) {
+	pairs, err := h.matcher.Mismatches(r.Context())
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondPairs(w, r, pairs)
+}
+
+func (h *Handler) respondPairs(w http.ResponseWriter, r *http.Request, pairs []fingerprint.Pair) {
+	limitStr := r.URL.Query().Get("limit")
+	offsetStr := r.URL.Query().Get("offset")
+
+	limit := 50
+	offset := 0
+
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+	if offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+
+	total := len(pairs)
+	page := []fingerprint.Pair{}
+	if offset < total {
+		end := offset + limit
+		if end > total {
+			end = total
+		}
+		page = pairs[offset:end]
+	}
+
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"pairs":  page,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// RunFingerprintScan queues fingerprint jobs for tracks analyzed before
+// fingerprinting existed or with an older algorithm version (optionally
+// filtered by library)
+func (h *Handler) RunFingerprintScan(w http.ResponseWriter, r *http.Request) {
+	libraryID := r.URL.Query().Get("library_id")
+
+	trackIDs, err := h.db.ListTracksWithoutFingerprint(r.Context(), libraryID, fingerprint.Version)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	queued := 0
+	skipped := 0
+
+	for _, trackID := range trackIDs {
+		job := &models.Job{
+			Type:        "fingerprint",
+			TargetType:  "track",
+			TargetID:    trackID,
+			Status:      models.StatusQueued,
+			MaxAttempts: 3,
+		}
+
+		if err := h.db.CreateJob(r.Context(), job); err != nil {
+			log.Warn().Err(err).Str("trackId", trackID).Msg("Failed to queue fingerprint job")
+			skipped++
+			continue
+		}
+		queued++
+	}
+
+	h.respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":  "queued",
+		"total":   len(trackIDs),
+		"queued":  queued,
+		"skipped": skipped,
+		"message": fmt.Sprintf("Queued %d fingerprint jobs", queued),
+	})
+}
+
+// Scan runs
+
+func (h *Handler) ListScanRuns(w http.ResponseWriter, r *http.Request) {
+	libraryID := chi.URLParam(r, "id")
+	limitStr := r.URL.Query().Get("limit")
+
+	limit := 20
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	runs, err := h.db.ListScanRuns(r.Context(), libraryID, limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, runs)
+}
+
+// Action logs
+
+func (h *Handler) ListActionLogs(w http.ResponseWriter, r *http.Request) {
+	targetType := r.URL.Query().Get("target_type")
+	targetID := r.URL.Query().Get("target_id")
+	limitStr := r.URL.Query().Get("limit")
+
+	limit := 50
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	logs, err := h.db.ListActionLogs(r.Context(), targetType, targetID, limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, logs)
+}
+
+type RevertRequest struct {
+	Force bool `json:"force"` // revert tracks edited again since the action
+}
+
+// PreviewRevert previews restoring the tags from before an action log entry
+func (h *Handler) PreviewRevert(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	preview, err := h.metadataWriter.PreviewRevert(r.Context(), id)
+	if err != nil {
+		h.respondRevertError(w, err)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, preview)
+}
+
+// RevertAction restores the tags from before a tag edit or bulk operation
+func (h *Handler) RevertAction(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req RevertRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		actor = "system"
+	}
+
+	result, err := h.metadataWriter.Revert(r.Context(), id, actor, req.Force)
+	if err != nil {
+		h.respondRevertError(w, err)
+		return
+	}
+
+	// Nothing was reverted because every track was edited again since
+	if result.SkippedCount > 0 && result.SuccessCount == 0 {
+		h.respondJSON(w, http.StatusConflict, result)
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) respondRevertError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h.respondError(w, http.StatusNotFound, "Action log not found")
+	case errors.Is(err, metadata.ErrNotRevertable):
+		h.respondError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Artwork management
+
+func (h *Handler) ListMissingArtwork(w http.ResponseWriter, r *http.Request) {
+	libraryID := r.URL.Query().Get("library_id")
+
+	missing, err := h.artworkManager.ListMissingArtwork(r.Context(), libraryID)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, missing)
 }
 
 type ExtractArtworkRequest struct {
@@ -717,6 +1874,10 @@ func (h *Handler) UploadArtwork(w http.ResponseWriter, r *http.Request) {
 	}
 
 	artworkInfo, err := h.artworkManager.UploadArtwork(r.Context(), trackID, imageData, mimeType)
+	if errors.Is(err, policy.ErrReadOnly) {
+		h.respondError(w, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		h.respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -895,69 +2056,218 @@ func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 
 // Job logs - for verbose output during scans
 
-// JobLoggerInterface allows dependency injection of the job logger
-type JobLoggerInterface interface {
-	GetLogSince(jobID string, sinceIndex int) ([]interface{}, int, string)
-	GetRecentJobs(limit int) interface{}
-	GetLog(jobID string) interface{}
-}
-
-var globalJobLogger JobLoggerInterface
-
-// SetJobLogger sets the global job logger for handlers
-func SetJobLogger(logger JobLoggerInterface) {
-	globalJobLogger = logger
+// jobLogFilter reads the level and module filters, each a comma-separated
+// list
+func jobLogFilter(r *http.Request) database.JobLogFilter {
+	split := func(v string) []string {
+		var out []string
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return database.JobLogFilter{
+		Status:  r.URL.Query().Get("status"),
+		Levels:  split(r.URL.Query().Get("level")),
+		Modules: split(r.URL.Query().Get("module")),
+	}
 }
 
 func (h *Handler) GetJobLogs(w http.ResponseWriter, r *http.Request) {
 	jobID := chi.URLParam(r, "id")
 	sinceStr := r.URL.Query().Get("since")
-
-	if globalJobLogger == nil {
-		h.respondError(w, http.StatusServiceUnavailable, "Job logger not available")
-		return
-	}
+	limitStr := r.URL.Query().Get("limit")
 
 	var sinceIndex int
 	if sinceStr != "" {
-		if parsed, err := strconv.Atoi(sinceStr); err == nil {
+		if parsed, err := strconv.Atoi(sinceStr); err == nil && parsed > 0 {
 			sinceIndex = parsed
 		}
 	}
+	limit := 500
+	if limitStr != "" {
+		if parsed, err := strconv.Atoi(limitStr); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
 
-	entries, nextIndex, status := globalJobLogger.GetLogSince(jobID, sinceIndex)
+	// Read the header first: every entry below its count has been written,
+	// so the next poll can start there even if the filter skipped them
+	jobLog, err := h.db.GetJobLog(r.Context(), jobID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			h.respondError(w, http.StatusNotFound, "Job not found")
+			return
+		}
+		h.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	if entries == nil {
-		h.respondError(w, http.StatusNotFound, "Job not found")
+	entries, err := h.db.ListJobLogEntries(r.Context(), jobID, sinceIndex, jobLogFilter(r), limit)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if entries == nil {
+		entries = []models.JobLogEntry{}
+	}
+
+	nextIndex := sinceIndex
+	if len(entries) > 0 {
+		nextIndex = entries[len(entries)-1].Index + 1
+	}
+	if len(entries) < limit && jobLog.EntryCount > nextIndex {
+		nextIndex = jobLog.EntryCount
+	}
 
 	h.respondJSON(w, http.StatusOK, map[string]interface{}{
 		"entries":   entries,
 		"nextIndex": nextIndex,
-		"status":    status,
+		"status":    jobLog.Status,
 	})
 }
 
 func (h *Handler) ListJobLogs(w http.ResponseWriter, r *http.Request) {
 	limitStr := r.URL.Query().Get("limit")
+	offsetStr := r.URL.Query().Get("offset")
+
 	limit := 20
+	offset := 0
+
 	if limitStr != "" {
 		if parsed, err := strconv.Atoi(limitStr); err == nil && parsed > 0 {
 			limit = parsed
 		}
 	}
+	if offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			offset = o
+		}
+	}
 
-	if globalJobLogger == nil {
-		h.respondJSON(w, http.StatusOK, map[string]interface{}{
-			"jobs": []interface{}{},
-		})
+	jobs, total, err := h.db.ListJobLogs(r.Context(), jobLogFilter(r), limit, offset)
+	if err != nil {
+		h.respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	jobs := globalJobLogger.GetRecentJobs(limit)
+	if jobs == nil {
+		jobs = []models.JobLog{}
+	}
 
 	h.respondJSON(w, http.StatusOK, map[string]interface{}{
-		"jobs": jobs,
+		"jobs":   jobs,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// Event streams - Server-Sent Events for job state, log entries, scan and
+// conversion progress
+
+// eventKeepAlive is how often an idle stream sends a comment so proxies
+// keep the connection open
+const eventKeepAlive = 15 * time.Second
+
+// StreamEvents streams every event, optionally narrowed with the job,
+// library and types query parameters
+func (h *Handler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	h.streamEvents(w, r, events.Filter{
+		JobID:     r.URL.Query().Get("job"),
+		LibraryID: r.URL.Query().Get("library"),
 	})
 }
+
+func (h *Handler) StreamJobEvents(w http.ResponseWriter, r *http.Request) {
+	h.streamEvents(w, r, events.Filter{JobID: chi.URLParam(r, "id")})
+}
+
+func (h *Handler) StreamLibraryEvents(w http.ResponseWriter, r *http.Request) {
+	h.streamEvents(w, r, events.Filter{LibraryID: chi.URLParam(r, "id")})
+}
+
+// streamEvents writes events matching filter until the client goes away.
+// A reconnecting client resumes after its Last-Event-ID header (or the
+// lastEventId query parameter); when events in between were dropped from
+// the history a "reset" event is sent first so it can reload its state.
+func (h *Handler) streamEvents(w http.ResponseWriter, r *http.Request, filter events.Filter) {
+	if h.events == nil {
+		h.respondError(w, http.StatusServiceUnavailable, "Event stream not available")
+		return
+	}
+
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.Types = append(filter.Types, t)
+		}
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+
+	sub, replay, complete := h.events.Subscribe(filter, lastID)
+	defer sub.Cancel()
+
+	// Streams outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Debug().Err(err).Msg("Could not clear write deadline for event stream")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if lastID != "" && !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range replay {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				// Dropped for falling behind; the client reconnects and resumes
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
@@ -0,0 +1,138 @@
+// Package iobudget limits how fast background work reads from the library,
+// so bulk analysis doesn't saturate a NAS that is also serving playback
+package iobudget
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Budget is a token bucket of bytes shared by every reader. Reads larger
+// than the bucket go into debt, delaying the next reader instead of being
+// split. A nil Budget is unlimited.
+type Budget struct {
+	rate float64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New creates a budget of bytesPerSec, allowing a burst of one second's
+// worth. Returns nil, an unlimited budget, if bytesPerSec is not positive.
+func New(bytesPerSec int64) *Budget {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &Budget{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n bytes from the budget, blocking until they are available or
+// ctx is done. Bytes taken before ctx is done are not returned.
+func (b *Budget) Wait(ctx context.Context, n int64) error {
+	if b == nil || n <= 0 {
+		return ctx.Err()
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// WaitFile takes the size of the file at path from the budget. It is used
+// before handing a file to ffmpeg, whose reads can't be metered directly.
+// A file that can't be stat'ed is left for the caller to report.
+func (b *Budget) WaitFile(ctx context.Context, path string) error {
+	return b.WaitRange(ctx, path, 0, 0)
+}
+
+// WaitRange takes the share of the file at path that duration seconds of
+// its fileDuration make up, for ffmpeg seeking to a range of the file and
+// reading only that, like the tracks of a cue sheet. Without both
+// durations, or for a range as long as the file, it takes the whole file.
+func (b *Budget) WaitRange(ctx context.Context, path string, duration, fileDuration float64) error {
+	if b == nil {
+		return ctx.Err()
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ctx.Err()
+	}
+	return b.Wait(ctx, rangeBytes(info.Size(), duration, fileDuration))
+}
+
+// rangeBytes returns how many of a file's size bytes reading duration
+// seconds of its fileDuration takes, assuming a constant bitrate
+func rangeBytes(size int64, duration, fileDuration float64) int64 {
+	if duration <= 0 || fileDuration <= 0 || duration >= fileDuration {
+		return size
+	}
+	return int64(math.Ceil(float64(size) * duration / fileDuration))
+}
+
+// Reader meters reads from r against the budget
+func (b *Budget) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, b: b}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *Budget
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.b.Wait(r.ctx, int64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Global budget, replaced by SetGlobal at startup
+var global *Budget
+
+// Global returns the budget shared by all background reads
+func Global() *Budget {
+	return global
+}
+
+// SetGlobal sets the budget shared by all background reads
+func SetGlobal(b *Budget) {
+	global = b
+}
@@ -1,89 +1,113 @@
 package jobs
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/events"
+	"github.com/ottavia-music/ottavia/internal/models"
 )
 
-// LogEntry represents a single log entry for a job
-type LogEntry struct {
-	Timestamp time.Time `json:"timestamp"`
-	Level     string    `json:"level"` // info, warn, error, debug
-	Module    string    `json:"module,omitempty"`
-	Message   string    `json:"message"`
-	Details   string    `json:"details,omitempty"`
+// LogRetention bounds how many job logs are kept. A zero field disables
+// that limit.
+type LogRetention struct {
+	MaxAge  time.Duration
+	MaxJobs int
 }
 
-// JobLog holds all log entries for a single job
-type JobLog struct {
-	JobID     string     `json:"jobId"`
-	TrackID   string     `json:"trackId,omitempty"`
-	Status    string     `json:"status"` // running, completed, failed
-	StartedAt time.Time  `json:"startedAt"`
-	EndedAt   *time.Time `json:"endedAt,omitempty"`
-	Entries   []LogEntry `json:"entries"`
-}
+const (
+	// pruneInterval is how often logs past the retention limits are deleted
+	pruneInterval = time.Hour
+	// flushInterval is how long entries may wait to be written
+	flushInterval = 250 * time.Millisecond
+	// flushBatch is how many waiting entries get written without waiting
+	// for the interval
+	flushBatch = 256
+)
 
-// Logger provides verbose logging for jobs
+// Logger provides verbose logging for jobs. Entries are published on the
+// event bus for live tails as they are logged, and written to the database
+// in batches, so they survive restarts and can be read while the job runs.
+// Writes happen outside the lock, so workers logging don't wait on each
+// other's database traffic.
 type Logger struct {
-	mu   sync.RWMutex
-	logs map[string]*JobLog
-	// Keep only last N jobs to avoid memory bloat
-	maxJobs int
-	order   []string // Track order for cleanup
+	db        *database.DB
+	bus       *events.Bus
+	retention LogRetention
+
+	mu      sync.Mutex
+	running map[string]*runningLog // jobs started by this process
+	pending []*models.JobLogEntry  // entries not yet written
+
+	flushMu sync.Mutex // keeps batches in order
+	wake    chan struct{}
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
-// NewLogger creates a new job logger
-func NewLogger(maxJobs int) *Logger {
-	if maxJobs <= 0 {
-		maxJobs = 100
-	}
+type runningLog struct {
+	next      int // index of the next entry
+	libraryID string
+}
+
+// NewLogger creates a job logger backed by db. A logger without a database
+// drops all entries.
+func NewLogger(db *database.DB, bus *events.Bus, retention LogRetention) *Logger {
 	return &Logger{
-		logs:    make(map[string]*JobLog),
-		maxJobs: maxJobs,
-		order:   make([]string, 0),
+		db:        db,
+		bus:       bus,
+		retention: retention,
+		running:   make(map[string]*runningLog),
+		wake:      make(chan struct{}, 1),
 	}
 }
 
-// StartJob begins logging for a new job
-func (l *Logger) StartJob(jobID, trackID string) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	// Clean up old jobs if needed
-	for len(l.order) >= l.maxJobs {
-		oldID := l.order[0]
-		l.order = l.order[1:]
-		delete(l.logs, oldID)
+// StartJob begins logging for a new job. The library, if known, lets
+// per-library subscribers follow the job's entries.
+func (l *Logger) StartJob(jobID, trackID, libraryID string) {
+	if l.db == nil {
+		return
 	}
 
-	l.logs[jobID] = &JobLog{
-		JobID:     jobID,
-		TrackID:   trackID,
-		Status:    "running",
-		StartedAt: time.Now(),
-		Entries:   make([]LogEntry, 0),
+	next, err := l.db.StartJobLog(context.Background(), jobID, trackID, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("job_id", jobID).Msg("Failed to start job log")
+		return
 	}
-	l.order = append(l.order, jobID)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running[jobID] = &runningLog{next: next, libraryID: libraryID}
 
 	l.addEntryLocked(jobID, "info", "", "Job started", "")
 }
 
-// EndJob marks a job as completed or failed
+// EndJob marks a job as completed or failed, once its entries are written
 func (l *Logger) EndJob(jobID string, success bool, errorMsg string) {
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	if _, ok := l.running[jobID]; !ok {
+		l.mu.Unlock()
+		return
+	}
 
-	if job, ok := l.logs[jobID]; ok {
-		now := time.Now()
-		job.EndedAt = &now
-		if success {
-			job.Status = "completed"
-			l.addEntryLocked(jobID, "info", "", "Job completed successfully", "")
-		} else {
-			job.Status = "failed"
-			l.addEntryLocked(jobID, "error", "", "Job failed", errorMsg)
-		}
+	status := "completed"
+	if success {
+		l.addEntryLocked(jobID, "info", "", "Job completed successfully", "")
+	} else {
+		status = "failed"
+		l.addEntryLocked(jobID, "error", "", "Job failed", errorMsg)
+	}
+	delete(l.running, jobID)
+	l.mu.Unlock()
+
+	l.flush()
+	if err := l.db.EndJobLog(context.Background(), jobID, status, time.Now()); err != nil {
+		log.Error().Err(err).Str("job_id", jobID).Msg("Failed to end job log")
 	}
 }
 
@@ -114,90 +138,142 @@ func (l *Logger) Error(jobID, module, message, details string) {
 	l.Log(jobID, "error", module, message, details)
 }
 
+// addEntryLocked queues an entry of a running job to be written; entries
+// of jobs that were not started are dropped
 func (l *Logger) addEntryLocked(jobID, level, module, message, details string) {
-	if job, ok := l.logs[jobID]; ok {
-		job.Entries = append(job.Entries, LogEntry{
-			Timestamp: time.Now(),
-			Level:     level,
-			Module:    module,
-			Message:   message,
-			Details:   details,
-		})
-	}
-}
-
-// GetLog returns the log for a specific job (returns interface{} for handler compatibility)
-func (l *Logger) GetLog(jobID string) interface{} {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-
-	if job, ok := l.logs[jobID]; ok {
-		// Return a copy
-		entriesCopy := make([]LogEntry, len(job.Entries))
-		copy(entriesCopy, job.Entries)
-		return &JobLog{
-			JobID:     job.JobID,
-			TrackID:   job.TrackID,
-			Status:    job.Status,
-			StartedAt: job.StartedAt,
-			EndedAt:   job.EndedAt,
-			Entries:   entriesCopy,
+	job, ok := l.running[jobID]
+	if !ok {
+		return
+	}
+
+	entry := &models.JobLogEntry{
+		JobID:     jobID,
+		Index:     job.next,
+		Timestamp: time.Now(),
+		Level:     level,
+		Module:    module,
+		Message:   message,
+		Details:   details,
+	}
+	job.next++
+	l.pending = append(l.pending, entry)
+	if len(l.pending) >= flushBatch {
+		select {
+		case l.wake <- struct{}{}:
+		default:
 		}
 	}
-	return nil
+
+	l.bus.Publish(events.Event{
+		Type:      events.TypeLog,
+		JobID:     jobID,
+		LibraryID: job.libraryID,
+		Time:      entry.Timestamp,
+		Data:      entry,
+	})
 }
 
-// GetLogSince returns log entries since a given index (returns interface{} for handler compatibility)
-func (l *Logger) GetLogSince(jobID string, sinceIndex int) ([]interface{}, int, string) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+// flush writes the entries queued so far
+func (l *Logger) flush() {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
 
-	if job, ok := l.logs[jobID]; ok {
-		if sinceIndex < 0 {
-			sinceIndex = 0
-		}
-		if sinceIndex >= len(job.Entries) {
-			return []interface{}{}, len(job.Entries), job.Status
-		}
-		entries := job.Entries[sinceIndex:]
-		result := make([]interface{}, len(entries))
-		for i, e := range entries {
-			result[i] = e
-		}
-		return result, len(job.Entries), job.Status
+	l.mu.Lock()
+	batch := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := l.db.AddJobLogEntries(context.Background(), batch); err != nil {
+		log.Error().Err(err).Int("entries", len(batch)).Msg("Failed to write job log entries")
 	}
-	return nil, 0, ""
 }
 
-// GetRecentJobs returns the most recent job logs (returns interface{} for handler compatibility)
-func (l *Logger) GetRecentJobs(limit int) interface{} {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+// Start writes queued entries, and prunes logs past the retention limits,
+// now and then periodically until Stop is called
+func (l *Logger) Start(ctx context.Context) {
+	if l.db == nil {
+		return
+	}
+
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-l.wake:
+			}
+			l.flush()
+		}
+	}()
 
-	if limit <= 0 || limit > len(l.order) {
-		limit = len(l.order)
+	if l.retention.MaxAge <= 0 && l.retention.MaxJobs <= 0 {
+		return
 	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
 
-	result := make([]*JobLog, 0, limit)
-	for i := len(l.order) - 1; i >= 0 && len(result) < limit; i-- {
-		if job, ok := l.logs[l.order[i]]; ok {
-			result = append(result, &JobLog{
-				JobID:     job.JobID,
-				TrackID:   job.TrackID,
-				Status:    job.Status,
-				StartedAt: job.StartedAt,
-				EndedAt:   job.EndedAt,
-				Entries:   nil, // Don't include entries in list view
-			})
+		for {
+			l.Prune(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 		}
+	}()
+}
+
+// Stop ends the periodic work and writes the entries still queued
+func (l *Logger) Stop() {
+	if l.cancel != nil {
+		l.cancel()
+	}
+	l.wg.Wait()
+	if l.db != nil {
+		l.flush()
+	}
+}
+
+// Prune deletes the logs past the retention limits
+func (l *Logger) Prune(ctx context.Context) {
+	var cutoff time.Time
+	if l.retention.MaxAge > 0 {
+		cutoff = time.Now().Add(-l.retention.MaxAge)
+	}
+
+	deleted, err := l.db.PruneJobLogs(ctx, cutoff, l.retention.MaxJobs)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to prune job logs")
+		return
+	}
+	if deleted > 0 {
+		log.Info().Int64("deleted", deleted).Msg("Pruned job logs")
 	}
-	return result
 }
 
-// Global logger instance
-var globalLogger = NewLogger(100)
+// Global logger instance, replaced by SetGlobalLogger at startup
+var globalLogger = NewLogger(nil, nil, LogRetention{})
 
 // GetGlobalLogger returns the global job logger
 func GetGlobalLogger() *Logger {
 	return globalLogger
 }
+
+// SetGlobalLogger sets the job logger used by the workers
+func SetGlobalLogger(logger *Logger) {
+	globalLogger = logger
+}
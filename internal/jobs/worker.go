@@ -3,6 +3,8 @@ package jobs
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,31 +12,85 @@ import (
 
 	"github.com/ottavia-music/ottavia/internal/analyzer"
 	"github.com/ottavia-music/ottavia/internal/audioscan"
+	"github.com/ottavia-music/ottavia/internal/converter"
 	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/duplicates"
+	"github.com/ottavia-music/ottavia/internal/events"
+	"github.com/ottavia-music/ottavia/internal/gc"
 	"github.com/ottavia-music/ottavia/internal/models"
+	"github.com/ottavia-music/ottavia/internal/replaygain"
 )
 
 type Worker struct {
 	db           *database.DB
+	bus          *events.Bus
 	analyzer     *analyzer.Analyzer
 	audioScanner *audioscan.Scanner
+	converter    *converter.Converter
+	duplicates   *duplicates.Detector
+	replayGain   *replaygain.Service
+	gc           *gc.Collector
 	workerCount  int
 	pollInterval time.Duration
+	limits       TypeLimits
+
+	schedMu sync.Mutex
+	busy    map[string]int     // jobs being processed, by type
+	pass    map[string]float64 // virtual time each type has been served to
+	vtime   float64            // virtual time of the last job started
 
 	running   bool
 	runningMu sync.Mutex
 	cancel    context.CancelFunc
 	wg        sync.WaitGroup
+
+	activeMu sync.Mutex
+	active   map[string]context.CancelFunc // jobs being processed, by ID
 }
 
-func NewWorker(db *database.DB, analyzer *analyzer.Analyzer, audioScanner *audioscan.Scanner, workerCount int) *Worker {
+// jobTypes are the job types the worker runs, in the order ties between
+// equally served types are broken. Conversions are claimed from their own
+// queue as "convert".
+var jobTypes = []string{"analyze", "fingerprint", "audioscan", "duplicates", "replaygain", "convert", "gc"}
+
+// TypeLimits shares the workers between job types. Concurrency caps how
+// many jobs of a type run at once; a type without a cap may use every
+// worker. When several types have queued jobs, each gets a share of the
+// job starts in proportion to its weight, 1 by default.
+type TypeLimits struct {
+	Concurrency map[string]int
+	Weights     map[string]int
+}
+
+func NewWorker(db *database.DB, bus *events.Bus, analyzer *analyzer.Analyzer, audioScanner *audioscan.Scanner, conv *converter.Converter, dupes *duplicates.Detector, rg *replaygain.Service, collector *gc.Collector, workerCount int, limits TypeLimits) *Worker {
 	return &Worker{
 		db:           db,
+		bus:          bus,
 		analyzer:     analyzer,
 		audioScanner: audioScanner,
+		converter:    conv,
+		duplicates:   dupes,
+		replayGain:   rg,
+		gc:           collector,
 		workerCount:  workerCount,
 		pollInterval: 5 * time.Second,
+		limits:       limits,
+		busy:         make(map[string]int),
+		pass:         make(map[string]float64),
+		active:       make(map[string]context.CancelFunc),
+	}
+}
+
+// Cancel stops a job this worker is processing. Returns false if the job
+// is not running here.
+func (w *Worker) Cancel(jobID string) bool {
+	w.activeMu.Lock()
+	defer w.activeMu.Unlock()
+	cancel, ok := w.active[jobID]
+	if ok {
+		cancel()
 	}
+	return ok
 }
 
 func (w *Worker) Start(ctx context.Context) {
@@ -87,33 +143,116 @@ func (w *Worker) workerLoop(ctx context.Context, id int) {
 			log.Debug().Int("worker_id", id).Msg("Worker stopping")
 			return
 		case <-ticker.C:
-			w.processNextJob(ctx, id)
+			// Keep working while there are jobs, polling again once idle
+			for ctx.Err() == nil && w.processNext(ctx, id) {
+			}
 		}
 	}
 }
 
-func (w *Worker) processNextJob(ctx context.Context, workerID int) {
-	// Try to get a job of any supported type
-	jobTypes := []string{"analyze", "audioscan"}
-	var job *models.Job
-	var err error
+// processNext runs one job of the type that is furthest behind its fair
+// share and under its concurrency cap. Returns false if no job was run.
+func (w *Worker) processNext(ctx context.Context, workerID int) bool {
+	for _, jobType := range w.schedule() {
+		if !w.acquire(jobType) {
+			continue
+		}
+		var ran bool
+		if jobType == "convert" {
+			ran = w.processNextConversion(ctx, workerID)
+		} else {
+			ran = w.processNextJob(ctx, workerID, jobType)
+		}
+		w.release(jobType)
+		if ran {
+			return true
+		}
+	}
+	return false
+}
 
-	for _, jobType := range jobTypes {
-		job, err = w.db.GetNextJob(ctx, jobType)
-		if err == nil {
-			break
+// schedule orders the job types by the virtual time they would start at,
+// least served first
+func (w *Worker) schedule() []string {
+	w.schedMu.Lock()
+	defer w.schedMu.Unlock()
+
+	types := make([]string, 0, len(jobTypes))
+	for _, t := range jobTypes {
+		if t == "convert" && w.converter == nil {
+			continue
 		}
+		types = append(types, t)
+	}
+	sort.SliceStable(types, func(i, j int) bool {
+		return w.startTimeLocked(types[i]) < w.startTimeLocked(types[j])
+	})
+	return types
+}
+
+// startTimeLocked is the virtual time a type's next job starts at. A type
+// that was idle starts from the current virtual time, so it gets its share
+// from now on without catching up on the time it had no jobs.
+func (w *Worker) startTimeLocked(jobType string) float64 {
+	if p := w.pass[jobType]; p > w.vtime {
+		return p
+	}
+	return w.vtime
+}
+
+// acquire reserves a slot for a job of the given type, if it is under its
+// concurrency cap
+func (w *Worker) acquire(jobType string) bool {
+	w.schedMu.Lock()
+	defer w.schedMu.Unlock()
+	if limit := w.limits.Concurrency[jobType]; limit > 0 && w.busy[jobType] >= limit {
+		return false
+	}
+	w.busy[jobType]++
+	return true
+}
+
+// release frees a slot taken by acquire
+func (w *Worker) release(jobType string) {
+	w.schedMu.Lock()
+	defer w.schedMu.Unlock()
+	w.busy[jobType]--
+}
+
+// started advances a type's virtual time once one of its jobs is claimed,
+// by less for heavier weights
+func (w *Worker) started(jobType string) {
+	w.schedMu.Lock()
+	defer w.schedMu.Unlock()
+	weight := w.limits.Weights[jobType]
+	if weight <= 0 {
+		weight = 1
+	}
+	start := w.startTimeLocked(jobType)
+	w.vtime = start
+	w.pass[jobType] = start + 1/float64(weight)
+}
+
+// processNextJob claims and runs one queued job of the given type. Returns
+// false if none was queued.
+func (w *Worker) processNextJob(ctx context.Context, workerID int, jobType string) bool {
+	job, err := w.db.GetNextJob(ctx, jobType, database.LeaseDuration)
+	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Error().Err(err).Str("type", jobType).Msg("Failed to get next job")
 		}
+		return false
 	}
+	w.started(jobType)
 
-	if job == nil {
-		return
+	libraryID, err := w.db.GetTargetLibraryID(ctx, job.TargetType, job.TargetID)
+	if err != nil {
+		log.Warn().Err(err).Str("job_id", job.ID).Msg("Failed to resolve job library")
 	}
+	w.publishJob(job.ID, libraryID, job.Type, job.Status, "")
 
 	logger := GetGlobalLogger()
-	logger.StartJob(job.ID, job.TargetID)
+	logger.StartJob(job.ID, job.TargetID, libraryID)
 
 	log.Info().
 		Str("job_id", job.ID).
@@ -127,26 +266,80 @@ func (w *Worker) processNextJob(ctx context.Context, workerID int) {
 	// Job is already marked as running by GetNextJob, just increment attempts
 	job.Attempts++
 
+	// Cancel aborts the job, and the ffmpeg it runs, through its context;
+	// so does losing its lease
+	jobCtx, cancelJob := context.WithCancelCause(ctx)
+	cancel := func() { cancelJob(nil) }
+	w.activeMu.Lock()
+	w.active[job.ID] = cancel
+	w.activeMu.Unlock()
+	defer func() {
+		w.activeMu.Lock()
+		delete(w.active, job.ID)
+		w.activeMu.Unlock()
+		cancel()
+	}()
+	go w.db.HoldLease(jobCtx, database.LeaseJobs, job.ID, cancelJob)
+
 	// Process based on type
 	var processErr error
 	switch job.Type {
 	case "analyze":
-		processErr = w.analyzer.AnalyzeFile(ctx, job.TargetID)
+		processErr = w.analyzer.AnalyzeFile(jobCtx, job.TargetID)
+	case "fingerprint":
+		processErr = w.analyzer.FingerprintTrack(jobCtx, job.TargetID)
 	case "audioscan":
 		if w.audioScanner != nil {
-			processErr = w.audioScanner.ScanTrackWithLogger(ctx, job.TargetID, job.ID, logger)
+			processErr = w.audioScanner.ScanTrackWithLogger(jobCtx, job.TargetID, job.ID, logger)
 		} else {
 			log.Warn().Msg("Audio scanner not configured")
 			logger.Warn(job.ID, "", "Audio scanner not configured", "")
 		}
+	case "duplicates":
+		if w.duplicates != nil {
+			processErr = w.duplicates.Run(jobCtx, job.TargetID, job.ID, logger)
+		} else {
+			log.Warn().Msg("Duplicate detector not configured")
+			logger.Warn(job.ID, "", "Duplicate detector not configured", "")
+		}
+	case "replaygain":
+		if w.replayGain != nil {
+			processErr = w.replayGain.Run(jobCtx, job, logger)
+		} else {
+			log.Warn().Msg("ReplayGain service not configured")
+			logger.Warn(job.ID, "", "ReplayGain service not configured", "")
+		}
+	case "gc":
+		if w.gc != nil {
+			_, processErr = w.gc.Run(jobCtx, false, job.ID, logger)
+		} else {
+			log.Warn().Msg("Garbage collector not configured")
+			logger.Warn(job.ID, "", "Garbage collector not configured", "")
+		}
 	default:
 		log.Warn().Str("type", job.Type).Msg("Unknown job type")
 		logger.Warn(job.ID, "", "Unknown job type: "+job.Type, "")
-		return
+		return true
 	}
 
 	// Update job status
-	if processErr != nil {
+	leaseLost := errors.Is(context.Cause(jobCtx), database.ErrLeaseLost)
+	if leaseLost {
+		log.Warn().Str("job_id", job.ID).Msg("Job lease lost")
+		logger.EndJob(job.ID, false, "Lease lost: the job was recovered or cancelled elsewhere")
+	} else if processErr != nil && jobCtx.Err() != nil && ctx.Err() == nil {
+		log.Info().Str("job_id", job.ID).Msg("Job cancelled")
+		job.Status = models.StatusCancelled
+		logger.EndJob(job.ID, false, "Cancelled")
+	} else if processErr != nil && ctx.Err() != nil {
+		// Shutdown interrupted the job: hand it back to run again at the
+		// next start, without charging the attempt
+		log.Info().Str("job_id", job.ID).Msg("Job interrupted by shutdown, requeued")
+		job.Attempts--
+		job.Status = models.StatusQueued
+		job.ScheduledAt = time.Now()
+		logger.EndJob(job.ID, false, "Interrupted by shutdown; requeued")
+	} else if processErr != nil {
 		log.Error().Err(processErr).Str("job_id", job.ID).Msg("Job failed")
 		job.LastError = sql.NullString{String: processErr.Error(), Valid: true}
 		logger.EndJob(job.ID, false, processErr.Error())
@@ -171,9 +364,97 @@ func (w *Worker) processNextJob(ctx context.Context, workerID int) {
 		logger.EndJob(job.ID, true, "")
 	}
 
-	if err := w.db.UpdateJob(ctx, job); err != nil {
-		log.Error().Err(err).Str("job_id", job.ID).Msg("Failed to update job status")
+	// A job cancelled, or recovered after its lease lapsed, while it ran
+	// already has its final status. One whose lease was lost isn't written
+	// at all, as it may be running again elsewhere. The outcome is saved
+	// even once shutdown has cancelled ctx.
+	saveCtx := context.WithoutCancel(ctx)
+	var updated bool
+	var finishErr error
+	if !leaseLost {
+		updated, finishErr = w.db.FinishJob(saveCtx, job)
 	}
+	if finishErr != nil {
+		log.Error().Err(finishErr).Str("job_id", job.ID).Msg("Failed to update job status")
+	} else if !updated {
+		if current, err := w.db.GetJob(saveCtx, job.ID); err == nil {
+			job.Status = current.Status
+		}
+	}
+	errorMsg := ""
+	if processErr != nil && job.Status != models.StatusCancelled {
+		errorMsg = processErr.Error()
+	}
+	w.publishJob(job.ID, libraryID, job.Type, job.Status, errorMsg)
+	return true
+}
+
+// processNextConversion claims and runs one queued conversion job. Returns
+// false if none was queued.
+func (w *Worker) processNextConversion(ctx context.Context, workerID int) bool {
+	job, err := w.db.GetNextConversionJob(ctx, database.LeaseDuration)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error().Err(err).Msg("Failed to get next conversion job")
+		}
+		return false
+	}
+	w.started("convert")
+
+	libraryID, err := w.db.GetTargetLibraryID(ctx, job.SourceType, job.SourceID)
+	if err != nil {
+		log.Warn().Err(err).Str("job_id", job.ID).Msg("Failed to resolve conversion library")
+	}
+	w.publishJob(job.ID, libraryID, "convert", job.Status, "")
+
+	// Losing the lease stops the conversion
+	convCtx, releaseLease := context.WithCancelCause(ctx)
+	defer releaseLease(nil)
+	go w.db.HoldLease(convCtx, database.LeaseConversions, job.ID, releaseLease)
+
+	logger := GetGlobalLogger()
+	logger.StartJob(job.ID, job.SourceID, libraryID)
+
+	log.Info().
+		Str("job_id", job.ID).
+		Str("source_type", job.SourceType).
+		Str("source", job.SourceID).
+		Str("profile", job.Profile).
+		Int("worker", workerID).
+		Msg("Processing conversion job")
+
+	if err := w.converter.Run(convCtx, job, logger); errors.Is(err, database.ErrLeaseLost) {
+		log.Warn().Str("job_id", job.ID).Msg("Conversion job lease lost")
+		logger.EndJob(job.ID, false, "Lease lost: the job was recovered or cancelled elsewhere")
+		return true
+	} else if err != nil {
+		log.Error().Err(err).Str("job_id", job.ID).Msg("Conversion job failed")
+		logger.EndJob(job.ID, false, err.Error())
+		w.publishJob(job.ID, libraryID, "convert", job.Status, err.Error())
+		return true
+	}
+
+	log.Info().Str("job_id", job.ID).Msg("Conversion job completed")
+	logger.EndJob(job.ID, true, "")
+	w.publishJob(job.ID, libraryID, "convert", job.Status, "")
+	return true
+}
+
+// publishJob reports a job state transition to event subscribers
+func (w *Worker) publishJob(jobID, libraryID, jobType, status, errorMsg string) {
+	data := map[string]interface{}{
+		"type":   jobType,
+		"status": status,
+	}
+	if errorMsg != "" {
+		data["error"] = errorMsg
+	}
+	w.bus.Publish(events.Event{
+		Type:      events.TypeJob,
+		JobID:     jobID,
+		LibraryID: libraryID,
+		Data:      data,
+	})
 }
 
 // Scheduler handles periodic library scans
@@ -228,16 +509,41 @@ func (s *Scheduler) schedulerLoop(ctx context.Context) {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
 
+	// Work left running by a previous process is recovered once its lease
+	// runs out
+	s.recoverExpired(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			s.recoverExpired(ctx)
 			s.checkLibraries(ctx)
 		}
 	}
 }
 
+// recoverExpired requeues or fails jobs, conversions and scans whose lease
+// has expired, and resets libraries stuck in the running state
+func (s *Scheduler) recoverExpired(ctx context.Context) {
+	rec, err := s.db.RecoverExpiredLeases(ctx, time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to recover expired leases")
+		return
+	}
+	if rec.Total() > 0 {
+		log.Warn().
+			Int64("jobs_requeued", rec.JobsRequeued).
+			Int64("jobs_failed", rec.JobsFailed).
+			Int64("conversions_requeued", rec.Conversions).
+			Int64("scans_failed", rec.ScanRuns).
+			Int64("libraries_reset", rec.Libraries).
+			Int64("job_logs_closed", rec.JobLogs).
+			Msg("Recovered work with expired leases")
+	}
+}
+
 func (s *Scheduler) checkLibraries(ctx context.Context) {
 	libraries, err := s.db.ListLibraries(ctx)
 	if err != nil {
@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"fmt"
+	"testing"
+)
+
+// run starts n jobs, each of the first type in schedule order that has
+// queued jobs, and returns how many of each type were started and the
+// order they were started in
+func run(w *Worker, queued map[string]bool, n int) (map[string]int, []string) {
+	counts := make(map[string]int)
+	var order []string
+	for i := 0; i < n; i++ {
+		for _, jobType := range w.schedule() {
+			if queued[jobType] {
+				w.started(jobType)
+				counts[jobType]++
+				order = append(order, jobType)
+				break
+			}
+		}
+	}
+	return counts, order
+}
+
+func TestScheduleOrder(t *testing.T) {
+	w := NewWorker(nil, nil, nil, nil, nil, nil, nil, nil, 1, TypeLimits{})
+
+	// Ties go by the order of jobTypes; without a converter there are no
+	// conversions to claim
+	want := "[analyze fingerprint audioscan duplicates replaygain gc]"
+	if got := fmt.Sprint(w.schedule()); got != want {
+		t.Errorf("schedule = %s, want %s", got, want)
+	}
+
+	// A type just served goes to the back
+	w.started("analyze")
+	if got := w.schedule(); got[len(got)-1] != "analyze" {
+		t.Errorf("schedule after an analyze job = %v", got)
+	}
+}
+
+func TestScheduleWeights(t *testing.T) {
+	for _, tc := range []struct {
+		weights map[string]int
+		want    map[string]int
+	}{
+		{nil, map[string]int{"analyze": 20, "fingerprint": 20, "audioscan": 20}},
+		{map[string]int{"analyze": 4}, map[string]int{"analyze": 40, "fingerprint": 10, "audioscan": 10}},
+		{map[string]int{"analyze": 3, "fingerprint": 2}, map[string]int{"analyze": 30, "fingerprint": 20, "audioscan": 10}},
+		// Weights below one count as one
+		{map[string]int{"analyze": 0, "fingerprint": -3, "audioscan": 1}, map[string]int{"analyze": 20, "fingerprint": 20, "audioscan": 20}},
+	} {
+		w := NewWorker(nil, nil, nil, nil, nil, nil, nil, nil, 1, TypeLimits{Weights: tc.weights})
+		counts, _ := run(w, map[string]bool{"analyze": true, "fingerprint": true, "audioscan": true}, 60)
+		for jobType, n := range tc.want {
+			if counts[jobType] != n {
+				t.Errorf("weights %v: %v, want %v", tc.weights, counts, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestIdleTypeDoesNotCatchUp(t *testing.T) {
+	w := NewWorker(nil, nil, nil, nil, nil, nil, nil, nil, 1, TypeLimits{})
+
+	// Only analysis jobs are queued for a while
+	run(w, map[string]bool{"analyze": true}, 50)
+
+	// A type with no jobs until now shares from here on rather than
+	// getting the 50 starts it missed
+	_, order := run(w, map[string]bool{"analyze": true, "fingerprint": true}, 6)
+	want := "[fingerprint analyze fingerprint analyze fingerprint analyze]"
+	if got := fmt.Sprint(order); got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+	if start := w.startTimeLocked("duplicates"); start != w.vtime {
+		t.Errorf("idle type starts at %v, virtual time is %v", start, w.vtime)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	w := NewWorker(nil, nil, nil, nil, nil, nil, nil, nil, 4, TypeLimits{Concurrency: map[string]int{"audioscan": 2}})
+	for i := 0; i < 2; i++ {
+		if !w.acquire("audioscan") {
+			t.Fatalf("slot %d refused", i+1)
+		}
+	}
+	if w.acquire("audioscan") {
+		t.Errorf("third audioscan slot granted")
+	}
+	for i := 0; i < 4; i++ {
+		if !w.acquire("analyze") {
+			t.Errorf("uncapped type refused")
+		}
+	}
+	w.release("audioscan")
+	if !w.acquire("audioscan") {
+		t.Errorf("released slot not granted")
+	}
+}
@@ -0,0 +1,266 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FLAC metadata block types
+const (
+	flacStreamInfo    = 0
+	flacPadding       = 1
+	flacVorbisComment = 4
+)
+
+// flacPaddingSize is the padding left after the metadata when a FLAC file
+// has to be rewritten, so later edits fit in place
+const flacPaddingSize = 4096
+
+// flacVorbisKeys are the Vorbis comment names ffmpeg maps to its own keys.
+// The first name is written; all are replaced.
+var flacVorbisKeys = map[string][]string{
+	"album_artist": {"ALBUMARTIST", "ALBUM ARTIST", "ALBUM_ARTIST"},
+	"track":        {"TRACKNUMBER"},
+	"disc":         {"DISCNUMBER"},
+	"comment":      {"DESCRIPTION", "COMMENT"},
+}
+
+type flacBlock struct {
+	typ  byte
+	data []byte
+}
+
+// readFLACMetadata reads the metadata blocks after the "fLaC" marker and
+// returns them with the offset at which the audio frames start
+func readFLACMetadata(f *os.File) ([]flacBlock, int64, error) {
+	marker, err := readAt(f, 0, 4)
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(marker) != "fLaC" {
+		// Includes FLAC files with a leading ID3v2 tag
+		return nil, 0, fmt.Errorf("%w: no FLAC marker", errNotNative)
+	}
+
+	var blocks []flacBlock
+	off := int64(4)
+	for {
+		header, err := readAt(f, off, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		last := header[0]&0x80 != 0
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		data, err := readAt(f, off+4, length)
+		if err != nil {
+			return nil, 0, err
+		}
+		blocks = append(blocks, flacBlock{typ: header[0] & 0x7f, data: data})
+		off += 4 + int64(length)
+		if last {
+			break
+		}
+	}
+	if len(blocks) == 0 || blocks[0].typ != flacStreamInfo {
+		return nil, 0, fmt.Errorf("%w: missing STREAMINFO", errNotNative)
+	}
+	return blocks, off, nil
+}
+
+// vorbisComments is a parsed VORBIS_COMMENT block; comments keep their
+// order and the spelling of their names
+type vorbisComments struct {
+	vendor   string
+	comments [][2]string
+}
+
+func parseVorbisComments(data []byte) (*vorbisComments, error) {
+	bad := fmt.Errorf("%w: malformed Vorbis comment block", errNotNative)
+	next := func() (string, bool) {
+		if len(data) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return "", false
+		}
+		s := string(data[4 : 4+n])
+		data = data[4+n:]
+		return s, true
+	}
+
+	vc := &vorbisComments{}
+	var ok bool
+	if vc.vendor, ok = next(); !ok || len(data) < 4 {
+		return nil, bad
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count; i++ {
+		c, ok := next()
+		if !ok {
+			return nil, bad
+		}
+		name, value, found := strings.Cut(c, "=")
+		if !found {
+			continue
+		}
+		vc.comments = append(vc.comments, [2]string{name, value})
+	}
+	return vc, nil
+}
+
+func (vc *vorbisComments) bytes() []byte {
+	var buf []byte
+	put := func(s string) {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+		buf = append(buf, s...)
+	}
+	put(vc.vendor)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vc.comments)))
+	for _, c := range vc.comments {
+		put(c[0] + "=" + c[1])
+	}
+	return buf
+}
+
+// set replaces every comment under key, or one of its aliases, with values
+func (vc *vorbisComments) set(key string, values []string) {
+	names := flacVorbisKeys[strings.ToLower(key)]
+	if names == nil {
+		names = []string{strings.ToUpper(key)}
+	}
+
+	kept := vc.comments[:0]
+	for _, c := range vc.comments {
+		match := false
+		for _, n := range names {
+			if strings.EqualFold(c[0], n) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			kept = append(kept, c)
+		}
+	}
+	vc.comments = kept
+	for _, v := range values {
+		vc.comments = append(vc.comments, [2]string{names[0], v})
+	}
+}
+
+func readFLACTags(f *os.File) (map[string][]string, error) {
+	blocks, _, err := readFLACMetadata(f)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string][]string)
+	for _, b := range blocks {
+		if b.typ != flacVorbisComment {
+			continue
+		}
+		vc, err := parseVorbisComments(b.data)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range vc.comments {
+			key := c[0]
+			for ffKey, names := range flacVorbisKeys {
+				for _, n := range names {
+					if strings.EqualFold(key, n) {
+						key = ffKey
+					}
+				}
+			}
+			tags[key] = append(tags[key], c[1])
+		}
+	}
+	return tags, nil
+}
+
+// writeFLACTags rewrites the VORBIS_COMMENT block, taking the space from
+// the padding when it fits. Other blocks, such as pictures and cue sheets,
+// are kept byte for byte.
+func writeFLACTags(path string, writes []tagWrite) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	blocks, audioStart, err := readFLACMetadata(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	vc := &vorbisComments{vendor: "ottavia"}
+	commentAt := -1
+	var kept []flacBlock
+	for _, b := range blocks {
+		switch b.typ {
+		case flacPadding:
+			continue
+		case flacVorbisComment:
+			if commentAt >= 0 {
+				// Only one comment block is allowed; merge strays into the first
+				extra, err := parseVorbisComments(b.data)
+				if err != nil {
+					return err
+				}
+				vc.comments = append(vc.comments, extra.comments...)
+				continue
+			}
+			parsed, err := parseVorbisComments(b.data)
+			if err != nil {
+				return err
+			}
+			vc = parsed
+			commentAt = len(kept)
+		}
+		kept = append(kept, b)
+	}
+	if commentAt < 0 {
+		// A new comment block goes right after STREAMINFO
+		commentAt = 1
+		kept = append(kept[:1], append([]flacBlock{{typ: flacVorbisComment}}, kept[1:]...)...)
+	}
+
+	for _, w := range writes {
+		vc.set(w.key, w.values)
+	}
+	kept[commentAt].data = vc.bytes()
+
+	// Fill the old metadata region exactly if the padding allows it
+	available := audioStart - 4
+	used := int64(0)
+	for _, b := range kept {
+		if len(b.data) > 0xFFFFFF {
+			return fmt.Errorf("FLAC metadata block too large")
+		}
+		used += 4 + int64(len(b.data))
+	}
+	padding := int64(flacPaddingSize)
+	if used == available {
+		padding = -1
+	} else if available-used >= 4 {
+		padding = available - used - 4
+	}
+	if padding >= 0 {
+		kept = append(kept, flacBlock{typ: flacPadding, data: make([]byte, padding)})
+	}
+
+	var buf []byte
+	for i, b := range kept {
+		typ := b.typ
+		if i == len(kept)-1 {
+			typ |= 0x80
+		}
+		n := len(b.data)
+		buf = append(buf, typ, byte(n>>16), byte(n>>8), byte(n))
+		buf = append(buf, b.data...)
+	}
+	return patchFile(path, 4, audioStart, buf)
+}
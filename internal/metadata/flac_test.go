@@ -0,0 +1,165 @@
+package metadata
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// flacAudio stands in for the audio frames after the metadata
+var flacAudio = []byte("FLAC-FRAMES")
+
+// writeFLACFixture writes a FLAC file with a Vorbis comment block and
+// padding bytes of padding, returning its path
+func writeFLACFixture(t *testing.T, comments [][2]string, padding int) string {
+	t.Helper()
+	blocks := []flacBlock{
+		{typ: flacStreamInfo, data: make([]byte, 34)},
+		{typ: flacVorbisComment, data: (&vorbisComments{vendor: "fixture", comments: comments}).bytes()},
+	}
+	if padding >= 0 {
+		blocks = append(blocks, flacBlock{typ: flacPadding, data: make([]byte, padding)})
+	}
+
+	data := []byte("fLaC")
+	for i, b := range blocks {
+		typ := b.typ
+		if i == len(blocks)-1 {
+			typ |= 0x80
+		}
+		n := len(b.data)
+		data = append(data, typ, byte(n>>16), byte(n>>8), byte(n))
+		data = append(data, b.data...)
+	}
+	data = append(data, flacAudio...)
+
+	path := filepath.Join(t.TempDir(), "fixture.flac")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readTagsOf(t *testing.T, path string) map[string][]string {
+	t.Helper()
+	tags, err := ReadTags(path)
+	if err != nil {
+		t.Fatalf("ReadTags: %v", err)
+	}
+	return tags
+}
+
+func readFLACLayout(t *testing.T, path string) ([]flacBlock, int64) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	blocks, audioStart, err := readFLACMetadata(f)
+	if err != nil {
+		t.Fatalf("readFLACMetadata: %v", err)
+	}
+	return blocks, audioStart
+}
+
+func checkFLACAudio(t *testing.T, path string, audioStart int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[audioStart:], flacAudio) {
+		t.Fatalf("audio frames changed: %q", data[audioStart:])
+	}
+}
+
+func TestFLACWriteReusesPadding(t *testing.T) {
+	path := writeFLACFixture(t, [][2]string{{"TITLE", "Old"}, {"ALBUM ARTIST", "Someone"}}, 1024)
+	before, _ := os.Stat(path)
+	_, oldStart := readFLACLayout(t, path)
+
+	err := writeFLACTags(path, []tagWrite{
+		{key: "title", values: []string{"New title"}},
+		{key: "album_artist", values: []string{"Someone Else"}},
+		{key: "artist", values: []string{"A", "B"}},
+	})
+	if err != nil {
+		t.Fatalf("writeFLACTags: %v", err)
+	}
+
+	after, _ := os.Stat(path)
+	if after.Size() != before.Size() {
+		t.Errorf("size = %d, want %d kept by shrinking the padding", after.Size(), before.Size())
+	}
+	blocks, audioStart := readFLACLayout(t, path)
+	if audioStart != oldStart {
+		t.Errorf("audio moved from %d to %d", oldStart, audioStart)
+	}
+	if last := blocks[len(blocks)-1]; last.typ != flacPadding || len(last.data) >= 1024 {
+		t.Errorf("last block = type %d of %d bytes, want shrunk padding", last.typ, len(last.data))
+	}
+	checkFLACAudio(t, path, audioStart)
+
+	tags := readTagsOf(t, path)
+	if got := tags["TITLE"]; len(got) != 1 || got[0] != "New title" {
+		t.Errorf("TITLE = %q", got)
+	}
+	if got := tags["album_artist"]; len(got) != 1 || got[0] != "Someone Else" {
+		t.Errorf("album_artist = %q, want the ALBUM ARTIST alias replaced", got)
+	}
+	if got := tags["ARTIST"]; len(got) != 2 || got[0] != "A" || got[1] != "B" {
+		t.Errorf("ARTIST = %q, want both values", got)
+	}
+}
+
+func TestFLACWriteGrowsPastPadding(t *testing.T) {
+	path := writeFLACFixture(t, [][2]string{{"TITLE", "Old"}}, 16)
+	before, _ := os.Stat(path)
+
+	long := strings.Repeat("x", 200)
+	if err := writeFLACTags(path, []tagWrite{{key: "comment", values: []string{long}}}); err != nil {
+		t.Fatalf("writeFLACTags: %v", err)
+	}
+
+	after, _ := os.Stat(path)
+	if after.Size() <= before.Size() {
+		t.Fatalf("size = %d, want the file to grow past %d", after.Size(), before.Size())
+	}
+	blocks, audioStart := readFLACLayout(t, path)
+	if last := blocks[len(blocks)-1]; last.typ != flacPadding || len(last.data) != flacPaddingSize {
+		t.Errorf("last block = type %d of %d bytes, want %d bytes of fresh padding", last.typ, len(last.data), flacPaddingSize)
+	}
+	checkFLACAudio(t, path, audioStart)
+
+	tags := readTagsOf(t, path)
+	if got := tags["comment"]; len(got) != 1 || got[0] != long {
+		t.Errorf("comment not written back")
+	}
+	if got := tags["TITLE"]; len(got) != 1 || got[0] != "Old" {
+		t.Errorf("TITLE = %q, want it kept", got)
+	}
+}
+
+func TestFLACWriteFillsExactly(t *testing.T) {
+	// With no padding and a change of the same size, no padding block is
+	// added and the audio stays put
+	path := writeFLACFixture(t, [][2]string{{"TITLE", "abc"}}, -1)
+	_, oldStart := readFLACLayout(t, path)
+
+	if err := writeFLACTags(path, []tagWrite{{key: "title", values: []string{"xyz"}}}); err != nil {
+		t.Fatalf("writeFLACTags: %v", err)
+	}
+	blocks, audioStart := readFLACLayout(t, path)
+	if audioStart != oldStart {
+		t.Errorf("audio moved from %d to %d", oldStart, audioStart)
+	}
+	for _, b := range blocks {
+		if b.typ == flacPadding {
+			t.Errorf("unexpected padding block")
+		}
+	}
+	checkFLACAudio(t, path, audioStart)
+}
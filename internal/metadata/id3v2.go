@@ -0,0 +1,379 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3v2PaddingSize is the padding left after the frames when a tag has to
+// grow, so later edits fit in place
+const id3v2PaddingSize = 2048
+
+// ID3v2 text encodings
+const (
+	id3Latin1  = 0
+	id3UTF16   = 1
+	id3UTF16BE = 2
+	id3UTF8    = 3
+)
+
+// id3v2Frames maps ffmpeg keys to the text frames ffmpeg reads them from,
+// per major version. The first frame is written; all are replaced.
+var id3v2Frames = map[string]map[byte][]string{
+	"album":        {3: {"TALB"}, 4: {"TALB"}},
+	"composer":     {3: {"TCOM"}, 4: {"TCOM"}},
+	"genre":        {3: {"TCON"}, 4: {"TCON"}},
+	"copyright":    {3: {"TCOP"}, 4: {"TCOP"}},
+	"encoded_by":   {3: {"TENC"}, 4: {"TENC"}},
+	"title":        {3: {"TIT2"}, 4: {"TIT2"}},
+	"language":     {3: {"TLAN"}, 4: {"TLAN"}},
+	"artist":       {3: {"TPE1"}, 4: {"TPE1"}},
+	"album_artist": {3: {"TPE2"}, 4: {"TPE2"}},
+	"performer":    {3: {"TPE3"}, 4: {"TPE3"}},
+	"disc":         {3: {"TPOS"}, 4: {"TPOS"}},
+	"publisher":    {3: {"TPUB"}, 4: {"TPUB"}},
+	"track":        {3: {"TRCK"}, 4: {"TRCK"}},
+	"encoder":      {3: {"TSSE"}, 4: {"TSSE"}},
+	"compilation":  {3: {"TCMP"}, 4: {"TCMP"}},
+	"grouping":     {3: {"TIT1"}, 4: {"TIT1"}},
+	"date":         {3: {"TYER", "TDAT"}, 4: {"TDRC", "TDRL"}},
+}
+
+var id3FrameID = regexp.MustCompile(`^[A-Z0-9]{4}$`)
+
+type id3Frame struct {
+	id    string
+	flags [2]byte
+	data  []byte
+}
+
+type id3Tag struct {
+	version byte // major version, 3 or 4
+	size    int64
+	frames  []id3Frame
+}
+
+// readID3v2 reads the ID3v2.3/2.4 tag at the start of a file. A file
+// without one returns a nil tag.
+func readID3v2(f *os.File) (*id3Tag, error) {
+	header, err := readAt(f, 0, 10)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:3]) != "ID3" {
+		return nil, nil
+	}
+	version, flags := header[3], header[5]
+	if version != 3 && version != 4 {
+		return nil, fmt.Errorf("%w: ID3v2.%d", errNotNative, version)
+	}
+	// Unsynchronised tags, extended headers and footers are rare enough to
+	// leave to ffmpeg
+	if flags&0xd0 != 0 {
+		return nil, fmt.Errorf("%w: ID3v2 header flags %#x", errNotNative, flags)
+	}
+
+	tag := &id3Tag{version: version, size: int64(synchsafe(header[6:10]))}
+	body, err := readAt(f, 10, int(tag.size))
+	if err != nil {
+		return nil, err
+	}
+	for len(body) >= 10 {
+		id := string(body[:4])
+		if !id3FrameID.MatchString(id) {
+			break // padding
+		}
+		var size int
+		if version == 4 {
+			size = synchsafe(body[4:8])
+		} else {
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		}
+		if size > len(body)-10 {
+			return nil, fmt.Errorf("%w: ID3v2 frame %s overruns the tag", errNotNative, id)
+		}
+		tag.frames = append(tag.frames, id3Frame{
+			id:    id,
+			flags: [2]byte{body[8], body[9]},
+			data:  body[10 : 10+size],
+		})
+		body = body[10+size:]
+	}
+	return tag, nil
+}
+
+// plain reports whether a frame's payload is stored as-is, without
+// compression, encryption or unsynchronisation
+func (t *id3Tag) plain(fr id3Frame) bool {
+	if t.version == 4 {
+		return fr.flags[1]&0x0f == 0
+	}
+	return fr.flags[1]&0xe0 == 0
+}
+
+func (t *id3Tag) bytes(padding int) []byte {
+	var body []byte
+	for _, fr := range t.frames {
+		body = append(body, fr.id...)
+		if t.version == 4 {
+			body = append(body, putSynchsafe(len(fr.data))...)
+		} else {
+			body = binary.BigEndian.AppendUint32(body, uint32(len(fr.data)))
+		}
+		body = append(body, fr.flags[0], fr.flags[1])
+		body = append(body, fr.data...)
+	}
+	body = append(body, make([]byte, padding)...)
+
+	header := []byte{'I', 'D', '3', t.version, 0, 0}
+	header = append(header, putSynchsafe(len(body))...)
+	return append(header, body...)
+}
+
+// set replaces the frames for an ffmpeg key with values
+func (t *id3Tag) set(key string, values []string) {
+	ids := id3v2Frames[strings.ToLower(key)][t.version]
+	isText := ids != nil
+	if !isText && id3FrameID.MatchString(key) && key[0] == 'T' && key != "TXXX" {
+		ids, isText = []string{key}, true
+	}
+	isComment := strings.EqualFold(key, "comment")
+
+	kept := t.frames[:0]
+	for _, fr := range t.frames {
+		var match bool
+		switch {
+		case isText:
+			match = containsString(ids, fr.id)
+		case isComment:
+			if fr.id == "COMM" && t.plain(fr) {
+				desc, _ := decodeComment(fr.data)
+				match = desc == ""
+			}
+		default:
+			if fr.id == "TXXX" && t.plain(fr) {
+				desc, _ := decodeUserText(fr.data)
+				match = strings.EqualFold(desc, key)
+			}
+		}
+		if !match {
+			kept = append(kept, fr)
+		}
+	}
+	t.frames = kept
+	if len(values) == 0 {
+		return
+	}
+
+	enc := byte(id3UTF8)
+	joined := strings.Join(values, "\x00")
+	if t.version == 3 {
+		enc = id3UTF16
+		joined = strings.Join(values, ";")
+	}
+	switch {
+	case isText:
+		value := joined
+		if ids[0] == "TYER" && len(value) > 4 {
+			value = value[:4]
+		}
+		t.frames = append(t.frames, id3Frame{id: ids[0], data: append([]byte{enc}, encodeID3(enc, value, false)...)})
+	case isComment:
+		data := []byte{enc, 'e', 'n', 'g'}
+		data = append(data, encodeID3(enc, "", true)...)
+		data = append(data, encodeID3(enc, joined, false)...)
+		t.frames = append(t.frames, id3Frame{id: "COMM", data: data})
+	default:
+		data := []byte{enc}
+		data = append(data, encodeID3(enc, key, true)...)
+		data = append(data, encodeID3(enc, joined, false)...)
+		t.frames = append(t.frames, id3Frame{id: "TXXX", data: data})
+	}
+}
+
+func readID3v2Tags(f *os.File) (map[string][]string, error) {
+	tag, err := readID3v2(f)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string][]string)
+	if tag == nil {
+		return tags, nil
+	}
+
+	names := make(map[string]string)
+	for key, versions := range id3v2Frames {
+		for _, id := range versions[tag.version] {
+			names[id] = key
+		}
+	}
+
+	for _, fr := range tag.frames {
+		if !tag.plain(fr) || len(fr.data) == 0 {
+			continue
+		}
+		switch {
+		case fr.id == "TXXX":
+			desc, value := decodeUserText(fr.data)
+			if desc != "" {
+				tags[desc] = append(tags[desc], value)
+			}
+		case fr.id == "COMM":
+			if desc, value := decodeComment(fr.data); desc == "" {
+				tags["comment"] = append(tags["comment"], value)
+			}
+		case fr.id[0] == 'T':
+			key := fr.id
+			if name, ok := names[fr.id]; ok {
+				key = name
+			}
+			if key == "date" && len(tags[key]) > 0 {
+				continue // TDAT after TYER, or TDRL after TDRC
+			}
+			value := decodeID3(fr.data[0], fr.data[1:])
+			tags[key] = append(tags[key], strings.Split(strings.TrimRight(value, "\x00"), "\x00")...)
+		}
+	}
+	return tags, nil
+}
+
+// writeID3v2Tags edits the ID3v2 tag of an MP3, reusing its padding when
+// the frames fit. Frames that are not changed, such as pictures, UFID and
+// PRIV, are kept byte for byte.
+func writeID3v2Tags(path string, writes []tagWrite) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	tag, err := readID3v2(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	oldSize := int64(-10)
+	if tag == nil {
+		tag = &id3Tag{version: 4}
+	} else {
+		oldSize = tag.size
+	}
+
+	for _, w := range writes {
+		tag.set(w.key, w.values)
+	}
+
+	data := tag.bytes(0)
+	if used := int64(len(data)) - 10; used <= oldSize {
+		data = tag.bytes(int(oldSize - used))
+	} else {
+		data = tag.bytes(id3v2PaddingSize)
+	}
+	return patchFile(path, 0, oldSize+10, data)
+}
+
+// decodeUserText splits a TXXX payload into description and value
+func decodeUserText(data []byte) (string, string) {
+	desc, rest := splitID3String(data[0], data[1:])
+	return decodeID3(data[0], desc), strings.TrimRight(decodeID3(data[0], rest), "\x00")
+}
+
+// decodeComment splits a COMM payload into description and text
+func decodeComment(data []byte) (string, string) {
+	if len(data) < 4 {
+		return "", ""
+	}
+	desc, rest := splitID3String(data[0], data[4:])
+	return decodeID3(data[0], desc), strings.TrimRight(decodeID3(data[0], rest), "\x00")
+}
+
+// splitID3String splits at the first terminator of the encoding
+func splitID3String(enc byte, data []byte) ([]byte, []byte) {
+	if enc == id3UTF16 || enc == id3UTF16BE {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return data[:i], data[i+2:]
+			}
+		}
+		return data, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+func decodeID3(enc byte, data []byte) string {
+	switch enc {
+	case id3Latin1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	case id3UTF16, id3UTF16BE:
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == id3UTF16 && len(data) >= 2 {
+			if data[0] == 0xff && data[1] == 0xfe {
+				order = binary.LittleEndian
+				data = data[2:]
+			} else if data[0] == 0xfe && data[1] == 0xff {
+				data = data[2:]
+			}
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			u := order.Uint16(data[i:])
+			if u == 0xfeff && len(units) > 0 && units[len(units)-1] == 0 {
+				continue // BOM of the next value in a list
+			}
+			units = append(units, u)
+		}
+		return string(utf16.Decode(units))
+	default:
+		return string(data)
+	}
+}
+
+// encodeID3 encodes s, with a terminator if it is followed by another
+// string in the frame
+func encodeID3(enc byte, s string, terminate bool) []byte {
+	var out []byte
+	switch enc {
+	case id3UTF16:
+		out = []byte{0xff, 0xfe}
+		for _, u := range utf16.Encode([]rune(s)) {
+			out = binary.LittleEndian.AppendUint16(out, u)
+		}
+		if terminate {
+			out = append(out, 0, 0)
+		}
+	default:
+		out = []byte(s)
+		if terminate {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+func synchsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func putSynchsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
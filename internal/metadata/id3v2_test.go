@@ -0,0 +1,184 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mp3Audio stands in for the MPEG frames after the tag
+var mp3Audio = []byte("MPEG-FRAMES")
+
+// writeID3Fixture writes an MP3 starting with an ID3v2 tag of the given
+// major version, header flags, frames and padding, returning its path
+func writeID3Fixture(t *testing.T, version, flags byte, frames []id3Frame, padding int) string {
+	t.Helper()
+	data := (&id3Tag{version: version, frames: frames}).bytes(padding)
+	data[5] = flags
+	data = append(data, mp3Audio...)
+
+	path := filepath.Join(t.TempDir(), "fixture.mp3")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// latin1Frame builds a text frame in ISO-8859-1
+func latin1Frame(id, value string) id3Frame {
+	return id3Frame{id: id, data: append([]byte{id3Latin1}, value...)}
+}
+
+// frameSize returns the raw size field of the first frame id in a file's tag
+func frameSize(t *testing.T, path, id string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte(id))
+	if i < 0 {
+		t.Fatalf("no %s frame", id)
+	}
+	return data[i+4 : i+8]
+}
+
+func checkMP3Audio(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, mp3Audio) {
+		t.Fatalf("audio frames changed")
+	}
+	size := int64(synchsafe(data[6:10]))
+	if int64(len(data)) != 10+size+int64(len(mp3Audio)) {
+		t.Fatalf("tag size %d doesn't end where the audio starts", size)
+	}
+}
+
+func TestID3v23FrameSizes(t *testing.T) {
+	path := writeID3Fixture(t, 3, 0, []id3Frame{latin1Frame("TIT2", "Old")}, 64)
+
+	// Long enough that a synchsafe size would differ from a plain one
+	title := strings.Repeat("a", 200)
+	err := writeID3v2Tags(path, []tagWrite{
+		{key: "title", values: []string{title}},
+		{key: "artist", values: []string{"A", "B"}},
+	})
+	if err != nil {
+		t.Fatalf("writeID3v2Tags: %v", err)
+	}
+
+	// UTF-16 with a BOM: 1 + 2 + 2*200 bytes, as a plain 32-bit integer
+	if got, want := frameSize(t, path, "TIT2"), binary.BigEndian.AppendUint32(nil, 403); !bytes.Equal(got, want) {
+		t.Errorf("TIT2 size = % x, want % x", got, want)
+	}
+	checkMP3Audio(t, path)
+
+	tags := readTagsOf(t, path)
+	if got := tags["title"]; len(got) != 1 || got[0] != title {
+		t.Errorf("title not read back")
+	}
+	// ID3v2.3 has no value separator; values are joined the way ffmpeg does
+	if got := tags["artist"]; len(got) != 1 || got[0] != "A;B" {
+		t.Errorf("artist = %q, want \"A;B\"", got)
+	}
+}
+
+func TestID3v24FrameSizes(t *testing.T) {
+	path := writeID3Fixture(t, 4, 0, []id3Frame{latin1Frame("TIT2", "Old")}, 64)
+
+	title := strings.Repeat("a", 200)
+	err := writeID3v2Tags(path, []tagWrite{
+		{key: "title", values: []string{title}},
+		{key: "artist", values: []string{"A", "B"}},
+	})
+	if err != nil {
+		t.Fatalf("writeID3v2Tags: %v", err)
+	}
+
+	// UTF-8: 1 + 200 bytes, synchsafe
+	if got, want := frameSize(t, path, "TIT2"), putSynchsafe(201); !bytes.Equal(got, want) {
+		t.Errorf("TIT2 size = % x, want % x", got, want)
+	}
+	checkMP3Audio(t, path)
+
+	tags := readTagsOf(t, path)
+	if got := tags["title"]; len(got) != 1 || got[0] != title {
+		t.Errorf("title not read back")
+	}
+	if got := tags["artist"]; len(got) != 2 || got[0] != "A" || got[1] != "B" {
+		t.Errorf("artist = %q, want two values", got)
+	}
+}
+
+func TestID3v2WriteReusesPadding(t *testing.T) {
+	picture := id3Frame{id: "APIC", data: []byte("\x00image/png\x00\x03\x00PNGDATA")}
+	path := writeID3Fixture(t, 4, 0, []id3Frame{latin1Frame("TIT2", "Old"), picture}, 512)
+	before, _ := os.Stat(path)
+
+	if err := writeID3v2Tags(path, []tagWrite{{key: "MusicBrainz Track Id", values: []string{"abc"}}}); err != nil {
+		t.Fatalf("writeID3v2Tags: %v", err)
+	}
+
+	after, _ := os.Stat(path)
+	if after.Size() != before.Size() {
+		t.Errorf("size = %d, want %d kept by using the padding", after.Size(), before.Size())
+	}
+	checkMP3Audio(t, path)
+
+	data, _ := os.ReadFile(path)
+	if !bytes.Contains(data, picture.data) {
+		t.Errorf("APIC frame not kept byte for byte")
+	}
+	tags := readTagsOf(t, path)
+	if got := tags["MusicBrainz Track Id"]; len(got) != 1 || got[0] != "abc" {
+		t.Errorf("TXXX = %q", got)
+	}
+	if got := tags["title"]; len(got) != 1 || got[0] != "Old" {
+		t.Errorf("title = %q, want it kept", got)
+	}
+}
+
+func TestID3v2WriteGrowsTag(t *testing.T) {
+	path := writeID3Fixture(t, 3, 0, []id3Frame{latin1Frame("TIT2", "Old")}, 0)
+
+	if err := writeID3v2Tags(path, []tagWrite{{key: "album", values: []string{"Longer album"}}}); err != nil {
+		t.Fatalf("writeID3v2Tags: %v", err)
+	}
+	checkMP3Audio(t, path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tag, err := readID3v2(f)
+	if err != nil {
+		t.Fatalf("readID3v2: %v", err)
+	}
+	used := int64(len(tag.bytes(0))) - 10
+	if tag.size-used != id3v2PaddingSize {
+		t.Errorf("padding = %d, want %d", tag.size-used, id3v2PaddingSize)
+	}
+}
+
+func TestID3v2AddsTagToBareFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bare.mp3")
+	if err := os.WriteFile(path, mp3Audio, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeID3v2Tags(path, []tagWrite{{key: "title", values: []string{"New"}}}); err != nil {
+		t.Fatalf("writeID3v2Tags: %v", err)
+	}
+	checkMP3Audio(t, path)
+	if got := readTagsOf(t, path)["title"]; len(got) != 1 || got[0] != "New" {
+		t.Errorf("title = %q", got)
+	}
+}
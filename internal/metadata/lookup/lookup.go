@@ -0,0 +1,444 @@
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/metadata"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+var (
+	// ErrReleaseNotFound is returned when a provider has no release with the given ID
+	ErrReleaseNotFound = errors.New("release not found")
+	// ErrNoMatchingTracks is returned when none of a release's tracks pair with the album's
+	ErrNoMatchingTracks = errors.New("release has no tracks matching the album")
+)
+
+// Provider looks up releases in an external metadata database
+type Provider interface {
+	// Name identifies the provider in action logs and API responses
+	Name() string
+	// SearchReleases returns releases matching an album, best first. Tracks
+	// may be left empty.
+	SearchReleases(ctx context.Context, q Query) ([]Release, error)
+	// GetRelease returns one release with its full tracklist
+	GetRelease(ctx context.Context, id string) (*Release, error)
+}
+
+// Query describes a local album to look up
+type Query struct {
+	Album      string
+	Artist     string
+	TrackCount int
+}
+
+// Release is a candidate release from a provider
+type Release struct {
+	ID             string         `json:"id"`
+	ReleaseGroupID string         `json:"releaseGroupId,omitempty"`
+	Title          string         `json:"title"`
+	Artist         string         `json:"artist"`
+	ArtistID       string         `json:"artistId,omitempty"`
+	Date           string         `json:"date,omitempty"`
+	Year           int            `json:"year,omitempty"`
+	Country        string         `json:"country,omitempty"`
+	TrackCount     int            `json:"trackCount"`
+	DiscCount      int            `json:"discCount,omitempty"`
+	Tracks         []ReleaseTrack `json:"tracks,omitempty"`
+}
+
+// ReleaseTrack is one track of a release
+type ReleaseTrack struct {
+	ID          string   `json:"id,omitempty"`
+	Disc        int      `json:"disc"`
+	Number      int      `json:"number"`
+	DiscTracks  int      `json:"discTracks,omitempty"` // tracks on this track's disc
+	Title       string   `json:"title"`
+	Artist      string   `json:"artist"`
+	ArtistID    string   `json:"artistId,omitempty"`
+	Duration    float64  `json:"duration"` // seconds, 0 if unknown
+	RecordingID string   `json:"recordingId,omitempty"`
+	ISRCs       []string `json:"isrcs,omitempty"`
+}
+
+// Score rates how well a release fits a local album. Each component is
+// 0..1; Total is 0..100.
+type Score struct {
+	Total      float64 `json:"total"`
+	TrackCount float64 `json:"trackCount"`
+	Durations  float64 `json:"durations"`
+	Titles     float64 `json:"titles"`
+}
+
+// Candidate is a scored release
+type Candidate struct {
+	Release Release `json:"release"`
+	Score   Score   `json:"score"`
+}
+
+// Score weights; durations are the strongest signal that a tracklist is the
+// same pressing
+const (
+	weightTrackCount = 0.25
+	weightDurations  = 0.40
+	weightTitles     = 0.35
+
+	// maxCandidates is how many search results are fetched in full and scored
+	maxCandidates = 5
+
+	// Duration differences up to durationExact seconds score 1, falling to 0
+	// at durationMax
+	durationExact = 3.0
+	durationMax   = 15.0
+)
+
+// Service finds candidate releases for local albums and applies a confirmed
+// match through the metadata writer
+type Service struct {
+	db       *database.DB
+	writer   *metadata.Writer
+	provider Provider
+}
+
+// New creates a lookup service backed by one provider
+func New(db *database.DB, writer *metadata.Writer, provider Provider) *Service {
+	return &Service{
+		db:       db,
+		writer:   writer,
+		provider: provider,
+	}
+}
+
+// ProviderName returns the name of the configured provider
+func (s *Service) ProviderName() string {
+	return s.provider.Name()
+}
+
+// Candidates searches the provider for an album and returns the top results
+// scored against the local tracks, best first
+func (s *Service) Candidates(ctx context.Context, albumName, artist string) ([]Candidate, error) {
+	detail, err := s.db.GetAlbumDetail(ctx, albumName, artist)
+	if err != nil {
+		return nil, err
+	}
+
+	releases, err := s.provider.SearchReleases(ctx, Query{
+		Album:      detail.Name,
+		Artist:     detail.Artist,
+		TrackCount: len(detail.Tracks),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("search releases: %w", err)
+	}
+	if len(releases) > maxCandidates {
+		releases = releases[:maxCandidates]
+	}
+
+	candidates := []Candidate{}
+	for _, summary := range releases {
+		release, err := s.provider.GetRelease(ctx, summary.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Warn().Err(err).Str("release_id", summary.ID).Msg("Failed to fetch release")
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Release: *release,
+			Score:   ScoreRelease(detail.Tracks, release),
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score.Total > candidates[j].Score.Total
+	})
+	return candidates, nil
+}
+
+// Preview shows the tag changes a confirmed release would make, without
+// writing anything
+func (s *Service) Preview(ctx context.Context, albumName, artist, releaseID string) (*metadata.BulkPreview, error) {
+	op, _, err := s.operation(ctx, albumName, artist, releaseID)
+	if err != nil {
+		return nil, err
+	}
+	return s.writer.PreviewBulkOperation(ctx, op)
+}
+
+// Apply writes the tags of a confirmed release to the album's tracks. Each
+// track's edit is action-logged by the writer; the match itself is logged
+// against the album.
+func (s *Service) Apply(ctx context.Context, albumName, artist, releaseID, actor string) (*metadata.BulkResult, error) {
+	op, release, err := s.operation(ctx, albumName, artist, releaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.writer.ApplyBulkOperation(ctx, op, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	beforeJSON, _ := json.Marshal(map[string]interface{}{
+		"album":  albumName,
+		"artist": artist,
+	})
+	afterJSON, _ := json.Marshal(map[string]interface{}{
+		"provider":     s.provider.Name(),
+		"releaseId":    release.ID,
+		"album":        release.Title,
+		"artist":       release.Artist,
+		"successCount": result.SuccessCount,
+		"failedCount":  result.FailedCount,
+		"actionLogIds": result.ActionLogIDs,
+	})
+	actionLog := &models.ActionLog{
+		Type:       "metadata_lookup",
+		TargetType: "album",
+		TargetID:   albumName,
+		Actor:      actor,
+		BeforeJSON: string(beforeJSON),
+		AfterJSON:  string(afterJSON),
+	}
+	if err := s.db.CreateActionLog(ctx, actionLog); err != nil {
+		log.Error().Err(err).Str("album", albumName).Msg("Failed to create action log")
+	}
+
+	return result, nil
+}
+
+// operation builds the per-track tag changes for a confirmed release
+func (s *Service) operation(ctx context.Context, albumName, artist, releaseID string) (*metadata.BulkOperation, *Release, error) {
+	detail, err := s.db.GetAlbumDetail(ctx, albumName, artist)
+	if err != nil {
+		return nil, nil, err
+	}
+	release, err := s.provider.GetRelease(ctx, releaseID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	op := &metadata.BulkOperation{
+		Operation: "set_tags",
+		Changes:   make(map[string]*metadata.TagChanges),
+	}
+	for i, j := range pairTracks(detail.Tracks, release.Tracks) {
+		if j < 0 {
+			continue
+		}
+		trackID := detail.Tracks[i].ID
+		changes := trackChanges(release, &release.Tracks[j])
+		// Identifiers the file's container cannot hold are skipped rather
+		// than failing the whole track
+		metadata.StripUnsupported(detail.Tracks[i].Path, changes)
+		op.TrackIDs = append(op.TrackIDs, trackID)
+		op.Changes[trackID] = changes
+	}
+	if len(op.TrackIDs) == 0 {
+		return nil, nil, ErrNoMatchingTracks
+	}
+	return op, release, nil
+}
+
+// trackChanges returns the tags and identifiers a release sets on one
+// track; empty values are left alone
+func trackChanges(release *Release, rt *ReleaseTrack) *metadata.TagChanges {
+	changes := &metadata.TagChanges{}
+	if rt.Title != "" {
+		changes.Title = &rt.Title
+	}
+	trackArtist := rt.Artist
+	if trackArtist == "" {
+		trackArtist = release.Artist
+	}
+	if trackArtist != "" {
+		changes.Artist = &trackArtist
+	}
+	if release.Title != "" {
+		changes.Album = &release.Title
+	}
+	if release.Artist != "" {
+		changes.AlbumArtist = &release.Artist
+	}
+	if rt.Number > 0 {
+		number := rt.Number
+		changes.TrackNumber = &number
+	}
+	if rt.Disc > 0 {
+		disc := rt.Disc
+		changes.DiscNumber = &disc
+	}
+	if release.Year > 0 {
+		year := release.Year
+		changes.Year = &year
+	}
+	if rt.DiscTracks > 0 {
+		total := rt.DiscTracks
+		changes.TotalTracks = &total
+	}
+	if release.DiscCount > 0 {
+		total := release.DiscCount
+		changes.TotalDiscs = &total
+	}
+	if len(rt.ISRCs) > 0 {
+		changes.ISRC = &rt.ISRCs[0]
+	}
+
+	changes.MBReleaseID = nonEmpty(release.ID)
+	changes.MBReleaseGroupID = nonEmpty(release.ReleaseGroupID)
+	changes.MBAlbumArtistID = nonEmpty(release.ArtistID)
+	changes.MBRecordingID = nonEmpty(rt.RecordingID)
+	changes.MBReleaseTrackID = nonEmpty(rt.ID)
+	if rt.ArtistID != "" {
+		changes.MBArtistID = &rt.ArtistID
+	} else {
+		changes.MBArtistID = nonEmpty(release.ArtistID)
+	}
+	return changes
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// ScoreRelease rates a release's tracklist against local album tracks.
+// Local tracks without a counterpart count as misses for durations and
+// titles.
+func ScoreRelease(local []database.AlbumTrack, release *Release) Score {
+	var score Score
+	if len(local) == 0 {
+		return score
+	}
+
+	remoteCount := len(release.Tracks)
+	if remoteCount == 0 {
+		remoteCount = release.TrackCount
+	}
+	if remoteCount > 0 {
+		diff := math.Abs(float64(len(local) - remoteCount))
+		score.TrackCount = math.Max(0, 1-diff/math.Max(float64(len(local)), float64(remoteCount)))
+	}
+
+	for i, j := range pairTracks(local, release.Tracks) {
+		if j < 0 {
+			continue
+		}
+		lt, rt := local[i], release.Tracks[j]
+		score.Durations += durationSimilarity(lt.Duration, rt.Duration)
+		score.Titles += titleSimilarity(lt.Title, rt.Title)
+	}
+	score.Durations /= float64(len(local))
+	score.Titles /= float64(len(local))
+
+	total := weightTrackCount*score.TrackCount + weightDurations*score.Durations + weightTitles*score.Titles
+	score.Total = math.Round(total*1000) / 10
+	return score
+}
+
+// pairTracks maps each local track to the index of its release track, or -1.
+// Tracks are matched by disc and track number when the local numbering is
+// complete and unique, otherwise by position.
+func pairTracks(local []database.AlbumTrack, remote []ReleaseTrack) []int {
+	pairs := make([]int, len(local))
+
+	type key struct{ disc, number int }
+	byKey := make(map[key]int, len(remote))
+	for j, rt := range remote {
+		byKey[key{rt.Disc, rt.Number}] = j
+	}
+
+	numbered := true
+	seen := make(map[key]bool, len(local))
+	for _, lt := range local {
+		k := key{lt.DiscNumber, lt.TrackNumber}
+		if lt.TrackNumber <= 0 || seen[k] {
+			numbered = false
+			break
+		}
+		seen[k] = true
+	}
+
+	for i, lt := range local {
+		pairs[i] = -1
+		if numbered {
+			if j, ok := byKey[key{lt.DiscNumber, lt.TrackNumber}]; ok {
+				pairs[i] = j
+			}
+		} else if i < len(remote) {
+			pairs[i] = i
+		}
+	}
+	return pairs
+}
+
+func durationSimilarity(a, b float64) float64 {
+	if a <= 0 || b <= 0 {
+		return 0
+	}
+	diff := math.Abs(a - b)
+	if diff <= durationExact {
+		return 1
+	}
+	if diff >= durationMax {
+		return 0
+	}
+	return 1 - (diff-durationExact)/(durationMax-durationExact)
+}
+
+// titleSimilarity is 1 minus the normalized edit distance between titles,
+// ignoring case, punctuation and spacing
+func titleSimilarity(a, b string) float64 {
+	ra, rb := []rune(normalizeTitle(a)), []rune(normalizeTitle(b))
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func normalizeTitle(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
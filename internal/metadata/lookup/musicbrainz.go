@@ -0,0 +1,248 @@
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MusicBrainz is a Provider for the MusicBrainz web service (version 2 JSON
+// API). The base URL can point at musicbrainz.org, a local mirror or a stub.
+type MusicBrainz struct {
+	baseURL     string
+	userAgent   string
+	minInterval time.Duration
+	client      *http.Client
+
+	mu   sync.Mutex
+	next time.Time // earliest time the next request may be sent
+}
+
+// NewMusicBrainz creates a MusicBrainz client. minInterval spaces requests
+// apart to respect the server's rate limit (0 disables throttling).
+func NewMusicBrainz(baseURL, userAgent string, minInterval time.Duration) *MusicBrainz {
+	return &MusicBrainz{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		userAgent:   userAgent,
+		minInterval: minInterval,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (m *MusicBrainz) Name() string {
+	return "musicbrainz"
+}
+
+// mbArtistCredit is one entry of a MusicBrainz artist credit list
+type mbArtistCredit struct {
+	Name       string `json:"name"`
+	JoinPhrase string `json:"joinphrase"`
+	Artist     struct {
+		ID string `json:"id"`
+	} `json:"artist"`
+}
+
+type mbRelease struct {
+	ID           string           `json:"id"`
+	Title        string           `json:"title"`
+	Date         string           `json:"date"`
+	Country      string           `json:"country"`
+	TrackCount   int              `json:"track-count"`
+	ArtistCredit []mbArtistCredit `json:"artist-credit"`
+	ReleaseGroup struct {
+		ID string `json:"id"`
+	} `json:"release-group"`
+	Media []struct {
+		Position   int `json:"position"`
+		TrackCount int `json:"track-count"`
+		Tracks     []struct {
+			ID           string           `json:"id"`
+			Position     int              `json:"position"`
+			Number       string           `json:"number"`
+			Title        string           `json:"title"`
+			Length       int              `json:"length"` // milliseconds
+			ArtistCredit []mbArtistCredit `json:"artist-credit"`
+			Recording    struct {
+				ID     string   `json:"id"`
+				Length int      `json:"length"`
+				ISRCs  []string `json:"isrcs"`
+			} `json:"recording"`
+		} `json:"tracks"`
+	} `json:"media"`
+}
+
+// SearchReleases runs a release search on album title and artist
+func (m *MusicBrainz) SearchReleases(ctx context.Context, q Query) ([]Release, error) {
+	terms := []string{"release:" + luceneQuote(q.Album)}
+	if q.Artist != "" {
+		terms = append(terms, "artist:"+luceneQuote(q.Artist))
+	}
+
+	params := url.Values{}
+	params.Set("query", strings.Join(terms, " AND "))
+	params.Set("fmt", "json")
+	params.Set("limit", "10")
+
+	var resp struct {
+		Releases []mbRelease `json:"releases"`
+	}
+	if err := m.get(ctx, "/ws/2/release/?"+params.Encode(), &resp); err != nil {
+		return nil, err
+	}
+
+	releases := make([]Release, 0, len(resp.Releases))
+	for i := range resp.Releases {
+		releases = append(releases, resp.Releases[i].toRelease())
+	}
+	return releases, nil
+}
+
+// GetRelease fetches a release with its recordings, artist credits, ISRCs
+// and release group
+func (m *MusicBrainz) GetRelease(ctx context.Context, id string) (*Release, error) {
+	params := url.Values{}
+	params.Set("inc", "recordings artist-credits isrcs release-groups")
+	params.Set("fmt", "json")
+
+	var resp mbRelease
+	if err := m.get(ctx, "/ws/2/release/"+url.PathEscape(id)+"?"+params.Encode(), &resp); err != nil {
+		return nil, err
+	}
+	release := resp.toRelease()
+	return &release, nil
+}
+
+func (r *mbRelease) toRelease() Release {
+	release := Release{
+		ID:             r.ID,
+		ReleaseGroupID: r.ReleaseGroup.ID,
+		Title:          r.Title,
+		Artist:         creditName(r.ArtistCredit),
+		ArtistID:       creditArtistID(r.ArtistCredit),
+		Date:           r.Date,
+		Country:        r.Country,
+		TrackCount:     r.TrackCount,
+		DiscCount:      len(r.Media),
+	}
+	if len(r.Date) >= 4 {
+		release.Year, _ = strconv.Atoi(r.Date[:4])
+	}
+
+	mediaTracks := 0
+	for _, medium := range r.Media {
+		mediaTracks += medium.TrackCount
+		for _, t := range medium.Tracks {
+			length := t.Length
+			if length == 0 {
+				length = t.Recording.Length
+			}
+			release.Tracks = append(release.Tracks, ReleaseTrack{
+				ID:          t.ID,
+				Disc:        medium.Position,
+				Number:      t.Position,
+				DiscTracks:  medium.TrackCount,
+				Title:       t.Title,
+				Artist:      creditName(t.ArtistCredit),
+				ArtistID:    creditArtistID(t.ArtistCredit),
+				Duration:    float64(length) / 1000,
+				RecordingID: t.Recording.ID,
+				ISRCs:       t.Recording.ISRCs,
+			})
+		}
+	}
+	if release.TrackCount == 0 {
+		release.TrackCount = mediaTracks
+	}
+	if release.TrackCount == 0 {
+		release.TrackCount = len(release.Tracks)
+	}
+	return release
+}
+
+// get performs a throttled GET and decodes the JSON response into v
+func (m *MusicBrainz) get(ctx context.Context, path string, v interface{}) error {
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if m.userAgent != "" {
+		req.Header.Set("User-Agent", m.userAgent)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("musicbrainz request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrReleaseNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("musicbrainz returned %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse musicbrainz response: %w", err)
+	}
+	return nil
+}
+
+// wait blocks until the rate limit allows another request
+func (m *MusicBrainz) wait(ctx context.Context) error {
+	if m.minInterval <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	now := time.Now()
+	at := m.next
+	if at.Before(now) {
+		at = now
+	}
+	m.next = at.Add(m.minInterval)
+	m.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(at)):
+		return nil
+	}
+}
+
+// creditName joins an artist credit list into a display name
+func creditName(credits []mbArtistCredit) string {
+	var sb strings.Builder
+	for _, c := range credits {
+		sb.WriteString(c.Name)
+		sb.WriteString(c.JoinPhrase)
+	}
+	return sb.String()
+}
+
+// creditArtistID returns the ID of the first credited artist
+func creditArtistID(credits []mbArtistCredit) string {
+	if len(credits) == 0 {
+		return ""
+	}
+	return credits[0].Artist.ID
+}
+
+// luceneQuote quotes a value as a Lucene phrase
+func luceneQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
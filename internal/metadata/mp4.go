@@ -0,0 +1,427 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mp4PaddingSize is the free space left after the movie atom when it has to
+// grow in front of the media data, so later edits fit in place
+const mp4PaddingSize = 2048
+
+// mp4Items maps ffmpeg keys to iTunes metadata atoms
+var mp4Items = map[string]string{
+	"title":        "\xa9nam",
+	"artist":       "\xa9ART",
+	"album":        "\xa9alb",
+	"album_artist": "aART",
+	"date":         "\xa9day",
+	"genre":        "\xa9gen",
+	"composer":     "\xa9wrt",
+	"comment":      "\xa9cmt",
+	"grouping":     "\xa9grp",
+	"lyrics":       "\xa9lyr",
+	"encoder":      "\xa9too",
+	"copyright":    "cprt",
+	"track":        "trkn",
+	"disc":         "disk",
+}
+
+// mp4Freeform prefixes the key of a freeform "----" item, followed by its
+// name. Tags without an atom of their own are stored this way.
+const (
+	mp4Freeform     = "----:" + mp4FreeformMean + ":"
+	mp4FreeformMean = "com.apple.iTunes"
+)
+
+// mp4Containers are the atoms whose payload is a list of child atoms, as far
+// as the tag writer needs to look into them
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true,
+	"udta": true, "meta": true, "ilst": true, "edts": true, "dinf": true,
+}
+
+type mp4Atom struct {
+	typ      string
+	data     []byte // payload of a leaf; the version and flags of a full "meta"
+	children []*mp4Atom
+}
+
+type mp4TopAtom struct {
+	typ         string
+	offset, end int64
+}
+
+// readMP4Layout lists the top-level atoms and parses the movie atom
+func readMP4Layout(f *os.File) ([]mp4TopAtom, int, *mp4Atom, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	size := info.Size()
+
+	var atoms []mp4TopAtom
+	moovAt := -1
+	for off := int64(0); off < size; {
+		header, err := readAt(f, off, 8)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		n := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:8])
+		switch n {
+		case 0:
+			n = size - off
+		case 1:
+			ext, err := readAt(f, off+8, 8)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			n = int64(binary.BigEndian.Uint64(ext))
+		}
+		if n < 8 || off+n > size {
+			return nil, 0, nil, fmt.Errorf("%w: malformed MP4 atom %q", errNotNative, typ)
+		}
+		if typ == "moof" {
+			return nil, 0, nil, fmt.Errorf("%w: fragmented MP4", errNotNative)
+		}
+		if typ == "moov" {
+			moovAt = len(atoms)
+		}
+		atoms = append(atoms, mp4TopAtom{typ: typ, offset: off, end: off + n})
+		off += n
+	}
+	if moovAt < 0 || len(atoms) == 0 || atoms[0].typ != "ftyp" {
+		return nil, 0, nil, fmt.Errorf("%w: no MP4 movie atom", errNotNative)
+	}
+
+	moov := atoms[moovAt]
+	data, err := readAt(f, moov.offset, int(moov.end-moov.offset))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	root, err := parseMP4Atoms(data)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(root) != 1 {
+		return nil, 0, nil, fmt.Errorf("%w: malformed MP4 movie atom", errNotNative)
+	}
+	return atoms, moovAt, root[0], nil
+}
+
+func parseMP4Atoms(data []byte) ([]*mp4Atom, error) {
+	var atoms []*mp4Atom
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: malformed MP4 atom", errNotNative)
+		}
+		n := int(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		if n < 8 || n > len(data) {
+			return nil, fmt.Errorf("%w: malformed MP4 atom %q", errNotNative, typ)
+		}
+		payload := data[8:n]
+		atom := &mp4Atom{typ: typ}
+		if mp4Containers[typ] {
+			if typ == "meta" && !(len(payload) >= 8 && string(payload[4:8]) == "hdlr") {
+				// The ISO full box form; QuickTime's has no version and flags
+				if len(payload) < 4 {
+					return nil, fmt.Errorf("%w: malformed MP4 meta atom", errNotNative)
+				}
+				atom.data, payload = payload[:4], payload[4:]
+			}
+			children, err := parseMP4Atoms(payload)
+			if err != nil {
+				return nil, err
+			}
+			atom.children = children
+		} else {
+			atom.data = payload
+		}
+		atoms = append(atoms, atom)
+		data = data[n:]
+	}
+	return atoms, nil
+}
+
+func (a *mp4Atom) bytes() []byte {
+	body := append([]byte(nil), a.data...)
+	for _, c := range a.children {
+		body = append(body, c.bytes()...)
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	out = append(out, a.typ...)
+	return append(out, body...)
+}
+
+func (a *mp4Atom) child(typ string) *mp4Atom {
+	for _, c := range a.children {
+		if c.typ == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// ilst returns the iTunes item list, creating moov/udta/meta/ilst as needed
+func (a *mp4Atom) ilst(create bool) *mp4Atom {
+	udta := a.child("udta")
+	if udta == nil {
+		if !create {
+			return nil
+		}
+		udta = &mp4Atom{typ: "udta"}
+		a.children = append(a.children, udta)
+	}
+	meta := udta.child("meta")
+	if meta == nil {
+		if !create {
+			return nil
+		}
+		hdlr := make([]byte, 25)
+		copy(hdlr[8:], "mdirappl")
+		meta = &mp4Atom{typ: "meta", data: make([]byte, 4), children: []*mp4Atom{{typ: "hdlr", data: hdlr}}}
+		udta.children = append(udta.children, meta)
+	}
+	ilst := meta.child("ilst")
+	if ilst == nil && create {
+		ilst = &mp4Atom{typ: "ilst"}
+		meta.children = append(meta.children, ilst)
+	}
+	return ilst
+}
+
+// shiftChunkOffsets moves every sample chunk offset at or after from by
+// delta, for when the media data moves
+func (a *mp4Atom) shiftChunkOffsets(from, delta int64) error {
+	for _, c := range a.children {
+		if err := c.shiftChunkOffsets(from, delta); err != nil {
+			return err
+		}
+	}
+	if a.typ != "stco" && a.typ != "co64" {
+		return nil
+	}
+	if len(a.data) < 8 {
+		return fmt.Errorf("%w: malformed %s atom", errNotNative, a.typ)
+	}
+	count := int(binary.BigEndian.Uint32(a.data[4:8]))
+	width := 4
+	if a.typ == "co64" {
+		width = 8
+	}
+	if len(a.data) < 8+count*width {
+		return fmt.Errorf("%w: malformed %s atom", errNotNative, a.typ)
+	}
+	for i := 0; i < count; i++ {
+		entry := a.data[8+i*width:]
+		if width == 4 {
+			v := int64(binary.BigEndian.Uint32(entry))
+			if v >= from {
+				v += delta
+				if v > 0xFFFFFFFF {
+					return fmt.Errorf("%w: chunk offset overflow", errNotNative)
+				}
+				binary.BigEndian.PutUint32(entry, uint32(v))
+			}
+		} else {
+			v := int64(binary.BigEndian.Uint64(entry))
+			if v >= from {
+				binary.BigEndian.PutUint64(entry, uint64(v+delta))
+			}
+		}
+	}
+	return nil
+}
+
+func readMP4Tags(f *os.File) (map[string][]string, error) {
+	_, _, moov, err := readMP4Layout(f)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string][]string)
+	ilst := moov.ilst(false)
+	if ilst == nil {
+		return tags, nil
+	}
+
+	names := make(map[string]string, len(mp4Items))
+	for key, typ := range mp4Items {
+		names[typ] = key
+	}
+	for _, item := range ilst.children {
+		key, ok := names[item.typ]
+		if item.typ == "----" {
+			key, ok = mp4FreeformName(item.data)
+		}
+		if !ok {
+			continue
+		}
+		for _, v := range mp4ItemValues(item) {
+			tags[key] = append(tags[key], v)
+		}
+	}
+	return tags, nil
+}
+
+// mp4ItemValues decodes the data atoms of an item: text, or the binary
+// number/total pairs of trkn and disk
+func mp4ItemValues(item *mp4Atom) []string {
+	children, err := parseMP4Atoms(item.data)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, c := range children {
+		if c.typ != "data" || len(c.data) < 8 {
+			continue
+		}
+		kind := binary.BigEndian.Uint32(c.data) & 0xFFFFFF
+		value := c.data[8:]
+		switch {
+		case (item.typ == "trkn" || item.typ == "disk") && len(value) >= 6:
+			n, total := binary.BigEndian.Uint16(value[2:]), binary.BigEndian.Uint16(value[4:])
+			if total > 0 {
+				values = append(values, fmt.Sprintf("%d/%d", n, total))
+			} else {
+				values = append(values, strconv.Itoa(int(n)))
+			}
+		case kind == 1:
+			values = append(values, string(value))
+		}
+	}
+	return values
+}
+
+// mp4FreeformName returns the name of a "----" item
+func mp4FreeformName(data []byte) (string, bool) {
+	children, err := parseMP4Atoms(data)
+	if err != nil {
+		return "", false
+	}
+	for _, c := range children {
+		if c.typ == "name" && len(c.data) > 4 {
+			return string(c.data[4:]), true
+		}
+	}
+	return "", false
+}
+
+// mp4Item builds an item atom holding values; a freeform key builds a
+// "----" item with its mean and name
+func mp4Item(typ string, values []string) *mp4Atom {
+	item := &mp4Atom{typ: typ}
+	if name, ok := strings.CutPrefix(typ, mp4Freeform); ok {
+		item.typ = "----"
+		item.data = append(item.data, (&mp4Atom{typ: "mean", data: append(make([]byte, 4), mp4FreeformMean...)}).bytes()...)
+		item.data = append(item.data, (&mp4Atom{typ: "name", data: append(make([]byte, 4), name...)}).bytes()...)
+	}
+	for _, v := range values {
+		var data []byte
+		if typ == "trkn" || typ == "disk" {
+			n, total, _ := strings.Cut(v, "/")
+			num, _ := strconv.Atoi(strings.TrimSpace(n))
+			tot, _ := strconv.Atoi(strings.TrimSpace(total))
+			data = make([]byte, 8, 16)
+			data = append(data, 0, 0, byte(num>>8), byte(num), byte(tot>>8), byte(tot))
+			if typ == "trkn" {
+				data = append(data, 0, 0)
+			}
+		} else {
+			data = make([]byte, 8, 8+len(v))
+			data[3] = 1 // UTF-8
+			data = append(data, v...)
+		}
+		item.data = append(item.data, (&mp4Atom{typ: "data", data: data}).bytes()...)
+	}
+	return item
+}
+
+// writeMP4Tags rewrites the iTunes item list. The movie atom is rewritten
+// in place when it keeps its size, can take or give space to a free atom
+// after it, or ends the file; otherwise the file is rewritten with padding
+// and the chunk offsets moved along with the media data.
+func writeMP4Tags(path string, writes []tagWrite) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	atoms, moovAt, moov, err := readMP4Layout(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range writes {
+		if _, ok := mp4Items[strings.ToLower(w.key)]; !ok && !strings.HasPrefix(w.key, mp4Freeform) {
+			return fmt.Errorf("%w: MP4 key %q", errNotNative, w.key)
+		}
+	}
+
+	ilst := moov.ilst(true)
+	for _, w := range writes {
+		typ, ok := mp4Items[strings.ToLower(w.key)]
+		if !ok {
+			typ = w.key
+		}
+		var kept []*mp4Atom
+		for _, item := range ilst.children {
+			if !mp4Replaces(typ, item) {
+				kept = append(kept, item)
+			}
+		}
+		ilst.children = kept
+		if len(w.values) > 0 {
+			ilst.children = append(ilst.children, mp4Item(typ, w.values))
+		}
+	}
+
+	start, end := atoms[moovAt].offset, atoms[moovAt].end
+	data := moov.bytes()
+	oldSize := end - start
+
+	// A free atom right after the movie atom can absorb the change
+	if moovAt+1 < len(atoms) && (atoms[moovAt+1].typ == "free" || atoms[moovAt+1].typ == "skip") {
+		end = atoms[moovAt+1].end
+	}
+	gap := end - start - int64(len(data))
+	switch {
+	case gap == 0 || end == atoms[len(atoms)-1].end:
+		return patchFile(path, start, end, data)
+	case gap >= 8:
+		return patchFile(path, start, end, append(data, mp4Free(gap)...))
+	}
+
+	// The media data after the movie atom moves; chunk offsets follow it
+	end = atoms[moovAt].end
+	delta := int64(len(data)) + mp4PaddingSize - oldSize
+	if err := moov.shiftChunkOffsets(end, delta); err != nil {
+		return err
+	}
+	data = append(moov.bytes(), mp4Free(mp4PaddingSize)...)
+	return patchFile(path, start, end, data)
+}
+
+// mp4Replaces reports whether writing the item typ replaces an existing
+// item. Freeform items are matched by name, ignoring case as players do,
+// and setting the genre text replaces an ID3-style numeric genre.
+func mp4Replaces(typ string, item *mp4Atom) bool {
+	if name, ok := strings.CutPrefix(typ, mp4Freeform); ok {
+		if item.typ != "----" {
+			return false
+		}
+		existing, ok := mp4FreeformName(item.data)
+		return ok && strings.EqualFold(existing, name)
+	}
+	return item.typ == typ || (typ == "\xa9gen" && item.typ == "gnre")
+}
+
+func mp4Free(size int64) []byte {
+	free := binary.BigEndian.AppendUint32(nil, uint32(size))
+	free = append(free, "free"...)
+	return append(free, make([]byte, size-8)...)
+}
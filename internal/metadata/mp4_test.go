@@ -0,0 +1,190 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mp4Chunks are the sample chunks in the fixture's media data
+var mp4Chunks = []string{"CHUNK-ONE", "CHUNK-TWO"}
+
+// writeMP4Fixture writes an M4A whose movie atom comes before the media
+// data, with a chunk offset table of type stco or co64 and a free atom of
+// freeSize bytes between them if freeSize > 0, returning its path
+func writeMP4Fixture(t *testing.T, offsets string, freeSize int64) string {
+	t.Helper()
+	ftyp := (&mp4Atom{typ: "ftyp", data: []byte("M4A \x00\x00\x02\x00M4A isom")}).bytes()
+
+	width := 4
+	if offsets == "co64" {
+		width = 8
+	}
+	table := &mp4Atom{typ: offsets, data: make([]byte, 8+len(mp4Chunks)*width)}
+	binary.BigEndian.PutUint32(table.data[4:], uint32(len(mp4Chunks)))
+	stbl := &mp4Atom{typ: "stbl", children: []*mp4Atom{table}}
+	trak := &mp4Atom{typ: "trak", children: []*mp4Atom{
+		{typ: "mdia", children: []*mp4Atom{{typ: "minf", children: []*mp4Atom{stbl}}}},
+	}}
+	moov := &mp4Atom{typ: "moov", children: []*mp4Atom{trak}}
+	moov.ilst(true).children = []*mp4Atom{mp4Item("\xa9nam", []string{"Old"})}
+
+	// The chunks start after the mdat header
+	pos := int64(len(ftyp)+len(moov.bytes())) + freeSize + 8
+	for i, c := range mp4Chunks {
+		entry := table.data[8+i*width:]
+		if width == 4 {
+			binary.BigEndian.PutUint32(entry, uint32(pos))
+		} else {
+			binary.BigEndian.PutUint64(entry, uint64(pos))
+		}
+		pos += int64(len(c))
+	}
+
+	data := append(ftyp, moov.bytes()...)
+	if freeSize > 0 {
+		data = append(data, mp4Free(freeSize)...)
+	}
+	data = append(data, (&mp4Atom{typ: "mdat", data: []byte(strings.Join(mp4Chunks, ""))}).bytes()...)
+
+	path := filepath.Join(t.TempDir(), "fixture.m4a")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkMP4Chunks checks that the chunk offset table still points at the
+// sample chunks, returning the offsets
+func checkMP4Chunks(t *testing.T, path string) []int64 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, _, moov, err := readMP4Layout(f)
+	if err != nil {
+		t.Fatalf("readMP4Layout: %v", err)
+	}
+	stbl := moov.child("trak").child("mdia").child("minf").child("stbl")
+	table, width := stbl.child("stco"), 4
+	if table == nil {
+		table, width = stbl.child("co64"), 8
+	}
+
+	var offsets []int64
+	for i, c := range mp4Chunks {
+		entry := table.data[8+i*width:]
+		off := int64(binary.BigEndian.Uint32(entry))
+		if width == 8 {
+			off = int64(binary.BigEndian.Uint64(entry))
+		}
+		got, err := readAt(f, off, len(c))
+		if err != nil || string(got) != c {
+			t.Fatalf("chunk %d at %d = %q, want %q", i, off, got, c)
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets
+}
+
+func TestMP4WriteGrowsAndShiftsChunkOffsets(t *testing.T) {
+	for _, offsets := range []string{"stco", "co64"} {
+		t.Run(offsets, func(t *testing.T) {
+			path := writeMP4Fixture(t, offsets, 0)
+			before := checkMP4Chunks(t, path)
+
+			err := writeMP4Tags(path, []tagWrite{
+				{key: "title", values: []string{"New title"}},
+				{key: "album", values: []string{strings.Repeat("a", 100)}},
+			})
+			if err != nil {
+				t.Fatalf("writeMP4Tags: %v", err)
+			}
+
+			after := checkMP4Chunks(t, path)
+			if after[0] <= before[0] {
+				t.Errorf("chunk offsets %v not shifted from %v", after, before)
+			}
+			if after[1]-after[0] != before[1]-before[0] {
+				t.Errorf("chunks moved apart: %v from %v", after, before)
+			}
+
+			data, _ := os.ReadFile(path)
+			if !bytes.Contains(data, mp4Free(mp4PaddingSize)) {
+				t.Errorf("no padding left after the movie atom")
+			}
+			tags := readTagsOf(t, path)
+			if got := tags["title"]; len(got) != 1 || got[0] != "New title" {
+				t.Errorf("title = %q", got)
+			}
+		})
+	}
+}
+
+func TestMP4WriteAbsorbsFreeAtom(t *testing.T) {
+	path := writeMP4Fixture(t, "stco", 512)
+	before := checkMP4Chunks(t, path)
+	info, _ := os.Stat(path)
+
+	if err := writeMP4Tags(path, []tagWrite{{key: "artist", values: []string{"Someone"}}}); err != nil {
+		t.Fatalf("writeMP4Tags: %v", err)
+	}
+
+	after := checkMP4Chunks(t, path)
+	if after[0] != before[0] {
+		t.Errorf("chunk offsets moved from %v to %v", before, after)
+	}
+	if now, _ := os.Stat(path); now.Size() != info.Size() {
+		t.Errorf("size = %d, want %d kept by shrinking the free atom", now.Size(), info.Size())
+	}
+	tags := readTagsOf(t, path)
+	if got := tags["artist"]; len(got) != 1 || got[0] != "Someone" {
+		t.Errorf("artist = %q", got)
+	}
+	if got := tags["title"]; len(got) != 1 || got[0] != "Old" {
+		t.Errorf("title = %q, want it kept", got)
+	}
+}
+
+func TestMP4WriteFreeformItems(t *testing.T) {
+	path := writeMP4Fixture(t, "stco", 1024)
+
+	write := func(values ...string) {
+		t.Helper()
+		if err := writeMP4Tags(path, []tagWrite{{key: mp4Freeform + "LABEL", values: values}}); err != nil {
+			t.Fatalf("writeMP4Tags: %v", err)
+		}
+	}
+	write("First")
+	write("Second")
+	checkMP4Chunks(t, path)
+
+	// Written once more, the item is replaced rather than added again
+	if got := readTagsOf(t, path)["LABEL"]; len(got) != 1 || got[0] != "Second" {
+		t.Errorf("LABEL = %q, want [Second]", got)
+	}
+
+	write()
+	if got, ok := readTagsOf(t, path)["LABEL"]; ok {
+		t.Errorf("LABEL = %q, want it removed", got)
+	}
+}
+
+func TestMP4WriteUnknownKeyFallsBack(t *testing.T) {
+	path := writeMP4Fixture(t, "stco", 0)
+	before, _ := os.ReadFile(path)
+
+	err := writeMP4Tags(path, []tagWrite{{key: "SOMETHING_ELSE", values: []string{"x"}}})
+	if !errors.Is(err, errNotNative) {
+		t.Fatalf("err = %v, want errNotNative", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Errorf("file changed")
+	}
+}
@@ -0,0 +1,210 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// errNotNative is returned by the native tag layer for files it does not
+// handle, so the caller can fall back to ffmpeg. Nothing has been written
+// when it is returned.
+var errNotNative = errors.New("not supported by native tag writer")
+
+// nativeFormat reads and edits the tags of one file format in place, keyed
+// by ffmpeg's metadata key spelling so the rest of the package need not
+// know which path wrote a tag
+type nativeFormat struct {
+	read  func(f *os.File) (map[string][]string, error)
+	write func(path string, writes []tagWrite) error
+}
+
+func nativeFormatFor(path string) *nativeFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		return &nativeFormat{read: readFLACTags, write: writeFLACTags}
+	case ".mp3":
+		return &nativeFormat{read: readID3v2Tags, write: writeID3v2Tags}
+	case ".m4a", ".alac", ".mp4":
+		return &nativeFormat{read: readMP4Tags, write: writeMP4Tags}
+	}
+	return nil
+}
+
+// ReadTags reads every tag of a FLAC, MP3 or MP4 file without ffmpeg.
+// Repeated values are returned as they are stored rather than joined.
+func ReadTags(path string) (map[string][]string, error) {
+	format := nativeFormatFor(path)
+	if format == nil {
+		return nil, errNotNative
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return format.read(f)
+}
+
+// writeNative writes tags from source into filePath with the native layer.
+// A tagged copy is made by copying source next to filePath, editing the
+// copy and renaming it into place.
+func writeNative(source, filePath string, writes []tagWrite) error {
+	format := nativeFormatFor(filePath)
+	if format == nil {
+		return errNotNative
+	}
+	if source == filePath {
+		return format.write(filePath, writes)
+	}
+
+	tmp := nativeTempPath(filePath)
+	if err := copyWholeFile(source, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := format.write(tmp, writes); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filePath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename temp file: %v", err)
+	}
+	return nil
+}
+
+// tagRows converts natively read tags into per-value rows
+func tagRows(tags map[string][]string) []models.TrackTag {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var rows []models.TrackTag
+	for _, key := range keys {
+		for i, v := range tags[key] {
+			rows = append(rows, models.TrackTag{Key: key, Position: i, Value: v})
+		}
+	}
+	return rows
+}
+
+// patchFile replaces the bytes [start, end) of a file with data. Same-size
+// edits and edits at the end of the file are written in place; anything
+// else rewrites the file through a temp file renamed over the original.
+func patchFile(path string, start, end int64, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	if int64(len(data)) == end-start || end == size {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(data, start); err != nil {
+			f.Close()
+			return err
+		}
+		if end == size {
+			if err := f.Truncate(start + int64(len(data))); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := nativeTempPath(path)
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := io.Copy(dst, io.NewSectionReader(src, 0, start)); err != nil {
+		return fail(err)
+	}
+	if _, err := dst.Write(data); err != nil {
+		return fail(err)
+	}
+	if _, err := io.Copy(dst, io.NewSectionReader(src, end, size-end)); err != nil {
+		return fail(err)
+	}
+	if err := dst.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename temp file: %v", err)
+	}
+	return nil
+}
+
+// nativeTempPath returns a temp file name beside path, on the same
+// filesystem so it can be renamed over it
+func nativeTempPath(path string) string {
+	ext := filepath.Ext(path)
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".ottavia_tmp_%d%s", time.Now().UnixNano(), ext))
+}
+
+func copyWholeFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// readAt reads exactly n bytes at off
+func readAt(f *os.File, off int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: truncated file", errNotNative)
+		}
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNativeFallsBackForUnsupportedID3v2(t *testing.T) {
+	for name, flags := range map[string]byte{
+		"unsynchronised":  0x80,
+		"extended header": 0x40,
+		"footer":          0x10,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeID3Fixture(t, 4, flags, []id3Frame{latin1Frame("TIT2", "Old")}, 32)
+			before, _ := os.ReadFile(path)
+
+			if _, err := ReadTags(path); !errors.Is(err, errNotNative) {
+				t.Errorf("ReadTags err = %v, want errNotNative", err)
+			}
+			err := writeNative(path, path, []tagWrite{{key: "title", values: []string{"New"}}})
+			if !errors.Is(err, errNotNative) {
+				t.Errorf("writeNative err = %v, want errNotNative", err)
+			}
+			if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+				t.Errorf("file changed before falling back")
+			}
+		})
+	}
+}
+
+func TestNativeFallsBackForOtherFormats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.ogg")
+	if err := os.WriteFile(path, []byte("OggS"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadTags(path); !errors.Is(err, errNotNative) {
+		t.Errorf("ReadTags err = %v, want errNotNative", err)
+	}
+	if err := writeNative(path, path, nil); !errors.Is(err, errNotNative) {
+		t.Errorf("writeNative err = %v, want errNotNative", err)
+	}
+
+	// A FLAC stream behind an ID3v2 tag is left to ffmpeg too
+	flac := writeFLACFixture(t, nil, 0)
+	data, _ := os.ReadFile(flac)
+	tagged := append((&id3Tag{version: 3}).bytes(0), data...)
+	if err := os.WriteFile(flac, tagged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeNative(flac, flac, []tagWrite{{key: "title", values: []string{"x"}}}); !errors.Is(err, errNotNative) {
+		t.Errorf("writeNative err = %v, want errNotNative", err)
+	}
+}
+
+func TestNativeWritesTaggedCopy(t *testing.T) {
+	source := writeFLACFixture(t, [][2]string{{"TITLE", "Old"}}, 256)
+	before, _ := os.ReadFile(source)
+	target := filepath.Join(t.TempDir(), "copy.flac")
+
+	if err := writeNative(source, target, []tagWrite{{key: "title", values: []string{"New"}}}); err != nil {
+		t.Fatalf("writeNative: %v", err)
+	}
+	if after, _ := os.ReadFile(source); !bytes.Equal(before, after) {
+		t.Errorf("source changed")
+	}
+	if got := readTagsOf(t, target)["TITLE"]; len(got) != 1 || got[0] != "New" {
+		t.Errorf("copy TITLE = %q", got)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(target), ".ottavia_tmp_*"))
+	if len(leftovers) > 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
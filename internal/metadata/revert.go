@@ -0,0 +1,393 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// ErrNotRevertable is returned for actions that did not edit tags
+var ErrNotRevertable = errors.New("action cannot be reverted")
+
+// TagConflict is a field that changed again after the action being reverted
+type TagConflict struct {
+	Field    string      `json:"field"`
+	Expected interface{} `json:"expected"` // value the action left behind
+	Current  interface{} `json:"current"`
+}
+
+// TrackRevert is the plan for reverting one track edit
+type TrackRevert struct {
+	ActionLogID string        `json:"actionLogId"`
+	TrackID     string        `json:"trackId"`
+	Path        string        `json:"path"`
+	Diffs       []TagDiff     `json:"diffs"`
+	Conflicts   []TagConflict `json:"conflicts,omitempty"`
+	CanWrite    bool          `json:"canWrite"`
+	Error       string        `json:"error,omitempty"`
+
+	changes *TagChanges
+}
+
+// RevertPreview shows what reverting an action would change
+type RevertPreview struct {
+	ActionLogID  string        `json:"actionLogId"`
+	Type         string        `json:"type"`
+	Tracks       []TrackRevert `json:"tracks"`
+	Conflicts    int           `json:"conflicts"` // tracks edited again since the action
+	CanRevertAll bool          `json:"canRevertAll"`
+}
+
+// RevertResult is the outcome of reverting an action
+type RevertResult struct {
+	ActionLogID  string        `json:"actionLogId"`
+	TotalTracks  int           `json:"totalTracks"`
+	SuccessCount int           `json:"successCount"`
+	FailedCount  int           `json:"failedCount"`
+	SkippedCount int           `json:"skippedCount"` // left alone because of conflicts
+	Results      []WriteResult `json:"results"`
+	Conflicts    []TrackRevert `json:"conflicts,omitempty"`
+	RevertID     string        `json:"revertId,omitempty"` // action log ID of the revert itself
+}
+
+// PreviewRevert performs a dry run of reverting a track edit, or every
+// track edit of a bulk operation
+func (w *Writer) PreviewRevert(ctx context.Context, actionID string) (*RevertPreview, error) {
+	action, edits, err := w.revertTargets(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &RevertPreview{
+		ActionLogID:  action.ID,
+		Type:         action.Type,
+		Tracks:       []TrackRevert{},
+		CanRevertAll: true,
+	}
+	for _, edit := range edits {
+		tr := w.planRevert(ctx, edit)
+		if len(tr.Conflicts) > 0 {
+			preview.Conflicts++
+			preview.CanRevertAll = false
+		}
+		if !tr.CanWrite {
+			preview.CanRevertAll = false
+		}
+		preview.Tracks = append(preview.Tracks, tr)
+	}
+	return preview, nil
+}
+
+// Revert restores the tag values from before an action through the same
+// atomic write path, logging a "revert" action per track. Tracks edited
+// again since the action are skipped unless force is set.
+func (w *Writer) Revert(ctx context.Context, actionID, actor string, force bool) (*RevertResult, error) {
+	action, edits, err := w.revertTargets(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RevertResult{
+		ActionLogID: action.ID,
+		TotalTracks: len(edits),
+		Results:     []WriteResult{},
+	}
+	revertIDs := []string{}
+
+	for _, edit := range edits {
+		tr := w.planRevert(ctx, edit)
+		if tr.changes == nil {
+			result.Results = append(result.Results, WriteResult{
+				TrackID: tr.TrackID,
+				Path:    tr.Path,
+				Success: false,
+				Error:   tr.Error,
+			})
+			result.FailedCount++
+			continue
+		}
+		if len(tr.Conflicts) > 0 && !force {
+			result.Conflicts = append(result.Conflicts, tr)
+			result.SkippedCount++
+			continue
+		}
+
+		r, err := w.applyChanges(ctx, tr.TrackID, tr.changes, actor, "revert", map[string]interface{}{
+			"revertOf": edit.ID,
+		})
+		if err != nil {
+			result.Results = append(result.Results, WriteResult{
+				TrackID: tr.TrackID,
+				Path:    tr.Path,
+				Success: false,
+				Error:   err.Error(),
+			})
+			result.FailedCount++
+			continue
+		}
+
+		result.Results = append(result.Results, *r)
+		if r.Success {
+			result.SuccessCount++
+			if r.ActionLogID != "" {
+				revertIDs = append(revertIDs, r.ActionLogID)
+			}
+		} else {
+			result.FailedCount++
+		}
+	}
+
+	if !isTrackEdit(action) {
+		// Log the group revert so it can itself be reverted as a whole
+		beforeJSON, _ := json.Marshal(map[string]interface{}{
+			"type": action.Type,
+		})
+		afterJSON, _ := json.Marshal(map[string]interface{}{
+			"successCount": result.SuccessCount,
+			"failedCount":  result.FailedCount,
+			"skippedCount": result.SkippedCount,
+			"actionLogIds": revertIDs,
+		})
+		actionLog := &models.ActionLog{
+			Type:       "revert",
+			TargetType: "action",
+			TargetID:   action.ID,
+			Actor:      actor,
+			BeforeJSON: string(beforeJSON),
+			AfterJSON:  string(afterJSON),
+		}
+		if err := w.db.CreateActionLog(ctx, actionLog); err != nil {
+			log.Error().Err(err).Str("action_id", action.ID).Msg("Failed to create action log")
+		} else {
+			result.RevertID = actionLog.ID
+		}
+	} else if len(revertIDs) > 0 {
+		result.RevertID = revertIDs[0]
+	}
+
+	return result, nil
+}
+
+// revertTargets loads an action and the track edits it covers, latest
+// first. Group actions (bulk edits, lookups, ReplayGain runs, group
+// reverts) list their track edits in "actionLogIds".
+func (w *Writer) revertTargets(ctx context.Context, actionID string) (*models.ActionLog, []*models.ActionLog, error) {
+	action, err := w.db.GetActionLog(ctx, actionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isTrackEdit(action) {
+		return action, []*models.ActionLog{action}, nil
+	}
+
+	var after struct {
+		ActionLogIDs []string `json:"actionLogIds"`
+	}
+	if err := json.Unmarshal([]byte(action.AfterJSON), &after); err != nil || after.ActionLogIDs == nil {
+		return nil, nil, ErrNotRevertable
+	}
+
+	edits := []*models.ActionLog{}
+	for i := len(after.ActionLogIDs) - 1; i >= 0; i-- {
+		edit, err := w.db.GetActionLog(ctx, after.ActionLogIDs[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("load action %s: %w", after.ActionLogIDs[i], err)
+		}
+		if isTrackEdit(edit) {
+			edits = append(edits, edit)
+		}
+	}
+	return action, edits, nil
+}
+
+func isTrackEdit(action *models.ActionLog) bool {
+	return action.TargetType == "track" && (action.Type == "tag_edit" || action.Type == "revert")
+}
+
+// planRevert works out the changes that restore a track edit's before
+// state and checks the fields it touched still hold the values it wrote
+func (w *Writer) planRevert(ctx context.Context, edit *models.ActionLog) TrackRevert {
+	tr := TrackRevert{
+		ActionLogID: edit.ID,
+		TrackID:     edit.TargetID,
+		Diffs:       []TagDiff{},
+	}
+
+	var before, after map[string]interface{}
+	if json.Unmarshal([]byte(edit.BeforeJSON), &before) != nil || json.Unmarshal([]byte(edit.AfterJSON), &after) != nil {
+		tr.Error = "Action has no readable tag state"
+		return tr
+	}
+
+	track, err := w.db.GetTrack(ctx, edit.TargetID)
+	if err != nil {
+		tr.Error = fmt.Sprintf("Track not found: %v", err)
+		return tr
+	}
+	tr.Path = track.Path
+
+	fields := changedFields(before, after)
+	current, err := w.currentState(ctx, track, fields)
+	if err != nil {
+		tr.Error = err.Error()
+		return tr
+	}
+
+	changes := &TagChanges{}
+	for _, field := range fields {
+		if !sameValue(current[field], after[field]) {
+			tr.Conflicts = append(tr.Conflicts, TagConflict{
+				Field:    field,
+				Expected: after[field],
+				Current:  current[field],
+			})
+		}
+		if err := revertField(changes, field, before[field]); err != nil {
+			tr.Error = err.Error()
+			return tr
+		}
+	}
+	tr.changes = changes
+
+	preview, err := w.PreviewChanges(ctx, track.ID, changes)
+	if err != nil {
+		tr.Error = err.Error()
+		return tr
+	}
+	tr.Diffs = preview.Diffs
+	tr.CanWrite = preview.CanWrite
+	tr.Error = preview.Error
+	return tr
+}
+
+// currentState returns the track's fields, plus the raw tags among fields,
+// in the shape they take in an action log after a JSON round trip
+func (w *Writer) currentState(ctx context.Context, track *models.Track, fields []string) (map[string]interface{}, error) {
+	state := w.trackToMap(track)
+
+	rawTags, err := w.db.ListTrackTags(ctx, track.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		key, ok := strings.CutPrefix(field, "tag:")
+		if !ok {
+			continue
+		}
+		values := []string{}
+		for _, tag := range rawTags {
+			if strings.EqualFold(tag.Key, key) {
+				values = append(values, tag.Value)
+			}
+		}
+		state[field] = values
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// changedFields returns the tag fields whose value differs between two
+// action states, in a stable order
+func changedFields(before, after map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	var fields []string
+	for _, m := range []map[string]interface{}{before, after} {
+		for field := range m {
+			if seen[field] || !isTagField(field) {
+				continue
+			}
+			seen[field] = true
+			if !sameValue(before[field], after[field]) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// isTagField reports whether an action state key is a tag, as opposed to
+// bookkeeping such as "revertOf"
+func isTagField(field string) bool {
+	if _, ok := baseKeys[field]; ok {
+		return true
+	}
+	if strings.HasPrefix(field, "tag:") {
+		return true
+	}
+	for _, f := range stringFields {
+		if f.name == field {
+			return true
+		}
+	}
+	for _, f := range intFields {
+		if f.name == field {
+			return true
+		}
+	}
+	for _, f := range floatFields {
+		if f.name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// revertField adds the change that puts one field back to value; nil
+// removes it
+func revertField(changes *TagChanges, field string, value interface{}) error {
+	if key, ok := strings.CutPrefix(field, "tag:"); ok {
+		values := []string{}
+		list, _ := value.([]interface{})
+		for _, v := range list {
+			values = append(values, fmt.Sprint(v))
+		}
+		if changes.Custom == nil {
+			changes.Custom = make(map[string][]string)
+		}
+		changes.Custom[key] = values
+		return nil
+	}
+	if value == nil {
+		changes.Clear = append(changes.Clear, field)
+		return nil
+	}
+	return setField(changes, field, value)
+}
+
+// sameValue compares two decoded JSON values. Floats allow for the rounding
+// of values read back from tags.
+func sameValue(a, b interface{}) bool {
+	if fa, ok := a.(float64); ok {
+		if fb, ok := b.(float64); ok {
+			return math.Abs(fa-fb) < 0.005
+		}
+	}
+	ja, _ := json.Marshal(emptyToNil(a))
+	jb, _ := json.Marshal(emptyToNil(b))
+	return string(ja) == string(jb)
+}
+
+// emptyToNil treats an empty tag list like an absent tag
+func emptyToNil(v interface{}) interface{} {
+	if list, ok := v.([]interface{}); ok && len(list) == 0 {
+		return nil
+	}
+	return v
+}
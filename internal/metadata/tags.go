@@ -0,0 +1,641 @@
+package metadata
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// Tag containers. Each spells the same field differently: Vorbis comments
+// use free-form upper-case names, ID3v2 uses frame IDs or TXXX descriptions
+// and MP4 uses fixed atoms, or freeform "----" items named like the tags
+// iTunes and Picard write.
+const (
+	ContainerVorbis = "vorbis" // FLAC, Ogg Vorbis, Opus
+	ContainerID3v2  = "id3v2"  // MP3, AIFF, DSF
+	ContainerMP4    = "mp4"    // M4A, ALAC
+	ContainerOther  = "other"  // WAV, WMA, APE, WavPack, ...
+)
+
+// ContainerForPath returns the tag container used by a file
+func ContainerForPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac", ".ogg", ".oga", ".opus":
+		return ContainerVorbis
+	case ".mp3", ".aiff", ".aif", ".dsf":
+		return ContainerID3v2
+	case ".m4a", ".alac", ".mp4":
+		return ContainerMP4
+	default:
+		return ContainerOther
+	}
+}
+
+// baseKeys are the ffmpeg keys of the core fields, which ffmpeg maps to
+// each container itself
+var baseKeys = map[string]string{
+	"title":       "title",
+	"artist":      "artist",
+	"album":       "album",
+	"albumArtist": "album_artist",
+	"trackNumber": "track",
+	"discNumber":  "disc",
+	"year":        "date",
+	"genre":       "genre",
+}
+
+// tagField maps one first-class field to the keys ffmpeg reads and writes.
+// In ID3v2, ffmpeg writes any key that is not a frame ID as a TXXX frame
+// with the key as its description.
+type tagField struct {
+	name  string            // field name in diffs, action logs and set_field
+	write map[string]string // ffmpeg metadata key per container; missing if ffmpeg cannot write it there
+	read  []string          // keys recognised when reading, compared case-insensitively
+}
+
+type stringField struct {
+	tagField
+	track  func(t *models.Track) *sql.NullString
+	change func(c *TagChanges) **string
+}
+
+type intField struct {
+	tagField
+	track  func(t *models.Track) *sql.NullInt32
+	change func(c *TagChanges) **int
+}
+
+type floatField struct {
+	tagField
+	track  func(t *models.Track) *sql.NullFloat64
+	change func(c *TagChanges) **float64
+	format string // value format when written
+}
+
+var stringFields = []stringField{
+	{
+		tagField: tagField{
+			name:  "composer",
+			write: map[string]string{ContainerVorbis: "COMPOSER", ContainerID3v2: "composer", ContainerMP4: "composer"},
+			read:  []string{"composer"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.Composer },
+		change: func(c *TagChanges) **string { return &c.Composer },
+	},
+	{
+		// ffmpeg stores "comment" as DESCRIPTION in Vorbis comments and COMM
+		// in ID3v2, and reads both back as "comment"
+		tagField: tagField{
+			name:  "comment",
+			write: map[string]string{ContainerVorbis: "comment", ContainerID3v2: "comment", ContainerMP4: "comment"},
+			read:  []string{"comment", "description"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.Comment },
+		change: func(c *TagChanges) **string { return &c.Comment },
+	},
+	{
+		tagField: tagField{
+			name:  "label",
+			write: map[string]string{ContainerVorbis: "LABEL", ContainerID3v2: "publisher", ContainerMP4: mp4Freeform + "LABEL"},
+			read:  []string{"label", "publisher", "organization"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.Label },
+		change: func(c *TagChanges) **string { return &c.Label },
+	},
+	{
+		tagField: tagField{
+			name:  "catalogNumber",
+			write: map[string]string{ContainerVorbis: "CATALOGNUMBER", ContainerID3v2: "CATALOGNUMBER", ContainerMP4: mp4Freeform + "CATALOGNUMBER"},
+			read:  []string{"catalognumber"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.CatalogNumber },
+		change: func(c *TagChanges) **string { return &c.CatalogNumber },
+	},
+	{
+		tagField: tagField{
+			name:  "isrc",
+			write: map[string]string{ContainerVorbis: "ISRC", ContainerID3v2: "TSRC", ContainerMP4: mp4Freeform + "ISRC"},
+			read:  []string{"isrc", "tsrc"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.ISRC },
+		change: func(c *TagChanges) **string { return &c.ISRC },
+	},
+	{
+		tagField: tagField{
+			name:  "musicbrainzRecordingId",
+			write: map[string]string{ContainerVorbis: "MUSICBRAINZ_TRACKID", ContainerID3v2: "MusicBrainz Track Id", ContainerMP4: mp4Freeform + "MusicBrainz Track Id"},
+			read:  []string{"musicbrainz_trackid", "musicbrainz track id"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.MBRecordingID },
+		change: func(c *TagChanges) **string { return &c.MBRecordingID },
+	},
+	{
+		tagField: tagField{
+			name:  "musicbrainzReleaseTrackId",
+			write: map[string]string{ContainerVorbis: "MUSICBRAINZ_RELEASETRACKID", ContainerID3v2: "MusicBrainz Release Track Id", ContainerMP4: mp4Freeform + "MusicBrainz Release Track Id"},
+			read:  []string{"musicbrainz_releasetrackid", "musicbrainz release track id"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.MBReleaseTrackID },
+		change: func(c *TagChanges) **string { return &c.MBReleaseTrackID },
+	},
+	{
+		tagField: tagField{
+			name:  "musicbrainzReleaseId",
+			write: map[string]string{ContainerVorbis: "MUSICBRAINZ_ALBUMID", ContainerID3v2: "MusicBrainz Album Id", ContainerMP4: mp4Freeform + "MusicBrainz Album Id"},
+			read:  []string{"musicbrainz_albumid", "musicbrainz album id"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.MBReleaseID },
+		change: func(c *TagChanges) **string { return &c.MBReleaseID },
+	},
+	{
+		tagField: tagField{
+			name:  "musicbrainzReleaseGroupId",
+			write: map[string]string{ContainerVorbis: "MUSICBRAINZ_RELEASEGROUPID", ContainerID3v2: "MusicBrainz Release Group Id", ContainerMP4: mp4Freeform + "MusicBrainz Release Group Id"},
+			read:  []string{"musicbrainz_releasegroupid", "musicbrainz release group id"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.MBReleaseGroupID },
+		change: func(c *TagChanges) **string { return &c.MBReleaseGroupID },
+	},
+	{
+		tagField: tagField{
+			name:  "musicbrainzArtistId",
+			write: map[string]string{ContainerVorbis: "MUSICBRAINZ_ARTISTID", ContainerID3v2: "MusicBrainz Artist Id", ContainerMP4: mp4Freeform + "MusicBrainz Artist Id"},
+			read:  []string{"musicbrainz_artistid", "musicbrainz artist id"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.MBArtistID },
+		change: func(c *TagChanges) **string { return &c.MBArtistID },
+	},
+	{
+		tagField: tagField{
+			name:  "musicbrainzAlbumArtistId",
+			write: map[string]string{ContainerVorbis: "MUSICBRAINZ_ALBUMARTISTID", ContainerID3v2: "MusicBrainz Album Artist Id", ContainerMP4: mp4Freeform + "MusicBrainz Album Artist Id"},
+			read:  []string{"musicbrainz_albumartistid", "musicbrainz album artist id"},
+		},
+		track:  func(t *models.Track) *sql.NullString { return &t.MBAlbumArtistID },
+		change: func(c *TagChanges) **string { return &c.MBAlbumArtistID },
+	},
+}
+
+// intFields are the totals. ID3v2 and MP4 have no separate total keys; the
+// total is written into the track or disc tag as "n/total".
+var intFields = []intField{
+	{
+		tagField: tagField{
+			name:  "totalTracks",
+			write: map[string]string{ContainerVorbis: "TRACKTOTAL"},
+			read:  []string{"tracktotal", "totaltracks"},
+		},
+		track:  func(t *models.Track) *sql.NullInt32 { return &t.TotalTracks },
+		change: func(c *TagChanges) **int { return &c.TotalTracks },
+	},
+	{
+		tagField: tagField{
+			name:  "totalDiscs",
+			write: map[string]string{ContainerVorbis: "DISCTOTAL"},
+			read:  []string{"disctotal", "totaldiscs"},
+		},
+		track:  func(t *models.Track) *sql.NullInt32 { return &t.TotalDiscs },
+		change: func(c *TagChanges) **int { return &c.TotalDiscs },
+	},
+}
+
+var floatFields = []floatField{
+	{
+		tagField: tagField{
+			name:  "replayGainTrackGain",
+			write: map[string]string{ContainerVorbis: "REPLAYGAIN_TRACK_GAIN", ContainerID3v2: "REPLAYGAIN_TRACK_GAIN", ContainerMP4: mp4Freeform + "replaygain_track_gain"},
+			read:  []string{"replaygain_track_gain"},
+		},
+		track:  func(t *models.Track) *sql.NullFloat64 { return &t.ReplayGainTrackGain },
+		change: func(c *TagChanges) **float64 { return &c.ReplayGainTrackGain },
+		format: "%+.2f dB",
+	},
+	{
+		tagField: tagField{
+			name:  "replayGainTrackPeak",
+			write: map[string]string{ContainerVorbis: "REPLAYGAIN_TRACK_PEAK", ContainerID3v2: "REPLAYGAIN_TRACK_PEAK", ContainerMP4: mp4Freeform + "replaygain_track_peak"},
+			read:  []string{"replaygain_track_peak"},
+		},
+		track:  func(t *models.Track) *sql.NullFloat64 { return &t.ReplayGainTrackPeak },
+		change: func(c *TagChanges) **float64 { return &c.ReplayGainTrackPeak },
+		format: "%.6f",
+	},
+	{
+		tagField: tagField{
+			name:  "replayGainAlbumGain",
+			write: map[string]string{ContainerVorbis: "REPLAYGAIN_ALBUM_GAIN", ContainerID3v2: "REPLAYGAIN_ALBUM_GAIN", ContainerMP4: mp4Freeform + "replaygain_album_gain"},
+			read:  []string{"replaygain_album_gain"},
+		},
+		track:  func(t *models.Track) *sql.NullFloat64 { return &t.ReplayGainAlbumGain },
+		change: func(c *TagChanges) **float64 { return &c.ReplayGainAlbumGain },
+		format: "%+.2f dB",
+	},
+	{
+		tagField: tagField{
+			name:  "replayGainAlbumPeak",
+			write: map[string]string{ContainerVorbis: "REPLAYGAIN_ALBUM_PEAK", ContainerID3v2: "REPLAYGAIN_ALBUM_PEAK", ContainerMP4: mp4Freeform + "replaygain_album_peak"},
+			read:  []string{"replaygain_album_peak"},
+		},
+		track:  func(t *models.Track) *sql.NullFloat64 { return &t.ReplayGainAlbumPeak },
+		change: func(c *TagChanges) **float64 { return &c.ReplayGainAlbumPeak },
+		format: "%.6f",
+	},
+}
+
+// ReadExtendedTags fills the extended track fields from probed tags. Fields
+// whose tags are absent are left unchanged.
+func ReadExtendedTags(track *models.Track, tags map[string]string) {
+	for _, f := range stringFields {
+		if v := lookupTag(tags, f.read); v != "" {
+			*f.track(track) = sql.NullString{String: v, Valid: true}
+		}
+	}
+	for _, f := range floatFields {
+		if v, ok := parseTagFloat(lookupTag(tags, f.read)); ok {
+			*f.track(track) = sql.NullFloat64{Float64: v, Valid: true}
+		}
+	}
+
+	// Totals come from their own keys or from "n/total" track and disc tags
+	if n := parseTotal(lookupTag(tags, intFields[0].read), lookupTag(tags, []string{"track", "tracknumber"})); n > 0 {
+		track.TotalTracks = sql.NullInt32{Int32: int32(n), Valid: true}
+	}
+	if n := parseTotal(lookupTag(tags, intFields[1].read), lookupTag(tags, []string{"disc", "discnumber"})); n > 0 {
+		track.TotalDiscs = sql.NullInt32{Int32: int32(n), Valid: true}
+	}
+}
+
+// multiValueKeys are the Vorbis comments commonly repeated for several
+// values, such as one ARTIST per artist. Only these are split when ffmpeg
+// has joined them; a ";" in a title or comment is left alone.
+var multiValueKeys = map[string]bool{
+	"artist": true, "artists": true, "albumartist": true, "album_artist": true,
+	"composer": true, "lyricist": true, "performer": true, "conductor": true,
+	"arranger": true, "remixer": true, "producer": true, "engineer": true,
+	"mixer": true, "genre": true, "mood": true, "label": true, "isrc": true,
+	"musicbrainz_artistid": true, "musicbrainz_albumartistid": true,
+}
+
+// RawTags converts a file's tags into per-value rows. FLAC, MP3 and MP4
+// files are read natively, so repeated values come through as stored;
+// otherwise the probed tags are used, where ffmpeg joins repeated Vorbis
+// comments with ";".
+func RawTags(path string, tags map[string]string) []models.TrackTag {
+	if native, err := ReadTags(path); err == nil {
+		return tagRows(native)
+	}
+
+	vorbis := ContainerForPath(path) == ContainerVorbis
+	var rows []models.TrackTag
+	for key, value := range tags {
+		values := []string{value}
+		if vorbis && multiValueKeys[strings.ToLower(key)] {
+			values = SplitTagValues(value)
+		}
+		for i, v := range values {
+			rows = append(rows, models.TrackTag{Key: key, Position: i, Value: v})
+		}
+	}
+	return rows
+}
+
+// SplitTagValues splits a value that ffmpeg joined from repeated tags
+func SplitTagValues(value string) []string {
+	parts := strings.Split(value, ";")
+	values := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			values = append(values, p)
+		}
+	}
+	if len(values) == 0 {
+		return []string{value}
+	}
+	return values
+}
+
+// UnsupportedFields returns the names of changed fields that cannot be
+// written to a file's container
+func UnsupportedFields(path string, changes *TagChanges) []string {
+	container := ContainerForPath(path)
+	var fields []string
+	check := func(f tagField, set bool) {
+		if set && f.write[container] == "" {
+			fields = append(fields, f.name)
+		}
+	}
+	for _, f := range stringFields {
+		check(f.tagField, *f.change(changes) != nil)
+	}
+	for _, f := range floatFields {
+		check(f.tagField, *f.change(changes) != nil)
+	}
+	if container != ContainerID3v2 && container != ContainerMP4 {
+		for _, f := range intFields {
+			check(f.tagField, *f.change(changes) != nil)
+		}
+	}
+	if container == ContainerMP4 && len(changes.Custom) > 0 {
+		fields = append(fields, "custom")
+	}
+	for _, name := range changes.Clear {
+		if !canClear(container, name) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// canClear reports whether a field can be removed from a container
+func canClear(container, name string) bool {
+	if _, ok := baseKeys[name]; ok {
+		return true
+	}
+	for _, f := range stringFields {
+		if f.name == name {
+			return f.write[container] != ""
+		}
+	}
+	for _, f := range intFields {
+		if f.name == name {
+			return container == ContainerID3v2 || container == ContainerMP4 || f.write[container] != ""
+		}
+	}
+	for _, f := range floatFields {
+		if f.name == name {
+			return f.write[container] != ""
+		}
+	}
+	return false
+}
+
+// clearField unsets a field on the track model
+func clearField(track *models.Track, name string) {
+	switch name {
+	case "title":
+		track.Title = sql.NullString{}
+	case "artist":
+		track.Artist = sql.NullString{}
+	case "album":
+		track.Album = sql.NullString{}
+	case "albumArtist":
+		track.AlbumArtist = sql.NullString{}
+	case "trackNumber":
+		track.TrackNumber = sql.NullInt32{}
+	case "discNumber":
+		track.DiscNumber = sql.NullInt32{}
+	case "year":
+		track.Year = sql.NullInt32{}
+	case "genre":
+		track.Genre = sql.NullString{}
+	}
+	for _, f := range stringFields {
+		if f.name == name {
+			*f.track(track) = sql.NullString{}
+		}
+	}
+	for _, f := range intFields {
+		if f.name == name {
+			*f.track(track) = sql.NullInt32{}
+		}
+	}
+	for _, f := range floatFields {
+		if f.name == name {
+			*f.track(track) = sql.NullFloat64{}
+		}
+	}
+}
+
+// StripUnsupported clears changes to fields that cannot be written to a
+// file's container, so a bulk edit still writes what it can
+func StripUnsupported(path string, changes *TagChanges) {
+	unsupported := make(map[string]bool)
+	for _, name := range UnsupportedFields(path, changes) {
+		unsupported[name] = true
+	}
+	for _, f := range stringFields {
+		if unsupported[f.name] {
+			*f.change(changes) = nil
+		}
+	}
+	for _, f := range intFields {
+		if unsupported[f.name] {
+			*f.change(changes) = nil
+		}
+	}
+	for _, f := range floatFields {
+		if unsupported[f.name] {
+			*f.change(changes) = nil
+		}
+	}
+	if unsupported["custom"] {
+		changes.Custom = nil
+	}
+}
+
+// setExtendedField sets one extended field for a set_field operation. It
+// reports false if field is not an extended field.
+func setExtendedField(changes *TagChanges, field string, value interface{}) (bool, error) {
+	for _, f := range stringFields {
+		if f.name == field {
+			v, ok := value.(string)
+			if !ok {
+				return true, fmt.Errorf("invalid value type for %s", field)
+			}
+			*f.change(changes) = &v
+			return true, nil
+		}
+	}
+	for _, f := range intFields {
+		if f.name == field {
+			v, ok := value.(float64)
+			if !ok {
+				return true, fmt.Errorf("invalid value type for %s", field)
+			}
+			n := int(v)
+			*f.change(changes) = &n
+			return true, nil
+		}
+	}
+	for _, f := range floatFields {
+		if f.name == field {
+			v, ok := value.(float64)
+			if !ok {
+				return true, fmt.Errorf("invalid value type for %s", field)
+			}
+			*f.change(changes) = &v
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tagWrite is one ffmpeg metadata key and its new values; no values removes
+// the tag
+type tagWrite struct {
+	key    string
+	values []string
+}
+
+// tagWrites returns the metadata to write for changes to a track, using the
+// key spelling of the file's container
+func tagWrites(track *models.Track, changes *TagChanges) []tagWrite {
+	container := ContainerForPath(track.Path)
+	var writes []tagWrite
+	add := func(key, value string) {
+		writes = append(writes, tagWrite{key: key, values: []string{value}})
+	}
+
+	if changes.Title != nil {
+		add("title", *changes.Title)
+	}
+	if changes.Artist != nil {
+		add("artist", *changes.Artist)
+	}
+	if changes.Album != nil {
+		add("album", *changes.Album)
+	}
+	if changes.AlbumArtist != nil {
+		add("album_artist", *changes.AlbumArtist)
+	}
+	if changes.Year != nil {
+		add("date", strconv.Itoa(*changes.Year))
+	}
+	if changes.Genre != nil {
+		add("genre", *changes.Genre)
+	}
+
+	cleared := make(map[string]bool, len(changes.Clear))
+	for _, name := range changes.Clear {
+		cleared[name] = true
+	}
+
+	// Track and disc numbers carry their totals in ID3v2 and MP4
+	packTotals := container == ContainerID3v2 || container == ContainerMP4
+	number := func(key string, n *int, current sql.NullInt32, clearNumber bool, total *int, currentTotal sql.NullInt32, clearTotal bool) {
+		if clearNumber {
+			writes = append(writes, tagWrite{key: key})
+			return
+		}
+		if n == nil && (!packTotals || (total == nil && !clearTotal)) {
+			return
+		}
+		value := int(current.Int32)
+		if n != nil {
+			value = *n
+		} else if value <= 0 {
+			// A total alone has nothing to attach to
+			return
+		}
+		if !packTotals {
+			add(key, strconv.Itoa(value))
+			return
+		}
+		t := int(currentTotal.Int32)
+		if total != nil {
+			t = *total
+		} else if clearTotal {
+			t = 0
+		}
+		if t > 0 {
+			add(key, fmt.Sprintf("%d/%d", value, t))
+		} else {
+			add(key, strconv.Itoa(value))
+		}
+	}
+	number("track", changes.TrackNumber, track.TrackNumber, cleared["trackNumber"], changes.TotalTracks, track.TotalTracks, cleared["totalTracks"])
+	number("disc", changes.DiscNumber, track.DiscNumber, cleared["discNumber"], changes.TotalDiscs, track.TotalDiscs, cleared["totalDiscs"])
+
+	for _, f := range stringFields {
+		if v := *f.change(changes); v != nil && f.write[container] != "" {
+			add(f.write[container], *v)
+		}
+	}
+	if !packTotals {
+		for _, f := range intFields {
+			if v := *f.change(changes); v != nil && f.write[container] != "" {
+				add(f.write[container], strconv.Itoa(*v))
+			}
+		}
+	}
+	for _, f := range floatFields {
+		if v := *f.change(changes); v != nil && f.write[container] != "" {
+			add(f.write[container], fmt.Sprintf(f.format, *v))
+		}
+	}
+
+	// Removals are written as keys without a value
+	for _, name := range changes.Clear {
+		if name == "trackNumber" || name == "discNumber" {
+			continue
+		}
+		if key, ok := baseKeys[name]; ok {
+			writes = append(writes, tagWrite{key: key})
+			continue
+		}
+		for _, f := range stringFields {
+			if f.name == name && f.write[container] != "" {
+				writes = append(writes, tagWrite{key: f.write[container]})
+			}
+		}
+		for _, f := range intFields {
+			if f.name == name && !packTotals && f.write[container] != "" {
+				writes = append(writes, tagWrite{key: f.write[container]})
+			}
+		}
+		for _, f := range floatFields {
+			if f.name == name && f.write[container] != "" {
+				writes = append(writes, tagWrite{key: f.write[container]})
+			}
+		}
+	}
+
+	for key, values := range changes.Custom {
+		writes = append(writes, tagWrite{key: key, values: values})
+	}
+	return writes
+}
+
+// lookupTag returns the first non-empty value among keys, matching tag
+// names case-insensitively
+func lookupTag(tags map[string]string, keys []string) string {
+	for _, want := range keys {
+		for k, v := range tags {
+			if strings.EqualFold(k, want) && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+	}
+	return ""
+}
+
+// parseTagFloat parses values such as "-6.54 dB" or "0.988525"
+func parseTagFloat(s string) (float64, bool) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// parseTotal reads a total from its own tag, falling back to the part after
+// "/" in a number tag
+func parseTotal(total, number string) int {
+	if n, err := strconv.Atoi(total); err == nil && n > 0 {
+		return n
+	}
+	if idx := strings.Index(number, "/"); idx >= 0 {
+		if n, err := strconv.Atoi(strings.TrimSpace(number[idx+1:])); err == nil {
+			return n
+		}
+	}
+	return 0
+}
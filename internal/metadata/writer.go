@@ -2,21 +2,28 @@ package metadata
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/ottavia-music/ottavia/internal/database"
 	"github.com/ottavia-music/ottavia/internal/models"
+	"github.com/ottavia-music/ottavia/internal/policy"
 	"github.com/rs/zerolog/log"
 )
 
 // Writer handles safe metadata writing operations
 type Writer struct {
 	db         *database.DB
+	policy     *policy.Policy
 	ffmpegPath string
 }
 
@@ -24,6 +31,7 @@ type Writer struct {
 func New(db *database.DB, ffmpegPath string) *Writer {
 	return &Writer{
 		db:         db,
+		policy:     policy.New(db),
 		ffmpegPath: ffmpegPath,
 	}
 }
@@ -38,6 +46,33 @@ type TagChanges struct {
 	DiscNumber  *int    `json:"discNumber,omitempty"`
 	Year        *int    `json:"year,omitempty"`
 	Genre       *string `json:"genre,omitempty"`
+
+	Composer      *string `json:"composer,omitempty"`
+	Comment       *string `json:"comment,omitempty"`
+	Label         *string `json:"label,omitempty"`
+	CatalogNumber *string `json:"catalogNumber,omitempty"`
+	ISRC          *string `json:"isrc,omitempty"`
+	TotalTracks   *int    `json:"totalTracks,omitempty"`
+	TotalDiscs    *int    `json:"totalDiscs,omitempty"`
+
+	MBRecordingID    *string `json:"musicbrainzRecordingId,omitempty"`
+	MBReleaseTrackID *string `json:"musicbrainzReleaseTrackId,omitempty"`
+	MBReleaseID      *string `json:"musicbrainzReleaseId,omitempty"`
+	MBReleaseGroupID *string `json:"musicbrainzReleaseGroupId,omitempty"`
+	MBArtistID       *string `json:"musicbrainzArtistId,omitempty"`
+	MBAlbumArtistID  *string `json:"musicbrainzAlbumArtistId,omitempty"`
+
+	ReplayGainTrackGain *float64 `json:"replayGainTrackGain,omitempty"`
+	ReplayGainTrackPeak *float64 `json:"replayGainTrackPeak,omitempty"`
+	ReplayGainAlbumGain *float64 `json:"replayGainAlbumGain,omitempty"`
+	ReplayGainAlbumPeak *float64 `json:"replayGainAlbumPeak,omitempty"`
+
+	// Custom sets raw tags by their key in the file's container. An empty
+	// list removes the tag.
+	Custom map[string][]string `json:"custom,omitempty"`
+
+	// Clear lists fields (by diff field name) to remove from the file
+	Clear []string `json:"clear,omitempty"`
 }
 
 // TagDiff represents the before/after diff for a single tag
@@ -49,17 +84,20 @@ type TagDiff struct {
 
 // WritePreview represents the result of a dry-run preview
 type WritePreview struct {
-	TrackID  string    `json:"trackId"`
-	Path     string    `json:"path"`
-	Diffs    []TagDiff `json:"diffs"`
-	CanWrite bool      `json:"canWrite"`
-	Error    string    `json:"error,omitempty"`
+	TrackID   string      `json:"trackId"`
+	Path      string      `json:"path"`
+	Diffs     []TagDiff   `json:"diffs"`
+	CanWrite  bool        `json:"canWrite"`
+	WriteMode policy.Mode `json:"writeMode,omitempty"`
+	Target    string      `json:"target,omitempty"` // tagged copy written instead of the file
+	Error     string      `json:"error,omitempty"`
 }
 
 // WriteResult represents the result of a write operation
 type WriteResult struct {
 	TrackID     string    `json:"trackId"`
 	Path        string    `json:"path"`
+	Target      string    `json:"target,omitempty"` // tagged copy written instead of the file
 	Success     bool      `json:"success"`
 	Diffs       []TagDiff `json:"diffs"`
 	ActionLogID string    `json:"actionLogId,omitempty"`
@@ -92,23 +130,58 @@ func (w *Writer) PreviewChanges(ctx context.Context, trackID string, changes *Ta
 		return preview, nil
 	}
 
-	// Check if file is writable
-	file, err := os.OpenFile(track.Path, os.O_WRONLY, 0)
+	// Check the library's write policy; a refusal still shows the diffs
+	decision, err := w.policy.TrackFile(ctx, track)
 	if err != nil {
+		return nil, err
+	}
+	preview.WriteMode = decision.Mode
+	switch decision.Mode {
+	case policy.ModeDenied:
 		preview.CanWrite = false
-		preview.Error = fmt.Sprintf("File is not writable: %v", err)
-		return preview, nil
+		preview.Error = decision.Reason
+	case policy.ModeCopy:
+		preview.Target = decision.Target
+		if err := checkCopyTarget(decision.Target); err != nil {
+			preview.CanWrite = false
+			preview.Error = err.Error()
+			return preview, nil
+		}
+	default:
+		// Check if file is writable
+		file, err := os.OpenFile(track.Path, os.O_WRONLY, 0)
+		if err != nil {
+			preview.CanWrite = false
+			preview.Error = fmt.Sprintf("File is not writable: %v", err)
+			return preview, nil
+		}
+		file.Close()
+	}
+
+	// Check that every changed field has a key in this container
+	if unsupported := UnsupportedFields(track.Path, changes); preview.CanWrite && len(unsupported) > 0 {
+		preview.CanWrite = false
+		preview.Error = fmt.Sprintf("Cannot write %s to %s tags", strings.Join(unsupported, ", "), ContainerForPath(track.Path))
 	}
-	file.Close()
 
 	// Calculate diffs
-	preview.Diffs = w.calculateDiffs(track, changes)
+	diffs, err := w.calculateDiffs(ctx, track, changes)
+	if err != nil {
+		return nil, err
+	}
+	preview.Diffs = diffs
 
 	return preview, nil
 }
 
 // ApplyChanges applies metadata changes to a track with safety mechanisms
 func (w *Writer) ApplyChanges(ctx context.Context, trackID string, changes *TagChanges, actor string) (*WriteResult, error) {
+	return w.applyChanges(ctx, trackID, changes, actor, "tag_edit", nil)
+}
+
+// applyChanges writes changes and records them as an action of the given
+// type. extra is merged into the action's after state.
+func (w *Writer) applyChanges(ctx context.Context, trackID string, changes *TagChanges, actor, actionType string, extra map[string]interface{}) (*WriteResult, error) {
 	// First, preview to get the diffs and check writability
 	preview, err := w.PreviewChanges(ctx, trackID, changes)
 	if err != nil {
@@ -119,6 +192,7 @@ func (w *Writer) ApplyChanges(ctx context.Context, trackID string, changes *TagC
 		return &WriteResult{
 			TrackID: trackID,
 			Path:    preview.Path,
+			Target:  preview.Target,
 			Success: false,
 			Diffs:   preview.Diffs,
 			Error:   preview.Error,
@@ -140,37 +214,71 @@ func (w *Writer) ApplyChanges(ctx context.Context, trackID string, changes *TagC
 		return nil, err
 	}
 
-	// Create before state for action log
+	// Create before state for action log, including raw tags being changed
 	beforeState := w.trackToMap(track)
+	for _, d := range preview.Diffs {
+		if strings.HasPrefix(d.Field, "tag:") {
+			beforeState[d.Field] = d.Before
+		}
+	}
 
-	// Perform the atomic write operation
-	if err := w.atomicWrite(ctx, track.Path, changes); err != nil {
+	// Perform the atomic write operation. A tagged copy starts from the
+	// previous copy, if any, so successive edits accumulate.
+	writes := tagWrites(track, changes)
+	source, target := track.Path, track.Path
+	if preview.WriteMode == policy.ModeCopy {
+		target = preview.Target
+		if _, err := os.Stat(target); err == nil {
+			source = target
+		}
+	}
+	if err := w.atomicWrite(ctx, source, target, writes); err != nil {
 		return &WriteResult{
 			TrackID: trackID,
 			Path:    track.Path,
+			Target:  preview.Target,
 			Success: false,
 			Diffs:   preview.Diffs,
 			Error:   fmt.Sprintf("Write failed: %v", err),
 		}, nil
 	}
 
-	// Update the database record
+	// Update the database record; a tagged copy leaves the source, and so
+	// the track, unchanged
 	w.applyChangesToTrack(track, changes)
-	if err := w.db.UpdateTrack(ctx, track); err != nil {
-		log.Error().Err(err).Str("track_id", trackID).Msg("Failed to update track in database after successful file write")
-		// Note: File was already modified, but DB update failed
-		// This is logged but not returned as failure since file write succeeded
+	if preview.WriteMode != policy.ModeCopy {
+		if err := w.db.UpdateTrack(ctx, track); err != nil {
+			log.Error().Err(err).Str("track_id", trackID).Msg("Failed to update track in database after successful file write")
+			// Note: File was already modified, but DB update failed
+			// This is logged but not returned as failure since file write succeeded
+		}
+		for _, tw := range writes {
+			if err := w.db.SetTrackTagValues(ctx, trackID, tw.key, tw.values); err != nil {
+				log.Error().Err(err).Str("track_id", trackID).Str("key", tw.key).Msg("Failed to update raw tag after successful file write")
+			}
+		}
 	}
 
 	// Create after state for action log
 	afterState := w.trackToMap(track)
+	if preview.WriteMode == policy.ModeCopy {
+		afterState["copyPath"] = preview.Target
+	}
+	for _, d := range preview.Diffs {
+		if strings.HasPrefix(d.Field, "tag:") {
+			afterState[d.Field] = d.After
+		}
+	}
+	for k, v := range extra {
+		afterState[k] = v
+	}
 
 	// Log the action
 	beforeJSON, _ := json.Marshal(beforeState)
 	afterJSON, _ := json.Marshal(afterState)
 
 	actionLog := &models.ActionLog{
-		Type:       "tag_edit",
+		Type:       actionType,
 		TargetType: "track",
 		TargetID:   trackID,
 		Actor:      actor,
@@ -185,49 +293,53 @@ func (w *Writer) ApplyChanges(ctx context.Context, trackID string, changes *TagC
 	return &WriteResult{
 		TrackID:     trackID,
 		Path:        track.Path,
+		Target:      preview.Target,
 		Success:     true,
 		Diffs:       preview.Diffs,
 		ActionLogID: actionLog.ID,
 	}, nil
 }
 
-// atomicWrite performs the actual metadata write using ffmpeg with atomic file operations
-func (w *Writer) atomicWrite(ctx context.Context, filePath string, changes *TagChanges) error {
+// atomicWrite performs the actual metadata write. FLAC, MP3 and MP4 tags are
+// edited in place by the native tag layer; other containers are remuxed
+// through ffmpeg with atomic file operations. The tags are written from
+// source into filePath, which is the same file unless a tagged copy is
+// being made.
+func (w *Writer) atomicWrite(ctx context.Context, source, filePath string, writes []tagWrite) error {
 	// Create a temporary file in the same directory (for same-filesystem rename)
 	dir := filepath.Dir(filePath)
 	ext := filepath.Ext(filePath)
 	tempFile := filepath.Join(dir, fmt.Sprintf(".ottavia_tmp_%d%s", time.Now().UnixNano(), ext))
 
-	// Build ffmpeg command to copy file with new metadata
-	args := []string{
-		"-i", filePath,
-		"-c", "copy", // Copy streams without re-encoding
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
-	// Add metadata arguments
-	if changes.Title != nil {
-		args = append(args, "-metadata", fmt.Sprintf("title=%s", *changes.Title))
-	}
-	if changes.Artist != nil {
-		args = append(args, "-metadata", fmt.Sprintf("artist=%s", *changes.Artist))
-	}
-	if changes.Album != nil {
-		args = append(args, "-metadata", fmt.Sprintf("album=%s", *changes.Album))
+	err := writeNative(source, filePath, writes)
+	if err == nil {
+		log.Info().Str("path", filePath).Msg("Successfully wrote metadata in place")
+		return nil
 	}
-	if changes.AlbumArtist != nil {
-		args = append(args, "-metadata", fmt.Sprintf("album_artist=%s", *changes.AlbumArtist))
-	}
-	if changes.TrackNumber != nil {
-		args = append(args, "-metadata", fmt.Sprintf("track=%d", *changes.TrackNumber))
+	if !errors.Is(err, errNotNative) {
+		return err
 	}
-	if changes.DiscNumber != nil {
-		args = append(args, "-metadata", fmt.Sprintf("disc=%d", *changes.DiscNumber))
+	log.Debug().Err(err).Str("path", filePath).Msg("Falling back to ffmpeg for metadata write")
+
+	// Build ffmpeg command to copy file with new metadata
+	args := []string{
+		"-i", source,
+		"-c", "copy", // Copy streams without re-encoding
 	}
-	if changes.Year != nil {
-		args = append(args, "-metadata", fmt.Sprintf("date=%d", *changes.Year))
+
+	// AIFF only carries ID3v2 tags when asked to
+	if ext == ".aiff" || ext == ".aif" {
+		args = append(args, "-write_id3v2", "1")
 	}
-	if changes.Genre != nil {
-		args = append(args, "-metadata", fmt.Sprintf("genre=%s", *changes.Genre))
+
+	// Add metadata arguments; repeated values are joined the way ffmpeg
+	// reports them
+	for _, tw := range writes {
+		args = append(args, "-metadata", fmt.Sprintf("%s=%s", tw.key, strings.Join(tw.values, ";")))
 	}
 
 	// Output to temp file
@@ -249,6 +361,16 @@ func (w *Writer) atomicWrite(ctx context.Context, filePath string, changes *TagC
 		return fmt.Errorf("temp file was not created")
 	}
 
+	// A new tagged copy has nothing to back up
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		if err := os.Rename(tempFile, filePath); err != nil {
+			os.Remove(tempFile)
+			return fmt.Errorf("failed to rename temp file: %v", err)
+		}
+		log.Info().Str("path", filePath).Str("source", source).Msg("Successfully wrote tagged copy")
+		return nil
+	}
+
 	// Create backup of original file
 	backupFile := filePath + ".ottavia_backup"
 	if err := os.Rename(filePath, backupFile); err != nil {
@@ -270,8 +392,28 @@ func (w *Writer) atomicWrite(ctx context.Context, filePath string, changes *TagC
 	return nil
 }
 
+// checkCopyTarget checks that a tagged copy can be created: the nearest
+// existing parent of its path must be a directory
+func checkCopyTarget(target string) error {
+	dir := filepath.Dir(target)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("Output path %s is not a directory", dir)
+			}
+			return nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return fmt.Errorf("Output path for %s does not exist", target)
+		}
+		dir = parent
+	}
+}
+
 // calculateDiffs computes the differences between current track state and proposed changes
-func (w *Writer) calculateDiffs(track *models.Track, changes *TagChanges) []TagDiff {
+func (w *Writer) calculateDiffs(ctx context.Context, track *models.Track, changes *TagChanges) ([]TagDiff, error) {
 	diffs := []TagDiff{}
 
 	if changes.Title != nil {
@@ -354,7 +496,60 @@ func (w *Writer) calculateDiffs(track *models.Track, changes *TagChanges) []TagD
 		}
 	}
 
-	return diffs
+	for _, f := range stringFields {
+		if v := *f.change(changes); v != nil && f.track(track).String != *v {
+			diffs = append(diffs, TagDiff{Field: f.name, Before: f.track(track).String, After: *v})
+		}
+	}
+	for _, f := range intFields {
+		if v := *f.change(changes); v != nil && int(f.track(track).Int32) != *v {
+			diffs = append(diffs, TagDiff{Field: f.name, Before: f.track(track).Int32, After: *v})
+		}
+	}
+	for _, f := range floatFields {
+		if v := *f.change(changes); v != nil {
+			current := f.track(track)
+			if !current.Valid || fmt.Sprintf(f.format, current.Float64) != fmt.Sprintf(f.format, *v) {
+				diffs = append(diffs, TagDiff{Field: f.name, Before: current.Float64, After: *v})
+			}
+		}
+	}
+
+	current := w.trackToMap(track)
+	for _, name := range changes.Clear {
+		if v, ok := current[name]; ok {
+			diffs = append(diffs, TagDiff{Field: name, Before: v, After: nil})
+		}
+	}
+
+	if len(changes.Custom) > 0 {
+		rawTags, err := w.db.ListTrackTags(ctx, track.ID)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(changes.Custom))
+		for key := range changes.Custom {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			current := []string{}
+			for _, tag := range rawTags {
+				if strings.EqualFold(tag.Key, key) {
+					current = append(current, tag.Value)
+				}
+			}
+			after := changes.Custom[key]
+			if after == nil {
+				after = []string{}
+			}
+			if !slices.Equal(current, after) {
+				diffs = append(diffs, TagDiff{Field: "tag:" + key, Before: current, After: after})
+			}
+		}
+	}
+
+	return diffs, nil
 }
 
 // applyChangesToTrack updates the track model with the changes
@@ -391,6 +586,24 @@ func (w *Writer) applyChangesToTrack(track *models.Track, changes *TagChanges) {
 		track.Genre.String = *changes.Genre
 		track.Genre.Valid = true
 	}
+	for _, f := range stringFields {
+		if v := *f.change(changes); v != nil {
+			*f.track(track) = sql.NullString{String: *v, Valid: true}
+		}
+	}
+	for _, f := range intFields {
+		if v := *f.change(changes); v != nil {
+			*f.track(track) = sql.NullInt32{Int32: int32(*v), Valid: true}
+		}
+	}
+	for _, f := range floatFields {
+		if v := *f.change(changes); v != nil {
+			*f.track(track) = sql.NullFloat64{Float64: *v, Valid: true}
+		}
+	}
+	for _, name := range changes.Clear {
+		clearField(track, name)
+	}
 }
 
 // trackToMap converts track metadata fields to a map for action logging
@@ -421,16 +634,32 @@ func (w *Writer) trackToMap(track *models.Track) map[string]interface{} {
 	if track.Genre.Valid {
 		m["genre"] = track.Genre.String
 	}
+	for _, f := range stringFields {
+		if v := f.track(track); v.Valid {
+			m[f.name] = v.String
+		}
+	}
+	for _, f := range intFields {
+		if v := f.track(track); v.Valid {
+			m[f.name] = v.Int32
+		}
+	}
+	for _, f := range floatFields {
+		if v := f.track(track); v.Valid {
+			m[f.name] = v.Float64
+		}
+	}
 
 	return m
 }
 
 // BulkOperation represents a bulk operation request
 type BulkOperation struct {
-	TrackIDs  []string    `json:"trackIds"`
-	Operation string      `json:"operation"` // "normalize_album_artist", "fix_track_numbers", "set_field"
-	Value     interface{} `json:"value,omitempty"`
-	Field     string      `json:"field,omitempty"` // for "set_field" operation
+	TrackIDs  []string               `json:"trackIds"`
+	Operation string                 `json:"operation"` // "normalize_album_artist", "fix_track_numbers", "set_field", "set_tags"
+	Value     interface{}            `json:"value,omitempty"`
+	Field     string                 `json:"field,omitempty"`   // for "set_field" operation
+	Changes   map[string]*TagChanges `json:"changes,omitempty"` // per-track changes for "set_tags" operation
 }
 
 // BulkResult represents the result of a bulk operation
@@ -440,6 +669,7 @@ type BulkResult struct {
 	FailedCount    int            `json:"failedCount"`
 	Results        []WriteResult  `json:"results"`
 	ActionLogIDs   []string       `json:"actionLogIds,omitempty"`
+	BulkID         string         `json:"bulkId,omitempty"` // action log ID of the whole operation, for reverting it
 }
 
 // BulkPreview represents the preview of a bulk operation
@@ -533,6 +763,34 @@ func (w *Writer) ApplyBulkOperation(ctx context.Context, op *BulkOperation, acto
 		}
 	}
 
+	// Group the per-track edits so the operation can be reverted as a whole
+	if len(result.ActionLogIDs) > 0 {
+		beforeJSON, _ := json.Marshal(map[string]interface{}{
+			"operation": op.Operation,
+			"field":     op.Field,
+			"value":     op.Value,
+			"trackIds":  op.TrackIDs,
+		})
+		afterJSON, _ := json.Marshal(map[string]interface{}{
+			"successCount": result.SuccessCount,
+			"failedCount":  result.FailedCount,
+			"actionLogIds": result.ActionLogIDs,
+		})
+		actionLog := &models.ActionLog{
+			Type:       "bulk_edit",
+			TargetType: "bulk",
+			TargetID:   op.Operation,
+			Actor:      actor,
+			BeforeJSON: string(beforeJSON),
+			AfterJSON:  string(afterJSON),
+		}
+		if err := w.db.CreateActionLog(ctx, actionLog); err != nil {
+			log.Error().Err(err).Str("operation", op.Operation).Msg("Failed to create action log")
+		} else {
+			result.BulkID = actionLog.ID
+		}
+	}
+
 	return result, nil
 }
 
@@ -545,6 +803,12 @@ func (w *Writer) operationToChanges(ctx context.Context, trackID string, op *Bul
 		return w.fixTrackNumberChanges(ctx, trackID, op)
 	case "set_field":
 		return w.setFieldChanges(op.Field, op.Value)
+	case "set_tags":
+		changes, ok := op.Changes[trackID]
+		if !ok || changes == nil {
+			return nil, fmt.Errorf("no changes for track")
+		}
+		return changes, nil
 	default:
 		return nil, fmt.Errorf("unknown operation: %s", op.Operation)
 	}
@@ -590,30 +854,37 @@ func (w *Writer) fixTrackNumberChanges(ctx context.Context, trackID string, op *
 // setFieldChanges creates changes for setting a single field on all tracks
 func (w *Writer) setFieldChanges(field string, value interface{}) (*TagChanges, error) {
 	changes := &TagChanges{}
+	if err := setField(changes, field, value); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
 
+// setField sets one field, by its diff name, from a JSON value
+func setField(changes *TagChanges, field string, value interface{}) error {
 	switch field {
 	case "title":
 		v, ok := value.(string)
 		if !ok {
-			return nil, fmt.Errorf("invalid value type for title")
+			return fmt.Errorf("invalid value type for title")
 		}
 		changes.Title = &v
 	case "artist":
 		v, ok := value.(string)
 		if !ok {
-			return nil, fmt.Errorf("invalid value type for artist")
+			return fmt.Errorf("invalid value type for artist")
 		}
 		changes.Artist = &v
 	case "album":
 		v, ok := value.(string)
 		if !ok {
-			return nil, fmt.Errorf("invalid value type for album")
+			return fmt.Errorf("invalid value type for album")
 		}
 		changes.Album = &v
 	case "albumArtist":
 		v, ok := value.(string)
 		if !ok {
-			return nil, fmt.Errorf("invalid value type for albumArtist")
+			return fmt.Errorf("invalid value type for albumArtist")
 		}
 		changes.AlbumArtist = &v
 	case "year":
@@ -624,15 +895,26 @@ func (w *Writer) setFieldChanges(field string, value interface{}) (*TagChanges,
 		case int:
 			year = v
 		default:
-			return nil, fmt.Errorf("invalid value type for year")
+			return fmt.Errorf("invalid value type for year")
 		}
 		changes.Year = &year
 	case "genre":
 		v, ok := value.(string)
 		if !ok {
-			return nil, fmt.Errorf("invalid value type for genre")
+			return fmt.Errorf("invalid value type for genre")
 		}
 		changes.Genre = &v
+	case "trackNumber":
+		var number int
+		switch v := value.(type) {
+		case float64:
+			number = int(v)
+		case int:
+			number = v
+		default:
+			return fmt.Errorf("invalid value type for trackNumber")
+		}
+		changes.TrackNumber = &number
 	case "discNumber":
 		var disc int
 		switch v := value.(type) {
@@ -641,14 +923,20 @@ func (w *Writer) setFieldChanges(field string, value interface{}) (*TagChanges,
 		case int:
 			disc = v
 		default:
-			return nil, fmt.Errorf("invalid value type for discNumber")
+			return fmt.Errorf("invalid value type for discNumber")
 		}
 		changes.DiscNumber = &disc
 	default:
-		return nil, fmt.Errorf("unknown field: %s", field)
+		known, err := setExtendedField(changes, field, value)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("unknown field: %s", field)
+		}
 	}
 
-	return changes, nil
+	return nil
 }
 
 // NormalizeAlbumArtist normalizes the album artist for all tracks in an album
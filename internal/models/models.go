@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql"
 	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -13,34 +14,91 @@ type Library struct {
 	RootPath      string         `db:"root_path" json:"rootPath"`
 	ScanInterval  string         `db:"scan_interval" json:"scanInterval"`
 	ReadOnly      bool           `db:"read_only" json:"readOnly"`
+	CopyOnWrite   bool           `db:"copy_on_write" json:"copyOnWrite"`
 	OutputPath    sql.NullString `db:"output_path" json:"outputPath,omitempty"`
-	AllowedFormats sql.NullString `db:"allowed_formats" json:"allowedFormats,omitempty"`
+	AllowedFormats sql.NullString `db:"allowed_formats" json:"allowedFormats,omitempty"` // comma-separated extensions, e.g. "flac,wav"
+	ScanRulesJSON string         `db:"scan_rules" json:"-"`
 	LastScanAt    sql.NullTime   `db:"last_scan_at" json:"lastScanAt,omitempty"`
 	Status        string         `db:"status" json:"status"`
 	CreatedAt     time.Time      `db:"created_at" json:"createdAt"`
 	UpdatedAt     time.Time      `db:"updated_at" json:"updatedAt"`
 
+	ScanRules ScanRules `db:"-" json:"scanRules"`
+
 	// Computed fields (populated by queries with aggregates)
 	TrackCount   int   `db:"track_count" json:"trackCount,omitempty"`
 	IssueCount   int   `db:"issue_count" json:"issueCount,omitempty"`
 	TotalSize    int64 `db:"total_size" json:"totalSize,omitempty"`
 }
 
+// ScanRules choose which files under a library's root are scanned, stored
+// as JSON in libraries.scan_rules
+type ScanRules struct {
+	// Glob patterns matched against paths relative to the root. A pattern
+	// without a slash matches any file or directory name, such as "@eaDir";
+	// one with a slash matches the end of the path, such as "*/Samples/*",
+	// unless it starts with a slash. "**" matches any number of
+	// directories. With include patterns, only files matching one are
+	// scanned; excludes win over includes.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// MaxDepth is how many directories below the root files are scanned
+	// in; 0 is unlimited
+	MaxDepth int `json:"maxDepth,omitempty"`
+	// FollowSymlinks scans symlinked files and directories; otherwise
+	// symlinks are skipped
+	FollowSymlinks bool `json:"followSymlinks,omitempty"`
+}
+
+func (l *Library) ParseScanRules() error {
+	l.ScanRules = ScanRules{}
+	if l.ScanRulesJSON != "" {
+		return json.Unmarshal([]byte(l.ScanRulesJSON), &l.ScanRules)
+	}
+	return nil
+}
+
+// Formats returns the allowed file extensions, lowercased with a leading
+// dot, or nil if every supported format is allowed
+func (l *Library) Formats() []string {
+	if !l.AllowedFormats.Valid {
+		return nil
+	}
+	var formats []string
+	for _, f := range strings.Split(l.AllowedFormats.String, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if !strings.HasPrefix(f, ".") {
+			f = "." + f
+		}
+		formats = append(formats, f)
+	}
+	return formats
+}
+
 // MediaFile represents a file on disk
 type MediaFile struct {
-	ID          string         `db:"id" json:"id"`
-	LibraryID   string         `db:"library_id" json:"libraryId"`
-	Path        string         `db:"path" json:"path"`
-	Filename    string         `db:"filename" json:"filename"`
-	Extension   string         `db:"extension" json:"extension"`
-	Size        int64          `db:"size" json:"size"`
-	Mtime       time.Time      `db:"mtime" json:"mtime"`
-	QuickHash   sql.NullString `db:"quick_hash" json:"quickHash,omitempty"`
-	FullHash    sql.NullString `db:"full_hash" json:"fullHash,omitempty"`
-	Status      string         `db:"status" json:"status"`
-	ErrorMsg    sql.NullString `db:"error_msg" json:"errorMsg,omitempty"`
-	CreatedAt   time.Time      `db:"created_at" json:"createdAt"`
-	UpdatedAt   time.Time      `db:"updated_at" json:"updatedAt"`
+	ID            string         `db:"id" json:"id"`
+	LibraryID     string         `db:"library_id" json:"libraryId"`
+	Path          string         `db:"path" json:"path"`
+	Filename      string         `db:"filename" json:"filename"`
+	Extension     string         `db:"extension" json:"extension"`
+	Size          int64          `db:"size" json:"size"`
+	Mtime         time.Time      `db:"mtime" json:"mtime"`
+	QuickHash     sql.NullString `db:"quick_hash" json:"quickHash,omitempty"`
+	FullHash      sql.NullString `db:"full_hash" json:"fullHash,omitempty"`
+	PCMHash       sql.NullString `db:"pcm_hash" json:"pcmHash,omitempty"`   // hash of the decoded audio, independent of tags
+	PCMError      sql.NullString `db:"pcm_error" json:"pcmError,omitempty"` // why the audio couldn't be decoded for PCMHash
+	PCMErrorSize  sql.NullInt64  `db:"pcm_error_size" json:"-"`
+	PCMErrorMtime sql.NullTime   `db:"pcm_error_mtime" json:"-"`
+	CuePath       sql.NullString `db:"cue_path" json:"cuePath,omitempty"` // sidecar cue sheet splitting the file
+	CueMtime      sql.NullTime   `db:"cue_mtime" json:"-"`
+	Status        string         `db:"status" json:"status"`
+	ErrorMsg      sql.NullString `db:"error_msg" json:"errorMsg,omitempty"`
+	CreatedAt     time.Time      `db:"created_at" json:"createdAt"`
+	UpdatedAt     time.Time      `db:"updated_at" json:"updatedAt"`
 }
 
 // Track represents audio track metadata
@@ -54,6 +112,12 @@ type Track struct {
 	Channels      int            `db:"channels" json:"channels"`
 	Bitrate       int            `db:"bitrate" json:"bitrate"`
 
+	// Tracks split from a single-file album image by a cue sheet are
+	// numbered from 1 and play Duration seconds from StartOffset; a file
+	// holding one track has index 0
+	CueIndex    int     `db:"cue_index" json:"cueIndex,omitempty"`
+	StartOffset float64 `db:"start_offset" json:"startOffset,omitempty"`
+
 	// Metadata tags
 	Title         sql.NullString `db:"title" json:"title,omitempty"`
 	Artist        sql.NullString `db:"artist" json:"artist,omitempty"`
@@ -64,6 +128,29 @@ type Track struct {
 	Year          sql.NullInt32  `db:"year" json:"year,omitempty"`
 	Genre         sql.NullString `db:"genre" json:"genre,omitempty"`
 
+	// Extended tags
+	Composer      sql.NullString `db:"composer" json:"composer,omitempty"`
+	Comment       sql.NullString `db:"comment" json:"comment,omitempty"`
+	Label         sql.NullString `db:"label" json:"label,omitempty"`
+	CatalogNumber sql.NullString `db:"catalog_number" json:"catalogNumber,omitempty"`
+	ISRC          sql.NullString `db:"isrc" json:"isrc,omitempty"`
+	TotalTracks   sql.NullInt32  `db:"total_tracks" json:"totalTracks,omitempty"`
+	TotalDiscs    sql.NullInt32  `db:"total_discs" json:"totalDiscs,omitempty"`
+
+	// MusicBrainz identifiers
+	MBRecordingID    sql.NullString `db:"mb_recording_id" json:"musicbrainzRecordingId,omitempty"`
+	MBReleaseTrackID sql.NullString `db:"mb_release_track_id" json:"musicbrainzReleaseTrackId,omitempty"`
+	MBReleaseID      sql.NullString `db:"mb_release_id" json:"musicbrainzReleaseId,omitempty"`
+	MBReleaseGroupID sql.NullString `db:"mb_release_group_id" json:"musicbrainzReleaseGroupId,omitempty"`
+	MBArtistID       sql.NullString `db:"mb_artist_id" json:"musicbrainzArtistId,omitempty"`
+	MBAlbumArtistID  sql.NullString `db:"mb_album_artist_id" json:"musicbrainzAlbumArtistId,omitempty"`
+
+	// ReplayGain (gain in dB, peak as linear sample amplitude)
+	ReplayGainTrackGain sql.NullFloat64 `db:"replaygain_track_gain" json:"replayGainTrackGain,omitempty"`
+	ReplayGainTrackPeak sql.NullFloat64 `db:"replaygain_track_peak" json:"replayGainTrackPeak,omitempty"`
+	ReplayGainAlbumGain sql.NullFloat64 `db:"replaygain_album_gain" json:"replayGainAlbumGain,omitempty"`
+	ReplayGainAlbumPeak sql.NullFloat64 `db:"replaygain_album_peak" json:"replayGainAlbumPeak,omitempty"`
+
 	HasArtwork    bool           `db:"has_artwork" json:"hasArtwork"`
 	ArtworkWidth  sql.NullInt32  `db:"artwork_width" json:"artworkWidth,omitempty"`
 	ArtworkHeight sql.NullInt32  `db:"artwork_height" json:"artworkHeight,omitempty"`
@@ -75,6 +162,31 @@ type Track struct {
 	Path          string         `db:"path" json:"path,omitempty"`
 	LibraryID     string         `db:"library_id" json:"libraryId,omitempty"`
 	LibraryName   string         `db:"library_name" json:"libraryName,omitempty"`
+	FileDuration  float64        `db:"file_duration" json:"-"` // length of the whole file, longer than Duration for a cue track
+}
+
+// FromCue reports whether the track is one of several a cue sheet splits
+// its file into
+func (t *Track) FromCue() bool {
+	return t.CueIndex > 0
+}
+
+// Span returns the part of its file a track plays, in seconds. A zero
+// duration is the whole file.
+func (t *Track) Span() (start, duration float64) {
+	if !t.FromCue() {
+		return 0, 0
+	}
+	return t.StartOffset, t.Duration
+}
+
+// TrackTag is one value of a raw tag as stored in the file. Multi-valued
+// tags have one row per value, ordered by Position.
+type TrackTag struct {
+	TrackID  string `db:"track_id" json:"-"`
+	Key      string `db:"key" json:"key"`
+	Position int    `db:"position" json:"position"`
+	Value    string `db:"value" json:"value"`
 }
 
 // ScanRun represents a library scan session
@@ -86,10 +198,13 @@ type ScanRun struct {
 	FilesNew     int          `db:"files_new" json:"filesNew"`
 	FilesChanged int          `db:"files_changed" json:"filesChanged"`
 	FilesDeleted int          `db:"files_deleted" json:"filesDeleted"`
+	FilesMoved   int          `db:"files_moved" json:"filesMoved"`
 	FilesFailed  int          `db:"files_failed" json:"filesFailed"`
 	StartedAt    time.Time    `db:"started_at" json:"startedAt"`
 	FinishedAt   sql.NullTime `db:"finished_at" json:"finishedAt,omitempty"`
 	ErrorMsg     sql.NullString `db:"error_msg" json:"errorMsg,omitempty"`
+	Incremental  bool           `db:"incremental" json:"incremental"` // only changed directories were rescanned
+	LeaseUntil   sql.NullTime   `db:"lease_expires_at" json:"-"`
 }
 
 // AnalysisResult represents audio analysis results for a track
@@ -176,18 +291,101 @@ type ActionLog struct {
 
 // ConversionJob represents a queued conversion task
 type ConversionJob struct {
-	ID          string         `db:"id" json:"id"`
-	SourceType  string         `db:"source_type" json:"sourceType"` // track/album/library
-	SourceID    string         `db:"source_id" json:"sourceId"`
-	Profile     string         `db:"profile" json:"profile"`
-	OutputPath  string         `db:"output_path" json:"outputPath"`
-	Status      string         `db:"status" json:"status"` // queued/running/success/failed/cancelled
-	Progress    float64        `db:"progress" json:"progress"`
-	LogsPath    sql.NullString `db:"logs_path" json:"logsPath,omitempty"`
-	ErrorMsg    sql.NullString `db:"error_msg" json:"errorMsg,omitempty"`
-	QueuedAt    time.Time      `db:"queued_at" json:"queuedAt"`
-	StartedAt   sql.NullTime   `db:"started_at" json:"startedAt,omitempty"`
-	FinishedAt  sql.NullTime   `db:"finished_at" json:"finishedAt,omitempty"`
+	ID           string         `db:"id" json:"id"`
+	SourceType   string         `db:"source_type" json:"sourceType"` // track/album/library
+	SourceID     string         `db:"source_id" json:"sourceId"`
+	SourceArtist string         `db:"source_artist" json:"sourceArtist,omitempty"` // album artist, for albums
+	Profile      string         `db:"profile" json:"profile"`
+	OutputPath   string         `db:"output_path" json:"outputPath"`
+	Status       string         `db:"status" json:"status"` // queued/running/success/failed/cancelled
+	Progress     float64        `db:"progress" json:"progress"`
+	LogsPath     sql.NullString `db:"logs_path" json:"logsPath,omitempty"`
+	ErrorMsg     sql.NullString `db:"error_msg" json:"errorMsg,omitempty"`
+	QueuedAt     time.Time      `db:"queued_at" json:"queuedAt"`
+	StartedAt    sql.NullTime   `db:"started_at" json:"startedAt,omitempty"`
+	FinishedAt   sql.NullTime   `db:"finished_at" json:"finishedAt,omitempty"`
+	LeaseUntil   sql.NullTime   `db:"lease_expires_at" json:"-"`
+}
+
+// Provenance links a conversion output back to its source, profile and encoder
+type Provenance struct {
+	ID                string         `db:"id" json:"id"`
+	ConversionJobID   string         `db:"conversion_job_id" json:"conversionJobId"`
+	OutputPath        string         `db:"output_path" json:"outputPath"`
+	OutputMediaFileID sql.NullString `db:"output_media_file_id" json:"outputMediaFileId,omitempty"`
+	OutputSHA256      string         `db:"output_sha256" json:"outputSha256"`
+	SourceMediaFileID string         `db:"source_media_file_id" json:"sourceMediaFileId"`
+	SourcePath        string         `db:"source_path" json:"sourcePath"`
+	ProfileID         string         `db:"profile_id" json:"profileId"`
+	ProfileJSON       string         `db:"profile_json" json:"-"` // profile snapshot at conversion time
+	FFmpegVersion     string         `db:"ffmpeg_version" json:"ffmpegVersion"`
+	VerifyStatus      string         `db:"verify_status" json:"verifyStatus"` // pending/pass/fail
+	VerifyJSON        sql.NullString `db:"verify_json" json:"-"`
+	CreatedAt         time.Time      `db:"created_at" json:"createdAt"`
+
+	Profile map[string]interface{} `db:"-" json:"profile,omitempty"`
+	Verify  map[string]interface{} `db:"-" json:"verify,omitempty"`
+}
+
+// DuplicateSet groups tracks across libraries that hold the same audio
+type DuplicateSet struct {
+	ID          string    `db:"id" json:"id"`
+	MatchType   string    `db:"match_type" json:"matchType"` // file/audio
+	MatchKey    string    `db:"match_key" json:"matchKey"`
+	MemberCount int       `db:"member_count" json:"memberCount"`
+	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
+
+	Members []DuplicateMember `db:"-" json:"members,omitempty"`
+}
+
+// DuplicateMember is a track in a duplicate set, ranked by quality (1 = best)
+type DuplicateMember struct {
+	SetID        string  `db:"set_id" json:"setId"`
+	TrackID      string  `db:"track_id" json:"trackId"`
+	Rank         int     `db:"rank" json:"rank"`
+	QualityScore float64 `db:"quality_score" json:"qualityScore"`
+
+	// Joined track fields
+	Path           string         `db:"path" json:"path"`
+	Size           int64          `db:"size" json:"size"`
+	LibraryID      string         `db:"library_id" json:"libraryId"`
+	LibraryName    string         `db:"library_name" json:"libraryName"`
+	Title          sql.NullString `db:"title" json:"title,omitempty"`
+	Artist         sql.NullString `db:"artist" json:"artist,omitempty"`
+	Album          sql.NullString `db:"album" json:"album,omitempty"`
+	Codec          string         `db:"codec" json:"codec"`
+	SampleRate     int            `db:"sample_rate" json:"sampleRate"`
+	BitDepth       int            `db:"bit_depth" json:"bitDepth"`
+	Bitrate        int            `db:"bitrate" json:"bitrate"`
+	LosslessStatus string         `db:"lossless_status" json:"losslessStatus"`
+	DRScore        int            `db:"dr_score" json:"drScore"`
+}
+
+// Fingerprint is a track's acoustic fingerprint: one 32-bit sub-fingerprint
+// per chroma frame of the start of the decoded audio
+type Fingerprint struct {
+	TrackID   string    `db:"track_id" json:"trackId"`
+	Version   int       `db:"version" json:"version"`
+	Duration  float64   `db:"duration" json:"duration"` // seconds of audio fingerprinted
+	Data      []byte    `db:"data" json:"-"`            // little-endian uint32 sub-fingerprints
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// AcousticMatch is a track whose fingerprint is close to another track's
+type AcousticMatch struct {
+	TrackID     string         `db:"track_id" json:"trackId"`
+	Path        string         `db:"path" json:"path"`
+	LibraryName string         `db:"library_name" json:"libraryName"`
+	Title       sql.NullString `db:"title" json:"title,omitempty"`
+	Artist      sql.NullString `db:"artist" json:"artist,omitempty"`
+	Album       sql.NullString `db:"album" json:"album,omitempty"`
+	Codec       string         `db:"codec" json:"codec"`
+	SampleRate  int            `db:"sample_rate" json:"sampleRate"`
+	BitDepth    int            `db:"bit_depth" json:"bitDepth"`
+	Bitrate     int            `db:"bitrate" json:"bitrate"`
+
+	Similarity float64 `db:"-" json:"similarity,omitempty"` // 1 - bit error rate over the aligned overlap
+	OffsetSec  float64 `db:"-" json:"offsetSec,omitempty"`  // where the audio starts relative to the other track
 }
 
 // Job represents a generic background job
@@ -206,10 +404,33 @@ type Job struct {
 	StartedAt   sql.NullTime   `db:"started_at" json:"startedAt,omitempty"`
 	FinishedAt  sql.NullTime   `db:"finished_at" json:"finishedAt,omitempty"`
 	CreatedAt   time.Time      `db:"created_at" json:"createdAt"`
+	LeaseUntil  sql.NullTime   `db:"lease_expires_at" json:"-"`
 
 	Payload     map[string]interface{} `db:"-" json:"payload,omitempty"`
 }
 
+// JobLog is the verbose log of one job. A retried job keeps appending to
+// the same log.
+type JobLog struct {
+	JobID      string     `db:"job_id" json:"jobId"`
+	TrackID    string     `db:"track_id" json:"trackId,omitempty"`
+	Status     string     `db:"status" json:"status"` // running/completed/failed
+	StartedAt  time.Time  `db:"started_at" json:"startedAt"`
+	EndedAt    *time.Time `db:"ended_at" json:"endedAt,omitempty"`
+	EntryCount int        `db:"entry_count" json:"entryCount"`
+}
+
+// JobLogEntry is one line of a job log; Index is its 0-based position
+type JobLogEntry struct {
+	JobID     string    `db:"job_id" json:"-"`
+	Index     int       `db:"seq" json:"index"`
+	Timestamp time.Time `db:"timestamp" json:"timestamp"`
+	Level     string    `db:"level" json:"level"` // info/debug/warn/error
+	Module    string    `db:"module" json:"module,omitempty"`
+	Message   string    `db:"message" json:"message"`
+	Details   string    `db:"details" json:"details,omitempty"`
+}
+
 // Settings represents user/app settings
 type Setting struct {
 	Key       string    `db:"key" json:"key"`
@@ -228,10 +449,29 @@ type ConversionProfile struct {
 	SampleRate  int       `db:"sample_rate" json:"sampleRate"`
 	BitDepth    int       `db:"bit_depth" json:"bitDepth"`
 	Bitrate     int       `db:"bitrate" json:"bitrate,omitempty"`
-	Options     string    `db:"options" json:"-"`
+	OptionsJSON string    `db:"options" json:"-"`
 	IsBuiltin   bool      `db:"is_builtin" json:"isBuiltin"`
 	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
 	UpdatedAt   time.Time `db:"updated_at" json:"updatedAt"`
+
+	Options ProfileOptions `db:"-" json:"options"`
+}
+
+// ProfileOptions holds encoder settings beyond codec/sample rate/bit depth,
+// stored as JSON in conversion_profiles.options
+type ProfileOptions struct {
+	// Lossy rate control: "cbr" or "vbr" (mp3, opus)
+	BitrateMode string `json:"bitrateMode,omitempty"`
+	// LAME VBR quality 0-9 when BitrateMode is "vbr" (0 = V0)
+	VBRQuality *int `json:"vbrQuality,omitempty"`
+	// FLAC compression level 0-12
+	CompressionLevel *int `json:"compressionLevel,omitempty"`
+	// Resampler engine: "swr" (FFmpeg default) or "soxr"
+	Resampler string `json:"resampler,omitempty"`
+	// soxr precision in bits (15-33, 20 = high quality, 28 = very high)
+	SoxrPrecision int `json:"soxrPrecision,omitempty"`
+	// Dither used when reducing bit depth (FFmpeg aresample dither_method)
+	Dither string `json:"dither,omitempty"`
 }
 
 // Helper methods
@@ -250,6 +490,26 @@ func (r *AnalysisResult) ParseStats() error {
 	return nil
 }
 
+func (p *ConversionProfile) ParseOptions() error {
+	p.Options = ProfileOptions{}
+	if p.OptionsJSON != "" {
+		return json.Unmarshal([]byte(p.OptionsJSON), &p.Options)
+	}
+	return nil
+}
+
+func (p *Provenance) ParseJSON() error {
+	if p.ProfileJSON != "" {
+		if err := json.Unmarshal([]byte(p.ProfileJSON), &p.Profile); err != nil {
+			return err
+		}
+	}
+	if p.VerifyJSON.Valid && p.VerifyJSON.String != "" {
+		return json.Unmarshal([]byte(p.VerifyJSON.String), &p.Verify)
+	}
+	return nil
+}
+
 // Status constants
 const (
 	StatusPending   = "pending"
@@ -264,6 +524,13 @@ const (
 	SeverityWarning = "warning"
 	SeverityError   = "error"
 
+	MatchFile  = "file"  // byte-identical files
+	MatchAudio = "audio" // same decoded audio, different tags or container
+
+	VerifyPending   = "pending"
+	VerifyPass      = "pass"
+	VerifyFail      = "fail"
+
 	LosslessPass    = "pass"
 	LosslessWarn    = "warn"
 	LosslessFail    = "fail"
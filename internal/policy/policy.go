@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// ErrReadOnly is returned when a write targets a read-only library
+var ErrReadOnly = errors.New("library is read-only")
+
+// Mode is how a permitted write is carried out
+type Mode string
+
+const (
+	ModeInPlace Mode = "in_place" // modify the file itself
+	ModeCopy    Mode = "copy"     // write a tagged copy under the library's output path
+	ModeDenied  Mode = "denied"
+)
+
+// Decision is the outcome of checking one write against the library settings
+type Decision struct {
+	Mode      Mode   `json:"mode"`
+	LibraryID string `json:"libraryId,omitempty"`
+	Source    string `json:"source"`
+	Target    string `json:"target,omitempty"` // file to write; the source unless copying
+	Reason    string `json:"reason,omitempty"` // why the write is refused
+}
+
+// Allowed reports whether the write may go ahead
+func (d *Decision) Allowed() bool {
+	return d.Mode != ModeDenied
+}
+
+// Err returns the refusal as an error wrapping ErrReadOnly, or nil
+func (d *Decision) Err() error {
+	if d.Allowed() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrReadOnly, d.Reason)
+}
+
+// Policy is the single place every mutating subsystem asks before touching
+// files that belong to a library
+type Policy struct {
+	db *database.DB
+}
+
+// New creates a write policy backed by the library settings in db
+func New(db *database.DB) *Policy {
+	return &Policy{db: db}
+}
+
+// TrackFile decides how a change to a track's file (tags, artwork) is
+// written. Tracks split from an album image by a cue sheet share the file,
+// so changes to one of them are refused.
+func (p *Policy) TrackFile(ctx context.Context, track *models.Track) (*Decision, error) {
+	lib, err := p.db.GetLibrary(ctx, track.LibraryID)
+	if err != nil {
+		return nil, fmt.Errorf("get library: %w", err)
+	}
+	if track.FromCue() {
+		return &Decision{
+			Mode:      ModeDenied,
+			LibraryID: lib.ID,
+			Source:    track.Path,
+			Reason:    fmt.Sprintf("%s is split into tracks by a cue sheet; edit the sheet instead", filepath.Base(track.Path)),
+		}, nil
+	}
+	return Decide(lib, track.Path), nil
+}
+
+// Decide applies a library's settings to a write of path. Read-only
+// libraries refuse the write, or redirect it to a copy mirrored under the
+// output path when copy-on-write is enabled.
+func Decide(lib *models.Library, path string) *Decision {
+	d := &Decision{
+		Mode:      ModeInPlace,
+		LibraryID: lib.ID,
+		Source:    path,
+		Target:    path,
+	}
+	if !lib.ReadOnly {
+		return d
+	}
+
+	d.Mode = ModeDenied
+	d.Target = ""
+	if !lib.CopyOnWrite {
+		d.Reason = fmt.Sprintf("Library %q is read-only", lib.Name)
+		return d
+	}
+	if !lib.OutputPath.Valid || lib.OutputPath.String == "" {
+		d.Reason = fmt.Sprintf("Library %q is read-only and has no output path for tagged copies", lib.Name)
+		return d
+	}
+
+	rel, err := filepath.Rel(lib.RootPath, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		rel = filepath.Base(path)
+	}
+	d.Mode = ModeCopy
+	d.Target = filepath.Join(lib.OutputPath.String, rel)
+	return d
+}
+
+// Output checks that a new file, such as a conversion output, may be
+// written at path. Paths inside a read-only library are refused unless they
+// are under some library's output path.
+func (p *Policy) Output(ctx context.Context, path string) (*Decision, error) {
+	d := &Decision{
+		Mode:   ModeInPlace,
+		Source: path,
+		Target: path,
+	}
+
+	lib, err := p.db.FindLibraryForPath(ctx, path)
+	if err == sql.ErrNoRows {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.LibraryID = lib.ID
+	if !lib.ReadOnly {
+		return d, nil
+	}
+
+	libs, err := p.db.ListLibraries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range libs {
+		if l.OutputPath.Valid && l.OutputPath.String != "" && contains(l.OutputPath.String, path) {
+			return d, nil
+		}
+	}
+
+	d.Mode = ModeDenied
+	d.Target = ""
+	d.Reason = fmt.Sprintf("%s is inside read-only library %q", path, lib.Name)
+	return d, nil
+}
+
+func contains(root, path string) bool {
+	root = strings.TrimSuffix(root, "/")
+	return path == root || strings.HasPrefix(path, root+"/")
+}
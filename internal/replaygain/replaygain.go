@@ -0,0 +1,360 @@
+package replaygain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/iobudget"
+	"github.com/ottavia-music/ottavia/internal/metadata"
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// DefaultReference is the ReplayGain 2.0 reference level, equivalent to the
+// 89 dB SPL of the original ReplayGain proposal
+const DefaultReference = -18.0
+
+// Opus R128 gains (RFC 7845) are always relative to the EBU R128 target and
+// stored as Q7.8 fixed point dB
+const (
+	r128Reference = -23.0
+	r128Scale     = 256
+)
+
+// JobLogger interface for verbose logging
+type JobLogger interface {
+	Info(jobID, module, message string)
+	Debug(jobID, module, message, details string)
+	Warn(jobID, module, message, details string)
+	Error(jobID, module, message, details string)
+}
+
+// Loudness is an EBU R128 measurement of one track or a whole album
+type Loudness struct {
+	Integrated float64 `json:"integratedLufs"`
+	TruePeak   float64 `json:"truePeakDbtp"`
+}
+
+// TrackGain is the measured loudness and resulting gain of one track
+type TrackGain struct {
+	TrackID  string   `json:"trackId"`
+	Path     string   `json:"path"`
+	Loudness Loudness `json:"loudness"`
+	Gain     float64  `json:"gain"` // dB
+	Peak     float64  `json:"peak"` // linear
+}
+
+// AlbumGain is the result of a gain computation for one album
+type AlbumGain struct {
+	Album     string      `json:"album"`
+	Artist    string      `json:"artist"`
+	Reference float64     `json:"referenceLufs"`
+	Loudness  Loudness    `json:"loudness"`
+	Gain      float64     `json:"gain"`
+	Peak      float64     `json:"peak"`
+	Tracks    []TrackGain `json:"tracks"`
+}
+
+// Options are the parameters of a ReplayGain job, stored as its payload
+type Options struct {
+	Album     string   `json:"album"`
+	Artist    string   `json:"artist"`
+	Reference *float64 `json:"referenceLufs,omitempty"`
+	DryRun    bool     `json:"dryRun"`
+	Actor     string   `json:"actor,omitempty"`
+}
+
+// Service computes track and album gain and writes it through the metadata
+// writer
+type Service struct {
+	db         *database.DB
+	writer     *metadata.Writer
+	ffmpegPath string
+	reference  float64
+}
+
+// New creates a ReplayGain service; reference is the default target
+// loudness in LUFS
+func New(db *database.DB, writer *metadata.Writer, ffmpegPath string, reference float64) *Service {
+	return &Service{
+		db:         db,
+		writer:     writer,
+		ffmpegPath: ffmpegPath,
+		reference:  reference,
+	}
+}
+
+// Reference returns the default reference level in LUFS
+func (s *Service) Reference() float64 {
+	return s.reference
+}
+
+// Run executes a queued ReplayGain job. A dry run logs the tag diffs
+// without writing; otherwise the tags are written and action-logged.
+func (s *Service) Run(ctx context.Context, job *models.Job, logger JobLogger) error {
+	logf := func(level, message, details string) {
+		log.Debug().Str("job_id", job.ID).Str("level", level).Msg(message)
+		if logger == nil {
+			return
+		}
+		switch level {
+		case "warn":
+			logger.Warn(job.ID, "replaygain", message, details)
+		case "debug":
+			logger.Debug(job.ID, "replaygain", message, details)
+		default:
+			logger.Info(job.ID, "replaygain", message)
+		}
+	}
+
+	var opts Options
+	if err := json.Unmarshal([]byte(job.PayloadJSON.String), &opts); err != nil {
+		return fmt.Errorf("invalid job payload: %w", err)
+	}
+	reference := s.reference
+	if opts.Reference != nil {
+		reference = *opts.Reference
+	}
+
+	logf("info", fmt.Sprintf("Measuring %q by %q at %.1f LUFS reference", opts.Album, opts.Artist, reference), "")
+	result, err := s.Compute(ctx, opts.Album, opts.Artist, reference)
+	if err != nil {
+		return err
+	}
+	for _, t := range result.Tracks {
+		logf("debug", fmt.Sprintf("%s: %.2f LUFS, gain %+.2f dB, peak %.6f",
+			filepath.Base(t.Path), t.Loudness.Integrated, t.Gain, t.Peak), "")
+	}
+	logf("info", fmt.Sprintf("Album: %.2f LUFS, gain %+.2f dB, peak %.6f",
+		result.Loudness.Integrated, result.Gain, result.Peak), "")
+
+	op := s.Operation(result)
+
+	if opts.DryRun {
+		preview, err := s.writer.PreviewBulkOperation(ctx, op)
+		if err != nil {
+			return err
+		}
+		for _, p := range preview.Previews {
+			diffs, _ := json.Marshal(p.Diffs)
+			if !p.CanWrite {
+				logf("warn", fmt.Sprintf("%s: cannot write", filepath.Base(p.Path)), p.Error)
+				continue
+			}
+			logf("info", fmt.Sprintf("%s: %d change(s)", filepath.Base(p.Path), len(p.Diffs)), string(diffs))
+		}
+		logf("info", "Dry run: no files were modified", "")
+		return nil
+	}
+
+	actor := opts.Actor
+	if actor == "" {
+		actor = "system"
+	}
+	bulk, err := s.Apply(ctx, result, job.ID, actor)
+	if err != nil {
+		return err
+	}
+	for _, r := range bulk.Results {
+		if !r.Success {
+			logf("warn", fmt.Sprintf("%s: write failed", filepath.Base(r.Path)), r.Error)
+		}
+	}
+	logf("info", fmt.Sprintf("Tagged %d of %d track(s)", bulk.SuccessCount, bulk.TotalTracks), "")
+	if bulk.SuccessCount == 0 && bulk.FailedCount > 0 {
+		return fmt.Errorf("no tracks could be tagged")
+	}
+	return nil
+}
+
+// Compute measures every track of an album and the album as a whole
+func (s *Service) Compute(ctx context.Context, albumName, artist string, reference float64) (*AlbumGain, error) {
+	detail, err := s.db.GetAlbumDetail(ctx, albumName, artist)
+	if err != nil {
+		return nil, err
+	}
+	if len(detail.Tracks) == 0 {
+		return nil, fmt.Errorf("album has no tracks")
+	}
+
+	result := &AlbumGain{
+		Album:     detail.Name,
+		Artist:    detail.Artist,
+		Reference: reference,
+	}
+
+	for _, t := range detail.Tracks {
+		if t.CueIndex > 0 {
+			return nil, fmt.Errorf("%s is split into tracks by a cue sheet, which share its gain tags", filepath.Base(t.Path))
+		}
+	}
+
+	paths := make([]string, len(detail.Tracks))
+	for i, t := range detail.Tracks {
+		paths[i] = t.Path
+		loudness, err := Measure(ctx, s.ffmpegPath, []string{t.Path})
+		if err != nil {
+			return nil, fmt.Errorf("measure %s: %w", filepath.Base(t.Path), err)
+		}
+		result.Tracks = append(result.Tracks, TrackGain{
+			TrackID:  t.ID,
+			Path:     t.Path,
+			Loudness: *loudness,
+			Gain:     reference - loudness.Integrated,
+			Peak:     dbToLinear(loudness.TruePeak),
+		})
+	}
+
+	// Album loudness is gated over the concatenated tracks, so it is not an
+	// average of the track values
+	album := &result.Tracks[0].Loudness
+	if len(paths) > 1 {
+		if album, err = Measure(ctx, s.ffmpegPath, paths); err != nil {
+			return nil, fmt.Errorf("measure album: %w", err)
+		}
+	}
+	result.Loudness = *album
+	result.Gain = reference - album.Integrated
+	result.Peak = dbToLinear(album.TruePeak)
+	return result, nil
+}
+
+// Operation builds the per-track tag changes for a computed result. Opus
+// files get R128 gains instead of ReplayGain tags.
+func (s *Service) Operation(result *AlbumGain) *metadata.BulkOperation {
+	op := &metadata.BulkOperation{
+		Operation: "set_tags",
+		Changes:   make(map[string]*metadata.TagChanges),
+	}
+	for i := range result.Tracks {
+		t := &result.Tracks[i]
+		changes := &metadata.TagChanges{}
+		if strings.EqualFold(filepath.Ext(t.Path), ".opus") {
+			changes.Custom = map[string][]string{
+				"R128_TRACK_GAIN": {r128Gain(t.Loudness.Integrated)},
+				"R128_ALBUM_GAIN": {r128Gain(result.Loudness.Integrated)},
+			}
+		} else {
+			changes.ReplayGainTrackGain = &t.Gain
+			changes.ReplayGainTrackPeak = &t.Peak
+			changes.ReplayGainAlbumGain = &result.Gain
+			changes.ReplayGainAlbumPeak = &result.Peak
+		}
+		op.TrackIDs = append(op.TrackIDs, t.TrackID)
+		op.Changes[t.TrackID] = changes
+	}
+	return op
+}
+
+// Apply writes a computed result. Each track's edit is action-logged by the
+// writer; the computation itself is logged against the album.
+func (s *Service) Apply(ctx context.Context, result *AlbumGain, jobID, actor string) (*metadata.BulkResult, error) {
+	bulk, err := s.writer.ApplyBulkOperation(ctx, s.Operation(result), actor)
+	if err != nil {
+		return nil, err
+	}
+
+	beforeJSON, _ := json.Marshal(map[string]interface{}{
+		"album":  result.Album,
+		"artist": result.Artist,
+	})
+	afterJSON, _ := json.Marshal(map[string]interface{}{
+		"jobId":         jobID,
+		"referenceLufs": result.Reference,
+		"loudness":      result.Loudness,
+		"gain":          result.Gain,
+		"peak":          result.Peak,
+		"successCount":  bulk.SuccessCount,
+		"failedCount":   bulk.FailedCount,
+		"actionLogIds":  bulk.ActionLogIDs,
+	})
+	actionLog := &models.ActionLog{
+		Type:       "replaygain",
+		TargetType: "album",
+		TargetID:   result.Album,
+		Actor:      actor,
+		BeforeJSON: string(beforeJSON),
+		AfterJSON:  string(afterJSON),
+	}
+	if err := s.db.CreateActionLog(ctx, actionLog); err != nil {
+		log.Error().Err(err).Str("album", result.Album).Msg("Failed to create action log")
+	}
+
+	return bulk, nil
+}
+
+// Measure runs ffmpeg's EBU R128 meter over the given files played back to
+// back and returns the integrated loudness and true peak
+func Measure(ctx context.Context, ffmpegPath string, paths []string) (*Loudness, error) {
+	args := []string{"-nostdin", "-hide_banner"}
+	var graph strings.Builder
+	for i, p := range paths {
+		if err := iobudget.Global().WaitFile(ctx, p); err != nil {
+			return nil, err
+		}
+		args = append(args, "-i", p)
+		fmt.Fprintf(&graph, "[%d:a:0]", i)
+	}
+	fmt.Fprintf(&graph, "concat=n=%d:v=0:a=1,ebur128=peak=true[out]", len(paths))
+	args = append(args, "-filter_complex", graph.String(), "-map", "[out]", "-f", "null", "-")
+
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %v", err)
+	}
+	return parseSummary(string(output))
+}
+
+// parseSummary reads the final summary block printed by the ebur128 filter
+func parseSummary(output string) (*Loudness, error) {
+	idx := strings.LastIndex(output, "Summary:")
+	if idx < 0 {
+		return nil, fmt.Errorf("no loudness summary in ffmpeg output")
+	}
+
+	var loudness Loudness
+	haveIntegrated, havePeak := false, false
+	for _, line := range strings.Split(output[idx:], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "I:":
+			loudness.Integrated, haveIntegrated = v, true
+		case "Peak:":
+			loudness.TruePeak, havePeak = v, true
+		}
+	}
+	if !haveIntegrated || !havePeak {
+		return nil, fmt.Errorf("incomplete loudness summary in ffmpeg output")
+	}
+	return &loudness, nil
+}
+
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// r128Gain formats the Q7.8 gain that brings loudness to the R128 target
+func r128Gain(integrated float64) string {
+	q := math.Round((r128Reference - integrated) * r128Scale)
+	q = math.Max(math.MinInt16, math.Min(math.MaxInt16, q))
+	return strconv.Itoa(int(q))
+}
@@ -0,0 +1,73 @@
+package replaygain
+
+import (
+	"math"
+	"testing"
+)
+
+const ebur128Output = `Input #0, flac, from 'a.flac':
+[Parsed_ebur128_0 @ 0x5581] t: 0.5        TARGET:-23 LUFS    M: -18.2 S:-120.7     I: -18.2 LUFS       LRA:   0.0 LU  FTPK: -2.1 dBFS  TPK: -2.1 dBFS
+[Parsed_ebur128_0 @ 0x5581] Summary:
+
+  Integrated loudness:
+    I:         -14.2 LUFS
+    Threshold: -24.5 LUFS
+
+  Loudness range:
+    LRA:         6.1 LU
+    Threshold: -34.3 LUFS
+    LRA low:   -19.6 LUFS
+    LRA high:  -13.5 LUFS
+
+  True peak:
+    Peak:        0.5 dBFS
+`
+
+func TestParseSummary(t *testing.T) {
+	l, err := parseSummary(ebur128Output)
+	if err != nil {
+		t.Fatalf("parseSummary: %v", err)
+	}
+	if l.Integrated != -14.2 || l.TruePeak != 0.5 {
+		t.Errorf("got %+v", l)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		output string
+	}{
+		{"no summary", "Input #0, flac, from 'a.flac':\n"},
+		{"no true peak", "Summary:\n  Integrated loudness:\n    I:         -14.2 LUFS\n"},
+		{"no integrated loudness", "Summary:\n  True peak:\n    Peak:        0.5 dBFS\n"},
+	} {
+		if _, err := parseSummary(tc.output); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+
+	// Digital silence has no measurable loudness
+	l, err = parseSummary("Summary:\n    I:         -70.0 LUFS\n    Peak:       -inf dBFS\n")
+	if err != nil || l.Integrated != -70 || !math.IsInf(l.TruePeak, -1) {
+		t.Errorf("silence: %+v, %v", l, err)
+	}
+}
+
+func TestR128Gain(t *testing.T) {
+	for _, tc := range []struct {
+		integrated float64
+		want       string
+	}{
+		{-23, "0"},
+		{-14, "-2304"},
+		{-30, "1792"},
+		{-23.001, "0"},
+		{-22.998, "-1"},
+		// Gains beyond Q7.8 are clamped to what the tag can hold
+		{200, "-32768"},
+		{-200, "32767"},
+	} {
+		if got := r128Gain(tc.integrated); got != tc.want {
+			t.Errorf("r128Gain(%v) = %s, want %s", tc.integrated, got, tc.want)
+		}
+	}
+}
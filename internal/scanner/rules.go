@@ -0,0 +1,395 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+// Reasons a path is left out of a scan, as reported by dry runs
+const (
+	skipHidden    = "hidden directory"
+	skipExcluded  = "excluded by %q"
+	skipIncluded  = "not matched by any include pattern"
+	skipFormat    = "format not allowed"
+	skipDepth     = "deeper than max depth"
+	skipSymlink   = "symlink"
+	skipOutOfRoot = "outside the library"
+)
+
+// pattern is a compiled include or exclude glob
+type pattern struct {
+	source   string
+	segments []string
+	anchored bool // matched from the root rather than at any depth
+}
+
+func compilePattern(source string) pattern {
+	return pattern{
+		source:   source,
+		segments: strings.Split(strings.Trim(source, "/"), "/"),
+		anchored: strings.HasPrefix(source, "/"),
+	}
+}
+
+// match reports whether the pattern matches the path, given as its
+// components relative to the root, or one of the directories it is in
+func (p pattern) match(rel []string) bool {
+	for end := 1; end <= len(rel); end++ {
+		if p.anchored {
+			if matchSegments(p.segments, rel[:end]) {
+				return true
+			}
+			continue
+		}
+		for start := 0; start < end; start++ {
+			if matchSegments(p.segments, rel[start:end]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchSegments matches path components against pattern components, where
+// "**" matches any number of components
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// ValidateRules checks a library's scan rules, so bad patterns are rejected
+// when saved rather than silently matching nothing
+func ValidateRules(rules models.ScanRules) error {
+	for _, list := range [][]string{rules.Include, rules.Exclude} {
+		for _, p := range list {
+			if strings.Trim(p, "/") == "" {
+				return fmt.Errorf("empty pattern %q", p)
+			}
+			for _, seg := range compilePattern(p).segments {
+				if _, err := path.Match(seg, ""); err != nil {
+					return fmt.Errorf("invalid pattern %q: %w", p, err)
+				}
+			}
+		}
+	}
+	if rules.MaxDepth < 0 {
+		return fmt.Errorf("max depth must not be negative")
+	}
+	return nil
+}
+
+// NormalizeFormats lowercases extensions and adds their leading dot,
+// rejecting those the scanner doesn't support
+func NormalizeFormats(formats []string) ([]string, error) {
+	var normalized []string
+	for _, f := range formats {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if !strings.HasPrefix(f, ".") {
+			f = "." + f
+		}
+		if !supportedExtensions[f] {
+			return nil, fmt.Errorf("unsupported format %q", f)
+		}
+		normalized = append(normalized, f)
+	}
+	return normalized, nil
+}
+
+// pathRules decides which paths under a library's root are scanned
+type pathRules struct {
+	root           string
+	include        []pattern
+	exclude        []pattern
+	formats        map[string]bool
+	maxDepth       int
+	followSymlinks bool
+}
+
+func newPathRules(lib *models.Library) *pathRules {
+	r := &pathRules{
+		root:           filepath.Clean(lib.RootPath),
+		formats:        supportedExtensions,
+		maxDepth:       lib.ScanRules.MaxDepth,
+		followSymlinks: lib.ScanRules.FollowSymlinks,
+	}
+	for _, p := range lib.ScanRules.Include {
+		r.include = append(r.include, compilePattern(p))
+	}
+	for _, p := range lib.ScanRules.Exclude {
+		r.exclude = append(r.exclude, compilePattern(p))
+	}
+	if formats := lib.Formats(); formats != nil {
+		r.formats = make(map[string]bool)
+		for _, f := range formats {
+			if supportedExtensions[f] {
+				r.formats[f] = true
+			}
+		}
+	}
+	return r
+}
+
+// rel splits a path into its components relative to the root. ok is false
+// for paths outside the root.
+func (r *pathRules) rel(p string) (rel []string, ok bool) {
+	relPath, err := filepath.Rel(r.root, p)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	if relPath == "." {
+		return nil, true
+	}
+	return strings.Split(filepath.ToSlash(relPath), "/"), true
+}
+
+// skipReason returns why a directory, or an audio file, is left out of
+// scans, or "" if it is scanned. Directories are checked along with the
+// directories they are in.
+func (r *pathRules) skipReason(p string, isDir bool) string {
+	rel, ok := r.rel(p)
+	if !ok {
+		return skipOutOfRoot
+	}
+	if len(rel) == 0 {
+		return ""
+	}
+
+	dirs := rel
+	if !isDir {
+		dirs = rel[:len(rel)-1]
+	}
+	for _, name := range dirs {
+		if strings.HasPrefix(name, ".") {
+			return skipHidden
+		}
+	}
+	if r.maxDepth > 0 && len(dirs) > r.maxDepth {
+		return skipDepth
+	}
+	for _, p := range r.exclude {
+		if p.match(rel) {
+			return fmt.Sprintf(skipExcluded, p.source)
+		}
+	}
+	if isDir {
+		return ""
+	}
+
+	if !r.formats[strings.ToLower(filepath.Ext(p))] {
+		return skipFormat
+	}
+	if len(r.include) > 0 {
+		included := false
+		for _, p := range r.include {
+			if p.match(rel) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return skipIncluded
+		}
+	}
+	return ""
+}
+
+// walkFunc is called for each file a walk scans, or with the error reading
+// a directory or file. A returned error stops the walk.
+type walkFunc func(path string, info fs.FileInfo, err error) error
+
+// skipFunc is told of each directory or audio file a walk leaves out
+type skipFunc func(path, reason string)
+
+// walk visits the audio files under dir that the rules allow, descending
+// into subdirectories when recursive. Files other than audio are ignored
+// without being reported. Symlinks are only followed when the rules allow,
+// and never into a directory already walked.
+func (r *pathRules) walk(ctx context.Context, dir string, recursive bool, visit walkFunc, skipped skipFunc) error {
+	if skipped == nil {
+		skipped = func(string, string) {}
+	}
+	walked := make(map[string]bool) // real paths of the directories walked
+	return r.walkDir(ctx, dir, recursive, walked, visit, skipped)
+}
+
+func (r *pathRules) walkDir(ctx context.Context, dir string, recursive bool, walked map[string]bool, visit walkFunc, skipped skipFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		if walked[real] {
+			return nil
+		}
+		walked[real] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return visit(dir, nil, err)
+	}
+
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		isDir := entry.IsDir()
+		audio := supportedExtensions[strings.ToLower(filepath.Ext(p))]
+
+		var info fs.FileInfo
+		if entry.Type()&fs.ModeSymlink != 0 {
+			info, err = os.Stat(p)
+			if err != nil {
+				if r.followSymlinks && audio {
+					if err := visit(p, nil, err); err != nil {
+						return err
+					}
+				}
+				continue // broken link
+			}
+			isDir = info.IsDir()
+			if !r.followSymlinks {
+				if isDir || audio {
+					skipped(p, skipSymlink)
+				}
+				continue
+			}
+		}
+
+		if isDir {
+			if !recursive {
+				continue
+			}
+			if reason := r.skipReason(p, true); reason != "" {
+				skipped(p, reason)
+				continue
+			}
+			if err := r.walkDir(ctx, p, recursive, walked, visit, skipped); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !audio {
+			continue
+		}
+		if reason := r.skipReason(p, false); reason != "" {
+			skipped(p, reason)
+			continue
+		}
+		if info == nil {
+			if info, err = entry.Info(); err != nil {
+				if err := visit(p, nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := visit(p, info, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkDirs visits the files of each directory of an incremental scan,
+// descending into subdirectories only for recursive ones. Directories that
+// no longer exist, or that the rules leave out, are skipped.
+func (r *pathRules) walkDirs(ctx context.Context, dirs []Dir, visit walkFunc) error {
+	for _, dir := range dirs {
+		p := filepath.Clean(dir.Path)
+		if r.skipReason(p, true) != "" {
+			continue
+		}
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		if err := r.walk(ctx, p, dir.Recursive, visit, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SkippedPath is a path a scan would leave out, and why
+type SkippedPath struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// DryRunResult lists the paths a scan of a library would include and leave
+// out, relative to the library root
+type DryRunResult struct {
+	Included      []string      `json:"included"`
+	Excluded      []SkippedPath `json:"excluded"`
+	IncludedCount int           `json:"includedCount"`
+	ExcludedCount int           `json:"excludedCount"`
+	Truncated     bool          `json:"truncated"` // more paths than the limit were found
+}
+
+// DryRun walks a library with its rules, as a scan would, without touching
+// the database, so rules can be tried before they are saved. Up to limit
+// paths of each kind are listed; all of them are counted.
+func (s *Scanner) DryRun(ctx context.Context, lib *models.Library, limit int) (*DryRunResult, error) {
+	rules := newPathRules(lib)
+	if _, err := os.Stat(rules.root); err != nil {
+		return nil, err
+	}
+
+	result := &DryRunResult{Included: []string{}, Excluded: []SkippedPath{}}
+	relPath := func(p string) string {
+		if rel, err := filepath.Rel(rules.root, p); err == nil {
+			return filepath.ToSlash(rel)
+		}
+		return p
+	}
+
+	visit := func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		result.IncludedCount++
+		if len(result.Included) < limit {
+			result.Included = append(result.Included, relPath(p))
+		}
+		return nil
+	}
+	skipped := func(p, reason string) {
+		result.ExcludedCount++
+		if len(result.Excluded) < limit {
+			result.Excluded = append(result.Excluded, SkippedPath{Path: relPath(p), Reason: reason})
+		}
+	}
+	if err := rules.walk(ctx, rules.root, true, visit, skipped); err != nil {
+		return nil, err
+	}
+
+	result.Truncated = result.IncludedCount > len(result.Included) || result.ExcludedCount > len(result.Excluded)
+	sort.Strings(result.Included)
+	sort.Slice(result.Excluded, func(i, j int) bool { return result.Excluded[i].Path < result.Excluded[j].Path })
+	return result, nil
+}
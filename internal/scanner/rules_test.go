@@ -0,0 +1,132 @@
+package scanner
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+func TestMatchSegments(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a", false},
+		{"*.flac", "song.flac", true},
+		{"*.flac", "song.mp3", false},
+		{"**", "", true},
+		{"**", "a/b/c", true},
+		{"**/b", "b", true},
+		{"**/b", "a/x/b", true},
+		{"**/b", "a/b/c", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/c", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/b/c", true},
+		{"a/**/c", "a/b/d", false},
+		{"**/Samples/**", "x/Samples/y/z.wav", true},
+		{"[ab]?", "bc", true},
+	} {
+		var name []string
+		if tc.name != "" {
+			name = strings.Split(tc.name, "/")
+		}
+		if got := matchSegments(strings.Split(tc.pattern, "/"), name); got != tc.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		// Without a slash, any component matches
+		{"@eaDir", "@eaDir", true},
+		{"@eaDir", "Artist/@eaDir/cover.jpg", true},
+		{"@eaDir", "Artist/eaDir", false},
+		// With one, the end of a path, or of the directories it is in
+		{"*/Samples", "Artist/Samples/kick.wav", true},
+		{"*/Samples", "Samples/kick.wav", false},
+		{"Live/*.mp3", "Artist/Live/01.mp3", true},
+		// Anchored patterns match from the root
+		{"/Incoming", "Incoming/a.flac", true},
+		{"/Incoming", "Artist/Incoming/a.flac", false},
+		{"/Artist/**/*.wav", "Artist/Album/Disc 1/01.wav", true},
+		{"/Artist/**/*.wav", "Other/Artist/Album/01.wav", false},
+	} {
+		if got := compilePattern(tc.pattern).match(strings.Split(tc.path, "/")); got != tc.want {
+			t.Errorf("%q matching %q = %v, want %v", tc.pattern, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	lib := &models.Library{
+		RootPath: "/music/",
+		ScanRules: models.ScanRules{
+			Include:  []string{"*.flac", "/Singles/**"},
+			Exclude:  []string{"@eaDir", "/Singles/Demos"},
+			MaxDepth: 2,
+		},
+		AllowedFormats: sql.NullString{String: "flac, MP3", Valid: true},
+	}
+	r := newPathRules(lib)
+
+	for _, tc := range []struct {
+		path  string
+		isDir bool
+		want  string
+	}{
+		{"/music", true, ""},
+		{"/music/Artist/Album/01.flac", false, ""},
+		{"/music/Singles/a.mp3", false, ""},
+		{"/music/Artist/a.mp3", false, skipIncluded},
+		{"/music/Artist/a.wav", false, skipFormat},
+		{"/music/.trash", true, skipHidden},
+		{"/music/Artist/.covers/a.flac", false, skipHidden},
+		{"/music/Artist/@eaDir", true, fmt.Sprintf(skipExcluded, "@eaDir")},
+		{"/music/Singles/Demos/a.flac", false, fmt.Sprintf(skipExcluded, "/Singles/Demos")},
+		// Max depth counts the directories a file is in
+		{"/music/Artist/Album", true, ""},
+		{"/music/Artist/Album/Disc 1", true, skipDepth},
+		{"/music/Artist/Album/Disc 1/01.flac", false, skipDepth},
+		{"/musicals/a.flac", false, skipOutOfRoot},
+		{"/other/a.flac", false, skipOutOfRoot},
+	} {
+		if got := r.skipReason(tc.path, tc.isDir); got != tc.want {
+			t.Errorf("skipReason(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+
+	// No max depth scans any depth
+	lib.ScanRules.MaxDepth = 0
+	if got := newPathRules(lib).skipReason("/music/a/b/c/d/e.flac", false); got != "" {
+		t.Errorf("without max depth: %q", got)
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	for _, tc := range []struct {
+		rules models.ScanRules
+		ok    bool
+	}{
+		{models.ScanRules{Include: []string{"*.flac", "/a/**/b"}}, true},
+		{models.ScanRules{Exclude: []string{"/"}}, false},
+		{models.ScanRules{Exclude: []string{"a/[b"}}, false},
+		{models.ScanRules{MaxDepth: -1}, false},
+	} {
+		if err := ValidateRules(tc.rules); (err == nil) != tc.ok {
+			t.Errorf("ValidateRules(%+v) = %v", tc.rules, err)
+		}
+	}
+}
@@ -3,12 +3,16 @@ package scanner
 import (
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,7 +20,10 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 
+	"github.com/ottavia-music/ottavia/internal/cue"
 	"github.com/ottavia-music/ottavia/internal/database"
+	"github.com/ottavia-music/ottavia/internal/events"
+	"github.com/ottavia-music/ottavia/internal/iobudget"
 	"github.com/ottavia-music/ottavia/internal/models"
 )
 
@@ -38,21 +45,36 @@ var supportedExtensions = map[string]bool{
 	".dff":  true,
 }
 
+// progressInterval limits how often scan progress is published
+const progressInterval = time.Second
+
+// ErrScanInProgress is returned when a library is already being scanned
+var ErrScanInProgress = errors.New("scan already in progress")
+
 type Scanner struct {
 	db          *database.DB
+	bus         *events.Bus
 	workerCount int
 	batchSize   int
 
-	running   bool
-	runningMu sync.Mutex
-	cancel    context.CancelFunc
+	scansMu sync.Mutex
+	scans   map[string]*activeScan // scans in progress, by library ID
 }
 
-func New(db *database.DB, workerCount, batchSize int) *Scanner {
+// activeScan is a scan in progress. run is a snapshot of its counters,
+// refreshed whenever progress is published.
+type activeScan struct {
+	run    models.ScanRun
+	cancel context.CancelFunc
+}
+
+func New(db *database.DB, bus *events.Bus, workerCount, batchSize int) *Scanner {
 	return &Scanner{
 		db:          db,
+		bus:         bus,
 		workerCount: workerCount,
 		batchSize:   batchSize,
+		scans:       make(map[string]*activeScan),
 	}
 }
 
@@ -62,20 +84,49 @@ type ScanResult struct {
 	Errors  []error
 }
 
+// Dir is a directory to rescan in an incremental scan
+type Dir struct {
+	Path      string
+	Recursive bool // also rescan its subdirectories
+}
+
+// ScanLibrary walks a library, recording new, changed and deleted files and
+// queueing analysis of new and changed ones. Different libraries can be scanned at the
+// same time; a library already being scanned returns ErrScanInProgress.
 func (s *Scanner) ScanLibrary(ctx context.Context, libraryID string) (*ScanResult, error) {
-	s.runningMu.Lock()
-	if s.running {
-		s.runningMu.Unlock()
-		return nil, fmt.Errorf("scan already in progress")
+	return s.scan(ctx, libraryID, nil)
+}
+
+// ScanDirs rescans only the given directories of a library, such as those
+// the watcher saw change. Files under a directory that no longer exists are
+// marked deleted. The library's last scan time is left alone, so interval
+// scans still run.
+func (s *Scanner) ScanDirs(ctx context.Context, libraryID string, dirs []Dir) (*ScanResult, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no directories to scan")
 	}
-	s.running = true
-	ctx, s.cancel = context.WithCancel(ctx)
-	s.runningMu.Unlock()
+	return s.scan(ctx, libraryID, dirs)
+}
+
+// scan walks the whole library, or only dirs for an incremental scan
+func (s *Scanner) scan(ctx context.Context, libraryID string, dirs []Dir) (*ScanResult, error) {
+	incremental := dirs != nil
+
+	s.scansMu.Lock()
+	if _, ok := s.scans[libraryID]; ok {
+		s.scansMu.Unlock()
+		return nil, ErrScanInProgress
+	}
+	scan := &activeScan{run: models.ScanRun{LibraryID: libraryID, Status: models.StatusPending}}
+	ctx, scan.cancel = context.WithCancel(ctx)
+	s.scans[libraryID] = scan
+	s.scansMu.Unlock()
 
 	defer func() {
-		s.runningMu.Lock()
-		s.running = false
-		s.runningMu.Unlock()
+		s.scansMu.Lock()
+		delete(s.scans, libraryID)
+		s.scansMu.Unlock()
+		scan.cancel()
 	}()
 
 	lib, err := s.db.GetLibrary(ctx, libraryID)
@@ -84,32 +135,103 @@ func (s *Scanner) ScanLibrary(ctx context.Context, libraryID string) (*ScanResul
 	}
 
 	run := &models.ScanRun{
-		LibraryID: libraryID,
+		LibraryID:   libraryID,
+		Incremental: incremental,
+		LeaseUntil:  sql.NullTime{Time: time.Now().Add(database.LeaseDuration), Valid: true},
 	}
 	if err := s.db.CreateScanRun(ctx, run); err != nil {
 		return nil, fmt.Errorf("failed to create scan run: %w", err)
 	}
+	leaseCtx, releaseLease := context.WithCancel(ctx)
+	defer releaseLease()
+	go s.db.HoldLease(leaseCtx, database.LeaseScanRuns, run.ID, nil)
+
+	if !incremental {
+		lib.Status = models.StatusRunning
+		if err := s.db.UpdateLibrary(ctx, lib); err != nil {
+			return nil, fmt.Errorf("failed to update library: %w", err)
+		}
+	}
 
 	result := &ScanResult{Run: run}
+	s.publish(run)
 
 	log.Info().
 		Str("library_id", libraryID).
 		Str("root_path", lib.RootPath).
+		Int("dirs", len(dirs)).
+		Bool("incremental", incremental).
 		Msg("Starting library scan")
 
-	existingFiles := make(map[string]*models.MediaFile)
-	files, err := s.db.ListMediaFiles(ctx, libraryID)
-	if err != nil && err != sql.ErrNoRows {
-		result.Errors = append(result.Errors, err)
+	var files []models.MediaFile
+	if incremental {
+		for _, dir := range dirs {
+			inDir, err := s.db.ListMediaFilesInDir(ctx, libraryID, dir.Path, dir.Recursive)
+			if err != nil {
+				result.Errors = append(result.Errors, err)
+			}
+			files = append(files, inDir...)
+		}
+	} else {
+		files, err = s.db.ListMediaFiles(ctx, libraryID)
+		if err != nil && err != sql.ErrNoRows {
+			result.Errors = append(result.Errors, err)
+		}
 	}
+	existingFiles := make(map[string]*models.MediaFile)
+	existingSizes := make(map[int64]bool)
 	for i := range files {
 		existingFiles[files[i].Path] = &files[i]
+		existingSizes[files[i].Size] = true
 	}
 
 	foundPaths := make(map[string]bool)
 	var scanErrors []error
+	lastProgress := time.Now()
+
+	// New files the size of a known file may be known files that moved;
+	// they are matched against the files that disappeared once the walk is
+	// done
+	var appeared []newFile
+	queueAnalysis := func(mf *models.MediaFile) {
+		job := &models.Job{
+			Type:        "analyze",
+			TargetType:  "media_file",
+			TargetID:    mf.ID,
+			Priority:    0,
+			MaxAttempts: 3,
+			ScheduledAt: time.Now(),
+		}
+		if err := s.db.CreateJob(ctx, job); err != nil {
+			scanErrors = append(scanErrors, fmt.Errorf("job create error: %w", err))
+		} else {
+			result.NewJobs = append(result.NewJobs, job.ID)
+		}
+	}
+	addFile := func(nf newFile) {
+		run.FilesNew++
+		mf := &models.MediaFile{
+			LibraryID: libraryID,
+			Path:      nf.path,
+			Filename:  filepath.Base(nf.path),
+			Extension: nf.ext,
+			Size:      nf.info.Size(),
+			Mtime:     nf.info.ModTime(),
+			QuickHash: nf.quickHash,
+			CuePath:   nf.cuePath,
+			CueMtime:  nf.cueMtime,
+		}
+		if err := s.db.CreateMediaFile(ctx, mf); err != nil {
+			scanErrors = append(scanErrors, fmt.Errorf("create error at %s: %w", nf.path, err))
+		}
+		queueAnalysis(mf)
+	}
+
+	// Cue sheets split the files they sit next to, so a file whose sheet
+	// was added, edited or removed is rescanned like a changed one
+	cueSheets := cue.NewFinder()
 
-	err = filepath.WalkDir(lib.RootPath, func(path string, d os.DirEntry, err error) error {
+	visit := func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			scanErrors = append(scanErrors, fmt.Errorf("walk error at %s: %w", path, err))
 			return nil
@@ -121,88 +243,161 @@ func (s *Scanner) ScanLibrary(ctx context.Context, libraryID string) (*ScanResul
 		default:
 		}
 
-		if d.IsDir() {
-			if strings.HasPrefix(d.Name(), ".") {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
 		ext := strings.ToLower(filepath.Ext(path))
-		if !supportedExtensions[ext] {
-			return nil
+		if foundPaths[path] {
+			return nil // under two of the directories rescanned
 		}
-
 		run.FilesFound++
 		foundPaths[path] = true
+		if time.Since(lastProgress) >= progressInterval {
+			lastProgress = time.Now()
+			if err := s.db.UpdateScanRun(ctx, run); err != nil {
+				log.Warn().Err(err).Str("scan_id", run.ID).Msg("Failed to save scan progress")
+			}
+			s.publish(run)
+		}
 
-		info, err := d.Info()
-		if err != nil {
-			scanErrors = append(scanErrors, fmt.Errorf("stat error at %s: %w", path, err))
-			return nil
+		// Files are matched by quick hash when they move, so one is kept for
+		// every file, including those scanned before it was recorded
+		hash := func() sql.NullString {
+			sum, err := quickHash(ctx, path)
+			if err != nil {
+				log.Warn().Err(err).Str("path", path).Msg("Failed to hash file")
+				return sql.NullString{}
+			}
+			return sql.NullString{String: sum, Valid: true}
 		}
 
+		cuePath, cueMtime := cueSheetOf(cueSheets, path)
+
+		// A file marked deleted that is back, before GC purged it, is
+		// rescanned like a changed one, keeping its history
 		existing, exists := existingFiles[path]
 		if exists {
-			if existing.Size == info.Size() && existing.Mtime.Unix() == info.ModTime().Unix() {
+			sameCue := existing.CuePath == cuePath && existing.CueMtime.Time.Unix() == cueMtime.Time.Unix()
+			if existing.Status != "deleted" && existing.Size == info.Size() && existing.Mtime.Unix() == info.ModTime().Unix() && sameCue {
+				if !existing.QuickHash.Valid {
+					if existing.QuickHash = hash(); existing.QuickHash.Valid {
+						s.db.UpdateMediaFile(ctx, existing)
+					}
+				}
 				return nil
 			}
 			run.FilesChanged++
 			existing.Size = info.Size()
 			existing.Mtime = info.ModTime()
 			existing.Status = models.StatusPending
-			existing.QuickHash = sql.NullString{}
+			existing.QuickHash = hash()
+			existing.FullHash = sql.NullString{}
+			existing.PCMHash = sql.NullString{}
+			existing.CuePath = cuePath
+			existing.CueMtime = cueMtime
 			if err := s.db.UpdateMediaFile(ctx, existing); err != nil {
 				scanErrors = append(scanErrors, fmt.Errorf("update error at %s: %w", path, err))
+			} else {
+				queueAnalysis(existing)
 			}
 		} else {
-			run.FilesNew++
-			mf := &models.MediaFile{
-				LibraryID: libraryID,
-				Path:      path,
-				Filename:  filepath.Base(path),
-				Extension: ext,
-				Size:      info.Size(),
-				Mtime:     info.ModTime(),
-			}
-			if err := s.db.CreateMediaFile(ctx, mf); err != nil {
-				scanErrors = append(scanErrors, fmt.Errorf("create error at %s: %w", path, err))
-			}
-
-			job := &models.Job{
-				Type:        "analyze",
-				TargetType:  "media_file",
-				TargetID:    mf.ID,
-				Priority:    0,
-				MaxAttempts: 3,
-				ScheduledAt: time.Now(),
-			}
-			if err := s.db.CreateJob(ctx, job); err != nil {
-				scanErrors = append(scanErrors, fmt.Errorf("job create error: %w", err))
+			nf := newFile{path: path, ext: ext, info: info, quickHash: hash(), cuePath: cuePath, cueMtime: cueMtime}
+			if existingSizes[info.Size()] {
+				appeared = append(appeared, nf)
 			} else {
-				result.NewJobs = append(result.NewJobs, job.ID)
+				addFile(nf)
 			}
 		}
 
 		return nil
-	})
+	}
 
-	if err != nil {
+	// Files the library's rules leave out are not found, so ones scanned
+	// before the rules changed are marked deleted
+	rules := newPathRules(lib)
+	skipped := 0
+	if incremental {
+		err = rules.walkDirs(ctx, dirs, visit)
+	} else {
+		err = rules.walk(ctx, rules.root, true, visit, func(string, string) { skipped++ })
+	}
+
+	// A cancelled walk saw only part of the library, so files it did not
+	// reach are not marked deleted
+	cancelled := ctx.Err() != nil
+	if err != nil && !cancelled {
 		result.Errors = append(result.Errors, err)
 	}
 	result.Errors = append(result.Errors, scanErrors...)
 
-	for path, mf := range existingFiles {
-		if !foundPaths[path] {
-			run.FilesDeleted++
-			mf.Status = "deleted"
-			s.db.UpdateMediaFile(ctx, mf)
+	// The run and library are still recorded after a cancel
+	ctx = context.WithoutCancel(ctx)
+
+	// Files that disappeared are either moved to one of the files that
+	// appeared, keeping their tracks, analysis and history, or deleted.
+	// Conversion outputs kept outside the root are never walked, so they
+	// are only missing once gone from disk.
+	var missing []*models.MediaFile
+	if !cancelled {
+		for path, mf := range existingFiles {
+			if foundPaths[path] || mf.Status == "deleted" {
+				continue
+			}
+			if _, inRoot := rules.rel(path); !inRoot {
+				if _, err := os.Stat(path); err == nil {
+					continue
+				}
+			}
+			missing = append(missing, mf)
+		}
+	}
+	missingBySize := make(map[int64][]*models.MediaFile)
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Path < missing[j].Path })
+	for _, mf := range missing {
+		missingBySize[mf.Size] = append(missingBySize[mf.Size], mf)
+	}
+
+	sort.Slice(appeared, func(i, j int) bool { return appeared[i].path < appeared[j].path })
+	moved := make(map[string]bool)
+	for _, nf := range appeared {
+		candidates := missingBySize[nf.info.Size()]
+		mf := matchMove(ctx, nf, candidates)
+		if mf == nil {
+			addFile(nf)
+			continue
+		}
+		missingBySize[mf.Size] = removeFile(candidates, mf)
+		moved[mf.ID] = true
+
+		log.Debug().Str("from", mf.Path).Str("to", nf.path).Msg("File moved")
+		mf.Path = nf.path
+		mf.Filename = filepath.Base(nf.path)
+		mf.Extension = nf.ext
+		mf.Mtime = nf.info.ModTime()
+		if nf.quickHash.Valid {
+			mf.QuickHash = nf.quickHash
+		}
+		mf.CuePath = nf.cuePath
+		mf.CueMtime = nf.cueMtime
+		if err := s.db.MoveMediaFile(ctx, mf); err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("move error at %s: %w", nf.path, err))
+			continue
+		}
+		run.FilesMoved++
+	}
+
+	for _, mf := range missing {
+		if moved[mf.ID] {
+			continue
 		}
+		run.FilesDeleted++
+		mf.Status = "deleted"
+		s.db.UpdateMediaFile(ctx, mf)
 	}
 
 	run.FilesFailed = len(result.Errors)
 	run.Status = models.StatusSuccess
-	if len(result.Errors) > 0 {
+	switch {
+	case cancelled:
+		run.Status = models.StatusCancelled
+	case len(result.Errors) > 0:
 		run.Status = models.StatusFailed
 		run.ErrorMsg = sql.NullString{String: result.Errors[0].Error(), Valid: true}
 	}
@@ -211,47 +406,232 @@ func (s *Scanner) ScanLibrary(ctx context.Context, libraryID string) (*ScanResul
 	if err := s.db.UpdateScanRun(ctx, run); err != nil {
 		result.Errors = append(result.Errors, err)
 	}
-
-	lib.LastScanAt = sql.NullTime{Time: time.Now(), Valid: true}
-	lib.Status = models.StatusSuccess
-	if err := s.db.UpdateLibrary(ctx, lib); err != nil {
-		result.Errors = append(result.Errors, err)
+	s.publish(run)
+
+	// A cancelled scan still counts as the last scan, so the scheduler
+	// doesn't start it again straight away
+	if !incremental {
+		lib.LastScanAt = sql.NullTime{Time: time.Now(), Valid: true}
+		lib.Status = models.StatusSuccess
+		if cancelled {
+			lib.Status = models.StatusCancelled
+		}
+		if err := s.db.UpdateLibrary(ctx, lib); err != nil {
+			result.Errors = append(result.Errors, err)
+		}
 	}
 
 	log.Info().
 		Str("library_id", libraryID).
+		Str("status", run.Status).
 		Int("found", run.FilesFound).
 		Int("new", run.FilesNew).
 		Int("changed", run.FilesChanged).
 		Int("deleted", run.FilesDeleted).
+		Int("moved", run.FilesMoved).
+		Int("skipped", skipped).
 		Msg("Scan completed")
 
 	return result, nil
 }
 
+// newFile is a file found at a path with no media file
+type newFile struct {
+	path      string
+	ext       string
+	info      fs.FileInfo
+	quickHash sql.NullString
+	cuePath   sql.NullString
+	cueMtime  sql.NullTime
+}
+
+// matchMove finds which of the disappeared files of the same size a new
+// file is, by quick hash, or by full hash for files hashed before quick
+// hashes were kept. When several match, the full hash and then the file
+// name narrow them down. Returns nil if none matches.
+func matchMove(ctx context.Context, nf newFile, candidates []*models.MediaFile) *models.MediaFile {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var full string
+	fullOf := func() string {
+		if full == "" {
+			sum, err := fullHash(ctx, nf.path)
+			if err != nil {
+				log.Warn().Err(err).Str("path", nf.path).Msg("Failed to hash file")
+				full = "-"
+			} else {
+				full = sum
+			}
+		}
+		return full
+	}
+
+	var matches []*models.MediaFile
+	for _, c := range candidates {
+		switch {
+		case c.QuickHash.Valid && nf.quickHash.Valid:
+			if c.QuickHash.String == nf.quickHash.String {
+				matches = append(matches, c)
+			}
+		case c.FullHash.Valid:
+			if c.FullHash.String == fullOf() {
+				matches = append(matches, c)
+			}
+		}
+	}
+
+	if len(matches) > 1 {
+		var same []*models.MediaFile
+		for _, c := range matches {
+			if c.FullHash.Valid && c.FullHash.String == fullOf() {
+				same = append(same, c)
+			}
+		}
+		if len(same) > 0 {
+			matches = same
+		}
+	}
+	if len(matches) > 1 {
+		name := filepath.Base(nf.path)
+		for _, c := range matches {
+			if c.Filename == name {
+				return c
+			}
+		}
+	}
+	if len(matches) > 0 {
+		// Still ambiguous only for identical copies, whose histories are
+		// interchangeable
+		return matches[0]
+	}
+	return nil
+}
+
+func removeFile(files []*models.MediaFile, mf *models.MediaFile) []*models.MediaFile {
+	for i, f := range files {
+		if f == mf {
+			return append(files[:i:i], files[i+1:]...)
+		}
+	}
+	return files
+}
+
+// publish sends a snapshot of the scan run's counters to subscribers and
+// to Progress
+func (s *Scanner) publish(run *models.ScanRun) {
+	s.scansMu.Lock()
+	if scan, ok := s.scans[run.LibraryID]; ok {
+		scan.run = *run
+	}
+	s.scansMu.Unlock()
+
+	s.bus.Publish(events.Event{
+		Type:      events.TypeScan,
+		JobID:     run.ID,
+		LibraryID: run.LibraryID,
+		Data:      *run,
+	})
+}
+
+// Cancel stops the scan of a library. Returns false if the library is not
+// being scanned.
+func (s *Scanner) Cancel(libraryID string) bool {
+	s.scansMu.Lock()
+	defer s.scansMu.Unlock()
+	scan, ok := s.scans[libraryID]
+	if ok {
+		scan.cancel()
+	}
+	return ok
+}
+
+// Stop cancels every scan in progress
 func (s *Scanner) Stop() {
-	s.runningMu.Lock()
-	defer s.runningMu.Unlock()
-	if s.cancel != nil {
-		s.cancel()
+	s.scansMu.Lock()
+	defer s.scansMu.Unlock()
+	for _, scan := range s.scans {
+		scan.cancel()
+	}
+}
+
+// Progress returns the counters of a library's scan in progress, as of the
+// last progress update
+func (s *Scanner) Progress(libraryID string) (models.ScanRun, bool) {
+	s.scansMu.Lock()
+	defer s.scansMu.Unlock()
+	scan, ok := s.scans[libraryID]
+	if !ok {
+		return models.ScanRun{}, false
 	}
+	return scan.run, true
+}
+
+// Active returns the counters of every scan in progress
+func (s *Scanner) Active() []models.ScanRun {
+	s.scansMu.Lock()
+	defer s.scansMu.Unlock()
+	runs := make([]models.ScanRun, 0, len(s.scans))
+	for _, scan := range s.scans {
+		runs = append(runs, scan.run)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.Before(runs[j].StartedAt)
+	})
+	return runs
 }
 
 func (s *Scanner) IsRunning() bool {
-	s.runningMu.Lock()
-	defer s.runningMu.Unlock()
-	return s.running
+	s.scansMu.Lock()
+	defer s.scansMu.Unlock()
+	return len(s.scans) > 0
 }
 
-func quickHash(path string) (string, error) {
+// IsScanning reports whether a library is being scanned
+func (s *Scanner) IsScanning(libraryID string) bool {
+	s.scansMu.Lock()
+	defer s.scansMu.Unlock()
+	_, ok := s.scans[libraryID]
+	return ok
+}
+
+// cueSheetOf returns the sidecar cue sheet of an audio file, if it has
+// one, and when the sheet was last modified
+func cueSheetOf(finder *cue.Finder, path string) (sql.NullString, sql.NullTime) {
+	cuePath := finder.Find(path)
+	if cuePath == "" {
+		return sql.NullString{}, sql.NullTime{}
+	}
+	var mtime sql.NullTime
+	if info, err := os.Stat(cuePath); err == nil {
+		mtime = sql.NullTime{Time: info.ModTime(), Valid: true}
+	}
+	return sql.NullString{String: cuePath, Valid: true}, mtime
+}
+
+// quickHashBlock is how much of each end of a file the quick hash reads
+const quickHashBlock = 64 * 1024
+
+// quickHash hashes the first and last 64 KiB of a file, enough to tell
+// apart files of the same size in practice
+func quickHash(ctx context.Context, path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := iobudget.Global().Wait(ctx, min(info.Size(), 2*quickHashBlock)); err != nil {
+		return "", err
+	}
+
 	h := md5.New()
-	buf := make([]byte, 64*1024)
+	buf := make([]byte, quickHashBlock)
 
 	n, err := f.Read(buf)
 	if err != nil && err != io.EOF {
@@ -259,9 +639,8 @@ func quickHash(path string) (string, error) {
 	}
 	h.Write(buf[:n])
 
-	info, _ := f.Stat()
-	if info.Size() > 64*1024 {
-		f.Seek(-64*1024, io.SeekEnd)
+	if info.Size() > quickHashBlock {
+		f.Seek(-quickHashBlock, io.SeekEnd)
 		n, err = f.Read(buf)
 		if err != nil && err != io.EOF {
 			return "", err
@@ -272,6 +651,22 @@ func quickHash(path string) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// fullHash returns the SHA-256 of the whole file, as stored in full_hash by
+// duplicate detection
+func fullHash(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, iobudget.Global().Reader(ctx, f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func generateID() string {
 	return uuid.NewString()
 }
@@ -0,0 +1,83 @@
+package scanner
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ottavia-music/ottavia/internal/models"
+)
+
+func TestMatchMove(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "moved.flac")
+	if err := os.WriteFile(path, []byte("the same audio, moved"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	full, err := fullHash(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nf := newFile{path: path, quickHash: sql.NullString{String: "quick", Valid: true}}
+
+	known := func(name, quick, fullSum string) *models.MediaFile {
+		return &models.MediaFile{
+			ID:        name,
+			Filename:  name,
+			QuickHash: sql.NullString{String: quick, Valid: quick != ""},
+			FullHash:  sql.NullString{String: fullSum, Valid: fullSum != ""},
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		candidates []*models.MediaFile
+		want       string
+	}{
+		{"none", nil, ""},
+		{"quick hash", []*models.MediaFile{
+			known("a.flac", "other", ""),
+			known("b.flac", "quick", ""),
+		}, "b.flac"},
+		{"quick hash differs", []*models.MediaFile{
+			known("a.flac", "other", full),
+		}, ""},
+		// Files hashed before quick hashes were kept only have a full hash
+		{"full hash fallback", []*models.MediaFile{
+			known("a.flac", "", "0000"),
+			known("b.flac", "", full),
+		}, "b.flac"},
+		{"full hash differs", []*models.MediaFile{
+			known("a.flac", "", "0000"),
+		}, ""},
+		{"no hashes", []*models.MediaFile{
+			known("a.flac", "", ""),
+		}, ""},
+		// Quick hashes only see the ends of a file; the full hash decides
+		{"ambiguous, full hash decides", []*models.MediaFile{
+			known("a.flac", "quick", "0000"),
+			known("b.flac", "quick", full),
+			known("c.flac", "quick", ""),
+		}, "b.flac"},
+		{"ambiguous, name decides", []*models.MediaFile{
+			known("a.flac", "quick", full),
+			known("moved.flac", "quick", full),
+		}, "moved.flac"},
+		{"ambiguous copies, first taken", []*models.MediaFile{
+			known("a.flac", "quick", ""),
+			known("b.flac", "quick", ""),
+		}, "a.flac"},
+	} {
+		got := matchMove(ctx, nf, tc.candidates)
+		gotID := ""
+		if got != nil {
+			gotID = got.ID
+		}
+		if gotID != tc.want {
+			t.Errorf("%s: matched %q, want %q", tc.name, gotID, tc.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+//go:build linux
+
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Filesystems whose inotify events miss changes made by other hosts
+var unreliableFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x00c36400: "ceph",
+}
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotifyWatch watches every directory of a tree with inotify, adding
+// watches for directories created or moved into it
+type inotifyWatch struct {
+	fd     int
+	file   *os.File
+	events chan<- watchEvent
+	done   chan struct{}
+
+	mu   sync.Mutex
+	dirs map[int]string // watched directory, by watch descriptor
+}
+
+// watchTree watches the tree under root, sending changes on events until
+// closed. events is closed when the watch stops.
+func watchTree(root string, events chan<- watchEvent) (treeWatch, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return nil, err
+	}
+	if name, ok := unreliableFilesystems[uint32(st.Type)]; ok {
+		return nil, fmt.Errorf("%w: %s filesystem", errWatchUnsupported, name)
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %w", err)
+	}
+	// A non-blocking descriptor is read through the runtime poller, so
+	// closing the file ends a pending read
+	w := &inotifyWatch{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: events,
+		done:   make(chan struct{}),
+		dirs:   make(map[int]string),
+	}
+	if err := w.addTree(root); err != nil {
+		w.file.Close()
+		if errors.Is(err, syscall.ENOSPC) {
+			return nil, fmt.Errorf("%w: inotify watch limit reached, raise fs.inotify.max_user_watches", errWatchUnsupported)
+		}
+		return nil, err
+	}
+
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatch) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+// send delivers an event unless the watch has been closed
+func (w *inotifyWatch) send(ev watchEvent) {
+	select {
+	case w.events <- ev:
+	case <-w.done:
+	}
+}
+
+// addTree watches dir and the directories under it, skipping hidden ones as
+// the scanner does
+func (w *inotifyWatch) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil // gone, or unreadable like it is for the scanner
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTDIR) {
+				return nil
+			}
+			return fmt.Errorf("watch %s: %w", path, err)
+		}
+		// A directory moved within the tree keeps its descriptor
+		w.mu.Lock()
+		w.dirs[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatch) read() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			off += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			if !w.handle(int(raw.Wd), raw.Mask, name) {
+				return
+			}
+		}
+	}
+}
+
+// handle turns one inotify event into changes to rescan. Returns false
+// once nothing is watched anymore, as when the library root was removed.
+func (w *inotifyWatch) handle(wd int, mask uint32, name string) bool {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.send(watchEvent{overflow: true})
+		return true
+	}
+
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	watching := len(w.dirs) > 0
+	w.mu.Unlock()
+	if !ok || name == "" || strings.HasPrefix(name, ".") {
+		return watching
+	}
+	path := filepath.Join(dir, name)
+
+	if mask&syscall.IN_ISDIR != 0 {
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			if err := w.addTree(path); err != nil {
+				// Changes under it can't be seen; rescan everything
+				w.send(watchEvent{overflow: true})
+				return true
+			}
+		}
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO|syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+			w.send(watchEvent{dir: Dir{Path: path, Recursive: true}})
+		}
+		return true
+	}
+
+	// A cue sheet changes how the files next to it are split
+	if ext := strings.ToLower(filepath.Ext(name)); supportedExtensions[ext] || ext == ".cue" {
+		w.send(watchEvent{dir: Dir{Path: dir}})
+	}
+	return true
+}
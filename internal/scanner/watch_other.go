@@ -0,0 +1,8 @@
+//go:build !linux
+
+package scanner
+
+// watchTree is only implemented with inotify on Linux
+func watchTree(root string, events chan<- watchEvent) (treeWatch, error) {
+	return nil, errWatchUnsupported
+}
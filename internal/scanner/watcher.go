@@ -0,0 +1,231 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ottavia-music/ottavia/internal/database"
+)
+
+// errWatchUnsupported is returned by watchTree on platforms and filesystems
+// where change notifications aren't available or reliable. Such libraries
+// are only scanned on their interval.
+var errWatchUnsupported = errors.New("filesystem watching not supported")
+
+// watchSyncInterval is how often the watched libraries are matched against
+// the configured ones, and failed watches are retried
+const watchSyncInterval = time.Minute
+
+// watchEvent is a change seen in a watched tree
+type watchEvent struct {
+	dir      Dir
+	overflow bool // events were lost; the whole library must be rescanned
+}
+
+// treeWatch is a platform watch on a library's directory tree
+type treeWatch interface {
+	Close() error
+}
+
+// Watcher watches library directories for changes and rescans just the
+// directories that changed, once they have been quiet for the debounce
+// period, so a copy in progress is scanned once it's done. Interval scans
+// keep running alongside, and remain the only scans of libraries on
+// network filesystems, where notifications aren't reliable.
+type Watcher struct {
+	db       *database.DB
+	scanner  *Scanner
+	debounce time.Duration
+	maxDelay time.Duration
+
+	mu     sync.Mutex
+	libs   map[string]*libraryWatch // by library ID
+	cancel context.CancelFunc
+}
+
+type libraryWatch struct {
+	root   string
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the watch has stopped
+}
+
+// NewWatcher creates a watcher. Changes are scanned once no new ones have
+// arrived for debounce, or maxDelay after the first, whichever is sooner.
+func NewWatcher(db *database.DB, scanner *Scanner, debounce, maxDelay time.Duration) *Watcher {
+	if maxDelay < debounce {
+		maxDelay = debounce
+	}
+	return &Watcher{
+		db:       db,
+		scanner:  scanner,
+		debounce: debounce,
+		maxDelay: maxDelay,
+		libs:     make(map[string]*libraryWatch),
+	}
+}
+
+func (w *Watcher) Start(ctx context.Context) {
+	w.mu.Lock()
+	if w.cancel != nil {
+		w.mu.Unlock()
+		return
+	}
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.mu.Unlock()
+
+	log.Info().Dur("debounce", w.debounce).Msg("Starting library watcher")
+
+	go func() {
+		ticker := time.NewTicker(watchSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			w.sync(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (w *Watcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+	for id, lw := range w.libs {
+		lw.cancel()
+		delete(w.libs, id)
+	}
+}
+
+// sync starts watching new libraries, restarts watches whose root moved or
+// that stopped, and stops watching deleted libraries
+func (w *Watcher) sync(ctx context.Context) {
+	libraries, err := w.db.ListLibraries(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list libraries for watching")
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, lib := range libraries {
+		seen[lib.ID] = true
+		if lw, ok := w.libs[lib.ID]; ok {
+			select {
+			case <-lw.done:
+			default:
+				if lw.root == lib.RootPath {
+					continue
+				}
+			}
+			lw.cancel()
+		}
+
+		lw := &libraryWatch{root: lib.RootPath, done: make(chan struct{})}
+		var watchCtx context.Context
+		watchCtx, lw.cancel = context.WithCancel(ctx)
+		w.libs[lib.ID] = lw
+		go w.watchLibrary(watchCtx, lib.ID, lw)
+	}
+
+	for id, lw := range w.libs {
+		if !seen[id] {
+			lw.cancel()
+			delete(w.libs, id)
+		}
+	}
+}
+
+// watchLibrary collects the changes in one library and scans them. A
+// library that can't be watched is left to interval scans; its watch is
+// not retried until its root path changes.
+func (w *Watcher) watchLibrary(ctx context.Context, libraryID string, lw *libraryWatch) {
+	events := make(chan watchEvent, 256)
+	watch, err := watchTree(lw.root, events)
+	if err != nil {
+		if errors.Is(err, errWatchUnsupported) {
+			log.Info().Err(err).Str("library_id", libraryID).Str("root_path", lw.root).Msg("Not watching library, relying on interval scans")
+			<-ctx.Done()
+		} else {
+			log.Warn().Err(err).Str("library_id", libraryID).Str("root_path", lw.root).Msg("Failed to watch library, will retry")
+		}
+		close(lw.done)
+		return
+	}
+	defer close(lw.done)
+	defer watch.Close()
+
+	log.Info().Str("library_id", libraryID).Str("root_path", lw.root).Msg("Watching library for changes")
+
+	pending := make(map[string]bool) // dirs to rescan, and whether recursively
+	fullScan := false
+	var first time.Time
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case ev, ok := <-events:
+			if !ok {
+				log.Warn().Str("library_id", libraryID).Msg("Library watch stopped, will retry")
+				return
+			}
+			if ev.overflow {
+				fullScan = true
+			} else {
+				pending[ev.dir.Path] = pending[ev.dir.Path] || ev.dir.Recursive
+			}
+
+			now := time.Now()
+			if first.IsZero() {
+				first = now
+			}
+			wait := w.debounce
+			if deadline := first.Add(w.maxDelay); now.Add(wait).After(deadline) {
+				wait = deadline.Sub(now)
+			}
+			timer.Reset(wait)
+
+		case <-timer.C:
+			var err error
+			if fullScan {
+				_, err = w.scanner.ScanLibrary(ctx, libraryID)
+			} else {
+				dirs := make([]Dir, 0, len(pending))
+				for path, recursive := range pending {
+					dirs = append(dirs, Dir{Path: path, Recursive: recursive})
+				}
+				_, err = w.scanner.ScanDirs(ctx, libraryID, dirs)
+			}
+
+			if errors.Is(err, ErrScanInProgress) {
+				// Changes are kept until the running scan has finished
+				first = time.Now()
+				timer.Reset(w.debounce)
+				continue
+			}
+			if err != nil {
+				log.Error().Err(err).Str("library_id", libraryID).Msg("Watched change scan failed")
+			}
+			pending = make(map[string]bool)
+			fullScan = false
+			first = time.Time{}
+		}
+	}
+}